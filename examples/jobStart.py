@@ -12,9 +12,9 @@ ServiceInput1 = "http://hdl.handle.net/11304/0591b2ed-d5c6-4007-bb99-6b473f3f07f
 ServiceInput2 = "some text to be parsed" # Any text fragment in English
 
 # Starting a job
-urlVars = {'access_token': accessToken}
+authHeaders = {'Authorization': 'Bearer ' + accessToken} # The access token is sent in a header, never in the URL
 formData = {'serviceID': NLTKServiceID, 'pid_input0': ServiceInput1, 'pid_input1': ServiceInput2}
-response = requests.post(GEFAddress + JobStartEndpoint, params = urlVars, data = formData, verify=False) # Certificate verification is OFF, because of the self-signed certificates
+response = requests.post(GEFAddress + JobStartEndpoint, headers = authHeaders, data = formData, verify=False) # Certificate verification is OFF, because of the self-signed certificates
 jsonResponse = json.loads(response.text)
 
 runningJobID = jsonResponse["jobID"]
@@ -39,13 +39,13 @@ print("The job has been finished")
 # Inspecting and downloading the output
 if len(jobOutputVolumeID)>0:
     print("Inspecting the output volume ->" + jobOutputVolumeID) # We need only the first one
-    response = requests.get(GEFAddress + VolumesEndpoint + "/" + jobOutputVolumeID + "/", params = urlVars, verify=False)
+    response = requests.get(GEFAddress + VolumesEndpoint + "/" + jobOutputVolumeID + "/", headers = authHeaders, verify=False)
     jsonResponse = json.loads(response.text)
     if len(jsonResponse["volumeContent"])>0:
         print("Downloading the first file from the output volume")
         outputFileName = jsonResponse["volumeContent"][0]["name"]
         with open(outputFileName, 'wb') as f:
-            resp = requests.get(GEFAddress + VolumesEndpoint + "/" + jobOutputVolumeID + "/" + outputFileName + "?content", params = urlVars, verify=False)
+            resp = requests.get(GEFAddress + VolumesEndpoint + "/" + jobOutputVolumeID + "/" + outputFileName + "?content", headers = authHeaders, verify=False)
             f.write(resp.content)
         print("File has been downloaded -> " + outputFileName)
     else:
@@ -2,7 +2,10 @@ package db
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"log"
 	"strings"
 	"time"
@@ -21,11 +24,76 @@ type User struct {
 
 // Token struct, also used to serialize JSON
 type Token struct {
-	ID     int64
-	Name   string
-	Secret string
-	UserID int64
-	Expire time.Time
+	ID           int64
+	Name         string
+	Secret       string // only known when the token is created, empty otherwise
+	UserID       int64
+	Expire       time.Time
+	Scopes       []string    // what the token can be used for; all the user can do if empty
+	ServiceIDs   []ServiceID // the services the token can be used with; any service if empty
+	CommunityIDs []int64     // the communities whose roles the token can use; all if empty
+}
+
+// The scopes of the access tokens
+const (
+	JobsCreateScope    = "jobs:create"    // submit and retry jobs
+	JobsReadScope      = "jobs:read"      // list and inspect jobs, with their logs and provenance
+	JobsWriteScope     = "jobs:write"     // edit, cancel, remove and publish jobs
+	VolumesReadScope   = "volumes:read"   // download the job data
+	ServicesWriteScope = "services:write" // build, edit and remove services and workflows
+	AdminScope         = "admin"          // use the superadministrator and community administrator privileges of the user
+)
+
+// TokenScopes lists all the scopes of the access tokens
+var TokenScopes = []string{JobsCreateScope, JobsReadScope, JobsWriteScope, VolumesReadScope, ServicesWriteScope, AdminScope}
+
+// HasScope tells if the token can be used for the scope; the tokens without scopes can be used
+// for anything, and only the unrestricted tokens match the empty scope
+func (t Token) HasScope(scope string) bool {
+	if scope == "" {
+		return t.Unrestricted()
+	}
+	if len(t.Scopes) == 0 {
+		return true
+	}
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Unrestricted tells if the token can be used for all the user can do: it has no scopes,
+// and is not restricted to services or communities
+func (t Token) Unrestricted() bool {
+	return len(t.Scopes) == 0 && len(t.ServiceIDs) == 0 && len(t.CommunityIDs) == 0
+}
+
+// AllowsService tells if the token can be used with a service
+func (t Token) AllowsService(serviceID ServiceID) bool {
+	if len(t.ServiceIDs) == 0 {
+		return true
+	}
+	for _, id := range t.ServiceIDs {
+		if id == serviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsCommunity tells if the token can use the roles of the user in a community
+func (t Token) AllowsCommunity(communityID int64) bool {
+	if len(t.CommunityIDs) == 0 {
+		return true
+	}
+	for _, id := range t.CommunityIDs {
+		if id == communityID {
+			return true
+		}
+	}
+	return false
 }
 
 // Community information
@@ -77,7 +145,7 @@ func (d *Db) ListCommunities() ([]Community, error) {
 		return nil, err
 	}
 
-	var comms []Community
+	comms := []Community{}
 	for _, c := range cs {
 		comms = append(comms, commTable2comm(c))
 	}
@@ -134,6 +202,50 @@ func (d *Db) AddCommunity(name, description string, addDefaultRoles bool) (Commu
 	return comm, nil
 }
 
+// UpdateCommunity changes the name and the description of a community
+func (d *Db) UpdateCommunity(community Community) error {
+	var c CommunityTable
+	err := d.db.SelectOne(&c, "SELECT * FROM Communities WHERE ID=?", community.ID)
+	if err != nil {
+		return err
+	}
+	if community.Name != c.Name {
+		_, err = d.GetCommunityByName(community.Name)
+		if err == nil {
+			return def.Err(nil, "a community is already named %s", community.Name)
+		}
+		if !IsNoResultsError(err) {
+			return err
+		}
+	}
+	c.Name = community.Name
+	c.Description = community.Description
+	_, err = d.db.Update(&c)
+	return err
+}
+
+// RemoveCommunity removes a community with its roles; the communities still having
+// services cannot be removed
+func (d *Db) RemoveCommunity(communityID int64) error {
+	services, err := d.db.SelectInt("SELECT count(*) FROM services WHERE CommunityID=? AND Deleted=?", communityID, false)
+	if err != nil {
+		return err
+	}
+	if services > 0 {
+		return def.Err(nil, "the community still has %d services", services)
+	}
+	_, err = d.db.Exec("DELETE FROM userroles WHERE RoleID IN (SELECT ID FROM roles WHERE CommunityID=?)", communityID)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("DELETE FROM roles WHERE CommunityID=?", communityID)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("DELETE FROM Communities WHERE ID=?", communityID)
+	return err
+}
+
 //  ListRoles returns the list of all roles
 func (d *Db) ListRoles() ([]Role, error) {
 	var roles []Role
@@ -158,6 +270,18 @@ func (d *Db) ListRoles() ([]Role, error) {
 	return roles, nil
 }
 
+// ListCommunityRoles returns the roles of a community
+func (d *Db) ListCommunityRoles(communityID int64) ([]Role, error) {
+	roles := []Role{}
+	_, err := d.db.Select(&roles,
+		`SELECT r.ID ID, r.Name Name, r.Description Description, c.ID CommunityID, c.Name CommunityName
+		FROM roles r, communities c
+		WHERE r.CommunityID = c.ID AND c.ID = ?
+		ORDER BY r.Name`,
+		communityID)
+	return roles, err
+}
+
 // GetRoleByID gets a role from the database
 func (d *Db) GetRoleUsers(roleID int64) ([]User, error) {
 	var users []User
@@ -225,7 +349,11 @@ func (d *Db) AddRoleToUser(userID, roleID int64) error {
 	var urs []UserRoleTable
 	_, err := d.db.Select(&urs, `SELECT * FROM userroles WHERE UserID=? AND RoleID=?`, userID, roleID)
 	if len(urs) > 0 {
-		return nil
+		if urs[0].Source != "" {
+			// a role granted by hand is kept when the identity provider stops asserting it
+			_, err = d.db.Exec("UPDATE userroles SET Source='' WHERE UserID=? AND RoleID=?", userID, roleID)
+		}
+		return err
 	}
 	ur := UserRoleTable{
 		UserID: userID,
@@ -235,6 +363,98 @@ func (d *Db) AddRoleToUser(userID, roleID int64) error {
 	return err
 }
 
+// RoleGrant is a role given to a user, by hand or by an identity provider
+type RoleGrant struct {
+	UserID        int64
+	UserEmail     string
+	RoleID        int64
+	RoleName      string
+	CommunityID   int64
+	CommunityName string
+	Source        string    // the identity provider which asserted the role, empty if granted by hand
+	Synced        time.Time // when the identity provider last asserted the role
+}
+
+// RoleSync lists the roles added and removed by SyncUserRoles
+type RoleSync struct {
+	Added   []int64
+	Removed []int64
+}
+
+// SyncUserRoles gives the user the roles asserted by an identity provider (the source), and removes
+// the roles the source asserted before but not anymore. The roles granted by hand are kept
+func (d *Db) SyncUserRoles(userID int64, source string, roleIDs []int64) (RoleSync, error) {
+	var sync RoleSync
+	if source == "" {
+		return sync, def.Err(nil, "the roles can only be synchronized with an identity provider")
+	}
+	var urs []UserRoleTable
+	_, err := d.db.Select(&urs, `SELECT * FROM userroles WHERE UserID=?`, userID)
+	if err != nil {
+		return sync, err
+	}
+	granted := map[int64]UserRoleTable{}
+	for _, ur := range urs {
+		granted[ur.RoleID] = ur
+	}
+
+	now := time.Now()
+	asserted := map[int64]bool{}
+	for _, roleID := range roleIDs {
+		if asserted[roleID] {
+			continue
+		}
+		asserted[roleID] = true
+		ur, ok := granted[roleID]
+		if !ok {
+			err = d.db.Insert(&UserRoleTable{UserID: userID, RoleID: roleID, Source: source, Synced: now})
+			if err != nil {
+				return sync, err
+			}
+			sync.Added = append(sync.Added, roleID)
+		} else if ur.Source == source {
+			_, err = d.db.Exec("UPDATE userroles SET Synced=? WHERE UserID=? AND RoleID=?", now, userID, roleID)
+			if err != nil {
+				return sync, err
+			}
+		}
+	}
+	for _, ur := range urs {
+		if ur.Source == source && !asserted[ur.RoleID] {
+			err = d.DeleteRoleFromUser(userID, ur.RoleID)
+			if err != nil {
+				return sync, err
+			}
+			sync.Removed = append(sync.Removed, ur.RoleID)
+		}
+	}
+	return sync, nil
+}
+
+// ListRoleGrants returns the roles of all the users, and where they come from
+func (d *Db) ListRoleGrants() ([]RoleGrant, error) {
+	return d.selectRoleGrants("")
+}
+
+// ListCommunityMembers returns the roles of the users in a community, and where they come from
+func (d *Db) ListCommunityMembers(communityID int64) ([]RoleGrant, error) {
+	return d.selectRoleGrants("WHERE r.CommunityID = ?", communityID)
+}
+
+func (d *Db) selectRoleGrants(where string, args ...interface{}) ([]RoleGrant, error) {
+	grants := []RoleGrant{}
+	_, err := d.db.Select(&grants,
+		`SELECT u.ID UserID, u.Email UserEmail, r.ID RoleID, r.Name RoleName,
+			r.CommunityID CommunityID, COALESCE(c.Name, '') CommunityName, ur.Source Source, ur.Synced Synced
+		FROM userroles ur
+		JOIN users u ON ur.UserID = u.ID
+		JOIN roles r ON ur.RoleID = r.ID
+		LEFT JOIN communities c ON r.CommunityID = c.ID
+		`+where+`
+		ORDER BY u.Email, r.CommunityID, r.Name`, args...)
+	return grants, err
+}
+
 // DeleteRoleFromUser
 func (d *Db) DeleteRoleFromUser(userID, roleID int64) error {
 	_, err := d.db.Exec("DELETE FROM userroles WHERE UserID=? AND RoleID=?", userID, roleID)
@@ -306,6 +526,18 @@ func (d *Db) IsJobOwner(userID int64, jobID JobID) bool {
 	return err == nil
 }
 
+// GetJobOwner returns the ID of the user owning a job
+func (d *Db) GetJobOwner(jobID JobID) (int64, error) {
+	var x OwnerTable
+	err := d.db.SelectOne(&x,
+		"SELECT * FROM owners WHERE ObjectType=? AND ObjectID=?",
+		"Job", string(jobID))
+	if err != nil {
+		return 0, err
+	}
+	return x.UserID, nil
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 
 // AddUser adds a user to the database
@@ -375,7 +607,7 @@ func (d *Db) GetTokenByID(tokenID int64) (Token, error) {
 // GetTokenBySecret returns a token by its Secret
 func (d *Db) GetTokenBySecret(accessToken string) (Token, error) {
 	var token TokenTable
-	err := d.db.SelectOne(&token, "SELECT * FROM tokens WHERE Secret=?", accessToken)
+	err := d.db.SelectOne(&token, "SELECT * FROM tokens WHERE Secret=?", hashTokenSecret(accessToken))
 	if err != nil {
 		return Token{}, err
 	}
@@ -384,24 +616,39 @@ func (d *Db) GetTokenBySecret(accessToken string) (Token, error) {
 
 // NewUserToken creates a new user access token
 func (d *Db) NewUserToken(userID int64, name string, expire time.Time) (Token, error) {
+	return d.NewScopedUserToken(userID, name, expire, nil, nil, nil)
+}
+
+// NewScopedUserToken creates a new user access token restricted to some scopes,
+// services and communities; see Token
+func (d *Db) NewScopedUserToken(userID int64, name string, expire time.Time, scopes []string, serviceIDs []ServiceID, communityIDs []int64) (Token, error) {
+	restrictions, err := json.Marshal(tokenRestrictions{scopes, serviceIDs, communityIDs})
+	if err != nil {
+		return Token{}, err
+	}
+
 	// generate crypto random string
 	buf := make([]byte, 36)
-	_, err := rand.Read(buf)
+	_, err = rand.Read(buf)
 	if err != nil {
 		return Token{}, def.Err(err, "Cannot read crypto/rand")
 	}
 
+	secret := base64.RawURLEncoding.EncodeToString(buf)
 	token := TokenTable{
-		Name:   name,
-		Secret: base64.RawURLEncoding.EncodeToString(buf),
-		UserID: userID,
-		Expire: expire,
+		Name:         name,
+		Secret:       hashTokenSecret(secret),
+		UserID:       userID,
+		Expire:       expire,
+		Restrictions: string(restrictions),
 	}
 	err = d.db.Insert(&token)
 	if err != nil {
 		return Token{}, err
 	}
-	return d.tokenTable2token(token), nil
+	newToken := d.tokenTable2token(token)
+	newToken.Secret = secret
+	return newToken, nil
 }
 
 // DeleteUserToken deletes the token from the database
@@ -433,14 +680,59 @@ func (d *Db) userTable2user(user *UserTable) *User {
 	}
 }
 
+// tokenRestrictions is how the scopes and restrictions of a token are stored; the
+// communities are kept by ID, so that renaming them does not change the tokens
+type tokenRestrictions struct {
+	Scopes       []string    `json:",omitempty"`
+	ServiceIDs   []ServiceID `json:",omitempty"`
+	CommunityIDs []int64     `json:",omitempty"`
+}
+
 func (d *Db) tokenTable2token(token TokenTable) Token {
+	var restrictions tokenRestrictions
+	if token.Restrictions != "" {
+		err := json.Unmarshal([]byte(token.Restrictions), &restrictions)
+		if err != nil {
+			// a token which cannot be read back should not be usable for anything
+			log.Println("cannot read the restrictions of token", token.ID, err)
+			restrictions.Scopes = []string{""}
+		}
+	}
 	return Token{
-		ID:     token.ID,
-		Name:   token.Name,
-		Secret: token.Secret,
-		UserID: token.UserID,
-		Expire: token.Expire,
+		ID:           token.ID,
+		Name:         token.Name,
+		UserID:       token.UserID,
+		Expire:       token.Expire,
+		Scopes:       restrictions.Scopes,
+		ServiceIDs:   restrictions.ServiceIDs,
+		CommunityIDs: restrictions.CommunityIDs,
+	}
+}
+
+// tokenSecretHashPrefix marks the hashed secrets in the tokens table
+const tokenSecretHashPrefix = "sha256:"
+
+// hashTokenSecret returns the form in which a token secret is stored. The secrets are
+// long random strings, so a plain hash is enough to keep them from being guessed
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return tokenSecretHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// hashStoredTokenSecrets replaces the secrets stored in plain text by older versions
+func hashStoredTokenSecrets(d Db) error {
+	var tokens []TokenTable
+	_, err := d.db.Select(&tokens, "SELECT * FROM tokens WHERE Secret NOT LIKE ?", tokenSecretHashPrefix+"%")
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		_, err = d.db.Exec("UPDATE tokens SET Secret=? WHERE ID=?", hashTokenSecret(token.Secret), token.ID)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 ///////////////////////////////////////////////////////////////////////////////
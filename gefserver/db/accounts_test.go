@@ -80,6 +80,62 @@ func TestUsersAndTokens(t *testing.T) {
 	testUserTokens(t, db, user1, user2)
 }
 
+func TestB2DropAccount(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	user := AddTestUser(t, db, name1, email1)
+	_, err = db.GetB2DropAccount(user.ID)
+	Expect(t, IsNoResultsError(err))
+
+	account := B2DropAccount{UserID: user.ID, Username: "user", Password: "secret"}
+	CheckErr(t, db.SetB2DropAccount(account))
+	stored, err := db.GetB2DropAccount(user.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, stored, account)
+
+	account.Password = "new secret"
+	CheckErr(t, db.SetB2DropAccount(account))
+	stored, err = db.GetB2DropAccount(user.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, stored, account)
+
+	CheckErr(t, db.RemoveB2DropAccount(user.ID))
+	_, err = db.GetB2DropAccount(user.ID)
+	Expect(t, IsNoResultsError(err))
+}
+
+func TestUserIdentities(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	user := AddTestUser(t, db, name1, email1)
+	found, err := db.GetUserByIdentity("idp", "subject-1")
+	CheckErr(t, err)
+	Expect(t, found == nil)
+
+	identity := UserIdentity{UserID: user.ID, Provider: "idp", Subject: "subject-1"}
+	CheckErr(t, db.AddUserIdentity(identity))
+	found, err = db.GetUserByIdentity("idp", "subject-1")
+	CheckErr(t, err)
+	ExpectNotNil(t, found)
+	ExpectEquals(t, found.ID, user.ID)
+	found, err = db.GetUserByIdentity("another-idp", "subject-1")
+	CheckErr(t, err)
+	Expect(t, found == nil)
+	identities, err := db.ListUserIdentities(user.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, identities, []UserIdentity{identity})
+
+	// a subject of a provider is linked to one user only
+	other := AddTestUser(t, db, name2, email2)
+	Expect(t, db.AddUserIdentity(UserIdentity{UserID: other.ID, Provider: "idp", Subject: "subject-1"}) != nil)
+}
+
 func TestCommunityAndUserRoles(t *testing.T) {
 	db, file, err := InitDbForTesting()
 	CheckErr(t, err)
@@ -137,6 +193,142 @@ func TestCommunityAndUserRoles(t *testing.T) {
 	ExpectEquals(t, roles, []Role{r2, r3, r1c2})
 }
 
+func TestSyncUserRoles(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	c1 := AddTestCommunity(t, db, "community1")
+	member, err := db.GetRoleByName(CommunityMemberRoleName, c1.ID)
+	CheckErr(t, err)
+	admin, err := db.GetRoleByName(CommunityAdminRoleName, c1.ID)
+	CheckErr(t, err)
+	manual := AddTestRole(t, db, c1, "manual")
+	user := AddTestUser(t, db, name1, email1)
+	CheckErr(t, db.AddRoleToUser(user.ID, manual.ID))
+
+	_, err = db.SyncUserRoles(user.ID, "", nil)
+	Expect(t, err != nil)
+
+	sync, err := db.SyncUserRoles(user.ID, "idp", []int64{member.ID, admin.ID, manual.ID})
+	CheckErr(t, err)
+	ExpectEquals(t, sync, RoleSync{Added: []int64{member.ID, admin.ID}})
+	roles, err := db.GetUserRoles(user.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, len(roles), 3)
+
+	grants, err := db.ListRoleGrants()
+	CheckErr(t, err)
+	sources := map[int64]string{}
+	for _, g := range grants {
+		ExpectEquals(t, g.UserEmail, email1)
+		ExpectEquals(t, g.CommunityName, c1.Name)
+		sources[g.RoleID] = g.Source
+	}
+	ExpectEquals(t, sources, map[int64]string{member.ID: "idp", admin.ID: "idp", manual.ID: ""})
+
+	// the roles not asserted anymore are removed, but not those granted by hand
+	CheckErr(t, db.AddRoleToUser(user.ID, admin.ID))
+	sync, err = db.SyncUserRoles(user.ID, "idp", nil)
+	CheckErr(t, err)
+	ExpectEquals(t, sync, RoleSync{Removed: []int64{member.ID}})
+	roles, err = db.GetUserRoles(user.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, roles, []Role{manual, admin})
+
+	// another identity provider does not remove the roles of the first one
+	sync, err = db.SyncUserRoles(user.ID, "idp", []int64{member.ID})
+	CheckErr(t, err)
+	sync, err = db.SyncUserRoles(user.ID, "other", nil)
+	CheckErr(t, err)
+	ExpectEquals(t, sync, RoleSync{})
+	roles, err = db.GetUserRoles(user.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, len(roles), 3)
+}
+
+func TestCommunityManagement(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	c1 := AddTestCommunity(t, db, "community1")
+	c2 := AddTestCommunity(t, db, "community2")
+	user := AddTestUser(t, db, name1, email1)
+	other := AddTestUser(t, db, name2, email2)
+	member, err := db.GetRoleByName(CommunityMemberRoleName, c1.ID)
+	CheckErr(t, err)
+	CheckErr(t, db.AddRoleToUser(user.ID, member.ID))
+
+	c1.Description = "new description"
+	CheckErr(t, db.UpdateCommunity(c1))
+	com, err := db.GetCommunityByID(c1.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, com, c1)
+	Expect(t, db.UpdateCommunity(Community{ID: c1.ID, Name: c2.Name}) != nil)
+
+	members, err := db.ListCommunityMembers(c1.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, len(members), 1)
+	ExpectEquals(t, members[0].UserID, user.ID)
+	ExpectEquals(t, members[0].RoleName, CommunityMemberRoleName)
+
+	state := NewJobStateOk("state", 0)
+	for _, s := range []Service{{ID: "public", Name: "public"}, {ID: "private", Name: "private", CommunityID: c1.ID}} {
+		CheckErr(t, db.AddService(other.ID, s))
+		CheckErr(t, db.AddJob(other.ID, Job{ID: JobID("job_" + s.ID), ServiceID: s.ID, Created: time.Now(), State: &state}))
+	}
+	private, err := db.GetService("private")
+	CheckErr(t, err)
+	ExpectEquals(t, private.CommunityName, c1.Name)
+
+	services := func(viewer *Viewer) []ServiceID {
+		list, _, err := db.FilterServices(ServiceFilter{Viewer: viewer, Sort: "-name"})
+		CheckErr(t, err)
+		var ids []ServiceID
+		for _, s := range list {
+			ids = append(ids, s.ID)
+		}
+		return ids
+	}
+	jobs := func(viewer *Viewer) []JobID {
+		list, _, err := db.FilterJobs(JobFilter{Viewer: viewer, Sort: "service"})
+		CheckErr(t, err)
+		var ids []JobID
+		for _, j := range list {
+			ids = append(ids, j.ID)
+		}
+		return ids
+	}
+
+	// the services of a community are only seen by its members, and by the owners of the jobs
+	ExpectEquals(t, services(nil), []ServiceID{"public", "private"})
+	ExpectEquals(t, services(&Viewer{}), []ServiceID{"public"})
+	ExpectEquals(t, services(&Viewer{UserID: user.ID}), []ServiceID{"public", "private"})
+	ExpectEquals(t, services(&Viewer{UserID: user.ID, CommunityIDs: []int64{c2.ID}}), []ServiceID{"public"})
+	ExpectEquals(t, jobs(&Viewer{}), []JobID{"job_public"})
+	ExpectEquals(t, jobs(&Viewer{UserID: user.ID}), []JobID{"job_private", "job_public"})
+	ExpectEquals(t, jobs(&Viewer{UserID: other.ID}), []JobID{"job_private", "job_public"})
+	visible, err := db.CanSeeService(&Viewer{UserID: other.ID}, "private")
+	CheckErr(t, err)
+	Expect(t, !visible)
+	visible, err = db.CanSeeJob(&Viewer{}, "job_private")
+	CheckErr(t, err)
+	Expect(t, !visible)
+
+	// the communities with services cannot be removed
+	Expect(t, db.RemoveCommunity(c1.ID) != nil)
+	CheckErr(t, db.RemoveService("private"))
+	CheckErr(t, db.RemoveCommunity(c1.ID))
+	_, err = db.GetCommunityByID(c1.ID)
+	Expect(t, IsNoResultsError(err))
+	roles, err := db.GetUserRoles(user.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, len(roles), 0)
+}
+
 func AddTestRole(t *testing.T, db Db, community Community, name string) Role {
 	r, err := db.AddRole(name, community.ID, "description of testrole "+name)
 	CheckErr(t, err)
@@ -241,6 +433,23 @@ func testUserTokens(t *testing.T, db Db, user1, user2 *User) {
 	token, err = db.GetTokenBySecret(t2.Secret)
 	CheckErr(t, err)
 	ExpectEqualTokens(t, token, t2)
+	ExpectEquals(t, token.Secret, "")
+
+	// only the hashes of the secrets are stored
+	var stored TokenTable
+	CheckErr(t, db.db.SelectOne(&stored, "SELECT * FROM tokens WHERE ID=?", t2.ID))
+	ExpectNotEquals(t, stored.Secret, t2.Secret)
+	ExpectEquals(t, stored.Secret, hashTokenSecret(t2.Secret))
+
+	// the secrets stored in plain text by older versions are hashed
+	_, err = db.db.Exec("UPDATE tokens SET Secret=? WHERE ID=?", t3.Secret, t3.ID)
+	CheckErr(t, err)
+	_, err = db.GetTokenBySecret(t3.Secret)
+	Expect(t, IsNoResultsError(err))
+	CheckErr(t, hashStoredTokenSecrets(db))
+	token, err = db.GetTokenBySecret(t3.Secret)
+	CheckErr(t, err)
+	ExpectEqualTokens(t, token, t3)
 
 	err = db.DeleteUserToken(user1.ID, t2.ID)
 	CheckErr(t, err)
@@ -254,11 +463,50 @@ func testUserTokens(t *testing.T, db Db, user1, user2 *User) {
 	CheckErr(t, err)
 	ExpectEqualTokens(t, tokenList[0], tt1)
 	ExpectEqualTokens(t, tokenList[1], tt2)
+
+	// the scopes and restrictions are stored with the token
+	eudat, err := db.GetCommunityByName("EUDAT")
+	CheckErr(t, err)
+	scoped, err := db.NewScopedUserToken(user2.ID, "bot", expire,
+		[]string{JobsCreateScope, VolumesReadScope}, []ServiceID{"service_1"}, []int64{eudat.ID})
+	CheckErr(t, err)
+	token, err = db.GetTokenBySecret(scoped.Secret)
+	CheckErr(t, err)
+	ExpectEqualTokens(t, token, scoped)
+	ExpectEquals(t, token.Scopes, []string{JobsCreateScope, VolumesReadScope})
+	Expect(t, token.HasScope(JobsCreateScope))
+	Expect(t, !token.HasScope(JobsWriteScope))
+	Expect(t, !token.HasScope(""))
+	Expect(t, token.AllowsService("service_1"))
+	Expect(t, !token.AllowsService("service_2"))
+	Expect(t, token.AllowsCommunity(eudat.ID))
+	Expect(t, !token.AllowsCommunity(eudat.ID+1))
+
+	// the communities are kept by ID, so renaming them does not change the tokens
+	eudat.Name = "EUDAT renamed"
+	CheckErr(t, db.UpdateCommunity(eudat))
+	token, err = db.GetTokenBySecret(scoped.Secret)
+	CheckErr(t, err)
+	ExpectEquals(t, token.CommunityIDs, []int64{eudat.ID})
+
+	// the tokens without scopes can be used for anything
+	Expect(t, tt1.HasScope(AdminScope))
+	Expect(t, tt1.HasScope(""))
+	Expect(t, tt1.AllowsService("service_2"))
+
+	// but only the tokens without restrictions are unrestricted
+	restricted, err := db.NewScopedUserToken(user2.ID, "community", expire, nil, nil, []int64{eudat.ID})
+	CheckErr(t, err)
+	Expect(t, restricted.HasScope(JobsReadScope))
+	Expect(t, !restricted.HasScope(""))
+	Expect(t, !restricted.Unrestricted())
+	Expect(t, tt1.Unrestricted())
 }
 
+// ExpectEqualTokens compares the tokens except for the secrets, which are
+// only returned when the tokens are created
 func ExpectEqualTokens(t *testing.T, t1, t2 Token) {
 	ExpectEquals(t, t1.ID, t2.ID)
 	ExpectEquals(t, t1.Name, t2.Name)
-	ExpectEquals(t, t1.Secret, t2.Secret)
 	ExpectEquals(t, t1.Expire.Unix(), t2.Expire.Unix())
 }
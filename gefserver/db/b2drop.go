@@ -0,0 +1,48 @@
+package db
+
+// B2DropAccount holds the credentials used to access the B2DROP folder of a user
+type B2DropAccount struct {
+	UserID   int64
+	Username string
+	Password string `json:"-"`
+}
+
+// SetB2DropAccount stores the B2DROP credentials of a user, replacing the previous ones
+func (d *Db) SetB2DropAccount(account B2DropAccount) error {
+	storedAccount := B2DropAccountTable{
+		UserID:   account.UserID,
+		Username: account.Username,
+		Password: account.Password,
+	}
+	var existing B2DropAccountTable
+	err := d.db.SelectOne(&existing, "SELECT * FROM B2DropAccounts WHERE UserID=?", account.UserID)
+	if IsNoResultsError(err) {
+		return d.db.Insert(&storedAccount)
+	}
+	if err != nil {
+		return err
+	}
+	storedAccount.Revision = existing.Revision
+	_, err = d.db.Update(&storedAccount)
+	return err
+}
+
+// GetB2DropAccount returns the B2DROP credentials of a user
+func (d *Db) GetB2DropAccount(userID int64) (B2DropAccount, error) {
+	var storedAccount B2DropAccountTable
+	err := d.db.SelectOne(&storedAccount, "SELECT * FROM B2DropAccounts WHERE UserID=?", userID)
+	if err != nil {
+		return B2DropAccount{}, err
+	}
+	return B2DropAccount{
+		UserID:   storedAccount.UserID,
+		Username: storedAccount.Username,
+		Password: storedAccount.Password,
+	}, nil
+}
+
+// RemoveB2DropAccount removes the B2DROP credentials of a user
+func (d *Db) RemoveB2DropAccount(userID int64) error {
+	_, err := d.db.Exec("DELETE FROM B2DropAccounts WHERE UserID=?", userID)
+	return err
+}
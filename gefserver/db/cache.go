@@ -0,0 +1,103 @@
+package db
+
+import "time"
+
+// CacheEntry describes a file of the input data cache, a copy of the file
+// found at an URL, kept to seed the input volumes of the jobs
+type CacheEntry struct {
+	ID           string // the name of the copy in the cache folder
+	URL          string
+	Name         string
+	Size         int64
+	Checksum     string
+	ETag         string // the validators of the cached version, sent by the server
+	LastModified string
+	Created      time.Time
+	LastUsed     time.Time
+	Hits         int // how many times the copy was used instead of downloading the file
+}
+
+func cacheEntryTable2CacheEntry(t CacheEntryTable) CacheEntry {
+	return CacheEntry{
+		ID:           t.ID,
+		URL:          t.URL,
+		Name:         t.Name,
+		Size:         t.Size,
+		Checksum:     t.Checksum,
+		ETag:         t.ETag,
+		LastModified: t.LastModified,
+		Created:      t.Created,
+		LastUsed:     t.LastUsed,
+		Hits:         t.Hits,
+	}
+}
+
+// SetCacheEntry adds an entry to the input data cache, replacing the previous entry with the same ID
+func (d *Db) SetCacheEntry(entry CacheEntry) error {
+	storedEntry := CacheEntryTable{
+		ID:           entry.ID,
+		URL:          entry.URL,
+		Name:         entry.Name,
+		Size:         entry.Size,
+		Checksum:     entry.Checksum,
+		ETag:         entry.ETag,
+		LastModified: entry.LastModified,
+		Created:      entry.Created,
+		LastUsed:     entry.LastUsed,
+		Hits:         entry.Hits,
+	}
+	var existing CacheEntryTable
+	err := d.db.SelectOne(&existing, "SELECT * FROM InputCache WHERE ID=?", entry.ID)
+	if IsNoResultsError(err) {
+		return d.db.Insert(&storedEntry)
+	}
+	if err != nil {
+		return err
+	}
+	storedEntry.Revision = existing.Revision
+	_, err = d.db.Update(&storedEntry)
+	return err
+}
+
+// GetCacheEntry returns an entry of the input data cache
+func (d *Db) GetCacheEntry(id string) (CacheEntry, error) {
+	var storedEntry CacheEntryTable
+	err := d.db.SelectOne(&storedEntry, "SELECT * FROM InputCache WHERE ID=?", id)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	return cacheEntryTable2CacheEntry(storedEntry), nil
+}
+
+// ListCacheEntries returns the entries of the input data cache, the least recently used first
+func (d *Db) ListCacheEntries() ([]CacheEntry, error) {
+	var storedEntries []CacheEntryTable
+	_, err := d.db.Select(&storedEntries, "SELECT * FROM InputCache ORDER BY LastUsed, ID")
+	if err != nil {
+		return nil, err
+	}
+	entries := []CacheEntry{}
+	for _, e := range storedEntries {
+		entries = append(entries, cacheEntryTable2CacheEntry(e))
+	}
+	return entries, nil
+}
+
+// UseCacheEntry records a use of an entry of the input data cache
+func (d *Db) UseCacheEntry(id string, used time.Time) error {
+	var storedEntry CacheEntryTable
+	err := d.db.SelectOne(&storedEntry, "SELECT * FROM InputCache WHERE ID=?", id)
+	if err != nil {
+		return err
+	}
+	storedEntry.LastUsed = used
+	storedEntry.Hits++
+	_, err = d.db.Update(&storedEntry)
+	return err
+}
+
+// RemoveCacheEntry removes an entry of the input data cache
+func (d *Db) RemoveCacheEntry(id string) error {
+	_, err := d.db.Exec("DELETE FROM InputCache WHERE ID=?", id)
+	return err
+}
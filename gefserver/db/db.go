@@ -3,6 +3,7 @@ package db
 import (
 	"bytes"
 	"database/sql"
+	"encoding/json"
 	"log"
 	"os"
 	"path/filepath"
@@ -38,6 +39,8 @@ type ConnectionTable struct {
 	CertPath    string
 	KeyPath     string
 	CAPath      string
+	Type        string
+	Kubernetes  string // JSON encoded def.KubernetesConfig
 	Revision    int
 }
 
@@ -46,14 +49,37 @@ type JobTable struct {
 	ID           string
 	ConnectionID int
 	ServiceID    string
+	WorkflowID   string // empty unless the job runs a chain of services
+	RetryOf      string // the job retried by this job, if any
+	Attempt      int
 	Created      time.Time
 	Duration     int64 // duration time in seconds
 	Error        string
 	Status       string
 	Code         int
+	Publication  string // JSON encoded JobPublication, empty if the job was never published
+	B2DropCopy   string // JSON encoded JobB2DropCopy, empty if the results were never copied into B2DROP
+	Name         string
+	Description  string
 	Revision     int
 }
 
+// JobProvenanceTable stores the provenance record of a job
+type JobProvenanceTable struct {
+	JobID    string
+	Record   string // JSON encoded JobProvenance
+	Revision int
+}
+
+// JobLabelTable stores a key/value label of a job
+type JobLabelTable struct {
+	ID       int64
+	JobID    string
+	Key      string
+	Value    string
+	Revision int
+}
+
 // VolumeTable contains information about input and output volumes for jobs
 type VolumeTable struct {
 	ID         string
@@ -61,6 +87,8 @@ type VolumeTable struct {
 	JobID      string
 	IOPortName string
 	Content    string
+	Local      bool  // true if Content is a file created by the GEF server for the job
+	Size       int64 // the size of the files, measured when the job has ended
 	Revision   int
 }
 
@@ -77,6 +105,37 @@ type TaskTable struct {
 	Revision       int
 }
 
+// StagedFileTable records the outcome of the download of a job input file (used to store data in a database)
+type StagedFileTable struct {
+	ID       int64
+	JobID    string
+	VolumeID string
+	Source   string
+	URL      string
+	Name     string
+	Size     int64
+	Checksum string
+	Verified bool
+	Cached   bool
+	Error    string
+	Revision int
+}
+
+// CacheEntryTable describes a file of the input data cache (used to store data in a database)
+type CacheEntryTable struct {
+	ID           string
+	URL          string
+	Name         string
+	Size         int64
+	Checksum     string
+	ETag         string
+	LastModified string
+	Created      time.Time
+	LastUsed     time.Time
+	Hits         int
+	Revision     int
+}
+
 // ServiceTable describes metadata for a GEF service (used to store data in a database)
 type ServiceTable struct {
 	ID           string
@@ -89,7 +148,11 @@ type ServiceTable struct {
 	Created      time.Time
 	Deleted      bool
 	Size         int64
-	Revision     int
+	// RetryMaxAttempts and RetryBackoff store the automatic retry policy of the service
+	RetryMaxAttempts int
+	RetryBackoff     int
+	CommunityID      int64 // 0 if everybody can see the service
+	Revision         int
 }
 
 // IOPortTable is used to store info about service inputs and outputs in a database
@@ -101,7 +164,14 @@ type IOPortTable struct {
 	ServiceID string
 	Type      string
 	FileName  string
-	Revision  int
+	Optional  bool
+	// DefaultValue, Pattern, Min, Max and EnumValues (JSON encoded) are the input constraints
+	DefaultValue string
+	Pattern      string
+	Min          string
+	Max          string
+	EnumValues   string
+	Revision     int
 }
 
 // ServiceCmdTable stores CMD options for services
@@ -113,6 +183,40 @@ type ServiceCmdTable struct {
 	Revision  int
 }
 
+// WorkflowTable describes a chain of GEF services (used to store data in a database)
+type WorkflowTable struct {
+	ID           string
+	ConnectionID int
+	Name         string
+	Description  string
+	Created      time.Time
+	Revision     int
+}
+
+// WorkflowStepTable stores the services of a workflow, in execution order
+type WorkflowStepTable struct {
+	ID         int
+	WorkflowID string
+	Position   int
+	ServiceID  string
+	Revision   int
+}
+
+// QueueTable stores the jobs waiting for execution or being executed, so that
+// they survive a server restart (used to store data in a database)
+type QueueTable struct {
+	JobID        string
+	UserID       int64
+	ConnectionID int
+	Inputs       string // JSON encoded list of input sources
+	Limits       string // JSON encoded def.LimitConfig
+	Timeouts     string // JSON encoded def.TimeoutConfig
+	Enqueued     time.Time
+	NotBefore    time.Time // the job is not started before this time
+	Started      bool
+	Revision     int
+}
+
 // UserTable stores the users in the db
 type UserTable struct {
 	ID       int64
@@ -125,11 +229,29 @@ type UserTable struct {
 
 // TokenTable stores user tokens in the db
 type TokenTable struct {
+	ID           int64
+	Name         string // token name, user defined
+	Secret       string // "sha256:" and the hash of the token secret, a random string
+	UserID       int64
+	Expire       time.Time
+	Restrictions string // JSON encoded scopes, services and communities the token is restricted to
+	Revision     int
+}
+
+// B2DropAccountTable stores the B2DROP credentials of the users
+type B2DropAccountTable struct {
+	UserID   int64
+	Username string
+	Password string // an app password, generated by the user in B2DROP for the GEF
+	Revision int
+}
+
+// UserIdentityTable links the users to the subject identifiers of the login providers
+type UserIdentityTable struct {
 	ID       int64
-	Name     string // token name, user defined
-	Secret   string // token secret, a random string
 	UserID   int64
-	Expire   time.Time
+	Provider string
+	Subject  string
 	Revision int
 }
 
@@ -154,6 +276,8 @@ type RoleTable struct {
 type UserRoleTable struct {
 	UserID   int64
 	RoleID   int64
+	Source   string    // the identity provider which asserted the role, empty if granted by hand
+	Synced   time.Time // when the identity provider last asserted the role
 	Revision int
 }
 
@@ -214,10 +338,18 @@ func setupDatabase(dataBase *sql.DB) (Db, error) {
 
 	dataBaseMap.AddTableWithName(JobTable{}, "Jobs").SetKeys(false, "ID").SetVersionCol(gorpVersionColumn)
 
+	dataBaseMap.AddTableWithName(JobLabelTable{}, "JobLabels").SetKeys(true, "ID").SetVersionCol(gorpVersionColumn)
+
+	dataBaseMap.AddTableWithName(JobProvenanceTable{}, "JobProvenance").SetKeys(false, "JobID").SetVersionCol(gorpVersionColumn)
+
 	dataBaseMap.AddTableWithName(VolumeTable{}, "Volumes").SetKeys(false, "ID").SetVersionCol(gorpVersionColumn)
 
 	dataBaseMap.AddTableWithName(TaskTable{}, "Tasks").SetKeys(false, "ID").SetVersionCol(gorpVersionColumn)
 
+	dataBaseMap.AddTableWithName(StagedFileTable{}, "StagedFiles").SetKeys(true, "ID").SetVersionCol(gorpVersionColumn)
+
+	dataBaseMap.AddTableWithName(CacheEntryTable{}, "InputCache").SetKeys(false, "ID").SetVersionCol(gorpVersionColumn)
+
 	dataBaseMap.AddTableWithName(ServiceTable{}, "Services").SetKeys(false, "ID").SetVersionCol(gorpVersionColumn)
 
 	dataBaseMap.AddTableWithName(IOPortTable{}, "IOPorts").SetVersionCol(gorpVersionColumn)
@@ -226,6 +358,12 @@ func setupDatabase(dataBase *sql.DB) (Db, error) {
 
 	dataBaseMap.AddTableWithName(BuildTable{}, "Builds").SetKeys(false, "ID").SetVersionCol(gorpVersionColumn)
 
+	dataBaseMap.AddTableWithName(WorkflowTable{}, "Workflows").SetKeys(false, "ID").SetVersionCol(gorpVersionColumn)
+
+	dataBaseMap.AddTableWithName(WorkflowStepTable{}, "WorkflowSteps").SetKeys(true, "ID").SetVersionCol(gorpVersionColumn)
+
+	dataBaseMap.AddTableWithName(QueueTable{}, "JobQueue").SetKeys(false, "JobID").SetVersionCol(gorpVersionColumn)
+
 	userTable := dataBaseMap.AddTableWithName(UserTable{}, "Users").SetKeys(true, "ID")
 	{
 		userTable.SetVersionCol(gorpVersionColumn)
@@ -252,12 +390,29 @@ func setupDatabase(dataBase *sql.DB) (Db, error) {
 	dataBaseMap.AddTableWithName(UserRoleTable{}, "UserRoles").SetVersionCol(gorpVersionColumn)
 	dataBaseMap.AddTableWithName(OwnerTable{}, "Owners").SetVersionCol(gorpVersionColumn)
 
+	dataBaseMap.AddTableWithName(B2DropAccountTable{}, "B2DropAccounts").SetKeys(false, "UserID").SetVersionCol(gorpVersionColumn)
+
+	identityTable := dataBaseMap.AddTableWithName(UserIdentityTable{}, "UserIdentities").SetKeys(true, "ID")
+	{
+		identityTable.SetVersionCol(gorpVersionColumn)
+		identityTable.SetUniqueTogether("Provider", "Subject")
+	}
+
 	err := dataBaseMap.CreateTablesIfNotExists()
 	if err != nil {
 		return Db{}, err
 	}
 
+	err = upgradeSchema(dataBaseMap)
+	if err != nil {
+		return Db{}, def.Err(err, "error in upgradeSchema")
+	}
+
 	db := Db{db: *dataBaseMap}
+	err = hashStoredTokenSecrets(db)
+	if err != nil {
+		return Db{}, def.Err(err, "error in hashStoredTokenSecrets")
+	}
 	err = initializeDatabaseValues(db)
 	if err != nil {
 		err = def.Err(err, "error in initializeDatabaseValues")
@@ -265,6 +420,47 @@ func setupDatabase(dataBase *sql.DB) (Db, error) {
 	return db, err
 }
 
+// schemaUpgrades lists the columns added to already existing tables;
+// CreateTablesIfNotExists does not alter the tables of an older database file
+var schemaUpgrades = []string{
+	"ALTER TABLE Jobs ADD COLUMN WorkflowID varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE Jobs ADD COLUMN RetryOf varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE Jobs ADD COLUMN Attempt integer NOT NULL DEFAULT 1",
+	"ALTER TABLE Services ADD COLUMN RetryMaxAttempts integer NOT NULL DEFAULT 0",
+	"ALTER TABLE Services ADD COLUMN RetryBackoff integer NOT NULL DEFAULT 0",
+	"ALTER TABLE JobQueue ADD COLUMN NotBefore datetime NOT NULL DEFAULT '0001-01-01 00:00:00+00:00'",
+	"ALTER TABLE Connections ADD COLUMN Type varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE Connections ADD COLUMN Kubernetes varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE IOPorts ADD COLUMN Optional boolean NOT NULL DEFAULT 0",
+	"ALTER TABLE IOPorts ADD COLUMN DefaultValue varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE IOPorts ADD COLUMN Pattern varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE IOPorts ADD COLUMN Min varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE IOPorts ADD COLUMN Max varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE IOPorts ADD COLUMN EnumValues varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE Jobs ADD COLUMN Publication varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE StagedFiles ADD COLUMN Cached boolean NOT NULL DEFAULT 0",
+	"ALTER TABLE Volumes ADD COLUMN Size integer NOT NULL DEFAULT 0",
+	"ALTER TABLE Jobs ADD COLUMN Name varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE Jobs ADD COLUMN Description varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE Tokens ADD COLUMN Restrictions varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE UserRoles ADD COLUMN Source varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE UserRoles ADD COLUMN Synced datetime NOT NULL DEFAULT '0001-01-01 00:00:00+00:00'",
+	"ALTER TABLE Services ADD COLUMN CommunityID integer NOT NULL DEFAULT 0",
+	"ALTER TABLE Volumes ADD COLUMN Local boolean NOT NULL DEFAULT 0",
+	"ALTER TABLE Jobs ADD COLUMN B2DropCopy varchar(255) NOT NULL DEFAULT ''",
+}
+
+// upgradeSchema applies the schemaUpgrades, skipping those already applied
+func upgradeSchema(dataBaseMap *gorp.DbMap) error {
+	for _, stmt := range schemaUpgrades {
+		_, err := dataBaseMap.Exec(stmt)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return def.Err(err, "schema upgrade failed: %s", stmt)
+		}
+	}
+	return nil
+}
+
 func initializeDatabaseValues(d Db) error {
 	_, err := d.AddRole(SuperAdminRoleName, 0, "Super Administrator of the site, with all privileges.")
 	if err != nil {
@@ -294,8 +490,13 @@ func (d *Db) Close() {
 
 // AddConnection adds a connection to the database
 func (d *Db) AddConnection(userID int64, connection def.DockerConfig) (ConnectionID, error) {
+	kubernetes, err := json.Marshal(connection.Kubernetes)
+	if err != nil {
+		return 0, def.Err(err, "cannot serialize the kubernetes configuration")
+	}
+
 	var ct ConnectionTable
-	err := d.db.SelectOne(&ct,
+	err = d.db.SelectOne(&ct,
 		"SELECT * FROM connections WHERE Endpoint=?",
 		connection.Endpoint)
 
@@ -309,6 +510,8 @@ func (d *Db) AddConnection(userID int64, connection def.DockerConfig) (Connectio
 	ct.CertPath = connection.CertPath
 	ct.KeyPath = connection.KeyPath
 	ct.CAPath = connection.CAPath
+	ct.Type = connection.Type
+	ct.Kubernetes = string(kubernetes)
 
 	if IsNoResultsError(err) {
 		err = d.db.Insert(&ct)
@@ -357,7 +560,8 @@ func (d *Db) GetConnections() (map[ConnectionID]def.DockerConfig, error) {
 
 	connections := make(map[ConnectionID]def.DockerConfig)
 	for _, c := range connectionTable {
-		connections[ConnectionID(c.ID)] = def.DockerConfig{
+		connection := def.DockerConfig{
+			Type:        c.Type,
 			Endpoint:    c.Endpoint,
 			Description: c.Description,
 			TLSVerify:   c.TLSVerify,
@@ -365,6 +569,13 @@ func (d *Db) GetConnections() (map[ConnectionID]def.DockerConfig, error) {
 			KeyPath:     c.KeyPath,
 			CAPath:      c.CAPath,
 		}
+		if c.Kubernetes != "" {
+			err = json.Unmarshal([]byte(c.Kubernetes), &connection.Kubernetes)
+			if err != nil {
+				return nil, def.Err(err, "cannot read the kubernetes configuration of connection %d", c.ID)
+			}
+		}
+		connections[ConnectionID(c.ID)] = connection
 	}
 
 	return connections, err
@@ -419,6 +630,10 @@ func (d *Db) AddJob(userID int64, job Job) error {
 	if err != nil {
 		return err
 	}
+	err = d.addJobLabels(job.ID, job.Labels)
+	if err != nil {
+		return err
+	}
 	ownership := OwnerTable{
 		UserID:     userID,
 		ObjectType: "Job",
@@ -427,13 +642,38 @@ func (d *Db) AddJob(userID int64, job Job) error {
 	return d.db.Insert(&ownership)
 }
 
-// RemoveJob removes a job and all corresponding tasks from the database
+// RemoveJob removes a job and all corresponding tasks and volumes from the database
 func (d *Db) RemoveJob(id JobID) error {
 	_, err := d.db.Exec("DELETE FROM Tasks WHERE jobID=?", string(id))
 	if err != nil {
 		return err
 	}
 
+	_, err = d.db.Exec("DELETE FROM StagedFiles WHERE JobID=?", string(id))
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec("DELETE FROM JobLabels WHERE JobID=?", string(id))
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec("DELETE FROM JobProvenance WHERE JobID=?", string(id))
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec("DELETE FROM Volumes WHERE jobID=?", string(id))
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec("DELETE FROM JobQueue WHERE JobID=?", string(id))
+	if err != nil {
+		return err
+	}
+
 	_, err = d.db.Exec("DELETE FROM Jobs WHERE ID=?", string(id))
 	if err != nil {
 		return err
@@ -453,26 +693,15 @@ func (d *Db) RemoveJobTask(taskID string) error {
 	return err
 }
 
-// CountRunningJobs returns a number of jobs currently running
-func (d *Db) CountRunningJobs() int64 {
-	count, err := d.db.SelectInt(
-		"SELECT count(*) FROM jobs WHERE jobs.Code<0")
-
-	if err != nil && !IsNoResultsError(err) {
-		log.Printf("ERROR in CountRunningJobs: %#v", err)
-	}
-	return count
+// CountRunningJobs returns the number of jobs currently running, i.e. admitted from the queue
+// and not finished; the jobs waiting in the queue are not counted
+func (d *Db) CountRunningJobs() (int64, error) {
+	return d.db.SelectInt("SELECT count(*) FROM JobQueue WHERE Started=?", true)
 }
 
-// CountUserRunningJobs returns a number of running jobs owned by a specific user
-func (d *Db) CountUserRunningJobs(userID int64) int64 {
-	count, err := d.db.SelectInt(
-		"SELECT count(*) FROM owners INNER JOIN jobs on owners.ObjectID = jobs.ID WHERE owners.UserID=? AND jobs.Code<0", userID)
-
-	if err != nil { //&& !IsNoResultsError(err) {
-		log.Printf("ERROR in CountUserRunningJobs: %#v", err)
-	}
-	return count
+// CountUserRunningJobs returns the number of running jobs owned by a specific user
+func (d *Db) CountUserRunningJobs(userID int64) (int64, error) {
+	return d.db.SelectInt("SELECT count(*) FROM JobQueue WHERE Started=? AND UserID=?", true, userID)
 }
 
 // jobTable2Job performs mapping of the database job table to its JSON representation
@@ -492,6 +721,35 @@ func (d *Db) jobTable2Job(storedJob JobTable) (Job, error) {
 		return job, err
 	}
 
+	var storedFiles []StagedFileTable
+	_, err = d.db.Select(&storedFiles, "SELECT * FROM StagedFiles WHERE JobID=? ORDER BY ID", storedJob.ID)
+	if err != nil {
+		return job, err
+	}
+
+	var storedLabels []JobLabelTable
+	_, err = d.db.Select(&storedLabels, "SELECT * FROM JobLabels WHERE JobID=?", storedJob.ID)
+	if err != nil {
+		return job, err
+	}
+	job.Labels = map[string]string{}
+	for _, l := range storedLabels {
+		job.Labels[l.Key] = l.Value
+	}
+	for _, f := range storedFiles {
+		job.StagedFiles = append(job.StagedFiles, StagedFile{
+			VolumeID: VolumeID(f.VolumeID),
+			Source:   f.Source,
+			URL:      f.URL,
+			Name:     f.Name,
+			Size:     f.Size,
+			Checksum: f.Checksum,
+			Verified: f.Verified,
+			Cached:   f.Cached,
+			Error:    f.Error,
+		})
+	}
+
 	for _, t := range storedTasks {
 		var curTask Task
 		curTask.Error = t.Error
@@ -511,6 +769,7 @@ func (d *Db) jobTable2Job(storedJob JobTable) (Job, error) {
 		var curJobVolume JobVolume
 		curJobVolume.Name = storedVolumes[s].IOPortName
 		curJobVolume.VolumeID = VolumeID(storedVolumes[s].ID)
+		curJobVolume.Size = storedVolumes[s].Size
 		if storedVolumes[s].IsInput {
 			inputVolumes = append(inputVolumes, curJobVolume)
 		} else {
@@ -525,7 +784,12 @@ func (d *Db) jobTable2Job(storedJob JobTable) (Job, error) {
 	job.ID = JobID(storedJob.ID)
 	job.ConnectionID = ConnectionID(storedJob.ConnectionID)
 	job.ServiceID = ServiceID(storedJob.ServiceID)
+	job.WorkflowID = WorkflowID(storedJob.WorkflowID)
+	job.RetryOf = JobID(storedJob.RetryOf)
+	job.Attempt = storedJob.Attempt
 	job.Created = storedJob.Created
+	job.Name = storedJob.Name
+	job.Description = storedJob.Description
 
 	if jobState.Code < 0 {
 		job.Duration = time.Now().Unix() - job.Created.Unix()
@@ -533,6 +797,23 @@ func (d *Db) jobTable2Job(storedJob JobTable) (Job, error) {
 		job.Duration = storedJob.Duration
 	}
 
+	if storedJob.Publication != "" {
+		var publication JobPublication
+		err = json.Unmarshal([]byte(storedJob.Publication), &publication)
+		if err != nil {
+			return job, err
+		}
+		job.Publication = &publication
+	}
+	if storedJob.B2DropCopy != "" {
+		var b2dropCopy JobB2DropCopy
+		err = json.Unmarshal([]byte(storedJob.B2DropCopy), &b2dropCopy)
+		if err != nil {
+			return job, err
+		}
+		job.B2DropCopy = &b2dropCopy
+	}
+
 	job.State = &jobState
 	job.InputVolume = inputVolumes
 	job.OutputVolume = outputVolumes
@@ -546,7 +827,12 @@ func (d *Db) job2JobTable(job Job) JobTable {
 	storedJob.ID = string(job.ID)
 	storedJob.ConnectionID = int(job.ConnectionID)
 	storedJob.ServiceID = string(job.ServiceID)
+	storedJob.WorkflowID = string(job.WorkflowID)
+	storedJob.RetryOf = string(job.RetryOf)
+	storedJob.Attempt = job.Attempt
 	storedJob.Created = job.Created
+	storedJob.Name = job.Name
+	storedJob.Description = job.Description
 	storedJob.Duration = job.Duration
 	storedJob.Error = job.State.Error
 	storedJob.Status = job.State.Status
@@ -582,6 +868,26 @@ func (d *Db) ListJobs() ([]Job, error) {
 	return jobs, err
 }
 
+// ListUnfinishedJobs returns the jobs which are still waiting or running
+func (d *Db) ListUnfinishedJobs() ([]Job, error) {
+	var jobs []Job
+	var jobsFromTable []JobTable
+	_, err := d.db.Select(&jobsFromTable, "SELECT * FROM Jobs WHERE Code<0 ORDER BY Created")
+	if err != nil {
+		return jobs, err
+	}
+
+	for _, j := range jobsFromTable {
+		var curJob Job
+		curJob, err = d.jobTable2Job(j)
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, curJob)
+	}
+	return jobs, nil
+}
+
 // GetJob returns a JSON ready representation of a job
 func (d *Db) GetJob(id JobID) (Job, error) {
 	var job Job
@@ -610,17 +916,202 @@ func (d *Db) SetJobState(id JobID, state JobState) error {
 	return err
 }
 
-// AddJobVolume sets a job input/output volume
-func (d *Db) AddJobVolume(id JobID, volume VolumeID, isInput bool, portName string, content string) error {
+// SetJobPublication sets the state of the publication of a job results
+func (d *Db) SetJobPublication(id JobID, publication JobPublication) error {
+	var storedJob JobTable
+	err := d.db.SelectOne(&storedJob, "SELECT * FROM jobs WHERE ID=?", string(id))
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(publication)
+	if err != nil {
+		return err
+	}
+	storedJob.Publication = string(data)
+	_, err = d.db.Update(&storedJob)
+	return err
+}
+
+// StartJobPublication sets the state of a new publication of a job results, unless a
+// publication is already in progress, in which case it returns ErrTransferInProgress
+func (d *Db) StartJobPublication(id JobID, publication JobPublication) error {
+	return d.startJobTransfer(id, func(job *JobTable) *string { return &job.Publication }, publication)
+}
+
+// SetJobB2DropCopy sets the state of the copy of a job results into B2DROP
+func (d *Db) SetJobB2DropCopy(id JobID, b2dropCopy JobB2DropCopy) error {
+	var storedJob JobTable
+	err := d.db.SelectOne(&storedJob, "SELECT * FROM jobs WHERE ID=?", string(id))
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(b2dropCopy)
+	if err != nil {
+		return err
+	}
+	storedJob.B2DropCopy = string(data)
+	_, err = d.db.Update(&storedJob)
+	return err
+}
+
+// StartJobB2DropCopy sets the state of a new copy of a job results into B2DROP, unless a
+// copy is already in progress, in which case it returns ErrTransferInProgress
+func (d *Db) StartJobB2DropCopy(id JobID, b2dropCopy JobB2DropCopy) error {
+	return d.startJobTransfer(id, func(job *JobTable) *string { return &job.B2DropCopy }, b2dropCopy)
+}
+
+// startJobTransfer replaces the JSON encoded state of a publication or a copy of a job
+// results, selected by field, unless the stored state has the in-progress code -1. The
+// version column makes the update fail if the job changed since it was read, in which
+// case the check is made again: two concurrent requests cannot both start a transfer
+func (d *Db) startJobTransfer(id JobID, field func(*JobTable) *string, state interface{}) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	for {
+		var storedJob JobTable
+		err := d.db.SelectOne(&storedJob, "SELECT * FROM jobs WHERE ID=?", string(id))
+		if err != nil {
+			return err
+		}
+
+		stored := field(&storedJob)
+		if *stored != "" {
+			var current struct{ Code int }
+			err = json.Unmarshal([]byte(*stored), &current)
+			if err != nil {
+				return err
+			}
+			if current.Code == -1 {
+				return ErrTransferInProgress
+			}
+		}
+		*stored = string(data)
+		_, err = d.db.Update(&storedJob)
+		if _, outdated := err.(gorp.OptimisticLockError); !outdated {
+			return err
+		}
+	}
+}
+
+// AddJobVolume sets a job input/output volume; the source is empty for the output volumes
+func (d *Db) AddJobVolume(id JobID, volume VolumeID, isInput bool, portName string, source JobInput) error {
 	var storedVolumes VolumeTable
 	storedVolumes.ID = string(volume)
 	storedVolumes.JobID = string(id)
 	storedVolumes.IsInput = isInput
 	storedVolumes.IOPortName = portName
-	storedVolumes.Content = content
+	storedVolumes.Content = source.Source
+	storedVolumes.Local = source.Local
 	return d.db.Insert(&storedVolumes)
 }
 
+// GetJobInputSources returns the sources from which the input volumes of a job were staged,
+// by input port name
+func (d *Db) GetJobInputSources(id JobID) (map[string]JobInput, error) {
+	var storedVolumes []VolumeTable
+	_, err := d.db.Select(&storedVolumes, "SELECT * FROM Volumes WHERE JobID=? AND IsInput=?", string(id), true)
+	if err != nil {
+		return nil, err
+	}
+
+	inputSrc := make(map[string]JobInput)
+	for _, v := range storedVolumes {
+		inputSrc[v.IOPortName] = JobInput{Source: v.Content, Local: v.Local}
+	}
+	return inputSrc, nil
+}
+
+// SetJobMetadata replaces the name, the description and the labels of a job
+func (d *Db) SetJobMetadata(id JobID, name string, description string, labels map[string]string) error {
+	var storedJob JobTable
+	err := d.db.SelectOne(&storedJob, "SELECT * FROM Jobs WHERE ID=?", string(id))
+	if err != nil {
+		return err
+	}
+
+	storedJob.Name = name
+	storedJob.Description = description
+	_, err = d.db.Update(&storedJob)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec("DELETE FROM JobLabels WHERE JobID=?", string(id))
+	if err != nil {
+		return err
+	}
+	return d.addJobLabels(id, labels)
+}
+
+func (d *Db) addJobLabels(id JobID, labels map[string]string) error {
+	for key, value := range labels {
+		err := d.db.Insert(&JobLabelTable{JobID: string(id), Key: key, Value: value})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveJobVolumes removes the volume records of a job
+func (d *Db) RemoveJobVolumes(id JobID) error {
+	_, err := d.db.Exec("DELETE FROM Volumes WHERE JobID=?", string(id))
+	return err
+}
+
+// SetJobVolumeSize records the size of the files of a job volume
+func (d *Db) SetJobVolumeSize(volume VolumeID, size int64) error {
+	var storedVolume VolumeTable
+	err := d.db.SelectOne(&storedVolume, "SELECT * FROM Volumes WHERE ID=?", string(volume))
+	if err != nil {
+		return err
+	}
+
+	storedVolume.Size = size
+	_, err = d.db.Update(&storedVolume)
+	return err
+}
+
+// GetUserStorageUsage returns the size of the volumes of the jobs owned by a user
+func (d *Db) GetUserStorageUsage(userID int64) (int64, error) {
+	return d.db.SelectInt(
+		`SELECT COALESCE(SUM(volumes.Size), 0) FROM volumes INNER JOIN owners
+		ON owners.ObjectType = ? AND owners.ObjectID = volumes.JobID
+		WHERE owners.UserID = ?`,
+		"Job", userID)
+}
+
+// GetCommunityStorageUsage returns the size of the volumes of the jobs owned by
+// the users having a role in a community
+func (d *Db) GetCommunityStorageUsage(communityID int64) (int64, error) {
+	return d.db.SelectInt(
+		`SELECT COALESCE(SUM(volumes.Size), 0) FROM volumes INNER JOIN owners
+		ON owners.ObjectType = ? AND owners.ObjectID = volumes.JobID
+		WHERE owners.UserID IN (
+			SELECT ur.UserID FROM userroles ur, roles r
+			WHERE ur.RoleID = r.ID AND r.CommunityID = ?)`,
+		"Job", communityID)
+}
+
+// ListVolumeIDs returns the IDs of the input and output volumes of all the jobs
+func (d *Db) ListVolumeIDs() ([]VolumeID, error) {
+	var storedVolumes []VolumeTable
+	_, err := d.db.Select(&storedVolumes, "SELECT * FROM Volumes ORDER BY ID")
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []VolumeID
+	for _, v := range storedVolumes {
+		ids = append(ids, VolumeID(v.ID))
+	}
+	return ids, nil
+}
+
 // SetJobDurationTime sets job finish time
 func (d *Db) SetJobDurationTime(id JobID, duration int64) error {
 	var storedJob JobTable
@@ -634,9 +1125,9 @@ func (d *Db) SetJobDurationTime(id JobID, duration int64) error {
 	return err
 }
 
-// AddJobTask adds a task to a job
+// AddJobTask adds a task to a job and returns the new task's ID
 func (d *Db) AddJobTask(id JobID, taskName string, taskContainer string, taskSwarmService string,
-	taskError string, taskExitCode int, taskConsoleOutput *bytes.Buffer) error {
+	taskError string, taskExitCode int, taskConsoleOutput *bytes.Buffer) (string, error) {
 	var newTask TaskTable
 	newTask.ID = uuid.New()
 	newTask.Name = taskName
@@ -646,7 +1137,39 @@ func (d *Db) AddJobTask(id JobID, taskName string, taskContainer string, taskSwa
 	newTask.ExitCode = taskExitCode
 	newTask.ConsoleOutput = taskConsoleOutput.String()
 	newTask.JobID = string(id)
-	return d.db.Insert(&newTask)
+	return newTask.ID, d.db.Insert(&newTask)
+}
+
+// SetJobTaskResult sets the outcome of a task which has ended
+func (d *Db) SetJobTaskResult(taskID string, taskError string, taskExitCode int, taskConsoleOutput *bytes.Buffer) error {
+	var storedTask TaskTable
+	err := d.db.SelectOne(&storedTask, "SELECT * FROM Tasks WHERE ID=?", taskID)
+	if err != nil {
+		return err
+	}
+
+	storedTask.Error = taskError
+	storedTask.ExitCode = taskExitCode
+	storedTask.ConsoleOutput = taskConsoleOutput.String()
+	_, err = d.db.Update(&storedTask)
+	return err
+}
+
+// AddJobStagedFile records the outcome of the download of an input file of a job
+func (d *Db) AddJobStagedFile(id JobID, file StagedFile) error {
+	storedFile := StagedFileTable{
+		JobID:    string(id),
+		VolumeID: string(file.VolumeID),
+		Source:   file.Source,
+		URL:      file.URL,
+		Name:     file.Name,
+		Size:     file.Size,
+		Checksum: file.Checksum,
+		Verified: file.Verified,
+		Cached:   file.Cached,
+		Error:    file.Error,
+	}
+	return d.db.Insert(&storedFile)
 }
 
 // serviceTable2Service performs mapping of the database service table to its JSON representation
@@ -665,13 +1188,10 @@ func (d *Db) serviceTable2Service(storedService ServiceTable) (Service, error) {
 	}
 
 	for _, i := range storedInputPorts {
-		var curInput IOPort
-		curInput.ID = i.ID
-		curInput.Name = i.Name
-		curInput.Path = i.Path
-		curInput.Type = i.Type
-		curInput.FileName = i.FileName
-
+		curInput, err := ioPortTable2IOPort(i)
+		if err != nil {
+			return service, err
+		}
 		inputPorts = append(inputPorts, curInput)
 	}
 
@@ -682,13 +1202,10 @@ func (d *Db) serviceTable2Service(storedService ServiceTable) (Service, error) {
 	}
 
 	for _, o := range storedOutputPorts {
-		var curOutput IOPort
-		curOutput.ID = o.ID
-		curOutput.Name = o.Name
-		curOutput.Path = o.Path
-		curOutput.Type = o.Type
-		curOutput.FileName = o.FileName
-
+		curOutput, err := ioPortTable2IOPort(o)
+		if err != nil {
+			return service, err
+		}
 		outputPorts = append(outputPorts, curOutput)
 	}
 
@@ -719,6 +1236,18 @@ func (d *Db) serviceTable2Service(storedService ServiceTable) (Service, error) {
 	service.Created = storedService.Created
 	service.Deleted = storedService.Deleted
 	service.Size = storedService.Size
+	service.Retry = RetryPolicy{
+		MaxAttempts: storedService.RetryMaxAttempts,
+		Backoff:     storedService.RetryBackoff,
+	}
+	service.CommunityID = storedService.CommunityID
+	if service.CommunityID != 0 {
+		community, err := d.GetCommunityByID(service.CommunityID)
+		if err != nil && !IsNoResultsError(err) {
+			return service, err
+		}
+		service.CommunityName = community.Name
+	}
 	service.Input = inputPorts
 	service.Input = inputPorts
 	service.Output = outputPorts
@@ -739,21 +1268,66 @@ func (d *Db) service2ServiceTable(service Service) ServiceTable {
 	storedService.Created = service.Created
 	storedService.Deleted = service.Deleted
 	storedService.Size = service.Size
+	storedService.RetryMaxAttempts = service.Retry.MaxAttempts
+	storedService.RetryBackoff = service.Retry.Backoff
+	storedService.CommunityID = service.CommunityID
 	return storedService
 }
 
+// ioPortTable2IOPort performs mapping of the database port table to its JSON representation
+func ioPortTable2IOPort(storedPort IOPortTable) (IOPort, error) {
+	var port IOPort
+	port.ID = storedPort.ID
+	port.Name = storedPort.Name
+	port.Path = storedPort.Path
+	port.Type = storedPort.Type
+	port.FileName = storedPort.FileName
+	port.Optional = storedPort.Optional
+	port.Default = storedPort.DefaultValue
+	port.Pattern = storedPort.Pattern
+	port.Min = storedPort.Min
+	port.Max = storedPort.Max
+	if storedPort.EnumValues != "" {
+		err := json.Unmarshal([]byte(storedPort.EnumValues), &port.Values)
+		if err != nil {
+			return port, def.Err(err, "cannot decode the values of port %s", storedPort.ID)
+		}
+	}
+	return port, nil
+}
+
+// ioPort2IOPortTable performs mapping of a port JSON representation to its database representation
+func ioPort2IOPortTable(serviceID ServiceID, port IOPort, isInput bool) (IOPortTable, error) {
+	var storedPort IOPortTable
+	storedPort.ID = port.ID
+	storedPort.Name = port.Name
+	storedPort.Path = port.Path
+	storedPort.IsInput = isInput
+	storedPort.ServiceID = string(serviceID)
+	storedPort.Type = port.Type
+	storedPort.FileName = port.FileName
+	storedPort.Optional = port.Optional
+	storedPort.DefaultValue = port.Default
+	storedPort.Pattern = port.Pattern
+	storedPort.Min = port.Min
+	storedPort.Max = port.Max
+	if len(port.Values) > 0 {
+		values, err := json.Marshal(port.Values)
+		if err != nil {
+			return storedPort, def.Err(err, "cannot encode the values of port %s", port.ID)
+		}
+		storedPort.EnumValues = string(values)
+	}
+	return storedPort, nil
+}
+
 // AddIOPort adds input and output ports to the database
 func (d *Db) AddIOPort(service Service) error {
-	var err error
 	for _, p := range service.Input {
-		var curInputPort IOPortTable
-		curInputPort.FileName = p.FileName
-		curInputPort.Type = p.Type
-		curInputPort.Path = p.Path
-		curInputPort.Name = p.Name
-		curInputPort.ID = p.ID
-		curInputPort.IsInput = true
-		curInputPort.ServiceID = string(service.ID)
+		curInputPort, err := ioPort2IOPortTable(service.ID, p, true)
+		if err != nil {
+			return err
+		}
 		err = d.db.Insert(&curInputPort)
 		if err != nil {
 			return err
@@ -761,20 +1335,16 @@ func (d *Db) AddIOPort(service Service) error {
 	}
 
 	for _, p := range service.Output {
-		var curOutputPort IOPortTable
-		curOutputPort.FileName = p.FileName
-		curOutputPort.Type = p.Type
-		curOutputPort.Path = p.Path
-		curOutputPort.Name = p.Name
-		curOutputPort.ID = p.ID
-		curOutputPort.IsInput = false
-		curOutputPort.ServiceID = string(service.ID)
+		curOutputPort, err := ioPort2IOPortTable(service.ID, p, false)
+		if err != nil {
+			return err
+		}
 		err = d.db.Insert(&curOutputPort)
 		if err != nil {
 			return err
 		}
 	}
-	return err
+	return nil
 }
 
 // AddService creates a new service in the database
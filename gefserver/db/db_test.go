@@ -1,8 +1,11 @@
 package db
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/EUDAT-GEF/GEF/gefserver/def"
 	. "github.com/EUDAT-GEF/GEF/gefserver/tests"
@@ -76,4 +79,532 @@ func TestConnection(t *testing.T) {
 	ExpectEquals(t, cmap[connID1], connection1)
 	ExpectNotNil(t, cmap[connID2])
 	ExpectEquals(t, cmap[connID2], connection2)
+
+	// kubernetes connection
+	connection3 := def.DockerConfig{
+		Type:     def.KubernetesConnectionType,
+		Endpoint: "https://kubernetes.example.com",
+		CAPath:   "/etc/gef/ca.pem",
+		Kubernetes: def.KubernetesConfig{
+			Namespace:    "gef",
+			TokenPath:    "/var/run/secrets/token",
+			StorageClass: "fast",
+			Images:       map[string]string{"volume-stage-in": "registry.example.com/stage-in:1"},
+		},
+	}
+	connID3, err := db.AddConnection(0, connection3)
+	CheckErr(t, err)
+	ExpectNotEquals(t, connID3, connID2)
+
+	cmap, err = db.GetConnections()
+	CheckErr(t, err)
+	ExpectEquals(t, len(cmap), 3)
+	ExpectEquals(t, cmap[connID3], connection3)
+}
+
+func TestWorkflow(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	workflow := Workflow{
+		ID:           WorkflowID("workflow_test_id"),
+		ConnectionID: ConnectionID(1),
+		Name:         "workflow name",
+		Description:  "workflow description",
+		Steps:        []ServiceID{"service_3", "service_1", "service_2"},
+	}
+	err = db.AddWorkflow(1, workflow)
+	CheckErr(t, err)
+	Expect(t, db.IsWorkflowOwner(1, workflow.ID))
+
+	w, err := db.GetWorkflow(workflow.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, w.Name, workflow.Name)
+	ExpectEquals(t, w.Steps, workflow.Steps)
+
+	workflows, err := db.ListWorkflows()
+	CheckErr(t, err)
+	ExpectEquals(t, len(workflows), 1)
+
+	err = db.RemoveWorkflow(workflow.ID)
+	CheckErr(t, err)
+	Expect(t, !db.IsWorkflowOwner(1, workflow.ID))
+
+	_, err = db.GetWorkflow(workflow.ID)
+	Expect(t, IsNoResultsError(err))
+}
+
+func TestJobQueue(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	first := QueuedJob{
+		JobID:        JobID("job_1"),
+		UserID:       1,
+		ConnectionID: ConnectionID(1),
+		Inputs:       []JobInput{{Source: "http://example.com/input.txt"}, {Source: "/tmp/inputs/a.txt", Local: true}},
+		Limits:       def.LimitConfig{Memory: 1024},
+		Timeouts:     def.TimeoutConfig{JobExecution: 100},
+		Enqueued:     time.Now(),
+	}
+	second := first
+	second.JobID = JobID("job_2")
+	second.UserID = 2
+	second.Enqueued = first.Enqueued.Add(time.Second)
+
+	CheckErr(t, db.AddQueuedJob(second))
+	CheckErr(t, db.AddQueuedJob(first))
+
+	waiting, err := db.ListQueuedJobs(ConnectionID(1), false)
+	CheckErr(t, err)
+	ExpectEquals(t, len(waiting), 2)
+	ExpectEquals(t, waiting[0].JobID, first.JobID)
+	ExpectEquals(t, waiting[0].Inputs, first.Inputs)
+	ExpectEquals(t, waiting[0].Limits, first.Limits)
+	ExpectEquals(t, waiting[0].Timeouts, first.Timeouts)
+
+	CheckErr(t, db.SetQueuedJobStarted(first.JobID, true))
+	running, err := db.CountRunningJobs()
+	CheckErr(t, err)
+	ExpectEquals(t, running, int64(1))
+	running, err = db.CountUserRunningJobs(2)
+	CheckErr(t, err)
+	ExpectEquals(t, running, int64(0))
+
+	q, err := db.GetQueuedJob(first.JobID)
+	CheckErr(t, err)
+	Expect(t, q.Started)
+
+	CheckErr(t, db.RemoveQueuedJob(first.JobID))
+	_, err = db.GetQueuedJob(first.JobID)
+	Expect(t, IsNoResultsError(err))
+
+	waiting, err = db.ListQueuedJobs(ConnectionID(1), false)
+	CheckErr(t, err)
+	ExpectEquals(t, len(waiting), 1)
+}
+
+func TestJobRetry(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	service := Service{
+		ID:           ServiceID("service_test_id"),
+		ConnectionID: ConnectionID(1),
+		Name:         "service name",
+		Retry:        RetryPolicy{MaxAttempts: 3, Backoff: 10},
+	}
+	CheckErr(t, db.AddService(1, service))
+	s, err := db.GetService(service.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, s.Retry, service.Retry)
+
+	state := NewJobStateError("staging failed", 1)
+	job := Job{
+		ID:           JobID("job_1"),
+		ConnectionID: ConnectionID(1),
+		ServiceID:    service.ID,
+		Attempt:      1,
+		Created:      time.Now(),
+		State:        &state,
+	}
+	CheckErr(t, db.AddJob(1, job))
+	CheckErr(t, db.AddJobVolume(job.ID, VolumeID("volume_1"), true, "input 1", JobInput{Source: "11304/pid"}))
+	CheckErr(t, db.AddJobVolume(job.ID, VolumeID("volume_2"), false, "output 1", JobInput{}))
+	CheckErr(t, db.AddJobVolume(job.ID, VolumeID("volume_0"), true, "input 2", JobInput{Source: "/tmp/upload", Local: true}))
+
+	inputSrc, err := db.GetJobInputSources(job.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, inputSrc, map[string]JobInput{
+		"input 1": {Source: "11304/pid"},
+		"input 2": {Source: "/tmp/upload", Local: true},
+	})
+
+	retry := job
+	retry.ID = JobID("job_2")
+	retry.RetryOf = job.ID
+	retry.Attempt = 2
+	CheckErr(t, db.AddJob(1, retry))
+
+	j, err := db.GetJob(retry.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, j.RetryOf, job.ID)
+	ExpectEquals(t, j.Attempt, 2)
+}
+
+func TestJobPublication(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	state := NewJobStateOk("Ended successfully", 0)
+	job := Job{ID: JobID("job_1"), ConnectionID: ConnectionID(1), Created: time.Now(), State: &state}
+	CheckErr(t, db.AddJob(1, job))
+	j, err := db.GetJob(job.ID)
+	CheckErr(t, err)
+	Expect(t, j.Publication == nil)
+
+	publication := JobPublication{Status: "Published", RecordURL: "https://b2share.example.com/record/1", PID: "11304/record"}
+	CheckErr(t, db.SetJobPublication(job.ID, publication))
+	j, err = db.GetJob(job.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, *j.Publication, publication)
+	ExpectEquals(t, *j.State, state)
+
+	// only one publication and one B2DROP copy can be in progress at a time
+	CheckErr(t, db.StartJobPublication(job.ID, JobPublication{Status: "Publishing", Code: -1}))
+	ExpectEquals(t, db.StartJobPublication(job.ID, JobPublication{Status: "Publishing", Code: -1}), ErrTransferInProgress)
+	b2dropCopy := JobB2DropCopy{Status: "Copying to B2DROP", Code: -1, FolderURL: "https://b2drop.example.com/GEF"}
+	CheckErr(t, db.StartJobB2DropCopy(job.ID, b2dropCopy))
+	ExpectEquals(t, db.StartJobB2DropCopy(job.ID, b2dropCopy), ErrTransferInProgress)
+	CheckErr(t, db.SetJobPublication(job.ID, publication))
+	CheckErr(t, db.StartJobPublication(job.ID, JobPublication{Status: "Publishing", Code: -1}))
+	j, err = db.GetJob(job.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, j.Publication.Code, -1)
+	ExpectEquals(t, *j.B2DropCopy, b2dropCopy)
+}
+
+func TestJobOwnerAndVolumes(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	state := NewJobStateOk("Ended successfully", 0)
+	job := Job{ID: JobID("job_1"), ConnectionID: ConnectionID(1), Created: time.Now(), State: &state}
+	CheckErr(t, db.AddJob(7, job))
+	CheckErr(t, db.AddJobVolume(job.ID, VolumeID("volume_2"), false, "output 1", JobInput{}))
+	CheckErr(t, db.AddJobVolume(job.ID, VolumeID("volume_1"), true, "input 1", JobInput{Source: "11304/pid"}))
+
+	owner, err := db.GetJobOwner(job.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, owner, int64(7))
+	ids, err := db.ListVolumeIDs()
+	CheckErr(t, err)
+	ExpectEquals(t, ids, []VolumeID{"volume_1", "volume_2"})
+
+	CheckErr(t, db.RemoveJob(job.ID))
+	_, err = db.GetJobOwner(job.ID)
+	Expect(t, IsNoResultsError(err))
+	ids, err = db.ListVolumeIDs()
+	CheckErr(t, err)
+	ExpectEquals(t, len(ids), 0)
+}
+
+func TestStorageUsage(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	community := AddTestCommunity(t, db, "community1")
+	member, err := db.GetRoleByName(CommunityMemberRoleName, community.ID)
+	CheckErr(t, err)
+	user1 := AddTestUser(t, db, name1, email1)
+	user2 := AddTestUser(t, db, name2, email2)
+	CheckErr(t, db.AddRoleToUser(user1.ID, member.ID))
+
+	state := NewJobStateOk("Ended successfully", 0)
+	for i, userID := range []int64{user1.ID, user1.ID, user2.ID} {
+		job := Job{ID: JobID(fmt.Sprintf("job_%d", i)), ConnectionID: ConnectionID(1), Created: time.Now(), State: &state}
+		CheckErr(t, db.AddJob(userID, job))
+		volume := VolumeID(fmt.Sprintf("volume_%d", i))
+		CheckErr(t, db.AddJobVolume(job.ID, volume, false, "output 1", JobInput{}))
+		CheckErr(t, db.SetJobVolumeSize(volume, int64(100*(i+1))))
+	}
+
+	job, err := db.GetJob(JobID("job_1"))
+	CheckErr(t, err)
+	ExpectEquals(t, job.OutputVolume[0].Size, int64(200))
+
+	used, err := db.GetUserStorageUsage(user1.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, used, int64(300))
+	used, err = db.GetUserStorageUsage(user2.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, used, int64(300))
+	used, err = db.GetCommunityStorageUsage(community.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, used, int64(300))
+
+	// the users of the community share its usage
+	CheckErr(t, db.AddRoleToUser(user2.ID, member.ID))
+	used, err = db.GetCommunityStorageUsage(community.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, used, int64(600))
+
+	CheckErr(t, db.RemoveJob(JobID("job_0")))
+	used, err = db.GetUserStorageUsage(user1.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, used, int64(200))
+}
+
+func TestFilterJobs(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	start := time.Now()
+	codes := []int{0, 1, 0, -1, 2}
+	for i, code := range codes {
+		state := NewJobStateOk("state", code)
+		job := Job{
+			ID:           JobID(fmt.Sprintf("job_%d", i)),
+			ConnectionID: ConnectionID(1 + i%2),
+			ServiceID:    ServiceID(fmt.Sprintf("service_%d", i%3)),
+			Created:      start.Add(time.Duration(i) * time.Hour),
+			Duration:     int64(10 - i),
+			State:        &state,
+		}
+		CheckErr(t, db.AddJob(int64(1+i%2), job))
+	}
+	ids := func(filter JobFilter) []JobID {
+		jobs, _, err := db.FilterJobs(filter)
+		CheckErr(t, err)
+		var ids []JobID
+		for _, j := range jobs {
+			ids = append(ids, j.ID)
+		}
+		return ids
+	}
+
+	// newest first by default
+	jobs, total, err := db.FilterJobs(JobFilter{})
+	CheckErr(t, err)
+	ExpectEquals(t, total, int64(5))
+	ExpectEquals(t, jobs[0].ID, JobID("job_4"))
+
+	ExpectEquals(t, ids(JobFilter{OwnerID: 2}), []JobID{"job_3", "job_1"})
+	ExpectEquals(t, ids(JobFilter{ConnectionID: 1, Sort: "created"}), []JobID{"job_0", "job_2", "job_4"})
+	ExpectEquals(t, ids(JobFilter{ServiceID: "service_0", Sort: "created"}), []JobID{"job_0", "job_3"})
+	ExpectEquals(t, ids(JobFilter{States: []int{1, 2}, Sort: "created"}), []JobID{"job_1", "job_4"})
+	ExpectEquals(t, ids(JobFilter{Sort: "duration", Limit: 2}), []JobID{"job_4", "job_3"})
+	ExpectEquals(t, ids(JobFilter{
+		CreatedAfter:  start.Add(30 * time.Minute),
+		CreatedBefore: start.Add(2 * time.Hour).UTC(),
+		Sort:          "created",
+	}), []JobID{"job_1"})
+
+	// the total counts all the selected jobs, not only those of the page
+	jobs, total, err = db.FilterJobs(JobFilter{States: []int{0}, Limit: 1, Offset: 1, Sort: "-created"})
+	CheckErr(t, err)
+	ExpectEquals(t, total, int64(2))
+	ExpectEquals(t, len(jobs), 1)
+	ExpectEquals(t, jobs[0].ID, JobID("job_0"))
+
+	_, _, err = db.FilterJobs(JobFilter{Sort: "ID"})
+	Expect(t, err != nil)
+}
+
+func TestJobMetadata(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	state := NewJobStateOk("Ended successfully", 0)
+	job := Job{
+		ID:          JobID("job_1"),
+		Name:        "first run",
+		Description: "with the default parameters",
+		Labels:      map[string]string{"project": "alpha", "batch": "1"},
+		Created:     time.Now(),
+		State:       &state,
+	}
+	CheckErr(t, db.AddJob(1, job))
+	other := Job{ID: JobID("job_2"), Created: time.Now(), State: &state}
+	CheckErr(t, db.AddJob(1, other))
+
+	j, err := db.GetJob(job.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, j.Name, job.Name)
+	ExpectEquals(t, j.Description, job.Description)
+	ExpectEquals(t, j.Labels, job.Labels)
+	j, err = db.GetJob(other.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, j.Labels, map[string]string{})
+
+	CheckErr(t, db.SetJobMetadata(other.ID, "second run", "", map[string]string{"project": "beta"}))
+	ids := func(filter JobFilter) []JobID {
+		jobs, _, err := db.FilterJobs(filter)
+		CheckErr(t, err)
+		var ids []JobID
+		for _, j := range jobs {
+			ids = append(ids, j.ID)
+		}
+		return ids
+	}
+	ExpectEquals(t, ids(JobFilter{Name: "RUN", Sort: "name"}), []JobID{"job_1", "job_2"})
+	ExpectEquals(t, ids(JobFilter{Labels: map[string]string{"project": "beta"}}), []JobID{"job_2"})
+	ExpectEquals(t, ids(JobFilter{Labels: map[string]string{"project": "", "batch": "1"}}), []JobID{"job_1"})
+
+	// the labels are replaced
+	CheckErr(t, db.SetJobMetadata(job.ID, job.Name, "", map[string]string{"batch": "2"}))
+	j, err = db.GetJob(job.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, j.Labels, map[string]string{"batch": "2"})
+	ExpectEquals(t, j.Description, "")
+
+	CheckErr(t, db.RemoveJob(job.ID))
+	ExpectEquals(t, len(ids(JobFilter{Labels: map[string]string{"batch": ""}})), 0)
+}
+
+func TestJobProvenance(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	state := NewJobStateOk("Ended successfully", 0)
+	job := Job{ID: JobID("job_1"), Created: time.Now(), State: &state}
+	CheckErr(t, db.AddJob(1, job))
+	_, err = db.GetJobProvenance(job.ID)
+	ExpectEquals(t, IsNoResultsError(err), true)
+
+	started := time.Date(2017, 5, 1, 10, 0, 0, 0, time.UTC)
+	provenance := JobProvenance{
+		JobID:   job.ID,
+		UserID:  1,
+		Started: started,
+		Inputs:  []JobInput{{Source: "11304/a"}, {Source: "https://example.com/b"}},
+		Limits:  def.LimitConfig{Memory: 1024},
+		Steps: []ProvenanceStep{{
+			ServiceID: ServiceID("service_1"),
+			ImageID:   ImageID("sha256:1234"),
+			Command:   []string{"wc", "/input"},
+			TaskName:  "Service execution",
+		}},
+	}
+	CheckErr(t, db.SetJobProvenance(provenance))
+
+	// the record is replaced as the job advances
+	provenance.Steps[0].InputVolumes = []VolumeID{"volume_1"}
+	provenance.Steps[0].Started = started.Add(time.Minute)
+	provenance.Steps[0].Ended = started.Add(2 * time.Minute)
+	CheckErr(t, db.SetJobProvenance(provenance))
+	p, err := db.GetJobProvenance(job.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, p, provenance)
+
+	// the inputs recorded as plain sources, before the local files were flagged, are not local
+	var inputs []JobInput
+	CheckErr(t, json.Unmarshal([]byte(`["11304/a", "/tmp/a.txt"]`), &inputs))
+	ExpectEquals(t, inputs, []JobInput{{Source: "11304/a"}, {Source: "/tmp/a.txt"}})
+
+	CheckErr(t, db.RemoveJob(job.ID))
+	_, err = db.GetJobProvenance(job.ID)
+	ExpectEquals(t, IsNoResultsError(err), true)
+}
+
+func TestFilterServices(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	for i, name := range []string{"Word count", "Clone", "word_split", "Removed"} {
+		service := Service{
+			ID:           ServiceID(fmt.Sprintf("service_%d", i)),
+			ConnectionID: ConnectionID(1 + i%2),
+			Name:         name,
+			Created:      time.Now(),
+			Size:         int64(i),
+		}
+		CheckErr(t, db.AddService(int64(1+i%2), service))
+	}
+	CheckErr(t, db.RemoveService(ServiceID("service_3")))
+	names := func(filter ServiceFilter) []string {
+		services, _, err := db.FilterServices(filter)
+		CheckErr(t, err)
+		var names []string
+		for _, s := range services {
+			names = append(names, s.Name)
+		}
+		return names
+	}
+
+	services, total, err := db.FilterServices(ServiceFilter{})
+	CheckErr(t, err)
+	ExpectEquals(t, total, int64(3))
+	ExpectEquals(t, services[0].Name, "Clone")
+
+	ExpectEquals(t, names(ServiceFilter{Name: "WORD"}), []string{"Word count", "word_split"})
+	ExpectEquals(t, names(ServiceFilter{Name: "d_"}), []string{"word_split"})
+	ExpectEquals(t, names(ServiceFilter{OwnerID: 2}), []string{"Clone"})
+	ExpectEquals(t, names(ServiceFilter{ConnectionID: 1, Sort: "-size"}), []string{"word_split", "Word count"})
+	ExpectEquals(t, names(ServiceFilter{Sort: "size", Offset: 1}), []string{"Clone", "word_split"})
+}
+
+func TestInputCache(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	now := time.Now()
+	first := CacheEntry{ID: "1", URL: "http://example.com/a", Name: "a", Size: 10, ETag: `"a"`, Created: now, LastUsed: now}
+	second := CacheEntry{ID: "2", URL: "http://example.com/b", Name: "b", Size: 20, ETag: `"b"`, Created: now, LastUsed: now.Add(time.Second)}
+	CheckErr(t, db.SetCacheEntry(first))
+	CheckErr(t, db.SetCacheEntry(second))
+
+	entry, err := db.GetCacheEntry("1")
+	CheckErr(t, err)
+	ExpectEquals(t, entry.URL, first.URL)
+	ExpectEquals(t, entry.ETag, first.ETag)
+
+	// the least recently used first
+	CheckErr(t, db.UseCacheEntry("1", now.Add(2*time.Second)))
+	entries, err := db.ListCacheEntries()
+	CheckErr(t, err)
+	ExpectEquals(t, len(entries), 2)
+	ExpectEquals(t, entries[0].ID, "2")
+	ExpectEquals(t, entries[1].ID, "1")
+	ExpectEquals(t, entries[1].Hits, 1)
+
+	second.ETag = `"b2"`
+	CheckErr(t, db.SetCacheEntry(second))
+	entry, err = db.GetCacheEntry("2")
+	CheckErr(t, err)
+	ExpectEquals(t, entry.ETag, `"b2"`)
+
+	CheckErr(t, db.RemoveCacheEntry("1"))
+	_, err = db.GetCacheEntry("1")
+	Expect(t, IsNoResultsError(err))
+}
+
+func TestServicePorts(t *testing.T) {
+	db, file, err := InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(file)
+
+	service := Service{
+		ID:           ServiceID("service_test_id"),
+		ConnectionID: ConnectionID(1),
+		Name:         "service name",
+		Input: []IOPort{
+			{ID: "input0", Name: "Iterations", Path: "/root/input0", Type: "integer", FileName: "n.txt",
+				Default: "10", Min: "1", Max: "100"},
+			{ID: "input1", Name: "Language", Path: "/root/input1", Type: "enum", FileName: "lang.txt",
+				Optional: true, Values: []string{"en", "de"}},
+			{ID: "input2", Name: "Data", Path: "/root/input2", Type: "url", Pattern: `https://.*`},
+		},
+		Output: []IOPort{
+			{ID: "output0", Name: "Output", Path: "/root/output"},
+		},
+	}
+	CheckErr(t, db.AddService(1, service))
+	s, err := db.GetService(service.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, s.Input, service.Input)
+	ExpectEquals(t, s.Output, service.Output)
 }
@@ -0,0 +1,47 @@
+package db
+
+// UserIdentity links a user to the subject identifier asserted by a login provider
+type UserIdentity struct {
+	UserID   int64
+	Provider string
+	Subject  string
+}
+
+// AddUserIdentity links a user to the subject of a login provider
+func (d *Db) AddUserIdentity(identity UserIdentity) error {
+	storedIdentity := UserIdentityTable{
+		UserID:   identity.UserID,
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+	}
+	return d.db.Insert(&storedIdentity)
+}
+
+// GetUserByIdentity returns the user linked to the subject of a login provider, nil if none
+func (d *Db) GetUserByIdentity(provider, subject string) (*User, error) {
+	var user UserTable
+	err := d.db.SelectOne(&user,
+		`SELECT u.* FROM users u JOIN UserIdentities i ON i.UserID = u.ID
+		WHERE i.Provider=? AND i.Subject=?`, provider, subject)
+	if IsNoResultsError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.userTable2user(&user), nil
+}
+
+// ListUserIdentities returns the subjects of the login providers linked to a user
+func (d *Db) ListUserIdentities(userID int64) ([]UserIdentity, error) {
+	var storedIdentities []UserIdentityTable
+	_, err := d.db.Select(&storedIdentities, "SELECT * FROM UserIdentities WHERE UserID=? ORDER BY ID", userID)
+	if err != nil {
+		return nil, err
+	}
+	identities := make([]UserIdentity, 0, len(storedIdentities))
+	for _, i := range storedIdentities {
+		identities = append(identities, UserIdentity{UserID: i.UserID, Provider: i.Provider, Subject: i.Subject})
+	}
+	return identities, nil
+}
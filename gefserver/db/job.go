@@ -1,31 +1,100 @@
 package db
 
-import "time"
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrTransferInProgress is returned when starting a publication or a B2DROP copy of the
+// results of a job while another one is in progress
+var ErrTransferInProgress = errors.New("a transfer of the job results is already in progress")
 
 // Job stores the information about a service execution (used to serialize JSON)
 type Job struct {
 	ID           JobID
 	ConnectionID ConnectionID
 	ServiceID    ServiceID
+	WorkflowID   WorkflowID
+	Name         string            // set by the owner, to tell the jobs apart
+	Description  string            // notes of the owner about the job
+	Labels       map[string]string // key/value labels set by the owner
+	RetryOf      JobID             // the job retried by this job, if any
+	Attempt      int               // 1 for a new job, incremented by each retry
 	Created      time.Time
 	Duration     int64
 	State        *JobState
 	InputVolume  []JobVolume
 	OutputVolume []JobVolume
 	Tasks        []Task
+	Publication  *JobPublication // the publication of the results, nil if they were never published
+	B2DropCopy   *JobB2DropCopy  // the last copy of the results into B2DROP, nil if they were never copied
+	StagedFiles  []StagedFile    // the input files downloaded from PIDs and URLs
 }
 
 // JobState keeps information about a job state
 type JobState struct {
 	Status string
 	Error  string
-	Code   int
+	Code   int // 0 - finished successfully, -1 - job in progress, 1 - there is an error, 2 - cancelled
+}
+
+// JobCancelledStatus is the status of a job stopped at the request of its owner
+const JobCancelledStatus = "Cancelled"
+
+// JobPublication keeps information about the publication of the job results in B2SHARE
+type JobPublication struct {
+	Status    string
+	Error     string
+	Code      int    // 0 - published, -1 - publication in progress, 1 - there is an error
+	RecordURL string // the B2SHARE record with the published files
+	PID       string // the PID of the record, if B2SHARE returned one
+}
+
+// JobB2DropCopy keeps information about the copy of the job results into a B2DROP folder
+type JobB2DropCopy struct {
+	Status    string
+	Error     string
+	Code      int    // 0 - copied, -1 - copy in progress, 1 - there is an error
+	FolderURL string // the WebDAV URL of the B2DROP folder
+}
+
+// StagedFile is the outcome of the download of an input file from a PID or a URL
+type StagedFile struct {
+	VolumeID VolumeID // the input volume of the file
+	Source   string   // the PID or URL given as input
+	URL      string   // the URL of the file, which the source resolved to
+	Name     string
+	Size     int64
+	Checksum string // the checksum of the downloaded content, as "algorithm:hex value"
+	Verified bool   // true if the checksum was verified against the PID record or B2SHARE
+	Cached   bool   // true if the file was copied from the input data cache
+	Error    string // why the download failed, if it did
+}
+
+// JobInput is the source of an input of a job: a PID, a URL, a value, or a file
+// created on the GEF host for the job request
+type JobInput struct {
+	Source string
+	Local  bool // true if Source is a file created by the GEF server (an upload or a value file)
+}
+
+// UnmarshalJSON also reads the inputs stored as plain sources, which are never local
+func (input *JobInput) UnmarshalJSON(data []byte) error {
+	var source string
+	if json.Unmarshal(data, &source) == nil {
+		*input = JobInput{Source: source}
+		return nil
+	}
+	type jobInput JobInput
+	return json.Unmarshal(data, (*jobInput)(input))
 }
 
 // JobVolume points to volumes bound to a particular job
 type JobVolume struct {
 	VolumeID VolumeID
 	Name     string
+	Size     int64 // the size of the files in bytes, known once the job has ended
 }
 
 // NewJobStateOk creates a new JobState with no error
@@ -46,6 +115,15 @@ func NewJobStateError(err string, code int) JobState {
 	}
 }
 
+// NewJobStateCancelled creates the JobState of a job stopped at the request of its owner
+func NewJobStateCancelled() JobState {
+	return JobState{
+		Status: JobCancelledStatus,
+		Error:  "",
+		Code:   2,
+	}
+}
+
 // JobID exported
 type JobID string
 
@@ -55,6 +133,9 @@ type VolumeID string
 // ContainerID exported
 type ContainerID string
 
+// TaskRunningExitCode is the exit code of a task which has not ended yet
+const TaskRunningExitCode = -1
+
 // Task contains tasks related to a specific job (used to serialize JSON)
 type Task struct {
 	ID             string
@@ -62,7 +143,7 @@ type Task struct {
 	ContainerID    ContainerID
 	SwarmServiceID string
 	Error          string
-	ExitCode       int
+	ExitCode       int // TaskRunningExitCode while the task is running
 	ConsoleOutput  string
 }
 
@@ -0,0 +1,291 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// JobFilter selects, sorts and pages the jobs returned by FilterJobs;
+// the zero value selects all the jobs, newest first
+type JobFilter struct {
+	OwnerID       int64 // 0 for any owner
+	ServiceID     ServiceID
+	ConnectionID  ConnectionID
+	States        []int             // the state codes, see JobState
+	Name          string            // a part of the name, matched case insensitively
+	Labels        map[string]string // the labels the jobs must have; an empty value matches any value
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Sort          string // a key of JobSortKeys, prefixed with "-" for the descending order
+	Limit         int    // 0 means no limit
+	Offset        int
+	Viewer        *Viewer // nil to select the jobs of all the communities
+}
+
+// ServiceFilter selects, sorts and pages the services returned by FilterServices;
+// the zero value selects all the services, sorted by name
+type ServiceFilter struct {
+	OwnerID      int64 // 0 for any owner
+	ConnectionID ConnectionID
+	Name         string // a part of the name, matched case insensitively
+	Sort         string // a key of ServiceSortKeys, prefixed with "-" for the descending order
+	CommunityID  int64  // 0 for any community
+	Limit        int    // 0 means no limit
+	Offset       int
+	Viewer       *Viewer // nil to select the services of all the communities
+}
+
+// Viewer restricts the listings to what a user can see: the public services, the services
+// of the communities in which the user has a role, and the jobs running these services or
+// owned by the user
+type Viewer struct {
+	UserID       int64   // 0 for the anonymous users
+	CommunityIDs []int64 // the communities the access token is restricted to; all if empty
+}
+
+// communities returns the query selecting the IDs of the communities the viewer belongs to
+func (v Viewer) communities() (string, []interface{}) {
+	query := "SELECT r.CommunityID FROM userroles ur JOIN roles r ON ur.RoleID = r.ID WHERE ur.UserID=? AND r.CommunityID != 0"
+	args := []interface{}{v.UserID}
+	if len(v.CommunityIDs) > 0 {
+		placeholders := make([]string, len(v.CommunityIDs))
+		for i, id := range v.CommunityIDs {
+			placeholders[i] = "?"
+			args = append(args, id)
+		}
+		query += " AND r.CommunityID IN (" + strings.Join(placeholders, ",") + ")"
+	}
+	return query, args
+}
+
+// services returns the condition selecting the services the viewer can see
+func (v Viewer) services() (string, []interface{}) {
+	query, args := v.communities()
+	return "(CommunityID=0 OR CommunityID IN (" + query + "))", args
+}
+
+// jobs returns the condition selecting the jobs the viewer can see; the jobs of the
+// services which are gone stay visible
+func (v Viewer) jobs() (string, []interface{}) {
+	query, args := v.communities()
+	return "(ID IN (SELECT ObjectID FROM owners WHERE ObjectType=? AND UserID=?) OR ServiceID NOT IN " +
+			"(SELECT ID FROM services WHERE CommunityID != 0 AND CommunityID NOT IN (" + query + ")))",
+		append([]interface{}{"Job", v.UserID}, args...)
+}
+
+// CanSeeService tells if the viewer can see a service; nil viewers see everything
+func (d *Db) CanSeeService(viewer *Viewer, serviceID ServiceID) (bool, error) {
+	if viewer == nil {
+		return true, nil
+	}
+	services, args := viewer.services()
+	count, err := d.db.SelectInt("SELECT count(*) FROM services WHERE ID=? AND "+services,
+		append([]interface{}{string(serviceID)}, args...)...)
+	return count > 0, err
+}
+
+// CanSeeJob tells if the viewer can see a job; nil viewers see everything
+func (d *Db) CanSeeJob(viewer *Viewer, jobID JobID) (bool, error) {
+	if viewer == nil {
+		return true, nil
+	}
+	jobs, args := viewer.jobs()
+	count, err := d.db.SelectInt("SELECT count(*) FROM Jobs WHERE ID=? AND "+jobs,
+		append([]interface{}{string(jobID)}, args...)...)
+	return count > 0, err
+}
+
+// JobSortKeys are the sort keys of the jobs, with their columns
+var JobSortKeys = map[string]string{
+	"created":  "Created",
+	"duration": "Duration",
+	"state":    "Code",
+	"service":  "ServiceID",
+	"name":     "Name",
+}
+
+// ServiceSortKeys are the sort keys of the services, with their columns
+var ServiceSortKeys = map[string]string{
+	"name":    "Name",
+	"created": "Created",
+	"version": "Version",
+	"size":    "Size",
+}
+
+// DefaultJobSort lists the newest jobs first
+const DefaultJobSort = "-created"
+
+// DefaultServiceSort lists the services in alphabetical order
+const DefaultServiceSort = "name"
+
+// FilterJobs returns a page of the jobs selected by a filter, and the number of all the
+// jobs selected by the filter
+func (d *Db) FilterJobs(filter JobFilter) ([]Job, int64, error) {
+	order, err := orderBy(filter.Sort, DefaultJobSort, JobSortKeys)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var where conditions
+	if filter.OwnerID != 0 {
+		where.add("ID IN (SELECT ObjectID FROM owners WHERE ObjectType=? AND UserID=?)", "Job", filter.OwnerID)
+	}
+	if filter.ServiceID != "" {
+		where.add("ServiceID=?", string(filter.ServiceID))
+	}
+	if filter.ConnectionID != 0 {
+		where.add("ConnectionID=?", int(filter.ConnectionID))
+	}
+	if len(filter.States) > 0 {
+		placeholders := make([]string, len(filter.States))
+		args := make([]interface{}, len(filter.States))
+		for i, code := range filter.States {
+			placeholders[i], args[i] = "?", code
+		}
+		where.add("Code IN ("+strings.Join(placeholders, ",")+")", args...)
+	}
+	if filter.Name != "" {
+		where.add("Name LIKE ? ESCAPE '\\'", "%"+escapeLike(filter.Name)+"%")
+	}
+	for key, value := range filter.Labels {
+		if value == "" {
+			where.add("ID IN (SELECT JobID FROM JobLabels WHERE Key=?)", key)
+		} else {
+			where.add("ID IN (SELECT JobID FROM JobLabels WHERE Key=? AND Value=?)", key, value)
+		}
+	}
+	if !filter.CreatedAfter.IsZero() {
+		where.add("julianday(Created) >= julianday(?)", filter.CreatedAfter)
+	}
+	if !filter.CreatedBefore.IsZero() {
+		where.add("julianday(Created) < julianday(?)", filter.CreatedBefore)
+	}
+	if filter.Viewer != nil {
+		clause, args := filter.Viewer.jobs()
+		where.add(clause, args...)
+	}
+
+	total, err := d.db.SelectInt("SELECT count(*) FROM Jobs"+where.sql(), where.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var jobsFromTable []JobTable
+	_, err = d.db.Select(&jobsFromTable,
+		"SELECT * FROM Jobs"+where.sql()+order+page(filter.Limit, filter.Offset), where.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	jobs := []Job{}
+	for _, j := range jobsFromTable {
+		job, err := d.jobTable2Job(j)
+		if err != nil {
+			return jobs, total, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, total, nil
+}
+
+// FilterServices returns a page of the (not deleted) services selected by a filter,
+// and the number of all the services selected by the filter
+func (d *Db) FilterServices(filter ServiceFilter) ([]Service, int64, error) {
+	order, err := orderBy(filter.Sort, DefaultServiceSort, ServiceSortKeys)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var where conditions
+	where.add("Deleted=?", false)
+	if filter.OwnerID != 0 {
+		where.add("ID IN (SELECT ObjectID FROM owners WHERE ObjectType=? AND UserID=?)", "Service", filter.OwnerID)
+	}
+	if filter.ConnectionID != 0 {
+		where.add("ConnectionID=?", int(filter.ConnectionID))
+	}
+	if filter.Name != "" {
+		where.add("Name LIKE ? ESCAPE '\\'", "%"+escapeLike(filter.Name)+"%")
+	}
+	if filter.CommunityID != 0 {
+		where.add("CommunityID=?", filter.CommunityID)
+	}
+	if filter.Viewer != nil {
+		clause, args := filter.Viewer.services()
+		where.add(clause, args...)
+	}
+
+	total, err := d.db.SelectInt("SELECT count(*) FROM services"+where.sql(), where.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var servicesFromTable []ServiceTable
+	_, err = d.db.Select(&servicesFromTable,
+		"SELECT * FROM services"+where.sql()+order+page(filter.Limit, filter.Offset), where.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	services := []Service{}
+	for _, s := range servicesFromTable {
+		service, err := d.serviceTable2Service(s)
+		if err != nil {
+			return services, total, err
+		}
+		services = append(services, service)
+	}
+	return services, total, nil
+}
+
+// conditions accumulates the conditions of a WHERE clause, with their arguments
+type conditions struct {
+	clauses []string
+	args    []interface{}
+}
+
+func (c *conditions) add(clause string, args ...interface{}) {
+	c.clauses = append(c.clauses, clause)
+	c.args = append(c.args, args...)
+}
+
+func (c conditions) sql() string {
+	if len(c.clauses) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(c.clauses, " AND ")
+}
+
+// orderBy returns the ORDER BY clause for a sort key; the ID breaks the ties,
+// so that the pages are stable
+func orderBy(sort string, defaultSort string, keys map[string]string) (string, error) {
+	if sort == "" {
+		sort = defaultSort
+	}
+	direction := "ASC"
+	if strings.HasPrefix(sort, "-") {
+		sort, direction = sort[1:], "DESC"
+	}
+	column, ok := keys[sort]
+	if !ok {
+		return "", def.Err(nil, "unknown sort key: %s", sort)
+	}
+	return fmt.Sprintf(" ORDER BY %s %s, ID %s", column, direction, direction), nil
+}
+
+// page returns the LIMIT clause of a page
+func page(limit int, offset int) string {
+	if limit <= 0 && offset <= 0 {
+		return ""
+	}
+	if limit <= 0 {
+		limit = -1 // no limit
+	}
+	return fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
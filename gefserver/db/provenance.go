@@ -0,0 +1,69 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// JobProvenance records how a job was executed: who ran it, with which inputs and limits,
+// and which images and commands were executed. It is recorded while the job runs, so that
+// it stays valid when the services are later edited or removed
+type JobProvenance struct {
+	JobID    JobID
+	UserID   int64
+	Started  time.Time
+	Inputs   []JobInput // the input sources, as given
+	Limits   def.LimitConfig
+	Timeouts def.TimeoutConfig
+	Steps    []ProvenanceStep
+}
+
+// ProvenanceStep records the execution of a service by a job
+type ProvenanceStep struct {
+	ServiceID     ServiceID
+	ServiceName   string
+	Version       string
+	ImageID       ImageID
+	RepoTag       string
+	Command       []string
+	TaskName      string // the name of the task executing the service
+	InputVolumes  []VolumeID
+	OutputVolumes []VolumeID
+	Started       time.Time // zero if the step was not executed
+	Ended         time.Time // zero if the step has not ended
+	ExitCode      int
+}
+
+// SetJobProvenance stores the provenance record of a job, replacing the previous one
+func (d *Db) SetJobProvenance(provenance JobProvenance) error {
+	record, err := json.Marshal(provenance)
+	if err != nil {
+		return err
+	}
+	storedProvenance := JobProvenanceTable{JobID: string(provenance.JobID), Record: string(record)}
+	var existing JobProvenanceTable
+	err = d.db.SelectOne(&existing, "SELECT * FROM JobProvenance WHERE JobID=?", storedProvenance.JobID)
+	if IsNoResultsError(err) {
+		return d.db.Insert(&storedProvenance)
+	}
+	if err != nil {
+		return err
+	}
+	storedProvenance.Revision = existing.Revision
+	_, err = d.db.Update(&storedProvenance)
+	return err
+}
+
+// GetJobProvenance returns the provenance record of a job
+func (d *Db) GetJobProvenance(jobID JobID) (JobProvenance, error) {
+	var storedProvenance JobProvenanceTable
+	err := d.db.SelectOne(&storedProvenance, "SELECT * FROM JobProvenance WHERE JobID=?", string(jobID))
+	if err != nil {
+		return JobProvenance{}, err
+	}
+	var provenance JobProvenance
+	err = json.Unmarshal([]byte(storedProvenance.Record), &provenance)
+	return provenance, err
+}
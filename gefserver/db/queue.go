@@ -0,0 +1,133 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// QueuedJob is a job waiting to be executed, or being executed, by the pier
+type QueuedJob struct {
+	JobID        JobID
+	UserID       int64
+	ConnectionID ConnectionID
+	Inputs       []JobInput
+	Limits       def.LimitConfig
+	Timeouts     def.TimeoutConfig
+	Enqueued     time.Time
+	NotBefore    time.Time
+	Started      bool
+}
+
+// AddQueuedJob adds a job to the execution queue
+func (d *Db) AddQueuedJob(queuedJob QueuedJob) error {
+	storedJob, err := queuedJob2QueueTable(queuedJob)
+	if err != nil {
+		return err
+	}
+	return d.db.Insert(&storedJob)
+}
+
+// GetQueuedJob returns the queue entry of a job
+func (d *Db) GetQueuedJob(jobID JobID) (QueuedJob, error) {
+	var storedJob QueueTable
+	err := d.db.SelectOne(&storedJob, "SELECT * FROM JobQueue WHERE JobID=?", string(jobID))
+	if err != nil {
+		return QueuedJob{}, err
+	}
+	return queueTable2QueuedJob(storedJob)
+}
+
+// ListQueuedJobs returns the queued jobs of a connection in their arrival order,
+// either the waiting ones or the ones already started
+func (d *Db) ListQueuedJobs(connectionID ConnectionID, started bool) ([]QueuedJob, error) {
+	var storedJobs []QueueTable
+	_, err := d.db.Select(&storedJobs,
+		"SELECT * FROM JobQueue WHERE ConnectionID=? AND Started=? ORDER BY Enqueued",
+		int(connectionID), started)
+	if err != nil {
+		return nil, err
+	}
+
+	var queuedJobs []QueuedJob
+	for _, j := range storedJobs {
+		queuedJob, err := queueTable2QueuedJob(j)
+		if err != nil {
+			return queuedJobs, err
+		}
+		queuedJobs = append(queuedJobs, queuedJob)
+	}
+	return queuedJobs, nil
+}
+
+// SetQueuedJobStarted marks a queued job as started or, if it has to be run again, as waiting
+func (d *Db) SetQueuedJobStarted(jobID JobID, started bool) error {
+	var storedJob QueueTable
+	err := d.db.SelectOne(&storedJob, "SELECT * FROM JobQueue WHERE JobID=?", string(jobID))
+	if err != nil {
+		return err
+	}
+
+	storedJob.Started = started
+	_, err = d.db.Update(&storedJob)
+	return err
+}
+
+// RemoveQueuedJob removes a job from the execution queue
+func (d *Db) RemoveQueuedJob(jobID JobID) error {
+	_, err := d.db.Exec("DELETE FROM JobQueue WHERE JobID=?", string(jobID))
+	return err
+}
+
+func queuedJob2QueueTable(queuedJob QueuedJob) (QueueTable, error) {
+	inputs, err := json.Marshal(queuedJob.Inputs)
+	if err != nil {
+		return QueueTable{}, def.Err(err, "cannot serialize job inputs")
+	}
+	limits, err := json.Marshal(queuedJob.Limits)
+	if err != nil {
+		return QueueTable{}, def.Err(err, "cannot serialize job limits")
+	}
+	timeouts, err := json.Marshal(queuedJob.Timeouts)
+	if err != nil {
+		return QueueTable{}, def.Err(err, "cannot serialize job timeouts")
+	}
+
+	return QueueTable{
+		JobID:        string(queuedJob.JobID),
+		UserID:       queuedJob.UserID,
+		ConnectionID: int(queuedJob.ConnectionID),
+		Inputs:       string(inputs),
+		Limits:       string(limits),
+		Timeouts:     string(timeouts),
+		Enqueued:     queuedJob.Enqueued,
+		NotBefore:    queuedJob.NotBefore,
+		Started:      queuedJob.Started,
+	}, nil
+}
+
+func queueTable2QueuedJob(storedJob QueueTable) (QueuedJob, error) {
+	queuedJob := QueuedJob{
+		JobID:        JobID(storedJob.JobID),
+		UserID:       storedJob.UserID,
+		ConnectionID: ConnectionID(storedJob.ConnectionID),
+		Enqueued:     storedJob.Enqueued,
+		NotBefore:    storedJob.NotBefore,
+		Started:      storedJob.Started,
+	}
+
+	err := json.Unmarshal([]byte(storedJob.Inputs), &queuedJob.Inputs)
+	if err != nil {
+		return queuedJob, def.Err(err, "cannot read job inputs")
+	}
+	err = json.Unmarshal([]byte(storedJob.Limits), &queuedJob.Limits)
+	if err != nil {
+		return queuedJob, def.Err(err, "cannot read job limits")
+	}
+	err = json.Unmarshal([]byte(storedJob.Timeouts), &queuedJob.Timeouts)
+	if err != nil {
+		return queuedJob, def.Err(err, "cannot read job timeouts")
+	}
+	return queuedJob, nil
+}
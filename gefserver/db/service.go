@@ -25,6 +25,18 @@ type Service struct {
 	Size         int64
 	Input        []IOPort
 	Output       []IOPort
+	Retry        RetryPolicy
+	// CommunityID restricts the service, and its jobs, to the users having a role
+	// in the community; 0 for a service everybody can see and run
+	CommunityID   int64
+	CommunityName string // set when the service is read
+}
+
+// RetryPolicy specifies how many times a failed job of a service is automatically
+// executed again; the delay before each retry starts at Backoff seconds and doubles
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     int
 }
 
 // ServiceID exported
@@ -42,4 +54,11 @@ type IOPort struct {
 	Path     string
 	Type     string
 	FileName string
+	// the input constraints, checked before a job is created
+	Optional bool
+	Default  string
+	Pattern  string   // regular expression the whole value must match
+	Min      string   // lower bound of the numeric values, if not empty
+	Max      string   // upper bound of the numeric values, if not empty
+	Values   []string // allowed values of the enum inputs
 }
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"time"
+)
+
+// WorkflowID exported
+type WorkflowID string
+
+// Workflow describes a chain of GEF services executed in sequence, where the
+// outputs of each service become the inputs of the next (used to serialize JSON)
+type Workflow struct {
+	ID           WorkflowID
+	ConnectionID ConnectionID
+	Name         string
+	Description  string
+	Created      time.Time
+	Steps        []ServiceID
+}
+
+// AddWorkflow creates a new workflow in the database
+func (d *Db) AddWorkflow(userID int64, workflow Workflow) error {
+	storedWorkflow := WorkflowTable{
+		ID:           string(workflow.ID),
+		ConnectionID: int(workflow.ConnectionID),
+		Name:         workflow.Name,
+		Description:  workflow.Description,
+		Created:      workflow.Created,
+	}
+	err := d.db.Insert(&storedWorkflow)
+	if err != nil {
+		return err
+	}
+
+	for i, serviceID := range workflow.Steps {
+		step := WorkflowStepTable{
+			WorkflowID: string(workflow.ID),
+			Position:   i,
+			ServiceID:  string(serviceID),
+		}
+		err = d.db.Insert(&step)
+		if err != nil {
+			return err
+		}
+	}
+
+	ownership := OwnerTable{
+		UserID:     userID,
+		ObjectType: "Workflow",
+		ObjectID:   string(workflow.ID),
+	}
+	return d.db.Insert(&ownership)
+}
+
+// RemoveWorkflow removes a workflow and its steps from the database
+func (d *Db) RemoveWorkflow(id WorkflowID) error {
+	_, err := d.db.Exec("DELETE FROM WorkflowSteps WHERE WorkflowID=?", string(id))
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec("DELETE FROM Workflows WHERE ID=?", string(id))
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec("DELETE FROM Owners WHERE ObjectType=? AND ObjectID=?",
+		"Workflow", string(id))
+	return err
+}
+
+// GetWorkflow returns a workflow ready to be converted into JSON
+func (d *Db) GetWorkflow(id WorkflowID) (Workflow, error) {
+	var storedWorkflow WorkflowTable
+	err := d.db.SelectOne(&storedWorkflow, "SELECT * FROM Workflows WHERE ID=?", string(id))
+	if err != nil {
+		return Workflow{}, err
+	}
+	return d.workflowTable2Workflow(storedWorkflow)
+}
+
+// ListWorkflows produces a list of all workflows ready to be converted into JSON
+func (d *Db) ListWorkflows() ([]Workflow, error) {
+	var workflows []Workflow
+	var workflowsFromTable []WorkflowTable
+	_, err := d.db.Select(&workflowsFromTable, "SELECT * FROM Workflows ORDER BY Name")
+	if err != nil {
+		return workflows, err
+	}
+
+	for _, w := range workflowsFromTable {
+		var curWorkflow Workflow
+		curWorkflow, err = d.workflowTable2Workflow(w)
+		if err != nil {
+			return workflows, err
+		}
+		workflows = append(workflows, curWorkflow)
+	}
+	return workflows, nil
+}
+
+// IsWorkflowOwner checks if a certain user owns a certain workflow
+func (d *Db) IsWorkflowOwner(userID int64, workflowID WorkflowID) bool {
+	var x OwnerTable
+	err := d.db.SelectOne(&x,
+		"SELECT * FROM owners WHERE UserID=? AND ObjectType=? AND ObjectID=?",
+		userID, "Workflow", string(workflowID))
+	return err == nil
+}
+
+// workflowTable2Workflow performs mapping of the database workflow table to its JSON representation
+func (d *Db) workflowTable2Workflow(storedWorkflow WorkflowTable) (Workflow, error) {
+	var storedSteps []WorkflowStepTable
+	_, err := d.db.Select(&storedSteps,
+		"SELECT * FROM WorkflowSteps WHERE WorkflowID=? ORDER BY Position", storedWorkflow.ID)
+	if err != nil {
+		return Workflow{}, err
+	}
+
+	workflow := Workflow{
+		ID:           WorkflowID(storedWorkflow.ID),
+		ConnectionID: ConnectionID(storedWorkflow.ConnectionID),
+		Name:         storedWorkflow.Name,
+		Description:  storedWorkflow.Description,
+		Created:      storedWorkflow.Created,
+	}
+	for _, s := range storedSteps {
+		workflow.Steps = append(workflow.Steps, ServiceID(s.ServiceID))
+	}
+	return workflow, nil
+}
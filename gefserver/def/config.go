@@ -24,19 +24,98 @@ type Configuration struct {
 	TmpDir string
 }
 
-// DockerConfig configuration for building docker clients
+// Connection types, selecting how the jobs of a connection are executed
+const (
+	DockerConnectionType     = "docker"
+	KubernetesConnectionType = "kubernetes"
+)
+
+// DockerConfig configuration for building docker clients, or, for the connections
+// of type kubernetes, Kubernetes API clients (Endpoint is then the API server URL)
 type DockerConfig struct {
+	Type        string // DockerConnectionType (the default) or KubernetesConnectionType
 	Description string
 	Endpoint    string
 	TLSVerify   bool
 	CertPath    string
 	KeyPath     string
 	CAPath      string
+	Kubernetes  KubernetesConfig
+}
+
+// KubernetesConfig configures the connections executing the jobs as Kubernetes Jobs
+type KubernetesConfig struct {
+	// Namespace of the Jobs and PersistentVolumeClaims, "default" if empty
+	Namespace string
+	// TokenPath is the file containing the bearer token, e.g. of a service account
+	TokenPath string
+	// StorageClass of the volume claims, the cluster default if empty
+	StorageClass string
+	// VolumeSize is the storage requested for each volume, "1Gi" if empty
+	VolumeSize string
+	// HelperImage copies files into and out of the volumes, "busybox" if empty
+	HelperImage string
+	// Images are the published images used for the GEF internal services, by service folder name
+	Images map[string]string
 }
 
 // PierConfig configuration for pier
 type PierConfig struct {
 	InternalServicesFolder string
+
+	// WorkersPerConnection is the number of jobs executed in parallel on each docker connection
+	WorkersPerConnection int
+	// MaxRunningJobs limits the number of jobs executed at the same time (0 means no limit)
+	MaxRunningJobs int
+	// MaxRunningJobsPerUser limits the number of jobs of a user executed at the same time (0 means no limit)
+	MaxRunningJobsPerUser int
+	// HandleServer resolves the PIDs given as job inputs, https://hdl.handle.net if empty
+	HandleServer string
+	// B2ShareURLs are the B2SHARE instances whose record URLs are staged in as all the record files
+	B2ShareURLs []string
+	// InputCacheSize is the maximum size in bytes of the cache of the files staged in
+	// from PIDs and URLs (0 disables the cache)
+	InputCacheSize int64
+	// InputCacheFolder keeps the cached files, the "inputcache" subfolder of the TmpDir if empty
+	InputCacheFolder string
+	// Retention sets when the janitor removes the ended jobs and the files left behind
+	Retention RetentionConfig
+	// Quotas limit the storage used by the job volumes
+	Quotas QuotaConfig
+}
+
+// RetentionConfig sets how long the ended jobs and the temporary files are kept
+// before the janitor removes them
+type RetentionConfig struct {
+	// Interval is how often (in seconds) the janitor runs; 0 disables it
+	Interval float64
+	// Jobs is how long the ended jobs are kept, by state
+	Jobs JobRetention
+	// Roles replaces the retention of the jobs owned by the users with these roles, by role
+	// name; if a user has several of these roles, the longest retention is used
+	Roles map[string]JobRetention
+	// TmpFiles is how long (in hours) the build folders and the input files are kept (0 means forever)
+	TmpFiles float64
+	// LeftoverAge is how long (in seconds) the volumes and the tasks not belonging to any job
+	// must have been found by the janitor before they are removed; 600 if 0
+	LeftoverAge float64
+}
+
+// QuotaConfig sets how much storage (in bytes, 0 meaning no limit) the job volumes
+// may use before no new jobs are accepted
+type QuotaConfig struct {
+	// User is the quota of each user
+	User int64
+	// Communities is the quota shared by the users having a role in a community, by community
+	// ID, which unlike the name cannot be changed
+	Communities map[int64]int64
+}
+
+// JobRetention is how long (in hours) the ended jobs are kept, by state; 0 means forever
+type JobRetention struct {
+	Succeeded float64
+	Failed    float64
+	Cancelled float64
 }
 
 // ServerConfig keeps the configuration options needed to make a Server
@@ -47,8 +126,15 @@ type ServerConfig struct {
 	TLSCertificateFilePath string
 	TLSKeyFilePath         string
 	B2Access               B2AccessConfig
+	OIDCProviders          []OIDCProviderConfig
+	RoleMappings           []RoleMappingConfig
 	B2Drop                 B2DropConfig
+	B2Share                B2ShareConfig
 	Administration         AdminConfig
+	// RejectURLAccessTokens refuses the access tokens given in the access_token query
+	// parameter, which end up in the proxy and access logs; the clients must send them
+	// in the Authorization header instead
+	RejectURLAccessTokens bool
 }
 
 // B2AccessConfig exported
@@ -57,11 +143,59 @@ type B2AccessConfig struct {
 	RedirectURL string
 }
 
+// OIDCProviderConfig describes an OpenID Connect identity provider the users can log in with,
+// besides B2ACCESS
+type OIDCProviderConfig struct {
+	// ID names the provider in the URLs: /wui/login?provider=ID, and /wui/oidc/ID,
+	// which must be the RedirectURL
+	ID string
+	// Name is shown to the users choosing how to log in
+	Name string
+	// Issuer is the issuer identifier of the provider; the discovery document is
+	// read from Issuer/.well-known/openid-configuration
+	Issuer      string
+	ClientID    string
+	RedirectURL string
+	// ClientSecretEnv is the environment variable holding the client secret
+	ClientSecretEnv string
+	// Scopes are requested besides openid; email and profile if empty
+	Scopes []string
+	Claims OIDCClaimsConfig
+	// LinkAccounts lets the users log in for the first time with this provider to an
+	// existing account having their email address; otherwise such logins are refused
+	LinkAccounts bool
+}
+
+// OIDCClaimsConfig names the claims of the ID token, or of the userinfo endpoint,
+// holding the user details
+type OIDCClaimsConfig struct {
+	Email        string // email if empty
+	Name         string // name if empty
+	Entitlements string // eduperson_entitlement if empty
+}
+
+// RoleMappingConfig gives a community role to the users logging in with an entitlement;
+// the role is removed when the identity provider stops asserting the entitlement
+type RoleMappingConfig struct {
+	// Provider is the ID of the identity provider (b2access for B2ACCESS); any provider if empty
+	Provider string
+	// Entitlement is a regular expression matching the whole entitlement
+	Entitlement string
+	Community   string
+	// Role is Member or Administrator; Member if empty
+	Role string
+}
+
 // B2DropConfig exported
 type B2DropConfig struct {
 	BaseURL string
 }
 
+// B2ShareConfig sets the B2SHARE instance where job results are published by default
+type B2ShareConfig struct {
+	BaseURL string
+}
+
 // InfoConfig exported
 type AdminConfig struct {
 	SuperAdminEmail string
@@ -80,6 +214,12 @@ type LimitConfig struct {
 	CPUQuota   int64 `json:"CPUQuota"`
 	Memory     int64 `json:"memory"`
 	MemorySwap int64 `json:"memorySwap"`
+	// MaxUploadSize is the maximum size in bytes of the files uploaded as inputs
+	// of a job, all together; 0 means unlimited
+	MaxUploadSize int64 `json:"maxUploadSize"`
+	// MaxStageInSize is the maximum size in bytes of each file downloaded from
+	// a PID or URL given as job input; 0 means unlimited
+	MaxStageInSize int64 `json:"maxStageInSize"`
 }
 
 // TimeoutConfig specifies timeout parameters (in seconds)
@@ -97,6 +237,9 @@ func (c DockerConfig) String() string {
 	if c.TLSVerify {
 		tls = "with TLS"
 	}
+	if c.Type == KubernetesConnectionType {
+		return fmt.Sprintf("%s %s %s -- %s", c.Type, c.Endpoint, c.Kubernetes.Namespace, c.Description)
+	}
 	return fmt.Sprintf("%s %s -- %s", c.Endpoint, tls, c.Description)
 }
 
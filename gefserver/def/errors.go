@@ -44,3 +44,20 @@ func PermissionErr(format string, a ...interface{}) PermissionError {
 		fmt.Sprintf(format, a...),
 	}
 }
+
+// AuthenticationError is returned when the credentials given with a request
+// are missing, malformed or not valid
+type AuthenticationError struct {
+	message string
+}
+
+func (e AuthenticationError) Error() string {
+	return e.message
+}
+
+// AuthenticationErr creates a new AuthenticationError
+func AuthenticationErr(format string, a ...interface{}) AuthenticationError {
+	return AuthenticationError{
+		fmt.Sprintf(format, a...),
+	}
+}
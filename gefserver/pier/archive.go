@@ -0,0 +1,107 @@
+package pier
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// Archive formats for downloading a folder of a volume
+const (
+	ArchiveTarGz = "tar.gz"
+	ArchiveZip   = "zip"
+)
+
+// archiveWriter writes the entries of a tar stream into an archive of another format
+type archiveWriter interface {
+	add(header *tar.Header, name string, content io.Reader) error
+	Close() error
+}
+
+// newArchiveWriter returns an archive writer and the archive content type for a format
+func newArchiveWriter(format string, w io.Writer) (archiveWriter, string, error) {
+	switch format {
+	case ArchiveTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarGzWriter{gz: gz, tw: tar.NewWriter(gz)}, "application/gzip", nil
+	case ArchiveZip:
+		return &zipWriter{zw: zip.NewWriter(w)}, "application/zip", nil
+	}
+	return nil, "", def.Err(nil, "unknown archive format: %s", format)
+}
+
+// IsArchiveFormat checks if a folder can be downloaded as an archive of this format
+func IsArchiveFormat(format string) bool {
+	return format == ArchiveTarGz || format == ArchiveZip
+}
+
+// archiveEntryName renames the top folder of a tar entry path to rootName
+func archiveEntryName(name string, rootName string) string {
+	parts := strings.SplitN(strings.Trim(strings.TrimPrefix(name, "./"), "/"), "/", 2)
+	if len(parts) < 2 {
+		return rootName
+	}
+	return rootName + "/" + parts[1]
+}
+
+type tarGzWriter struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarGzWriter) add(header *tar.Header, name string, content io.Reader) error {
+	h := *header
+	h.Name = name
+	if h.Typeflag == tar.TypeDir {
+		h.Name += "/"
+	}
+	err := a.tw.WriteHeader(&h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, content)
+	return err
+}
+
+func (a *tarGzWriter) Close() error {
+	err := a.tw.Close()
+	if err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipWriter) add(header *tar.Header, name string, content io.Reader) error {
+	// zip archives only keep folders and regular files
+	if header.Typeflag != tar.TypeDir && header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+		return nil
+	}
+	h, err := zip.FileInfoHeader(header.FileInfo())
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	if header.Typeflag == tar.TypeDir {
+		h.Name += "/"
+	} else {
+		h.Method = zip.Deflate
+	}
+	f, err := a.zw.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	return err
+}
+
+func (a *zipWriter) Close() error {
+	return a.zw.Close()
+}
@@ -0,0 +1,88 @@
+package pier
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// Image describes a service image known to an execution backend
+type Image struct {
+	ID      string
+	RepoTag string
+	Labels  map[string]string
+	Created time.Time
+	Size    int64
+	Cmd     []string
+}
+
+// VolumeBind mounts a data volume at a path inside a task
+type VolumeBind struct {
+	VolumeID   db.VolumeID
+	MountPoint string
+	ReadOnly   bool
+}
+
+// TaskRef identifies a task started by an execution backend: its container and,
+// for the backends wrapping containers into services (e.g. Docker Swarm), its service
+type TaskRef struct {
+	ContainerID string
+	ServiceID   string
+}
+
+// ErrVolumeInUse is returned when removing a volume still mounted by a task
+var ErrVolumeInUse = errors.New("volume in use and cannot be removed")
+
+// ErrNoSuchVolume is returned when removing a volume which does not exist
+var ErrNoSuchVolume = errors.New("no such volume")
+
+// ExecutionBackend runs the tasks of the GEF jobs and manages their images and data volumes.
+// The Docker implementation runs the tasks as plain containers or, in Swarm Mode, as swarm services.
+type ExecutionBackend interface {
+	// BuildImage builds an image from a directory containing a Dockerfile
+	BuildImage(dirPath string) (Image, error)
+	// ImportImage loads an image from a tar archive
+	ImportImage(tarFilePath string) (Image, error)
+	// TagImage adds a repository tag to an image
+	TagImage(id string, repo string, tag string) error
+
+	// NewVolume creates an empty data volume
+	NewVolume() (db.VolumeID, error)
+	// RemoveVolume removes a data volume; ErrVolumeInUse and ErrNoSuchVolume are expected errors
+	RemoveVolume(id db.VolumeID) error
+
+	// StartTask runs an image with the given volumes mounted; the console output of the
+	// task is written into the returned buffer while it runs
+	StartTask(imageID string, repoTag string, cmd []string, binds []VolumeBind, limits def.LimitConfig, timeouts def.TimeoutConfig) (TaskRef, *bytes.Buffer, error)
+	// WaitTask waits for a task to end and returns its exit code
+	WaitTask(task TaskRef) (int, error)
+	// TerminateTask stops and removes a task; removing an already removed task is not an error
+	TerminateTask(task TaskRef) error
+	// TaskLogs writes the console output of a task; when following, until the task ends
+	TaskLogs(ctx context.Context, task TaskRef, follow bool, w io.Writer) error
+
+	// CopyFromTask returns a tar stream with a file or folder of a task
+	CopyFromTask(task TaskRef, path string) (io.Reader, error)
+	// CopyToTask copies a local file into a folder of a task
+	CopyToTask(task TaskRef, srcPath string, dstPath string) error
+}
+
+// SwarmBackend is implemented by the execution backends able to switch to the Docker Swarm Mode
+type SwarmBackend interface {
+	InitiateSwarmMode(listenAddr string, advertiseAddr string) (string, error)
+	LeaveIfInSwarmMode() error
+}
+
+// LeftoverLister is implemented by the execution backends able to list the data volumes and
+// the ended tasks they have created, so that the janitor can remove those left behind
+type LeftoverLister interface {
+	// ListVolumes lists the data volumes created by NewVolume
+	ListVolumes() ([]db.VolumeID, error)
+	// ListStoppedTasks lists the tasks which have ended but have not been terminated
+	ListStoppedTasks() ([]TaskRef, error)
+}
@@ -0,0 +1,263 @@
+package pier
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/stagein"
+)
+
+const inputCacheTmpDir = "inputcache"
+
+// inputCache keeps copies of the files staged in from PIDs and URLs, to seed the input
+// volumes of the next jobs using the same files. A copy is only used if the server tells
+// that the file has not changed since (using the ETag and Last-Modified validators),
+// and the least recently used copies are evicted when the cache exceeds its size
+type inputCache struct {
+	db      *db.Db
+	folder  string
+	maxSize int64
+	mutex   sync.Mutex
+}
+
+// newInputCache opens the cache folder, removing the files left there without
+// a cache entry (e.g. after a crash)
+func newInputCache(database *db.Db, folder string, maxSize int64) (*inputCache, error) {
+	err := os.MkdirAll(folder, 0700)
+	if err != nil {
+		return nil, def.Err(err, "Cannot create the input cache folder %s", folder)
+	}
+	cache := &inputCache{db: database, folder: folder, maxSize: maxSize}
+
+	entries, err := database.ListCacheEntries()
+	if err != nil {
+		return nil, def.Err(err, "Cannot list the input cache entries")
+	}
+	known := map[string]bool{}
+	for _, e := range entries {
+		known[e.ID] = true
+	}
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, def.Err(err, "Cannot read the input cache folder %s", folder)
+	}
+	for _, f := range files {
+		if !known[f.Name()] {
+			os.RemoveAll(filepath.Join(folder, f.Name()))
+		}
+	}
+	return cache, nil
+}
+
+// cacheEntryID derives the name of the cached copy of a file from its URL
+func cacheEntryID(fileURL string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(fileURL)))
+}
+
+// fetch puts a file into a folder, copied from the cache if the server tells that it has
+// not changed, and downloaded otherwise; the second value is true if the cache was used
+func (c *inputCache) fetch(stager stagein.Stager, f stagein.File, folder string, maxSize int64) (stagein.Result, bool, error) {
+	if c == nil {
+		result, err := stager.Download(f, folder, maxSize)
+		return result, false, err
+	}
+
+	id := cacheEntryID(f.URL)
+	var validators stagein.Validators
+	entry, err := c.db.GetCacheEntry(id)
+	if err == nil {
+		validators = stagein.Validators{ETag: entry.ETag, LastModified: entry.LastModified}
+	}
+	result, err := stager.DownloadIfModified(f, folder, maxSize, validators)
+	if err != nil {
+		return result, false, err
+	}
+	if result.NotModified {
+		result, err = c.seed(f, entry, folder)
+		if err == nil {
+			return result, true, nil
+		}
+		log.Println("input cache: cannot use the copy of", f.URL, err)
+		// download the file again, the copy will be replaced
+		result, err = stager.Download(f, folder, maxSize)
+		if err != nil {
+			return result, false, err
+		}
+	}
+	c.store(id, folder, result)
+	return result, false, nil
+}
+
+// seed links the cached copy of a file into a folder, and verifies it
+func (c *inputCache) seed(f stagein.File, entry db.CacheEntry, folder string) (stagein.Result, error) {
+	filePath := filepath.Join(folder, entry.Name)
+	c.mutex.Lock()
+	err := linkOrCopy(filepath.Join(c.folder, entry.ID), filePath)
+	if err == nil {
+		err = c.db.UseCacheEntry(entry.ID, time.Now())
+	}
+	c.mutex.Unlock()
+	if err != nil {
+		return stagein.Result{Name: entry.Name, URL: f.URL}, err
+	}
+	return stagein.Verify(f, filePath)
+}
+
+// store keeps a copy of a downloaded file, unless it cannot be revalidated
+// (the server sent no validators) or it is larger than the whole cache
+func (c *inputCache) store(id string, folder string, result stagein.Result) {
+	if (result.ETag == "" && result.LastModified == "") || result.Size > c.maxSize {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cachedPath := filepath.Join(c.folder, id)
+	os.Remove(cachedPath)
+	err := linkOrCopy(filepath.Join(folder, result.Name), cachedPath)
+	if err != nil {
+		log.Println("input cache: cannot keep a copy of", result.URL, err)
+		return
+	}
+	now := time.Now()
+	err = c.db.SetCacheEntry(db.CacheEntry{
+		ID:           id,
+		URL:          result.URL,
+		Name:         result.Name,
+		Size:         result.Size,
+		Checksum:     result.Checksum,
+		ETag:         result.ETag,
+		LastModified: result.LastModified,
+		Created:      now,
+		LastUsed:     now,
+	})
+	if err != nil {
+		log.Println("input cache: cannot add an entry for", result.URL, err)
+		os.Remove(cachedPath)
+		return
+	}
+	c.evict()
+}
+
+// evict removes the least recently used copies until the cache fits its size;
+// the mutex must be held
+func (c *inputCache) evict() {
+	entries, err := c.db.ListCacheEntries()
+	if err != nil {
+		log.Println("input cache: cannot list the entries", err)
+		return
+	}
+	size := int64(0)
+	for _, e := range entries {
+		size += e.Size
+	}
+	for _, e := range entries {
+		if size <= c.maxSize {
+			return
+		}
+		err = c.remove(e.ID)
+		if err != nil {
+			log.Println("input cache: cannot evict", e.URL, err)
+			continue
+		}
+		size -= e.Size
+	}
+}
+
+// remove removes an entry and its copy; the mutex must be held
+func (c *inputCache) remove(id string) error {
+	err := c.db.RemoveCacheEntry(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(c.folder, id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// linkOrCopy makes a file available at a new path, as a hard link if possible
+func linkOrCopy(src string, dst string) error {
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// InputCache describes the cache of the files staged in from PIDs and URLs
+type InputCache struct {
+	Entries []db.CacheEntry // the least recently used first
+	Size    int64
+	MaxSize int64 // 0 if the cache is disabled
+}
+
+// GetInputCache lists the files of the input data cache
+func (p *Pier) GetInputCache() (InputCache, error) {
+	cache := InputCache{Entries: []db.CacheEntry{}}
+	if p.inputCache == nil {
+		return cache, nil
+	}
+	entries, err := p.db.ListCacheEntries()
+	if err != nil {
+		return cache, def.Err(err, "Cannot list the input cache entries")
+	}
+	cache.Entries = entries
+	for _, e := range entries {
+		cache.Size += e.Size
+	}
+	cache.MaxSize = p.inputCache.maxSize
+	return cache, nil
+}
+
+// PurgeInputCache removes an entry of the input data cache, or all of them if entryID is empty
+func (p *Pier) PurgeInputCache(entryID string) error {
+	if p.inputCache == nil {
+		return nil
+	}
+	c := p.inputCache
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if entryID != "" {
+		_, err := p.db.GetCacheEntry(entryID)
+		if err != nil {
+			return err
+		}
+		return c.remove(entryID)
+	}
+	entries, err := p.db.ListCacheEntries()
+	if err != nil {
+		return def.Err(err, "Cannot list the input cache entries")
+	}
+	for _, e := range entries {
+		err = c.remove(e.ID)
+		if err != nil {
+			return def.Err(err, "Cannot remove the input cache entry %s", e.ID)
+		}
+	}
+	return nil
+}
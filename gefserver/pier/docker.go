@@ -0,0 +1,137 @@
+package pier
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/internal/dckr"
+)
+
+// dockerBackend executes the GEF tasks on a Docker server, as plain containers,
+// or as swarm services when the server is in Swarm Mode
+type dockerBackend struct {
+	client dckr.Client
+}
+
+func newDockerBackend(config def.DockerConfig) (*dockerBackend, error) {
+	client, err := dckr.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &dockerBackend{client}, nil
+}
+
+func dckrImage2Image(image dckr.Image) Image {
+	return Image{
+		ID:      string(image.ID),
+		RepoTag: image.RepoTag,
+		Labels:  image.Labels,
+		Created: image.Created,
+		Size:    image.Size,
+		Cmd:     image.Cmd,
+	}
+}
+
+func (b *dockerBackend) BuildImage(dirPath string) (Image, error) {
+	image, err := b.client.BuildImage(dirPath)
+	return dckrImage2Image(image), err
+}
+
+func (b *dockerBackend) ImportImage(tarFilePath string) (Image, error) {
+	imageID, err := b.client.ImportImageFromTar(tarFilePath)
+	if err != nil {
+		return Image{}, err
+	}
+	image, err := b.client.InspectImage(imageID)
+	return dckrImage2Image(image), err
+}
+
+func (b *dockerBackend) TagImage(id string, repo string, tag string) error {
+	return b.client.TagImage(id, repo, tag)
+}
+
+func (b *dockerBackend) NewVolume() (db.VolumeID, error) {
+	volume, err := b.client.NewVolume()
+	return db.VolumeID(volume.ID), err
+}
+
+func (b *dockerBackend) RemoveVolume(id db.VolumeID) error {
+	err := b.client.RemoveVolume(dckr.VolumeID(id))
+	switch err {
+	case dckr.NoSuchVolume:
+		return ErrNoSuchVolume
+	case dckr.VolumeInUse:
+		return ErrVolumeInUse
+	}
+	return err
+}
+
+func (b *dockerBackend) ListVolumes() ([]db.VolumeID, error) {
+	volumes, err := b.client.ListGefVolumes()
+	if err != nil {
+		return nil, err
+	}
+	var ids []db.VolumeID
+	for _, v := range volumes {
+		ids = append(ids, db.VolumeID(v.ID))
+	}
+	return ids, nil
+}
+
+// ListStoppedTasks lists the exited containers; in Swarm Mode the containers of the
+// services are managed by the swarm, and none are listed
+func (b *dockerBackend) ListStoppedTasks() ([]TaskRef, error) {
+	swarmOn, err := b.client.IsSwarmActive()
+	if err != nil || swarmOn {
+		return nil, err
+	}
+	containers, err := b.client.ListStoppedGefContainers()
+	if err != nil {
+		return nil, err
+	}
+	var tasks []TaskRef
+	for _, id := range containers {
+		tasks = append(tasks, TaskRef{ContainerID: string(id)})
+	}
+	return tasks, nil
+}
+
+func (b *dockerBackend) StartTask(imageID string, repoTag string, cmd []string, binds []VolumeBind, limits def.LimitConfig, timeouts def.TimeoutConfig) (TaskRef, *bytes.Buffer, error) {
+	var volBinds []dckr.VolBind
+	for _, bind := range binds {
+		volBinds = append(volBinds, dckr.NewVolBind(dckr.VolumeID(bind.VolumeID), bind.MountPoint, bind.ReadOnly))
+	}
+	containerID, swarmServiceID, output, err := b.client.StartImageOrSwarmService(imageID, repoTag, cmd, volBinds, limits, timeouts)
+	return TaskRef{ContainerID: string(containerID), ServiceID: swarmServiceID}, output, err
+}
+
+func (b *dockerBackend) WaitTask(task TaskRef) (int, error) {
+	return b.client.WaitContainerOrSwarmService(task.ContainerID)
+}
+
+func (b *dockerBackend) TerminateTask(task TaskRef) error {
+	return b.client.TerminateContainerOrSwarmService(task.ContainerID, task.ServiceID)
+}
+
+func (b *dockerBackend) TaskLogs(ctx context.Context, task TaskRef, follow bool, w io.Writer) error {
+	return b.client.ContainerLogs(ctx, task.ContainerID, follow, w)
+}
+
+func (b *dockerBackend) CopyFromTask(task TaskRef, path string) (io.Reader, error) {
+	return b.client.GetTarStream(task.ContainerID, path)
+}
+
+func (b *dockerBackend) CopyToTask(task TaskRef, srcPath string, dstPath string) error {
+	return b.client.UploadFile2Container(task.ContainerID, srcPath, dstPath)
+}
+
+func (b *dockerBackend) InitiateSwarmMode(listenAddr string, advertiseAddr string) (string, error) {
+	return b.client.InitiateSwarmMode(listenAddr, advertiseAddr)
+}
+
+func (b *dockerBackend) LeaveIfInSwarmMode() error {
+	return b.client.LeaveIfInSwarmMode()
+}
@@ -0,0 +1,77 @@
+package pier
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// Dockerfile is the metadata of a Dockerfile, for the execution backends which cannot build images
+type Dockerfile struct {
+	From   string
+	Labels map[string]string
+	Cmd    []string
+	// Instructions are the other build instructions found, in upper case
+	Instructions []string
+}
+
+var dockerfileLabelRegexp = regexp.MustCompile(`"([^"]*)"\s*=\s*"([^"]*)"`)
+
+// ReadDockerfile reads the FROM, LABEL and CMD instructions of the Dockerfile of a folder
+func ReadDockerfile(dirPath string) (Dockerfile, error) {
+	dockerfile := Dockerfile{Labels: make(map[string]string)}
+	f, err := os.Open(filepath.Join(dirPath, "Dockerfile"))
+	if err != nil {
+		return dockerfile, def.Err(err, "cannot read Dockerfile")
+	}
+	defer f.Close()
+
+	var lines []string
+	continued := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasSuffix(line, "\\") {
+			continued += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		lines = append(lines, continued+line)
+		continued = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return dockerfile, def.Err(err, "cannot read Dockerfile")
+	}
+
+	for _, line := range lines {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) < 2 {
+			continue
+		}
+		instruction, args := strings.ToUpper(fields[0]), strings.TrimSpace(fields[1])
+		switch instruction {
+		case "FROM":
+			dockerfile.From = strings.Fields(args)[0]
+		case "LABEL":
+			for _, m := range dockerfileLabelRegexp.FindAllStringSubmatch(args, -1) {
+				dockerfile.Labels[m[1]] = m[2]
+			}
+		case "CMD":
+			dockerfile.Cmd = nil
+			if json.Unmarshal([]byte(args), &dockerfile.Cmd) != nil {
+				dockerfile.Cmd = []string{"/bin/sh", "-c", args}
+			}
+		case "MAINTAINER":
+		default:
+			dockerfile.Instructions = append(dockerfile.Instructions, instruction)
+		}
+	}
+	return dockerfile, nil
+}
@@ -0,0 +1,539 @@
+// Package fake implements an in-memory execution backend for the pier,
+// used to test the GEF without a Docker daemon
+package fake
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
+)
+
+// KilledExitCode is the exit code of the tasks terminated while running
+const KilledExitCode = 137
+
+// workDir is where the relative paths of a task are resolved
+const workDir = "/root"
+
+// logPollInterval is how often the output of a followed task is checked
+const logPollInterval = 10 * time.Millisecond
+
+// Handler simulates the execution of an image; it returns the exit code of the task
+type Handler func(task *Task) int
+
+// Backend is an in-memory pier.ExecutionBackend. Images are built only from the
+// labels and the command of their Dockerfile; running an image calls the Handler
+// registered for the name of its build folder. Volumes and task files are kept in memory.
+type Backend struct {
+	mutex    sync.Mutex
+	counter  int
+	handlers map[string]Handler
+	images   map[string]*image
+	volumes  map[db.VolumeID]*volume
+	tasks    map[string]*Task
+	// onNewVolume is called before each volume is created, if set
+	onNewVolume func()
+}
+
+type image struct {
+	pier.Image
+	name string
+	tags []string
+}
+
+type file struct {
+	data     []byte
+	modified time.Time
+}
+
+type volume struct {
+	files   map[string]file // keyed by the path relative to the volume root
+	mounted int
+}
+
+// Task is a running image, as seen by its Handler
+type Task struct {
+	backend  *Backend
+	id       string
+	cmd      []string
+	binds    []pier.VolumeBind
+	files    map[string]file // the task files outside volumes, keyed by absolute path
+	output   *bytes.Buffer
+	done     chan struct{}
+	stopped  chan struct{}
+	exitCode int
+}
+
+// NewBackend creates a fake backend, with handlers simulating the GEF internal services
+func NewBackend() *Backend {
+	b := &Backend{
+		handlers: make(map[string]Handler),
+		images:   make(map[string]*image),
+		volumes:  make(map[db.VolumeID]*volume),
+		tasks:    make(map[string]*Task),
+	}
+	b.Handle("volume-filelist", fileList)
+	b.Handle("copy-to-and-from-volume", copyFiles)
+	b.Handle("B2SHARE_access_image", b2shareAccess)
+	return b
+}
+
+// Handle sets the handler simulating the images built from a folder with the given name;
+// the images without a handler end successfully without doing anything
+func (b *Backend) Handle(name string, handler Handler) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers[name] = handler
+}
+
+// OnNewVolume sets a function called before each volume is created, outside the locks of
+// the backend; tests use it to act while a job is between two of its steps
+func (b *Backend) OnNewVolume(hook func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.onNewVolume = hook
+}
+
+func (b *Backend) newID(prefix string) string {
+	b.counter++
+	return fmt.Sprintf("%s%d", prefix, b.counter)
+}
+
+// BuildImage reads the LABEL and CMD instructions of a Dockerfile
+func (b *Backend) BuildImage(dirPath string) (pier.Image, error) {
+	dockerfile, err := pier.ReadDockerfile(dirPath)
+	if err != nil {
+		return pier.Image{}, err
+	}
+	img := pier.Image{Labels: dockerfile.Labels, Cmd: dockerfile.Cmd}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	img.ID = b.newID("sha256:fake")
+	img.RepoTag = img.ID
+	img.Created = time.Now()
+	b.images[img.ID] = &image{Image: img, name: filepath.Base(dirPath)}
+	return img, nil
+}
+
+// ImportImage is not supported, the fake backend cannot read image layers
+func (b *Backend) ImportImage(tarFilePath string) (pier.Image, error) {
+	return pier.Image{}, errors.New("importing images is not supported by the fake backend")
+}
+
+// TagImage adds a tag to an image
+func (b *Backend) TagImage(id string, repo string, tag string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	img, found := b.images[id]
+	if !found {
+		return fmt.Errorf("no such image: %s", id)
+	}
+	img.tags = append(img.tags, repo+":"+tag)
+	return nil
+}
+
+// NewVolume creates an empty volume
+func (b *Backend) NewVolume() (db.VolumeID, error) {
+	b.mutex.Lock()
+	hook := b.onNewVolume
+	b.mutex.Unlock()
+	if hook != nil {
+		hook()
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	id := db.VolumeID(b.newID("volume"))
+	b.volumes[id] = &volume{files: make(map[string]file)}
+	return id, nil
+}
+
+// RemoveVolume removes a volume not mounted by any task
+func (b *Backend) RemoveVolume(id db.VolumeID) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	vol, found := b.volumes[id]
+	if !found {
+		return pier.ErrNoSuchVolume
+	}
+	if vol.mounted > 0 {
+		return pier.ErrVolumeInUse
+	}
+	delete(b.volumes, id)
+	return nil
+}
+
+// ListVolumes lists the volumes, in creation order
+func (b *Backend) ListVolumes() ([]db.VolumeID, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var ids []db.VolumeID
+	for id := range b.volumes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return idLess(string(ids[i]), string(ids[j])) })
+	return ids, nil
+}
+
+// ListStoppedTasks lists the tasks whose handler has returned, but which have not been terminated
+func (b *Backend) ListStoppedTasks() ([]pier.TaskRef, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var ids []string
+	for id, task := range b.tasks {
+		select {
+		case <-task.done:
+			ids = append(ids, id)
+		default:
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return idLess(ids[i], ids[j]) })
+	var tasks []pier.TaskRef
+	for _, id := range ids {
+		tasks = append(tasks, pier.TaskRef{ContainerID: id})
+	}
+	return tasks, nil
+}
+
+// idLess orders the IDs made by newID by their counter
+func idLess(a string, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// StartTask runs the handler of an image in a new goroutine
+func (b *Backend) StartTask(imageID string, repoTag string, cmd []string, binds []pier.VolumeBind, limits def.LimitConfig, timeouts def.TimeoutConfig) (pier.TaskRef, *bytes.Buffer, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	img := b.findImage(imageID, repoTag)
+	if img == nil {
+		return pier.TaskRef{}, nil, fmt.Errorf("no such image: %s", imageID)
+	}
+	for _, bind := range binds {
+		if _, found := b.volumes[bind.VolumeID]; !found {
+			return pier.TaskRef{}, nil, fmt.Errorf("no such volume: %s", bind.VolumeID)
+		}
+	}
+	for _, bind := range binds {
+		b.volumes[bind.VolumeID].mounted++
+	}
+
+	if len(cmd) == 0 {
+		cmd = img.Cmd
+	}
+	task := &Task{
+		backend: b,
+		id:      b.newID("container"),
+		cmd:     cmd,
+		binds:   binds,
+		files:   make(map[string]file),
+		output:  &bytes.Buffer{},
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	b.tasks[task.id] = task
+
+	handler, found := b.handlers[img.name]
+	go func() {
+		exitCode := 0
+		if found {
+			exitCode = handler(task)
+		}
+		b.mutex.Lock()
+		task.exitCode = exitCode
+		b.mutex.Unlock()
+		close(task.done)
+	}()
+	return pier.TaskRef{ContainerID: task.id}, task.output, nil
+}
+
+func (b *Backend) findImage(imageID string, repoTag string) *image {
+	if img, found := b.images[imageID]; found {
+		return img
+	}
+	for _, img := range b.images {
+		for _, tag := range img.tags {
+			if tag == repoTag {
+				return img
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Backend) getTask(ref pier.TaskRef) (*Task, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	task, found := b.tasks[ref.ContainerID]
+	if !found {
+		return nil, fmt.Errorf("no such task: %s", ref.ContainerID)
+	}
+	return task, nil
+}
+
+// WaitTask waits for the handler of a task to return, or for the task to be terminated
+func (b *Backend) WaitTask(ref pier.TaskRef) (int, error) {
+	task, err := b.getTask(ref)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case <-task.done:
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return task.exitCode, nil
+	case <-task.stopped:
+		return KilledExitCode, nil
+	}
+}
+
+// TerminateTask removes a task and unmounts its volumes; a running handler
+// is notified by Task.Stopped and cannot change the volumes anymore
+func (b *Backend) TerminateTask(ref pier.TaskRef) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	task, found := b.tasks[ref.ContainerID]
+	if !found {
+		return nil
+	}
+	delete(b.tasks, ref.ContainerID)
+	close(task.stopped)
+	for _, bind := range task.binds {
+		if vol, found := b.volumes[bind.VolumeID]; found {
+			vol.mounted--
+		}
+	}
+	return nil
+}
+
+// TaskLogs writes the output of a task; when following, until the task ends or is terminated
+func (b *Backend) TaskLogs(ctx context.Context, ref pier.TaskRef, follow bool, w io.Writer) error {
+	task, err := b.getTask(ref)
+	if err != nil {
+		return err
+	}
+	sent := 0
+	for {
+		b.mutex.Lock()
+		chunk := append([]byte{}, task.output.Bytes()[sent:]...)
+		b.mutex.Unlock()
+		finished := task.isFinished()
+
+		if len(chunk) > 0 {
+			sent += len(chunk)
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+		}
+		if !follow || finished {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(logPollInterval):
+		}
+	}
+}
+
+// CopyFromTask returns a tar stream with a file or a folder of a task;
+// relative paths are resolved in the /root folder
+func (b *Backend) CopyFromTask(ref pier.TaskRef, filePath string) (io.Reader, error) {
+	task, err := b.getTask(ref)
+	if err != nil {
+		return nil, err
+	}
+	if !path.IsAbs(filePath) {
+		filePath = path.Join(workDir, filePath)
+	}
+	filePath = path.Clean(filePath)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var names []string
+	files := make(map[string]file)
+	if f, found := task.lookup(filePath); found {
+		names = append(names, path.Base(filePath))
+		files[path.Base(filePath)] = f
+	} else {
+		for _, name := range task.list(filePath) {
+			f, _ := task.lookup(path.Join(filePath, name))
+			name = path.Join(path.Base(filePath), name)
+			names = append(names, name)
+			files[name] = f
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no such file or folder: %s", filePath)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		f := files[name]
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(f.data)), ModTime: f.modified, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// CopyToTask copies a local file into a folder of a task
+func (b *Backend) CopyToTask(ref pier.TaskRef, srcPath string, dstPath string) error {
+	task, err := b.getTask(ref)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return err
+	}
+	return task.WriteFile(path.Join(dstPath, filepath.Base(srcPath)), data)
+}
+
+// Args returns the command line of the task
+func (t *Task) Args() []string {
+	return t.cmd
+}
+
+// Stopped is closed when the task is terminated
+func (t *Task) Stopped() <-chan struct{} {
+	return t.stopped
+}
+
+// Printf writes to the console output of the task, unless terminated
+func (t *Task) Printf(format string, args ...interface{}) {
+	t.backend.mutex.Lock()
+	defer t.backend.mutex.Unlock()
+	select {
+	case <-t.stopped:
+		return
+	default:
+	}
+	fmt.Fprintf(t.output, format, args...)
+}
+
+// ReadFile reads a file of the task, possibly from a mounted volume
+func (t *Task) ReadFile(filePath string) ([]byte, error) {
+	t.backend.mutex.Lock()
+	defer t.backend.mutex.Unlock()
+	f, found := t.lookup(path.Clean(filePath))
+	if !found {
+		return nil, fmt.Errorf("no such file: %s", filePath)
+	}
+	return f.data, nil
+}
+
+// WriteFile writes a file of the task, possibly into a mounted volume
+func (t *Task) WriteFile(filePath string, data []byte) error {
+	t.backend.mutex.Lock()
+	defer t.backend.mutex.Unlock()
+	select {
+	case <-t.stopped:
+		return errors.New("the task has been terminated")
+	default:
+	}
+
+	filePath = path.Clean(filePath)
+	f := file{data: append([]byte{}, data...), modified: time.Now()}
+	vol, bind, rel := t.resolve(filePath)
+	if vol == nil {
+		t.files[filePath] = f
+		return nil
+	}
+	if bind.ReadOnly {
+		return fmt.Errorf("read-only file system: %s", filePath)
+	}
+	vol.files[rel] = f
+	return nil
+}
+
+// ListFiles returns the paths, relative to a folder, of all the files in the folder and its subfolders
+func (t *Task) ListFiles(dirPath string) []string {
+	t.backend.mutex.Lock()
+	defer t.backend.mutex.Unlock()
+	return t.list(path.Clean(dirPath))
+}
+
+func (t *Task) isFinished() bool {
+	select {
+	case <-t.done:
+		return true
+	case <-t.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// resolve finds the volume mounted at the deepest mount point containing a path;
+// rel is the path relative to the volume root
+func (t *Task) resolve(filePath string) (vol *volume, bind pier.VolumeBind, rel string) {
+	for _, b := range t.binds {
+		mountPoint := path.Clean(b.MountPoint)
+		if filePath != mountPoint && !strings.HasPrefix(filePath, mountPoint+"/") {
+			continue
+		}
+		if vol != nil && len(mountPoint) <= len(path.Clean(bind.MountPoint)) {
+			continue
+		}
+		vol, bind = t.backend.volumes[b.VolumeID], b
+		rel = strings.TrimPrefix(strings.TrimPrefix(filePath, mountPoint), "/")
+	}
+	return vol, bind, rel
+}
+
+func (t *Task) lookup(filePath string) (file, bool) {
+	vol, _, rel := t.resolve(filePath)
+	if vol == nil {
+		f, found := t.files[filePath]
+		return f, found
+	}
+	f, found := vol.files[rel]
+	return f, found
+}
+
+func (t *Task) list(dirPath string) []string {
+	var names []string
+	add := func(files map[string]file, dir string) {
+		for name := range files {
+			if dir == "" {
+				names = append(names, name)
+			} else if strings.HasPrefix(name, dir+"/") {
+				names = append(names, strings.TrimPrefix(name, dir+"/"))
+			}
+		}
+	}
+	vol, _, rel := t.resolve(dirPath)
+	if vol == nil {
+		add(t.files, dirPath)
+	} else {
+		add(vol.files, rel)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,163 @@
+package fake
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
+)
+
+// fileList simulates the volume-filelist image, writing the list of the files of the
+// volume mounted in /root/volume into /root/_filelist.json
+func fileList(task *Task) int {
+	args := task.Args()
+	subFolder := ""
+	if len(args) > 1 {
+		subFolder = strings.Trim(args[1], "/")
+	}
+	recursive := len(args) > 2 && args[2] == "r"
+
+	root := path.Join("/root/volume", subFolder)
+	items := []pier.VolumeItem{}
+	for _, name := range task.ListFiles(root) {
+		data, err := task.ReadFile(path.Join(root, name))
+		if err != nil {
+			task.Printf("%s\n", err)
+			return 1
+		}
+		items = addVolumeItem(items, subFolder, strings.Split(name, "/"), int64(len(data)), recursive)
+	}
+
+	list, err := json.Marshal(items)
+	if err != nil {
+		task.Printf("%s\n", err)
+		return 1
+	}
+	err = task.WriteFile("/root/_filelist.json", list)
+	if err != nil {
+		task.Printf("%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// addVolumeItem adds a file to a folder tree; parts is the file path
+// relative to the folder, split in path elements
+func addVolumeItem(items []pier.VolumeItem, folder string, parts []string, size int64, recursive bool) []pier.VolumeItem {
+	if len(parts) == 1 {
+		return append(items, pier.VolumeItem{
+			Name:       parts[0],
+			Size:       size,
+			Modified:   time.Now(),
+			Path:       folder,
+			FolderTree: []pier.VolumeItem{},
+		})
+	}
+
+	for i := range items {
+		if items[i].IsFolder && items[i].Name == parts[0] {
+			if recursive {
+				items[i].FolderTree = addVolumeItem(items[i].FolderTree, path.Join(folder, parts[0]), parts[1:], size, recursive)
+			}
+			return items
+		}
+	}
+	subFolder := pier.VolumeItem{
+		Name:       parts[0],
+		Modified:   time.Now(),
+		IsFolder:   true,
+		Path:       folder,
+		FolderTree: []pier.VolumeItem{},
+	}
+	if recursive {
+		subFolder.FolderTree = addVolumeItem(subFolder.FolderTree, path.Join(folder, parts[0]), parts[1:], size, recursive)
+	}
+	return append(items, subFolder)
+}
+
+// copyFiles simulates the copy-to-and-from-volume image, running "cp src dstFolder";
+// any other command (e.g. "ls", used to keep the container alive) does nothing
+func copyFiles(task *Task) int {
+	args := task.Args()
+	if len(args) != 3 || args[0] != "cp" {
+		return 0
+	}
+	src, dst := path.Clean(args[1]), path.Clean(args[2])
+
+	data, err := task.ReadFile(src)
+	if err == nil {
+		err = task.WriteFile(path.Join(dst, path.Base(src)), data)
+	} else {
+		for _, name := range task.ListFiles(src) {
+			data, err = task.ReadFile(path.Join(src, name))
+			if err != nil {
+				break
+			}
+			err = task.WriteFile(path.Join(dst, path.Base(src), name), data)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		task.Printf("cp: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// b2shareAccess simulates the B2SHARE access image, printing responses like the scripts do
+// for a B2SHARE instance accepting every token; the uploaded files must exist in the volume.
+// The token must be given in a file: a token on the command line is refused
+func b2shareAccess(task *Task) int {
+	args := task.Args()
+	if len(args) < 2 {
+		task.Printf("usage: python script.py ...\n")
+		return 1
+	}
+	targetURL, tokenFile := "", ""
+	for i := range args {
+		switch {
+		case args[i] == "--access_token":
+			task.Printf("the access token must not be given on the command line\n")
+			return 1
+		case args[i] == "--target_url" && i+1 < len(args):
+			targetURL = args[i+1]
+		case args[i] == "--access_token_file" && i+1 < len(args):
+			tokenFile = args[i+1]
+		}
+	}
+	if token, err := task.ReadFile(tokenFile); err != nil || len(token) == 0 {
+		task.Printf("Calling the B2SHARE instance requires an access token.\n")
+		return 0
+	}
+
+	var response interface{}
+	switch path.Base(args[1]) {
+	case "create_new_deposition.py":
+		response = map[string]string{"deposit_id": "fakedeposition", "location": targetURL + "/deposit/fakedeposition"}
+	case "load_file_into_deposition.py":
+		data, err := task.ReadFile(path.Join("/input_directory", args[3]))
+		if err != nil {
+			task.Printf("File %s could not be found in input_directory. Exiting.\n", args[3])
+			return 0
+		}
+		response = map[string]interface{}{"name": path.Base(args[3]), "size": len(data)}
+	case "commit_deposition.py":
+		var metadata map[string]interface{}
+		if err := json.Unmarshal([]byte(args[3]), &metadata); err != nil {
+			task.Printf("invalid metadata: %s\n", err)
+			return 2
+		}
+		response = map[string]interface{}{"record_id": 1, "location": "/record/1", "PID": "11304/fake-record"}
+	default:
+		task.Printf("unknown script: %s\n", args[1])
+		return 1
+	}
+
+	data, _ := json.MarshalIndent(response, "", "    ")
+	task.Printf("Content type: application/json\n%s\n", data)
+	return 0
+}
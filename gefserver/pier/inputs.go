@@ -0,0 +1,216 @@
+package pier
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+)
+
+// Input types, declared by the eudat.gef.service.input.N.type labels
+const (
+	InputTypeString  = "string"  // a text, written into the FileName file
+	InputTypeURL     = "url"     // a URL or a PID, downloaded into the volume
+	InputTypePID     = "pid"     // a PID, downloaded into the volume
+	InputTypeURLList = "urllist" // URLs or PIDs separated by white space, all downloaded into the volume
+	InputTypeInteger = "integer" // an integer, written into the FileName file
+	InputTypeFloat   = "float"   // a number, written into the FileName file
+	InputTypeBoolean = "boolean" // true or false, written into the FileName file
+	InputTypeEnum    = "enum"    // one of the port Values, written into the FileName file
+	InputTypeFile    = "file"    // an uploaded file, or a URL or a PID downloaded into the volume
+	InputTypeWebDAV  = "webdav"  // a file path in the B2DROP folder of the user, downloaded into the volume
+)
+
+var pidRegexp = regexp.MustCompile(`^(hdl:|https?://hdl\.handle\.net/)?\d+(\.\d+)*/\S+$`)
+var urlRegexp = regexp.MustCompile(`^https?://\S+$`)
+
+// InputError describes an invalid input value
+type InputError struct {
+	ID      string // the input port ID
+	Name    string // the input port name
+	Value   string
+	Message string
+}
+
+// inputType returns the normalized type of an input port
+func inputType(port db.IOPort) string {
+	return strings.ToLower(strings.TrimSpace(port.Type))
+}
+
+// IsValueInput tells whether the input value is written into the FileName file
+// of the input volume, rather than downloaded or uploaded
+func IsValueInput(port db.IOPort) bool {
+	switch inputType(port) {
+	case InputTypeString, InputTypeInteger, InputTypeFloat, InputTypeBoolean, InputTypeEnum:
+		return true
+	}
+	return false
+}
+
+// IsWebDAVInput tells whether the input value is a file in the B2DROP folder of the user
+func IsWebDAVInput(port db.IOPort) bool {
+	return inputType(port) == InputTypeWebDAV
+}
+
+// CheckInputs validates the input values of a service, given in the order of its input ports;
+// it returns the values with the defaults applied, and an error for each invalid value
+func CheckInputs(ports []db.IOPort, values []string) ([]string, []InputError) {
+	checked := make([]string, len(ports))
+	var invalid []InputError
+	for i, port := range ports {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		if inputType(port) != InputTypeString {
+			value = strings.TrimSpace(value)
+		}
+		if value == "" && inputType(port) != InputTypeFile {
+			value = port.Default
+		}
+		if value == "" {
+			if !port.Optional {
+				invalid = append(invalid, InputError{port.ID, port.Name, value, "a value is required"})
+			}
+			continue
+		}
+
+		value, err := checkInput(port, value)
+		if err != nil {
+			invalid = append(invalid, InputError{port.ID, port.Name, value, err.Error()})
+			continue
+		}
+		checked[i] = value
+	}
+	if len(values) > len(ports) {
+		invalid = append(invalid, InputError{Message: fmt.Sprintf("the service has %d inputs, %d values given", len(ports), len(values))})
+	}
+	return checked, invalid
+}
+
+// checkInput validates a non-empty input value and returns it normalized
+func checkInput(port db.IOPort, value string) (string, error) {
+	switch inputType(port) {
+	case InputTypeString:
+		return value, checkPattern(port, value)
+	case InputTypeURL:
+		if !urlRegexp.MatchString(value) && !pidRegexp.MatchString(value) {
+			return value, fmt.Errorf("not a URL or a PID")
+		}
+		return value, checkPattern(port, value)
+	case InputTypePID:
+		if !pidRegexp.MatchString(value) {
+			return value, fmt.Errorf("not a PID")
+		}
+		return value, checkPattern(port, value)
+	case InputTypeURLList:
+		for _, item := range strings.Fields(value) {
+			if !urlRegexp.MatchString(item) && !pidRegexp.MatchString(item) {
+				return value, fmt.Errorf("not a URL or a PID: %s", item)
+			}
+			err := checkPattern(port, item)
+			if err != nil {
+				return value, err
+			}
+		}
+		return strings.Join(strings.Fields(value), "\n"), nil
+	case InputTypeInteger:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return value, fmt.Errorf("not an integer")
+		}
+		return value, checkRange(port, float64(n))
+	case InputTypeFloat:
+		x, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return value, fmt.Errorf("not a number")
+		}
+		return value, checkRange(port, x)
+	case InputTypeBoolean:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return value, fmt.Errorf("not a boolean (true or false)")
+		}
+		return strconv.FormatBool(b), nil
+	case InputTypeEnum:
+		for _, v := range port.Values {
+			if value == v {
+				return value, nil
+			}
+		}
+		return value, fmt.Errorf("not one of: %s", strings.Join(port.Values, ", "))
+	case InputTypeFile:
+		// the uploaded files are not checked; the values are downloaded
+		if !urlRegexp.MatchString(value) && !pidRegexp.MatchString(value) {
+			return value, fmt.Errorf("not an uploaded file, a URL or a PID")
+		}
+		return value, checkPattern(port, value)
+	case InputTypeWebDAV:
+		if urlRegexp.MatchString(value) {
+			return value, checkPattern(port, value)
+		}
+		// the paths are kept relative to the B2DROP folder
+		cleaned := strings.TrimPrefix(path.Clean("/"+value), "/")
+		if cleaned == "" {
+			return value, fmt.Errorf("not a file path")
+		}
+		return cleaned, checkPattern(port, cleaned)
+	case "":
+		return value, fmt.Errorf("the input type is not specified by the service")
+	}
+	return value, fmt.Errorf("unknown input type: %s", port.Type)
+}
+
+// WebDAVFileURL returns the URL of a checked webdav input value, a path relative to
+// the WebDAV folder folderURL or a URL; the URLs must point inside the folder
+func WebDAVFileURL(folderURL string, value string) (string, error) {
+	if urlRegexp.MatchString(value) {
+		prefix := strings.TrimRight(folderURL, "/") + "/"
+		if !strings.HasPrefix(value, prefix) {
+			return value, fmt.Errorf("not a file of the B2DROP folder %s", prefix)
+		}
+		for _, segment := range strings.Split(value[len(prefix):], "/") {
+			if unescaped, err := url.PathUnescape(segment); err != nil || unescaped == ".." {
+				return value, fmt.Errorf("not a file of the B2DROP folder %s", prefix)
+			}
+		}
+		return value, nil
+	}
+	return joinURL(folderURL, value), nil
+}
+
+// checkPattern checks that the whole value matches the port pattern, if any
+func checkPattern(port db.IOPort, value string) error {
+	if port.Pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + port.Pattern + ")$")
+	if err != nil {
+		return fmt.Errorf("bad pattern in the service description: %s", err)
+	}
+	if !re.MatchString(value) {
+		return fmt.Errorf("does not match the pattern %s", port.Pattern)
+	}
+	return nil
+}
+
+// checkRange checks that the value is within the port bounds, if any
+func checkRange(port db.IOPort, x float64) error {
+	if port.Min != "" {
+		min, err := strconv.ParseFloat(port.Min, 64)
+		if err == nil && x < min {
+			return fmt.Errorf("must be at least %s", port.Min)
+		}
+	}
+	if port.Max != "" {
+		max, err := strconv.ParseFloat(port.Max, 64)
+		if err == nil && x > max {
+			return fmt.Errorf("must be at most %s", port.Max)
+		}
+	}
+	return nil
+}
@@ -661,6 +661,25 @@ func (c Client) WaitContainerOrSwarmService(containerID string) (int, error) {
 	}
 }
 
+// ContainerLogs writes the console output of a container; when following, it keeps
+// writing until the container stops or the context is cancelled. The containers of
+// swarm services can only be followed if they run on the node we are connected to.
+func (c Client) ContainerLogs(ctx context.Context, containerID string, follow bool, w io.Writer) error {
+	err := c.c.Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    containerID,
+		OutputStream: w,
+		ErrorStream:  w,
+		Follow:       follow,
+		Stdout:       true,
+		Stderr:       true,
+	})
+	if err != nil {
+		return def.Err(err, "cannot get container logs")
+	}
+	return nil
+}
+
 // ListContainers lists the docker images
 func (c Client) ListContainers() ([]Container, error) {
 	conts, err := c.c.ListContainers(
@@ -710,9 +729,15 @@ func (c Client) InspectContainer(id ContainerID) (Container, error) {
 	return ret, err
 }
 
+// VolumeLabel marks the volumes created by NewVolume
+const VolumeLabel = "eudat.gef.volume"
+
+// serviceLabel is set on all the GEF service images, and inherited by their containers
+const serviceLabel = "eudat.gef.service.name"
+
 // NewVolume builds an empty Docker volume
 func (c *Client) NewVolume() (Volume, error) {
-	cvo := docker.CreateVolumeOptions{}
+	cvo := docker.CreateVolumeOptions{Labels: map[string]string{VolumeLabel: "true"}}
 	v, err := c.c.CreateVolume(cvo)
 	if err != nil {
 		return Volume{}, err
@@ -738,6 +763,44 @@ func (c Client) ListVolumes() ([]Volume, error) {
 	return ret, nil
 }
 
+// ListGefVolumes lists the volumes created by NewVolume
+func (c Client) ListGefVolumes() ([]Volume, error) {
+	vols, err := c.c.ListVolumes(docker.ListVolumesOptions{
+		Filters: map[string][]string{"label": {VolumeLabel}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]Volume, 0, 0)
+	for _, vol := range vols {
+		ret = append(ret, Volume{
+			ID: VolumeID(vol.Name),
+		})
+	}
+	return ret, nil
+}
+
+// ListStoppedGefContainers lists the containers of the GEF service images which have exited
+func (c Client) ListStoppedGefContainers() ([]ContainerID, error) {
+	conts, err := c.c.ListContainers(docker.ListContainersOptions{
+		All: true,
+		Filters: map[string][]string{
+			"status": {"exited", "dead"},
+			"label":  {serviceLabel},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]ContainerID, 0, 0)
+	for _, cont := range conts {
+		ret = append(ret, ContainerID(cont.ID))
+	}
+	return ret, nil
+}
+
 //RemoveVolume removes a volume
 func (c Client) RemoveVolume(id VolumeID) error {
 	return c.c.RemoveVolume(string(id))
@@ -0,0 +1,369 @@
+package pier
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// janitorTmpDirs are the subfolders of the TmpDir whose stale folders are removed
+var janitorTmpDirs = []string{BuildsTmpDir, InputsTmpDir, stageInTmpDir, webdavTmpDir}
+
+// defaultLeftoverAge is how long the leftovers are found before being removed, when the
+// LeftoverAge retention is not set
+const defaultLeftoverAge = 10 * time.Minute
+
+// janitor remembers when its runs first found the current leftovers. A leftover is only
+// removed once it has been found for the LeftoverAge, so that the volumes and tasks which
+// have just been created (and are not recorded yet) are not mistaken for leftovers
+type janitor struct {
+	mutex     sync.Mutex
+	leftovers map[string]time.Time // when first found, keyed by connection, kind and ID
+}
+
+// JanitorReport lists what the janitor has removed or, in a dry run, would remove
+type JanitorReport struct {
+	DryRun  bool
+	Time    time.Time
+	Jobs    []ExpiredJob
+	Volumes []Leftover // the volumes which do not belong to any job
+	Tasks   []Leftover // the ended tasks which have not been terminated
+	TmpDirs []string
+	Errors  []string
+}
+
+// ExpiredJob is an ended job kept for longer than its retention
+type ExpiredJob struct {
+	ID      db.JobID
+	UserID  int64
+	Status  string
+	Ended   time.Time
+	Expired time.Time
+}
+
+// Leftover is a volume or a task left behind on a connection
+type Leftover struct {
+	ConnectionID db.ConnectionID
+	ID           string
+	Pending      bool // true if not found for the LeftoverAge yet; it is removed by a later run
+}
+
+// startJanitor runs the janitor periodically
+func (p *Pier) startJanitor(interval float64) {
+	ticker := time.NewTicker(time.Duration(interval * float64(time.Second)))
+	for range ticker.C {
+		report, err := p.RunJanitor(false)
+		if err != nil {
+			log.Println("janitor:", err)
+			continue
+		}
+		for _, e := range report.Errors {
+			log.Println("janitor:", e)
+		}
+		volumes, tasks := removedLeftovers(report.Volumes), removedLeftovers(report.Tasks)
+		if len(report.Jobs)+volumes+tasks+len(report.TmpDirs) > 0 {
+			log.Printf("janitor: removed %d jobs, %d volumes, %d tasks and %d temporary folders",
+				len(report.Jobs), volumes, tasks, len(report.TmpDirs))
+		}
+	}
+}
+
+func removedLeftovers(leftovers []Leftover) int {
+	n := 0
+	for _, l := range leftovers {
+		if !l.Pending {
+			n++
+		}
+	}
+	return n
+}
+
+// RunJanitor removes the jobs kept for longer than their retention (with their volumes
+// and tasks), the volumes and the tasks left behind on the connections, and the stale
+// temporary folders; a dry run only lists them
+func (p *Pier) RunJanitor(dryRun bool) (JanitorReport, error) {
+	p.janitor.mutex.Lock()
+	defer p.janitor.mutex.Unlock()
+
+	now := time.Now()
+	report := JanitorReport{
+		DryRun:  dryRun,
+		Time:    now,
+		Jobs:    []ExpiredJob{},
+		Volumes: []Leftover{},
+		Tasks:   []Leftover{},
+		TmpDirs: []string{},
+		Errors:  []string{},
+	}
+
+	jobs, err := p.db.ListJobs()
+	if err != nil {
+		return report, def.Err(err, "Cannot list the jobs")
+	}
+	var keptJobs []db.Job
+	for _, job := range jobs {
+		expired, ok := p.expiredJob(job, now)
+		if !ok {
+			keptJobs = append(keptJobs, job)
+			continue
+		}
+		if !dryRun {
+			_, err = p.RemoveJob(expired.UserID, job.ID)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("cannot remove job %s: %s", job.ID, err))
+				keptJobs = append(keptJobs, job)
+				continue
+			}
+		}
+		report.Jobs = append(report.Jobs, expired)
+	}
+
+	p.collectLeftovers(&report, now, dryRun)
+	p.collectTmpDirs(&report, keptJobs, now, dryRun)
+	return report, nil
+}
+
+// expiredJob tells if an ended job has been kept for longer than its retention;
+// the jobs whose results are being published or copied into B2DROP are kept
+func (p *Pier) expiredJob(job db.Job, now time.Time) (ExpiredJob, bool) {
+	if job.State == nil || job.State.Code < 0 {
+		return ExpiredJob{}, false
+	}
+	if job.Publication != nil && job.Publication.Code == -1 {
+		return ExpiredJob{}, false
+	}
+	if job.B2DropCopy != nil && job.B2DropCopy.Code == -1 {
+		return ExpiredJob{}, false
+	}
+	userID, err := p.db.GetJobOwner(job.ID)
+	if err != nil && !db.IsNoResultsError(err) {
+		log.Println("janitor: cannot get the owner of job", job.ID, err)
+		return ExpiredJob{}, false
+	}
+
+	hours := p.jobRetention(userID, job.State.Code)
+	if hours == 0 {
+		return ExpiredJob{}, false
+	}
+	ended := job.Created.Add(time.Duration(job.Duration) * time.Second)
+	expired := ended.Add(time.Duration(hours * float64(time.Hour)))
+	if now.Before(expired) {
+		return ExpiredJob{}, false
+	}
+	return ExpiredJob{ID: job.ID, UserID: userID, Status: job.State.Status, Ended: ended, Expired: expired}, true
+}
+
+// jobRetention returns how long (in hours, 0 meaning forever) the jobs of a user ended
+// with the given state code are kept
+func (p *Pier) jobRetention(userID int64, code int) float64 {
+	config := p.config.Retention
+	retention := config.Jobs
+	if len(config.Roles) > 0 {
+		roles, err := p.db.GetUserRoles(userID)
+		if err != nil {
+			log.Println("janitor: cannot get the roles of user", userID, err)
+		}
+		found := false
+		for _, r := range roles {
+			roleRetention, ok := config.Roles[r.Name]
+			if !ok {
+				continue
+			}
+			if !found {
+				retention, found = roleRetention, true
+				continue
+			}
+			retention = def.JobRetention{
+				Succeeded: longerRetention(retention.Succeeded, roleRetention.Succeeded),
+				Failed:    longerRetention(retention.Failed, roleRetention.Failed),
+				Cancelled: longerRetention(retention.Cancelled, roleRetention.Cancelled),
+			}
+		}
+	}
+
+	switch code {
+	case 0:
+		return retention.Succeeded
+	case 2:
+		return retention.Cancelled
+	}
+	return retention.Failed
+}
+
+func longerRetention(a float64, b float64) float64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// collectLeftovers removes the volumes not belonging to any job and the ended tasks
+// which have not been terminated, on the connections whose backend can list them;
+// a dry run does not record the leftovers it finds
+func (p *Pier) collectLeftovers(report *JanitorReport, now time.Time, dryRun bool) {
+	minAge := time.Duration(p.config.Retention.LeftoverAge * float64(time.Second))
+	if minAge <= 0 {
+		minAge = defaultLeftoverAge
+	}
+	firstFound := func(key string) time.Time {
+		if found, ok := p.janitor.leftovers[key]; ok {
+			return found
+		}
+		return now
+	}
+
+	var connectionIDs []db.ConnectionID
+	for id := range p.docker {
+		connectionIDs = append(connectionIDs, id)
+	}
+	sort.Slice(connectionIDs, func(i, j int) bool { return connectionIDs[i] < connectionIDs[j] })
+
+	found := map[string]time.Time{}
+	for _, connectionID := range connectionIDs {
+		backend := p.docker[connectionID].backend
+		lister, ok := backend.(LeftoverLister)
+		if !ok {
+			continue
+		}
+
+		volumes, err := lister.ListVolumes()
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("cannot list the volumes of connection %d: %s", connectionID, err))
+		}
+		// the job volumes are read after listing the volumes, to also know the volumes just created
+		known := map[db.VolumeID]bool{}
+		jobVolumes, err := p.db.ListVolumeIDs()
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("cannot list the job volumes: %s", err))
+			return
+		}
+		for _, id := range jobVolumes {
+			known[id] = true
+		}
+		for _, id := range volumes {
+			if known[id] {
+				continue
+			}
+			key := fmt.Sprintf("%d/volume/%s", connectionID, id)
+			found[key] = firstFound(key)
+			leftover := Leftover{ConnectionID: connectionID, ID: string(id), Pending: now.Sub(found[key]) < minAge}
+			if !dryRun && !leftover.Pending {
+				err = backend.RemoveVolume(id)
+				if err != nil && err != ErrNoSuchVolume {
+					report.Errors = append(report.Errors, fmt.Sprintf("cannot remove volume %s: %s", id, err))
+					continue
+				}
+			}
+			report.Volumes = append(report.Volumes, leftover)
+		}
+
+		tasks, err := lister.ListStoppedTasks()
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("cannot list the tasks of connection %d: %s", connectionID, err))
+		}
+		for _, task := range tasks {
+			key := fmt.Sprintf("%d/task/%s", connectionID, task.ContainerID)
+			found[key] = firstFound(key)
+			leftover := Leftover{ConnectionID: connectionID, ID: task.ContainerID, Pending: now.Sub(found[key]) < minAge}
+			if !dryRun && !leftover.Pending {
+				err = backend.TerminateTask(task)
+				if err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("cannot remove task %s: %s", task.ContainerID, err))
+					continue
+				}
+			}
+			report.Tasks = append(report.Tasks, leftover)
+		}
+	}
+	if !dryRun {
+		p.janitor.leftovers = found
+	}
+}
+
+// collectTmpDirs removes the temporary folders not modified for longer than their
+// retention, except the folders of the builds in progress and those holding the input
+// files of the jobs which are kept; the inputs of the jobs waiting in the queue are only
+// recorded there, their volumes being created when the jobs start
+func (p *Pier) collectTmpDirs(report *JanitorReport, keptJobs []db.Job, now time.Time, dryRun bool) {
+	hours := p.config.Retention.TmpFiles
+	if hours == 0 {
+		return
+	}
+	limit := now.Add(-time.Duration(hours * float64(time.Hour)))
+
+	var inputSources []db.JobInput
+	inputSourcesRead := false
+	isJobInput := func(folder string) bool {
+		if !inputSourcesRead {
+			for _, job := range keptJobs {
+				sources, err := p.db.GetJobInputSources(job.ID)
+				if err != nil {
+					log.Println("janitor: cannot get the input sources of job", job.ID, err)
+				}
+				for _, src := range sources {
+					inputSources = append(inputSources, src)
+				}
+				queuedJob, err := p.db.GetQueuedJob(job.ID)
+				if err == nil {
+					inputSources = append(inputSources, queuedJob.Inputs...)
+				} else if !db.IsNoResultsError(err) {
+					log.Println("janitor: cannot get the queued inputs of job", job.ID, err)
+				}
+			}
+			inputSourcesRead = true
+		}
+		for _, src := range inputSources {
+			if src.Local && strings.HasPrefix(src.Source, folder+string(filepath.Separator)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, subDir := range janitorTmpDirs {
+		folder := filepath.Join(p.tmpDir, subDir)
+		entries, err := ioutil.ReadDir(folder)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("cannot read the folder %s: %s", folder, err))
+			continue
+		}
+		for _, e := range entries {
+			if e.ModTime().After(limit) {
+				continue
+			}
+			path := filepath.Join(folder, e.Name())
+			if subDir == BuildsTmpDir {
+				build, err := p.db.GetBuild(e.Name())
+				if err == nil && build.State.Code == -1 {
+					continue
+				}
+			}
+			if subDir == InputsTmpDir && isJobInput(path) {
+				continue
+			}
+			if !dryRun {
+				err = os.RemoveAll(path)
+				if err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("cannot remove the folder %s: %s", path, err))
+					continue
+				}
+			}
+			report.TmpDirs = append(report.TmpDirs, path)
+		}
+	}
+}
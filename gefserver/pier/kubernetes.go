@@ -0,0 +1,770 @@
+package pier
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/pborman/uuid"
+)
+
+// KubernetesPollInterval is how often the status of a running Kubernetes Job is checked
+var KubernetesPollInterval = time.Second
+
+const (
+	kubeDefaultNamespace   = "default"
+	kubeDefaultVolumeSize  = "1Gi"
+	kubeDefaultHelperImage = "busybox"
+	kubeTaskLabel          = "eudat.gef.task"
+	kubeVolumeLabel        = "eudat.gef.volume"
+	kubeWorkDir            = "/root"
+	// kubeHelperReady is created by a helper pod once the files to copy are ready
+	kubeHelperReady = "/tmp/.gef-helper-ready"
+	// kubeHelperLifetime bounds, in seconds, the life of a helper pod left behind
+	kubeHelperLifetime = 24 * 3600
+)
+
+// kubeImagePullErrors are the reasons of the containers waiting for an image which cannot be pulled
+var kubeImagePullErrors = map[string]bool{
+	"ErrImagePull":     true,
+	"ImagePullBackOff": true,
+	"InvalidImageName": true,
+}
+
+var errKubeNotFound = errors.New("kubernetes object not found")
+
+// kubernetesBackend executes the GEF tasks as Kubernetes Jobs, with a PersistentVolumeClaim
+// for each volume. Kubernetes cannot build images: the image of a service is the one named
+// by the FROM instruction of its Dockerfile, or, for the internal services, a configured one.
+type kubernetesBackend struct {
+	endpoint  string
+	namespace string
+	token     string
+	config    def.KubernetesConfig
+	client    *http.Client
+	tlsConfig *tls.Config // also used by the exec connections, which are not made by the client
+
+	mutex   sync.Mutex
+	outputs map[string]*bytes.Buffer // the console output of the tasks, by Job name
+}
+
+// NewKubernetesBackend creates an execution backend for a connection of type kubernetes
+func NewKubernetesBackend(config def.DockerConfig) (ExecutionBackend, error) {
+	k := &kubernetesBackend{
+		endpoint:  strings.TrimRight(config.Endpoint, "/"),
+		namespace: config.Kubernetes.Namespace,
+		config:    config.Kubernetes,
+		outputs:   make(map[string]*bytes.Buffer),
+	}
+	if k.namespace == "" {
+		k.namespace = kubeDefaultNamespace
+	}
+	if k.config.VolumeSize == "" {
+		k.config.VolumeSize = kubeDefaultVolumeSize
+	}
+	if k.config.HelperImage == "" {
+		k.config.HelperImage = kubeDefaultHelperImage
+	}
+
+	if config.Kubernetes.TokenPath != "" {
+		token, err := ioutil.ReadFile(config.Kubernetes.TokenPath)
+		if err != nil {
+			return nil, def.Err(err, "cannot read the kubernetes token")
+		}
+		k.token = strings.TrimSpace(string(token))
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.CAPath != "" {
+		ca, err := ioutil.ReadFile(config.CAPath)
+		if err != nil {
+			return nil, def.Err(err, "cannot read the kubernetes CA certificate")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, def.Err(nil, "invalid kubernetes CA certificate: %s", config.CAPath)
+		}
+	}
+	if config.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertPath, config.KeyPath)
+		if err != nil {
+			return nil, def.Err(err, "cannot read the kubernetes client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	k.tlsConfig = tlsConfig
+	k.client = &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}}
+	return k, nil
+}
+
+// The subset of the Kubernetes API objects used by the backend
+
+type kubeMeta struct {
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type kubeResources struct {
+	Requests map[string]string `json:"requests,omitempty"`
+	Limits   map[string]string `json:"limits,omitempty"`
+}
+
+type kubeVolumeClaim struct {
+	APIVersion string              `json:"apiVersion"`
+	Kind       string              `json:"kind"`
+	Metadata   kubeMeta            `json:"metadata"`
+	Spec       kubeVolumeClaimSpec `json:"spec"`
+}
+
+type kubeVolumeClaimSpec struct {
+	AccessModes      []string      `json:"accessModes"`
+	StorageClassName string        `json:"storageClassName,omitempty"`
+	Resources        kubeResources `json:"resources"`
+}
+
+type kubeVolumeClaimList struct {
+	Items []kubeVolumeClaim `json:"items"`
+}
+
+type kubeJobList struct {
+	Items []kubeJob `json:"items"`
+}
+
+type kubeJob struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   kubeMeta      `json:"metadata"`
+	Spec       kubeJobSpec   `json:"spec"`
+	Status     kubeJobStatus `json:"status"`
+}
+
+type kubeJobSpec struct {
+	BackoffLimit          int             `json:"backoffLimit"`
+	ActiveDeadlineSeconds int64           `json:"activeDeadlineSeconds,omitempty"`
+	Template              kubePodTemplate `json:"template"`
+}
+
+type kubeJobStatus struct {
+	Active     int                `json:"active"`
+	Succeeded  int                `json:"succeeded"`
+	Failed     int                `json:"failed"`
+	Conditions []kubeJobCondition `json:"conditions"`
+}
+
+type kubeJobCondition struct {
+	Type    string `json:"type"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+type kubePodTemplate struct {
+	Metadata kubeMeta    `json:"metadata"`
+	Spec     kubePodSpec `json:"spec"`
+}
+
+type kubePodSpec struct {
+	RestartPolicy string          `json:"restartPolicy"`
+	Containers    []kubeContainer `json:"containers"`
+	Volumes       []kubeVolume    `json:"volumes,omitempty"`
+}
+
+type kubeContainer struct {
+	Name         string            `json:"name"`
+	Image        string            `json:"image"`
+	Command      []string          `json:"command,omitempty"`
+	Args         []string          `json:"args,omitempty"`
+	VolumeMounts []kubeVolumeMount `json:"volumeMounts,omitempty"`
+	Resources    kubeResources     `json:"resources"`
+}
+
+type kubeVolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+type kubeVolume struct {
+	Name                  string             `json:"name"`
+	PersistentVolumeClaim kubeVolumeClaimRef `json:"persistentVolumeClaim"`
+}
+
+type kubeVolumeClaimRef struct {
+	ClaimName string `json:"claimName"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+type kubePodList struct {
+	Items []kubePod `json:"items"`
+}
+
+type kubePod struct {
+	Metadata kubeMeta      `json:"metadata"`
+	Status   kubePodStatus `json:"status"`
+}
+
+type kubePodStatus struct {
+	Phase             string                `json:"phase"`
+	ContainerStatuses []kubeContainerStatus `json:"containerStatuses"`
+}
+
+type kubeContainerStatus struct {
+	State struct {
+		Waiting *struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"waiting"`
+		Terminated *struct {
+			ExitCode int    `json:"exitCode"`
+			Reason   string `json:"reason"`
+		} `json:"terminated"`
+	} `json:"state"`
+}
+
+type kubeStatus struct {
+	Message string `json:"message"`
+}
+
+// request sends a request to the API server; the responses with an error status are turned into errors
+func (k *kubernetesBackend) request(ctx context.Context, method string, apiPath string, in interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, def.Err(err, "cannot serialize kubernetes request")
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, k.endpoint+apiPath, body)
+	if err != nil {
+		return nil, def.Err(err, "cannot create kubernetes request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errKubeNotFound
+		}
+		var status kubeStatus
+		json.NewDecoder(resp.Body).Decode(&status)
+		return nil, fmt.Errorf("kubernetes %s %s failed: %s %s", method, apiPath, resp.Status, status.Message)
+	}
+	return resp, nil
+}
+
+// do sends a request to the API server and decodes the response into out, if not nil
+func (k *kubernetesBackend) do(method string, apiPath string, in interface{}, out interface{}) error {
+	resp, err := k.request(context.Background(), method, apiPath, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return def.Err(err, "cannot read kubernetes response")
+	}
+	return nil
+}
+
+func (k *kubernetesBackend) apiPath(group string, resource string, name string) string {
+	p := fmt.Sprintf("/api/v1/namespaces/%s/%s", k.namespace, resource)
+	if group != "" {
+		p = fmt.Sprintf("/apis/%s/namespaces/%s/%s", group, k.namespace, resource)
+	}
+	if name != "" {
+		p += "/" + name
+	}
+	return p
+}
+
+// BuildImage cannot build an image: it reads the Dockerfile, which must only refer to a published
+// image, unless a published image is configured for the folder, as for the internal services
+func (k *kubernetesBackend) BuildImage(dirPath string) (Image, error) {
+	dockerfile, err := ReadDockerfile(dirPath)
+	if err != nil {
+		return Image{}, err
+	}
+	imageName, configured := k.config.Images[filepath.Base(dirPath)]
+	if !configured {
+		if len(dockerfile.Instructions) > 0 {
+			return Image{}, def.Err(nil, "Kubernetes connections cannot build images: the Dockerfile can only "+
+				"refer to a published image (FROM) and set labels and CMD, found %s", strings.Join(dockerfile.Instructions, ", "))
+		}
+		imageName = dockerfile.From
+	}
+	if imageName == "" {
+		return Image{}, def.Err(nil, "no image specified by the Dockerfile")
+	}
+	return Image{
+		ID:      imageName,
+		RepoTag: imageName,
+		Labels:  dockerfile.Labels,
+		Created: time.Now(),
+		Cmd:     dockerfile.Cmd,
+	}, nil
+}
+
+// ImportImage is not supported, the images must be published in a registry
+func (k *kubernetesBackend) ImportImage(tarFilePath string) (Image, error) {
+	return Image{}, def.Err(nil, "Kubernetes connections cannot import image archives, "+
+		"publish the image in a registry and build a service from a Dockerfile referring to it")
+}
+
+// TagImage does nothing, the images are referred to by their published name
+func (k *kubernetesBackend) TagImage(id string, repo string, tag string) error {
+	return nil
+}
+
+// NewVolume creates a PersistentVolumeClaim
+func (k *kubernetesBackend) NewVolume() (db.VolumeID, error) {
+	claim := kubeVolumeClaim{
+		APIVersion: "v1",
+		Kind:       "PersistentVolumeClaim",
+		Metadata:   kubeMeta{Name: "gef-" + uuid.New(), Labels: map[string]string{kubeVolumeLabel: "true"}},
+		Spec: kubeVolumeClaimSpec{
+			AccessModes:      []string{"ReadWriteOnce"},
+			StorageClassName: k.config.StorageClass,
+			Resources:        kubeResources{Requests: map[string]string{"storage": k.config.VolumeSize}},
+		},
+	}
+	err := k.do("POST", k.apiPath("", "persistentvolumeclaims", ""), claim, nil)
+	if err != nil {
+		return "", def.Err(err, "cannot create a PersistentVolumeClaim")
+	}
+	return db.VolumeID(claim.Metadata.Name), nil
+}
+
+// RemoveVolume deletes a PersistentVolumeClaim; Kubernetes postpones the
+// removal of the claims still mounted by a pod
+func (k *kubernetesBackend) RemoveVolume(id db.VolumeID) error {
+	err := k.do("DELETE", k.apiPath("", "persistentvolumeclaims", string(id)), nil, nil)
+	if err == errKubeNotFound {
+		return ErrNoSuchVolume
+	}
+	return err
+}
+
+// ListVolumes lists the PersistentVolumeClaims created by NewVolume
+func (k *kubernetesBackend) ListVolumes() ([]db.VolumeID, error) {
+	var claims kubeVolumeClaimList
+	query := "?labelSelector=" + url.QueryEscape(kubeVolumeLabel)
+	err := k.do("GET", k.apiPath("", "persistentvolumeclaims", "")+query, nil, &claims)
+	if err != nil {
+		return nil, err
+	}
+	var ids []db.VolumeID
+	for _, claim := range claims.Items {
+		ids = append(ids, db.VolumeID(claim.Metadata.Name))
+	}
+	return ids, nil
+}
+
+// ListStoppedTasks lists the Jobs of the tasks which have succeeded or failed
+func (k *kubernetesBackend) ListStoppedTasks() ([]TaskRef, error) {
+	var jobs kubeJobList
+	query := "?labelSelector=" + url.QueryEscape(kubeTaskLabel)
+	err := k.do("GET", k.apiPath("batch/v1", "jobs", "")+query, nil, &jobs)
+	if err != nil {
+		return nil, err
+	}
+	var tasks []TaskRef
+	for _, job := range jobs.Items {
+		if job.Status.Succeeded > 0 || job.Status.Failed > 0 {
+			tasks = append(tasks, TaskRef{ContainerID: job.Metadata.Name})
+		}
+	}
+	return tasks, nil
+}
+
+// newJob describes a Job running a single container with the given volumes
+func (k *kubernetesBackend) newJob(image string, command []string, args []string, binds []VolumeBind) kubeJob {
+	name := "gef-" + uuid.New()
+	container := kubeContainer{
+		Name:    "task",
+		Image:   image,
+		Command: command,
+		Args:    args,
+	}
+	var volumes []kubeVolume
+	for i, bind := range binds {
+		volumeName := fmt.Sprintf("volume%d", i)
+		volumes = append(volumes, kubeVolume{
+			Name:                  volumeName,
+			PersistentVolumeClaim: kubeVolumeClaimRef{ClaimName: string(bind.VolumeID), ReadOnly: bind.ReadOnly},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, kubeVolumeMount{
+			Name:      volumeName,
+			MountPath: bind.MountPoint,
+			ReadOnly:  bind.ReadOnly,
+		})
+	}
+
+	labels := map[string]string{kubeTaskLabel: name}
+	return kubeJob{
+		APIVersion: "batch/v1",
+		Kind:       "Job",
+		Metadata:   kubeMeta{Name: name, Labels: labels},
+		Spec: kubeJobSpec{
+			BackoffLimit: 0, // a failed task is not restarted
+			Template: kubePodTemplate{
+				Metadata: kubeMeta{Labels: labels},
+				Spec: kubePodSpec{
+					RestartPolicy: "Never",
+					Containers:    []kubeContainer{container},
+					Volumes:       volumes,
+				},
+			},
+		},
+	}
+}
+
+// kubeResourceLimits translates the docker limits: the CPU quota becomes a CPU limit,
+// the CPU shares a CPU request (1024 shares being a CPU)
+func kubeResourceLimits(limits def.LimitConfig) kubeResources {
+	resources := kubeResources{Requests: map[string]string{}, Limits: map[string]string{}}
+	cpuLimit := int64(0)
+	if limits.CPUQuota > 0 && limits.CPUPeriod > 0 {
+		cpuLimit = limits.CPUQuota * 1000 / limits.CPUPeriod
+		resources.Limits["cpu"] = fmt.Sprintf("%dm", cpuLimit)
+	}
+	if limits.CPUShares > 0 {
+		cpuRequest := limits.CPUShares * 1000 / 1024
+		if cpuLimit > 0 && cpuRequest > cpuLimit {
+			cpuRequest = cpuLimit
+		}
+		resources.Requests["cpu"] = fmt.Sprintf("%dm", cpuRequest)
+	}
+	if limits.Memory > 0 {
+		resources.Limits["memory"] = fmt.Sprintf("%d", limits.Memory)
+	}
+	return resources
+}
+
+func (k *kubernetesBackend) startJob(job kubeJob) (TaskRef, *bytes.Buffer, error) {
+	err := k.do("POST", k.apiPath("batch/v1", "jobs", ""), job, nil)
+	if err != nil {
+		return TaskRef{}, nil, def.Err(err, "cannot create a Kubernetes Job")
+	}
+	output := &bytes.Buffer{}
+	k.mutex.Lock()
+	k.outputs[job.Metadata.Name] = output
+	k.mutex.Unlock()
+	return TaskRef{ContainerID: job.Metadata.Name}, output, nil
+}
+
+// StartTask creates a Job running the image; the command replaces the CMD of the image
+func (k *kubernetesBackend) StartTask(imageID string, repoTag string, cmd []string, binds []VolumeBind, limits def.LimitConfig, timeouts def.TimeoutConfig) (TaskRef, *bytes.Buffer, error) {
+	job := k.newJob(imageID, nil, cmd, binds)
+	job.Spec.Template.Spec.Containers[0].Resources = kubeResourceLimits(limits)
+	if timeouts.JobExecution > 0 {
+		job.Spec.ActiveDeadlineSeconds = int64(timeouts.JobExecution)
+	}
+	return k.startJob(job)
+}
+
+// taskPod returns the pod of the Job of a task
+func (k *kubernetesBackend) taskPod(task TaskRef) (kubePod, error) {
+	var pods kubePodList
+	query := "?labelSelector=" + url.QueryEscape(kubeTaskLabel+"="+task.ContainerID)
+	err := k.do("GET", k.apiPath("", "pods", "")+query, nil, &pods)
+	if err != nil {
+		return kubePod{}, err
+	}
+	if len(pods.Items) == 0 {
+		return kubePod{}, errKubeNotFound
+	}
+	return pods.Items[0], nil
+}
+
+// WaitTask waits for the Job of a task to end and stores the console output of its pod
+func (k *kubernetesBackend) WaitTask(task TaskRef) (int, error) {
+	var job kubeJob
+	for {
+		err := k.do("GET", k.apiPath("batch/v1", "jobs", task.ContainerID), nil, &job)
+		if err == errKubeNotFound {
+			return 0, def.Err(nil, "the Kubernetes Job %s has been removed", task.ContainerID)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if job.Status.Succeeded > 0 || job.Status.Failed > 0 {
+			break
+		}
+
+		pod, err := k.taskPod(task)
+		if err == nil && len(pod.Status.ContainerStatuses) > 0 {
+			waiting := pod.Status.ContainerStatuses[0].State.Waiting
+			if waiting != nil && kubeImagePullErrors[waiting.Reason] {
+				return 0, def.Err(nil, "cannot pull the image: %s %s", waiting.Reason, waiting.Message)
+			}
+		}
+		time.Sleep(KubernetesPollInterval)
+	}
+
+	k.mutex.Lock()
+	output, found := k.outputs[task.ContainerID]
+	k.mutex.Unlock()
+	if found && output.Len() == 0 {
+		err := k.TaskLogs(context.Background(), task, false, output)
+		if err != nil {
+			log.Println("cannot read the output of Kubernetes Job ", task.ContainerID, ": ", err)
+		}
+	}
+
+	pod, err := k.taskPod(task)
+	if err == nil && len(pod.Status.ContainerStatuses) > 0 {
+		if terminated := pod.Status.ContainerStatuses[0].State.Terminated; terminated != nil {
+			return terminated.ExitCode, nil
+		}
+	}
+	if job.Status.Succeeded > 0 {
+		return 0, nil
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == "Failed" {
+			return 0, def.Err(nil, "the Kubernetes Job failed: %s %s", condition.Reason, condition.Message)
+		}
+	}
+	return 0, def.Err(nil, "the Kubernetes Job failed")
+}
+
+// TerminateTask deletes the Job of a task, with its pod
+func (k *kubernetesBackend) TerminateTask(task TaskRef) error {
+	k.mutex.Lock()
+	delete(k.outputs, task.ContainerID)
+	k.mutex.Unlock()
+
+	deleteOptions := map[string]string{
+		"kind":              "DeleteOptions",
+		"apiVersion":        "v1",
+		"propagationPolicy": "Background",
+	}
+	err := k.do("DELETE", k.apiPath("batch/v1", "jobs", task.ContainerID), deleteOptions, nil)
+	if err == errKubeNotFound {
+		return nil
+	}
+	return err
+}
+
+// TaskLogs writes the log of the pod of a task
+func (k *kubernetesBackend) TaskLogs(ctx context.Context, task TaskRef, follow bool, w io.Writer) error {
+	pod, err := k.taskPod(task)
+	if err != nil {
+		return def.Err(err, "cannot find the pod of Kubernetes Job %s", task.ContainerID)
+	}
+	logPath := k.apiPath("", "pods", pod.Metadata.Name) + "/log"
+	if follow {
+		logPath += "?follow=true"
+	}
+	resp, err := k.request(ctx, "GET", logPath, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// taskJob returns the container and the volumes of the Job of a task
+func (k *kubernetesBackend) taskJob(task TaskRef) (kubeContainer, []VolumeBind, error) {
+	var job kubeJob
+	err := k.do("GET", k.apiPath("batch/v1", "jobs", task.ContainerID), nil, &job)
+	if err != nil {
+		return kubeContainer{}, nil, def.Err(err, "cannot get Kubernetes Job %s", task.ContainerID)
+	}
+	if len(job.Spec.Template.Spec.Containers) == 0 {
+		return kubeContainer{}, nil, def.Err(nil, "Kubernetes Job %s has no container", task.ContainerID)
+	}
+	container := job.Spec.Template.Spec.Containers[0]
+
+	claims := make(map[string]kubeVolumeClaimRef)
+	for _, v := range job.Spec.Template.Spec.Volumes {
+		claims[v.Name] = v.PersistentVolumeClaim
+	}
+	var binds []VolumeBind
+	for _, m := range container.VolumeMounts {
+		binds = append(binds, VolumeBind{
+			VolumeID:   db.VolumeID(claims[m.Name].ClaimName),
+			MountPoint: m.MountPath,
+			ReadOnly:   m.ReadOnly,
+		})
+	}
+	return container, binds, nil
+}
+
+// kubeInVolumes tells if a path is inside one of the mounted volumes
+func kubeInVolumes(filePath string, binds []VolumeBind, writable bool) bool {
+	for _, bind := range binds {
+		mountPoint := path.Clean(bind.MountPoint)
+		if filePath == mountPoint || strings.HasPrefix(filePath, mountPoint+"/") {
+			if !writable || !bind.ReadOnly {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startHelper starts a helper Job mounting some volumes, which stays idle so that files can be
+// copied through the pods/exec subresource, and waits for its pod to run. If a command is
+// given, it is run first, and kubeHelperReady is only created once it has ended
+func (k *kubernetesBackend) startHelper(image string, command []string, binds []VolumeBind) (TaskRef, kubePod, error) {
+	script := fmt.Sprintf("touch %s && exec sleep %d", kubeHelperReady, kubeHelperLifetime)
+	cmd := []string{"sh", "-c", script}
+	if len(command) > 0 {
+		cmd = append([]string{"sh", "-c", `"$@" >/dev/null 2>&1; ` + script, "sh"}, command...)
+	}
+	job := k.newJob(image, cmd, nil, binds)
+	job.Spec.ActiveDeadlineSeconds = kubeHelperLifetime
+	task, _, err := k.startJob(job)
+	if err != nil {
+		return task, kubePod{}, err
+	}
+
+	for {
+		pod, err := k.taskPod(task)
+		if err == nil {
+			if pod.Status.Phase == "Running" {
+				return task, pod, nil
+			}
+			if pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+				err = def.Err(nil, "the Kubernetes helper Job %s has ended", task.ContainerID)
+			} else if len(pod.Status.ContainerStatuses) > 0 {
+				waiting := pod.Status.ContainerStatuses[0].State.Waiting
+				if waiting != nil && kubeImagePullErrors[waiting.Reason] {
+					err = def.Err(nil, "cannot pull the image: %s %s", waiting.Reason, waiting.Message)
+				}
+			}
+		} else if err == errKubeNotFound {
+			err = nil // the pod is not created yet
+		}
+		if err != nil {
+			k.removeHelper(task)
+			return task, kubePod{}, err
+		}
+		time.Sleep(KubernetesPollInterval)
+	}
+}
+
+// removeHelper removes a helper Job, with its pod
+func (k *kubernetesBackend) removeHelper(task TaskRef) {
+	err := k.TerminateTask(task)
+	if err != nil {
+		log.Println("cannot remove Kubernetes Job ", task.ContainerID, ": ", err)
+	}
+}
+
+// CopyFromTask returns a tar stream with a file or folder of a task; relative paths are
+// resolved in the /root folder. The pods of the tasks have ended, so tar is run through the
+// pods/exec subresource in a helper pod mounting the same volumes; the files outside the
+// volumes are recreated first by running the command of the task again, as the GEF internal
+// services writing such files (file lists, copies out of a volume) are idempotent. The stream
+// is spooled into an unlinked temporary file, so that the helper is removed as soon as the
+// copy ends, whether or not the caller reads the whole stream.
+func (k *kubernetesBackend) CopyFromTask(task TaskRef, filePath string) (io.Reader, error) {
+	if !path.IsAbs(filePath) {
+		filePath = path.Join(kubeWorkDir, filePath)
+	}
+	filePath = path.Clean(filePath)
+	container, binds, err := k.taskJob(task)
+	if err != nil {
+		return nil, err
+	}
+
+	image, command := k.config.HelperImage, []string(nil)
+	if !kubeInVolumes(filePath, binds, false) {
+		image, command = container.Image, container.Args
+	}
+	helper, pod, err := k.startHelper(image, command, binds)
+	if err != nil {
+		return nil, def.Err(err, "cannot copy %s from Kubernetes Job %s", filePath, task.ContainerID)
+	}
+	defer k.removeHelper(helper)
+
+	spool, err := ioutil.TempFile("", "gef_kube_copy")
+	if err != nil {
+		return nil, def.Err(err, "cannot create a temporary file")
+	}
+	os.Remove(spool.Name())
+	script := fmt.Sprintf(`until [ -e %s ]; do sleep 1; done; tar -cf - -C "$1" "$2"`, kubeHelperReady)
+	err = k.exec(pod.Metadata.Name, []string{"sh", "-c", script, "sh", path.Dir(filePath), path.Base(filePath)}, nil, spool)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		return nil, def.Err(err, "cannot copy %s from Kubernetes Job %s", filePath, task.ContainerID)
+	}
+	return spool, nil
+}
+
+// CopyToTask copies a local file into a writable volume of a task; the file is streamed
+// through the pods/exec subresource to a helper pod mounting the volumes of the task
+func (k *kubernetesBackend) CopyToTask(task TaskRef, srcPath string, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dstFile := path.Join(dstPath, filepath.Base(srcPath))
+	_, binds, err := k.taskJob(task)
+	if err != nil {
+		return err
+	}
+	if !kubeInVolumes(dstFile, binds, true) {
+		return def.Err(nil, "Kubernetes connections can only copy files into the writable volumes of a task: %s", dstFile)
+	}
+
+	helper, pod, err := k.startHelper(k.config.HelperImage, nil, binds)
+	if err != nil {
+		return def.Err(err, "cannot copy %s into Kubernetes Job %s", srcPath, task.ContainerID)
+	}
+	defer k.removeHelper(helper)
+
+	// the end of stdin cannot be signalled, so head stops after the size of the file
+	command := []string{"sh", "-c", `head -c "$1" > "$2"`, "sh", strconv.FormatInt(info.Size(), 10), dstFile}
+	err = k.exec(pod.Metadata.Name, command, src, ioutil.Discard)
+	if err != nil {
+		return def.Err(err, "cannot copy %s into Kubernetes Job %s", srcPath, task.ContainerID)
+	}
+	return nil
+}
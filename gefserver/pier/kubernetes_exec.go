@@ -0,0 +1,285 @@
+package pier
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// kubeExecProtocol is the WebSocket subprotocol of the pods/exec subresource: the first
+// byte of each message is the stream it belongs to
+const kubeExecProtocol = "v4.channel.k8s.io"
+
+// The streams of kubeExecProtocol
+const (
+	kubeStreamStdin  = 0
+	kubeStreamStdout = 1
+	kubeStreamStderr = 2
+	kubeStreamStatus = 3 // the exit status of the command, as a JSON Status object
+)
+
+// The WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// wsAcceptGUID is appended to the key of a WebSocket handshake to compute the accept header
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// kubeExecMaxFrame bounds the size of the frames read from the API server
+const kubeExecMaxFrame = 16 << 20
+
+// kubeExecMaxStderr bounds how much of the error output of a command is reported
+const kubeExecMaxStderr = 4096
+
+// kubeExecConn is a WebSocket connection to the pods/exec subresource
+type kubeExecConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex // serializes the writes
+}
+
+// exec runs a command in the container of a running pod, streaming stdin (if not nil) to
+// the command and its output to stdout; it fails if the command exits with a non-zero code.
+// The protocol cannot signal the end of stdin: the command must stop reading by itself
+func (k *kubernetesBackend) exec(podName string, command []string, stdin io.Reader, stdout io.Writer) error {
+	query := url.Values{"container": {"task"}, "stdout": {"true"}, "stderr": {"true"}, "command": command}
+	if stdin != nil {
+		query.Set("stdin", "true")
+	}
+	conn, err := k.dialExec(k.apiPath("", "pods", podName) + "/exec?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer conn.conn.Close()
+
+	if stdin != nil {
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := stdin.Read(buf)
+				if n > 0 {
+					if conn.writeFrame(wsBinary, append([]byte{kubeStreamStdin}, buf[:n]...)) != nil {
+						return
+					}
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	var stderr, status bytes.Buffer
+	stream := byte(kubeStreamStdout)
+	for done := false; !done; {
+		opcode, payload, err := conn.readFrame()
+		if err == io.EOF && status.Len() > 0 {
+			break // closed without a close frame, once the command has ended
+		}
+		if err != nil {
+			return def.Err(err, "cannot read the kubernetes exec stream")
+		}
+		switch opcode {
+		case wsClose:
+			conn.writeFrame(wsClose, nil)
+			done = true
+		case wsPing:
+			conn.writeFrame(wsPong, payload)
+		case wsText, wsBinary, wsContinuation:
+			if opcode != wsContinuation {
+				if len(payload) == 0 {
+					continue
+				}
+				stream, payload = payload[0], payload[1:]
+			}
+			switch stream {
+			case kubeStreamStdout:
+				if _, err := stdout.Write(payload); err != nil {
+					return def.Err(err, "cannot write the output of the kubernetes exec command")
+				}
+			case kubeStreamStderr:
+				if room := kubeExecMaxStderr - stderr.Len(); room > 0 {
+					if len(payload) > room {
+						payload = payload[:room]
+					}
+					stderr.Write(payload)
+				}
+			case kubeStreamStatus:
+				status.Write(payload)
+			}
+		}
+	}
+
+	var result struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}
+	if status.Len() == 0 {
+		return def.Err(nil, "the kubernetes exec stream ended without the status of the command")
+	}
+	if err := json.Unmarshal(status.Bytes(), &result); err != nil {
+		return def.Err(err, "cannot read the status of the kubernetes exec command")
+	}
+	if result.Status != "Success" {
+		return def.Err(nil, "kubernetes exec command failed: %s %s", result.Message, stderr.String())
+	}
+	return nil
+}
+
+// dialExec opens a WebSocket connection to the pods/exec subresource; the connection is not
+// made by the http client of the backend, which cannot keep a connection once upgraded
+func (k *kubernetesBackend) dialExec(apiPath string) (*kubeExecConn, error) {
+	u, err := url.Parse(k.endpoint + apiPath)
+	if err != nil {
+		return nil, def.Err(err, "bad kubernetes exec URL")
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+	var conn net.Conn
+	if u.Scheme == "https" {
+		conn, err = tls.Dial("tcp", host, k.tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, def.Err(err, "cannot connect to the kubernetes API server")
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		conn.Close()
+		return nil, def.Err(err, "cannot create kubernetes exec request")
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Protocol", kubeExecProtocol)
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, def.Err(err, "cannot send kubernetes exec request")
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, def.Err(err, "cannot read kubernetes exec response")
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer conn.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, kubeExecMaxStderr))
+		var status kubeStatus
+		json.Unmarshal(body, &status)
+		return nil, def.Err(nil, "kubernetes exec failed: %s %s", resp.Status, status.Message)
+	}
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) ||
+		resp.Header.Get("Sec-WebSocket-Protocol") != kubeExecProtocol {
+		conn.Close()
+		return nil, def.Err(nil, "the kubernetes API server does not support the %s exec protocol", kubeExecProtocol)
+	}
+	return &kubeExecConn{conn: conn, reader: reader}, nil
+}
+
+// writeFrame sends a single frame; the frames of the clients are masked
+func (c *kubeExecConn) writeFrame(opcode byte, payload []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	default:
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(n))
+		frame = append(append(frame, 0x80|127), size[:]...)
+	}
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// readFrame reads a frame, which a server may have masked although it should not
+func (c *kubeExecConn) readFrame() (opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode = header[0] & 0x0F
+	size := uint64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > kubeExecMaxFrame {
+		return 0, nil, def.Err(nil, "kubernetes exec frame too large: %d bytes", size)
+	}
+	var mask [4]byte
+	masked := header[1]&0x80 != 0
+	if masked {
+		if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
@@ -0,0 +1,140 @@
+package pier
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// logPollInterval is how often a followed job is checked for new tasks
+const logPollInterval = time.Second
+
+// LogPosition identifies a point in the console output of a job:
+// the index of a task and a byte offset in the output of that task
+type LogPosition struct {
+	Task   int
+	Offset int
+}
+
+// LogStream receives the console output of the tasks of a job
+type LogStream interface {
+	// Output receives a chunk of the output of a task; next is the position following the chunk
+	Output(task db.Task, chunk []byte, next LogPosition) error
+}
+
+// StreamJobLogs sends the console output of the tasks of a job, starting from a position.
+// When following, the output of the running task is streamed while it is produced, and
+// the function returns only when the job ends, the context is cancelled or the stream fails.
+func (p *Pier) StreamJobLogs(ctx context.Context, jobID db.JobID, from LogPosition, follow bool, stream LogStream) (db.Job, error) {
+	pos := from
+	for {
+		job, err := p.db.GetJob(jobID)
+		if err != nil {
+			return job, err
+		}
+
+		for ; pos.Task < len(job.Tasks); pos = (LogPosition{Task: pos.Task + 1}) {
+			task := job.Tasks[pos.Task]
+			if task.ExitCode == db.TaskRunningExitCode && job.State.Code == -1 {
+				pos, err = p.streamRunningTask(ctx, job, pos, follow, stream)
+				if err != nil {
+					return job, err
+				}
+				break // the task is done when its result is stored
+			}
+
+			w := newLogWriter(stream, task, pos)
+			w.Write([]byte(task.ConsoleOutput))
+			if w.err != nil {
+				return job, w.err
+			}
+		}
+
+		if !follow || job.State.Code != -1 {
+			return job, nil
+		}
+		select {
+		case <-ctx.Done():
+			return job, ctx.Err()
+		case <-time.After(logPollInterval):
+		}
+	}
+}
+
+// streamRunningTask sends the output of a running task taken from the execution backend;
+// if the container is already gone, the output will be found in the task result
+func (p *Pier) streamRunningTask(ctx context.Context, job db.Job, pos LogPosition, follow bool, stream LogStream) (LogPosition, error) {
+	task := job.Tasks[pos.Task]
+	if task.ContainerID == "" {
+		return pos, nil
+	}
+	docker, found := p.docker[job.ConnectionID]
+	if !found {
+		return pos, def.Err(nil, "Cannot find docker connection")
+	}
+
+	w := newLogWriter(stream, task, pos)
+	err := docker.backend.TaskLogs(ctx, TaskRef{ContainerID: string(task.ContainerID), ServiceID: task.SwarmServiceID}, follow, w)
+	if w.err != nil {
+		return w.next(), w.err
+	}
+	if ctx.Err() != nil {
+		return w.next(), ctx.Err()
+	}
+	if err != nil {
+		log.Println(err)
+	}
+	return w.next(), nil
+}
+
+// logWriter forwards the output of a task to a LogStream,
+// skipping the part already sent before the starting position
+type logWriter struct {
+	stream LogStream
+	task   db.Task
+	skip   int
+	pos    LogPosition
+	err    error // the error of the stream, as opposed to the errors of the output source
+}
+
+func newLogWriter(stream LogStream, task db.Task, from LogPosition) *logWriter {
+	return &logWriter{
+		stream: stream,
+		task:   task,
+		skip:   from.Offset,
+		pos:    LogPosition{Task: from.Task},
+	}
+}
+
+func (w *logWriter) Write(data []byte) (int, error) {
+	n := len(data)
+	if w.pos.Offset < w.skip {
+		k := w.skip - w.pos.Offset
+		if k > len(data) {
+			k = len(data)
+		}
+		w.pos.Offset += k
+		data = data[k:]
+	}
+	if len(data) == 0 {
+		return n, nil
+	}
+
+	w.pos.Offset += len(data)
+	w.err = w.stream.Output(w.task, data, w.pos)
+	if w.err != nil {
+		return 0, w.err
+	}
+	return n, nil
+}
+
+// next returns the position following the output sent so far
+func (w *logWriter) next() LogPosition {
+	if w.pos.Offset < w.skip {
+		return LogPosition{Task: w.pos.Task, Offset: w.skip}
+	}
+	return w.pos
+}
@@ -1,10 +1,14 @@
 package pier
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sync"
 	"time"
 
 	"strconv"
@@ -12,7 +16,6 @@ import (
 
 	"github.com/EUDAT-GEF/GEF/gefserver/db"
 	"github.com/EUDAT-GEF/GEF/gefserver/def"
-	"github.com/EUDAT-GEF/GEF/gefserver/pier/internal/dckr"
 	"github.com/pborman/uuid"
 )
 
@@ -28,40 +31,110 @@ const ServiceImagePrefix = "service_"
 // GefImageTag tag for all images created by the GEF
 const GefImageTag = "gef"
 
+// The subfolders of the TmpDir where the build contexts and the input files sent
+// by the users are kept
+const (
+	BuildsTmpDir = "builds"
+	InputsTmpDir = "inputs"
+)
+
+// errJobStopped is returned instead of starting a task when its job was cancelled or timed out
+var errJobStopped = errors.New("the job was stopped")
+
 var JobTimeOutError = "Job execution timeout exceeded"
 var JobTimeOutAndRemovalError = "Job execution timeout exceeded and container removal failed"
 
-// Pier is a master struct for gef-docker abstractions
+// Pier is a master struct for gef-docker abstractions; the tasks of the jobs
+// are executed by the execution backend of each connection
 type Pier struct {
 	db       *db.Db
 	docker   map[db.ConnectionID]dockerConnection
 	config   def.PierConfig
 	tmpDir   string
 	timeOuts def.TimeoutConfig
+	queue    *jobQueue
+	// inputCache is nil if the input data cache is disabled
+	inputCache *inputCache
+	janitor    janitor
+	// jobLocks serialize the start of the tasks of a job with its cancellation or timeout
+	jobLocks jobLocks
+}
+
+// jobLocks are mutexes by job, which only exist while they are used
+type jobLocks struct {
+	mutex sync.Mutex
+	locks map[db.JobID]*jobLock
+}
+
+type jobLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks the mutex of a job, returning the function unlocking it
+func (l *jobLocks) lock(jobID db.JobID) func() {
+	l.mutex.Lock()
+	if l.locks == nil {
+		l.locks = map[db.JobID]*jobLock{}
+	}
+	jl := l.locks[jobID]
+	if jl == nil {
+		jl = &jobLock{}
+		l.locks[jobID] = jl
+	}
+	jl.users++
+	l.mutex.Unlock()
+
+	jl.Lock()
+	return func() {
+		jl.Unlock()
+		l.mutex.Lock()
+		jl.users--
+		if jl.users == 0 {
+			delete(l.locks, jobID)
+		}
+		l.mutex.Unlock()
+	}
 }
 
 type dockerConnection struct {
-	client              dckr.Client
-	stageIn             internalImage
+	backend             ExecutionBackend
 	fileList            internalImage
 	copyToAndFromVolume internalImage
+	b2shareAccess       internalImage // empty if it could not be built; only needed to publish results
 	// mavenEGI            internalImage
 }
 
 type internalImage struct {
-	id      dckr.ImageID
+	id      string
 	repoTag string
 	cmd     []string
 }
 
 // NewPier creates a new pier with all the needed setup
 func NewPier(database *db.Db, pierConfig def.PierConfig, tmpDir string, timeOuts def.TimeoutConfig) (*Pier, error) {
+	tmpDir, err := def.MakeTmpDir(tmpDir)
+	if err != nil {
+		return nil, def.Err(err, "error creating pier")
+	}
 	pier := Pier{
 		db:       database,
 		docker:   make(map[db.ConnectionID]dockerConnection),
 		config:   pierConfig,
 		tmpDir:   tmpDir,
 		timeOuts: timeOuts,
+		queue:    newJobQueue(),
+	}
+	if pierConfig.InputCacheSize > 0 {
+		folder := pierConfig.InputCacheFolder
+		if folder == "" {
+			folder = filepath.Join(tmpDir, inputCacheTmpDir)
+		}
+		cache, err := newInputCache(database, folder, pierConfig.InputCacheSize)
+		if err != nil {
+			return nil, def.Err(err, "error creating pier")
+		}
+		pier.inputCache = cache
 	}
 	connections, err := database.GetConnections()
 	if err != nil {
@@ -84,6 +157,9 @@ func NewPier(database *db.Db, pierConfig def.PierConfig, tmpDir string, timeOuts
 			return nil, def.Err(nil, "internal error: mismatching connection ids")
 		}
 	}
+	if pierConfig.Retention.Interval > 0 {
+		go pier.startJanitor(pierConfig.Retention.Interval)
+	}
 	log.Println("Pier created")
 	return &pier, nil
 }
@@ -93,19 +169,33 @@ func (p *Pier) GetConnections() (map[db.ConnectionID]def.DockerConfig, error) {
 	return p.db.GetConnections()
 }
 
-// AddDockerConnection instantiates the docker client and sets the pier's docker connection
+// AddDockerConnection instantiates the docker client, or the Kubernetes client for the
+// connections of type kubernetes, and sets the pier's docker connection
 func (p *Pier) AddDockerConnection(userID int64, config def.DockerConfig) (db.ConnectionID, error) {
-	client, err := dckr.NewClient(config)
+	var backend ExecutionBackend
+	var err error
+	switch config.Type {
+	case "", def.DockerConnectionType:
+		backend, err = newDockerBackend(config)
+	case def.KubernetesConnectionType:
+		backend, err = NewKubernetesBackend(config)
+	default:
+		return 0, def.Err(nil, "Unknown connection type: %s", config.Type)
+	}
 	if err != nil {
-		return 0, def.Err(err, "Cannot create docker client for config:", config)
+		return 0, def.Err(err, "Cannot create the client for config: %v", config)
 	}
+	return p.AddConnection(userID, config, backend)
+}
 
+// AddConnection sets up a connection executing the jobs with the given backend
+func (p *Pier) AddConnection(userID int64, config def.DockerConfig, backend ExecutionBackend) (db.ConnectionID, error) {
 	connID, err := p.db.AddConnection(userID, config)
 	if err != nil {
 		return connID, def.Err(err, "DB error while adding docker connection:", config)
 	}
 
-	buildInternalImage := func(docker dckr.Client, name string) (internalImage, error) {
+	buildInternalImage := func(backend ExecutionBackend, name string) (internalImage, error) {
 		log.Print("building internal service: " + name)
 		path := filepath.Join(p.config.InternalServicesFolder, name)
 		abspath, err := filepath.Abs(path)
@@ -113,13 +203,13 @@ func (p *Pier) AddDockerConnection(userID int64, config def.DockerConfig) (db.Co
 		if err != nil {
 			return newImage, def.Err(err, "absolute filepath failed: %s", path)
 		}
-		img, err := docker.BuildImage(abspath)
+		img, err := backend.BuildImage(abspath)
 		if err != nil {
 			return newImage, def.Err(err, "internal image build failed: %s", abspath)
 		}
-		err = docker.TagImage(string(img.ID), InternalImagePrefix+string(img.ID), GefImageTag)
+		err = backend.TagImage(img.ID, InternalImagePrefix+img.ID, GefImageTag)
 		if err != nil {
-			return newImage, def.Err(err, "could not tag internal service: %s", string(img.ID))
+			return newImage, def.Err(err, "could not tag internal service: %s", img.ID)
 		}
 		newImage.id = img.ID
 		newImage.cmd = img.Cmd
@@ -127,17 +217,19 @@ func (p *Pier) AddDockerConnection(userID int64, config def.DockerConfig) (db.Co
 		return newImage, nil
 	}
 
-	stageInImage, err := buildInternalImage(client, "volume-stage-in")
+	fileListImage, err := buildInternalImage(backend, "volume-filelist")
 	if err != nil {
 		return connID, err
 	}
-	fileListImage, err := buildInternalImage(client, "volume-filelist")
+	copyToAndFromVolumeImage, err := buildInternalImage(backend, "copy-to-and-from-volume")
 	if err != nil {
 		return connID, err
 	}
-	copyToAndFromVolumeImage, err := buildInternalImage(client, "copy-to-and-from-volume")
+
+	// publishing to B2SHARE is optional, the connection works without it
+	b2shareAccessImage, err := buildInternalImage(backend, "B2SHARE_access_image")
 	if err != nil {
-		return connID, err
+		log.Println("publishing to B2SHARE is disabled:", err)
 	}
 
 	// mavenEGIImage, err := buildInternalImage(client, "maven-EGI")
@@ -145,13 +237,22 @@ func (p *Pier) AddDockerConnection(userID int64, config def.DockerConfig) (db.Co
 	// 	return connID, err
 	// }
 
+	_, known := p.docker[connID]
 	p.docker[connID] = dockerConnection{
-		client,
-		stageInImage,
+		backend,
 		fileListImage,
 		copyToAndFromVolumeImage,
+		b2shareAccessImage,
 		// mavenEGIImage,
 	}
+	if !known {
+		// the jobs left unfinished on this connection by a previous run of the server
+		err = p.reconcileJobs(connID)
+		if err != nil {
+			return connID, def.Err(err, "error reconciling unfinished jobs")
+		}
+	}
+	p.startWorkers(connID)
 	return connID, nil
 }
 
@@ -161,7 +262,11 @@ func (p *Pier) InitiateSwarmMode(connectionID db.ConnectionID, listenAddr string
 	if !found {
 		return "", def.Err(nil, "Cannot find docker connection")
 	}
-	return docker.client.InitiateSwarmMode(listenAddr, advertiseAddr)
+	swarm, ok := docker.backend.(SwarmBackend)
+	if !ok {
+		return "", def.Err(nil, "The execution backend does not support the Swarm Mode")
+	}
+	return swarm.InitiateSwarmMode(listenAddr, advertiseAddr)
 }
 
 // LeaveIfInSwarmMode deactivates the Swarm Mode, if it was on
@@ -170,7 +275,11 @@ func (p *Pier) LeaveIfInSwarmMode(connectionID db.ConnectionID) error {
 	if !found {
 		return def.Err(nil, "Cannot find docker connection")
 	}
-	return docker.client.LeaveIfInSwarmMode()
+	swarm, ok := docker.backend.(SwarmBackend)
+	if !ok {
+		return nil // never in Swarm Mode
+	}
+	return swarm.LeaveIfInSwarmMode()
 }
 
 // BuildService builds a services based on the content of the provided folder
@@ -179,18 +288,18 @@ func (p *Pier) BuildService(connectionID db.ConnectionID, userID int64, buildDir
 	if !found {
 		return db.Service{}, def.Err(nil, "Cannot find docker connection")
 	}
-	image, err := docker.client.BuildImage(buildDir)
+	image, err := docker.backend.BuildImage(buildDir)
 	if err != nil {
 		return db.Service{}, def.Err(err, "docker BuildImage failed")
 	}
 	log.Println("Tagging the image")
-	err = docker.client.TagImage(string(image.ID), ServiceImagePrefix+string(image.ID), GefImageTag)
+	err = docker.backend.TagImage(image.ID, ServiceImagePrefix+image.ID, GefImageTag)
 	if err != nil {
-		return db.Service{}, def.Err(err, "could not tag a service image: %s", string(image.ID))
+		return db.Service{}, def.Err(err, "could not tag a service image: %s", image.ID)
 	}
 
 	service := NewServiceFromImage(connectionID, image)
-	service.RepoTag = ServiceImagePrefix + string(image.ID) + ":" + GefImageTag
+	service.RepoTag = ServiceImagePrefix + image.ID + ":" + GefImageTag
 	err = p.db.AddService(userID, service)
 	if err != nil {
 		return db.Service{}, def.Err(err, "could not add a new service to the database")
@@ -206,6 +315,8 @@ func (p *Pier) startTimeOutTicker(jobId db.JobID, timeOut float64) {
 		return
 	}
 
+	// the time spent waiting in the queue does not count
+	startingTime := time.Now()
 	ticker := time.NewTicker(time.Second * time.Duration(p.timeOuts.CheckInterval))
 	for range ticker.C {
 		job, err := p.db.GetJob(jobId)
@@ -223,30 +334,22 @@ func (p *Pier) startTimeOutTicker(jobId db.JobID, timeOut float64) {
 			break
 		}
 
-		startingTime := job.Created
 		currentTime := time.Now()
 		durationTime := time.Duration(currentTime.Sub(startingTime))
 		if durationTime.Seconds() >= timeOut {
-			err = p.db.SetJobState(job.ID, db.NewJobStateError(JobTimeOutError, 1))
+			ticker.Stop()
+			job, err = p.stopJob(job.ID, db.NewJobStateError(JobTimeOutError, 1))
 			if err != nil {
 				log.Println(err)
-			}
-			ticker.Stop()
-
-			docker, found := p.docker[job.ConnectionID]
-			if !found {
-				log.Println("ERROR: startTimeOutTicker: ConnectionID cannot be found")
-				return
+				break
 			}
 
-			for _, task := range job.Tasks {
-				err = docker.client.TerminateContainerOrSwarmService(string(task.ContainerID), task.SwarmServiceID)
+			err = p.terminateJobTasks(job)
+			if err != nil {
+				log.Println(err)
+				err = p.db.SetJobState(job.ID, db.NewJobStateError(JobTimeOutAndRemovalError, 1))
 				if err != nil {
 					log.Println(err)
-					err = p.db.SetJobState(job.ID, db.NewJobStateError(JobTimeOutAndRemovalError, 1))
-					if err != nil {
-						log.Println(err)
-					}
 				}
 			}
 
@@ -255,34 +358,165 @@ func (p *Pier) startTimeOutTicker(jobId db.JobID, timeOut float64) {
 	}
 }
 
+// terminateJobTasks removes the containers or swarm services of all the tasks of a job
+func (p *Pier) terminateJobTasks(job db.Job) error {
+	docker, found := p.docker[job.ConnectionID]
+	if !found {
+		return def.Err(nil, "Cannot find docker connection")
+	}
+
+	var lastErr error
+	for _, task := range job.Tasks {
+		if task.ContainerID == "" && task.SwarmServiceID == "" {
+			continue // the task has never started
+		}
+		err := docker.backend.TerminateTask(TaskRef{ContainerID: string(task.ContainerID), ServiceID: task.SwarmServiceID})
+		if err != nil {
+			log.Println(err)
+			lastErr = def.Err(err, "Cannot remove a container/swarm service")
+		}
+	}
+	return lastErr
+}
+
+// stopJob sets the final state of a running job and returns the job with all its tasks:
+// once the state is set, executeTask does not start new tasks for the job
+func (p *Pier) stopJob(jobID db.JobID, state db.JobState) (db.Job, error) {
+	unlock := p.jobLocks.lock(jobID)
+	defer unlock()
+	job, err := p.db.GetJob(jobID)
+	if err != nil {
+		return job, def.Err(err, "Cannot get the job")
+	}
+	if job.State.Code != -1 {
+		return job, def.Err(nil, "The job is not running")
+	}
+	err = p.db.SetJobState(jobID, state)
+	if err != nil {
+		return job, def.Err(err, "Cannot set the job state")
+	}
+	return p.db.GetJob(jobID)
+}
+
+// isJobStopped checks if a job has been cancelled or has timed out while its tasks were running
+func (p *Pier) isJobStopped(jobID db.JobID) bool {
+	job, err := p.db.GetJob(jobID)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return job.State.Code >= 0
+}
+
 // RunService exported
-func (p *Pier) RunService(userID int64, id db.ServiceID, inputSrc []string, limits def.LimitConfig, timeouts def.TimeoutConfig) (db.Job, error) {
-	service, err := p.db.GetService(id)
+func (p *Pier) RunService(userID int64, id db.ServiceID, inputSrc []db.JobInput, limits def.LimitConfig, timeouts def.TimeoutConfig) (db.Job, error) {
+	return p.StartJob(userID, db.Job{ServiceID: id}, inputSrc, limits, timeouts)
+}
+
+// RunWorkflow starts a job executing all the services of a workflow in sequence
+func (p *Pier) RunWorkflow(userID int64, id db.WorkflowID, inputSrc []db.JobInput, limits def.LimitConfig, timeouts def.TimeoutConfig) (db.Job, error) {
+	return p.StartJob(userID, db.Job{WorkflowID: id}, inputSrc, limits, timeouts)
+}
+
+// StartJob starts a job executing the workflow of the given job, or else its service; the
+// new job is stored with the name, the description and the labels of the given one before
+// being queued, so that they are not written while the job runs
+func (p *Pier) StartJob(userID int64, job db.Job, inputSrc []db.JobInput, limits def.LimitConfig, timeouts def.TimeoutConfig) (db.Job, error) {
+	steps, err := p.getJobServices(job)
 	if err != nil {
 		return db.Job{}, err
 	}
+	return p.startJob(userID, job, steps, inputSrc, limits, timeouts)
+}
+
+// AddWorkflow checks that a chain of services can be executed and stores it as a new workflow
+func (p *Pier) AddWorkflow(userID int64, workflow db.Workflow) (db.Workflow, error) {
+	if len(workflow.Steps) == 0 {
+		return workflow, def.Err(nil, "a workflow must have at least one service")
+	}
+	workflow.ID = db.WorkflowID(uuid.New())
+	workflow.Created = time.Now()
+
+	steps, err := p.getWorkflowServices(workflow)
+	if err != nil {
+		return workflow, err
+	}
+	workflow.ConnectionID = steps[0].ConnectionID
+
+	for i := 1; i < len(steps); i++ {
+		if steps[i].ConnectionID != workflow.ConnectionID {
+			return workflow, def.Err(nil, "all the services of a workflow must use the same docker connection")
+		}
+	}
+
+	err = p.db.AddWorkflow(userID, workflow)
+	if err != nil {
+		return workflow, def.Err(err, "could not add a new workflow to the database")
+	}
+	return workflow, nil
+}
+
+// getWorkflowServices returns the services of a workflow, in execution order; the outputs
+// of each service must match the inputs of the next one, as the services can be edited
+// after the workflow was added
+func (p *Pier) getWorkflowServices(workflow db.Workflow) ([]db.Service, error) {
+	var steps []db.Service
+	for i, serviceID := range workflow.Steps {
+		service, err := p.db.GetService(serviceID)
+		if err != nil {
+			return nil, def.Err(err, "cannot get workflow service %s", serviceID)
+		}
+		if service.Deleted {
+			return nil, def.Err(nil, "workflow service %s has been removed", serviceID)
+		}
+		if i > 0 && len(steps[i-1].Output) != len(service.Input) {
+			return nil, def.Err(nil, "service %s has %d outputs, but the next service %s expects %d inputs",
+				steps[i-1].ID, len(steps[i-1].Output), service.ID, len(service.Input))
+		}
+		steps = append(steps, service)
+	}
+	return steps, nil
+}
 
-	jobState := db.NewJobStateOk("Created", -1)
-	job := db.Job{
+// startJob adds a new job to the database and to the queue of jobs waiting for execution;
+// the job is refused with a QuotaError if a storage quota of the user is exhausted
+func (p *Pier) startJob(userID int64, metadata db.Job, steps []db.Service, inputSrc []db.JobInput, limits def.LimitConfig, timeouts def.TimeoutConfig) (db.Job, error) {
+	job := newJob(metadata.WorkflowID, steps)
+	job.Name, job.Description, job.Labels = metadata.Name, metadata.Description, metadata.Labels
+	err := p.checkStorageQuota(userID)
+	if err != nil {
+		return job, err
+	}
+	err = p.submitJob(userID, job, inputSrc, limits, timeouts, time.Now())
+	return job, err
+}
+
+// newJob creates a job executing a service or a workflow
+func newJob(workflowID db.WorkflowID, steps []db.Service) db.Job {
+	jobState := db.NewJobStateOk(JobQueuedStatus, -1)
+	return db.Job{
 		ID:           db.JobID(uuid.New()),
-		ConnectionID: service.ConnectionID,
-		ServiceID:    service.ID,
+		ConnectionID: steps[0].ConnectionID,
+		ServiceID:    steps[0].ID,
+		WorkflowID:   workflowID,
+		Attempt:      1,
 		Created:      time.Now(),
 		State:        &jobState,
 	}
+}
 
-	err = p.db.AddJob(userID, job)
+// submitJob adds a job to the database and queues it, to be started not before a given time
+func (p *Pier) submitJob(userID int64, job db.Job, inputSrc []db.JobInput, limits def.LimitConfig, timeouts def.TimeoutConfig, notBefore time.Time) error {
+	err := p.db.AddJob(userID, job)
 	if err != nil {
-		return job, err
+		return err
 	}
 
 	if len(inputSrc) == 0 {
-		return job, def.Err(err, "no input data was provided")
+		return def.Err(err, "no input data was provided")
 	}
 
-	go p.runJob(&job, service, inputSrc, limits, timeouts)
-
-	return job, err
+	return p.enqueueJob(userID, job, inputSrc, limits, timeouts, notBefore)
 }
 
 func (p *Pier) updateJobDurationTime(job db.Job) {
@@ -292,9 +526,13 @@ func (p *Pier) updateJobDurationTime(job db.Job) {
 	}
 }
 
-func (p *Pier) runJob(job *db.Job, service db.Service, inputSrc []string, limits def.LimitConfig, timeouts def.TimeoutConfig) {
+// runJob stages the input data for the first service and executes the services in sequence;
+// the output volumes of each service are mounted as the input volumes of the next one;
+// the webdav inputs are downloaded with the B2DROP credentials of the job owner, userID
+func (p *Pier) runJob(userID int64, job *db.Job, steps []db.Service, inputSrc []db.JobInput, limits def.LimitConfig, timeouts def.TimeoutConfig) {
+	service := steps[0]
 	if len(inputSrc) != len(service.Input) {
-		err := p.db.SetJobState(job.ID, db.NewJobStateError("Input source number mismatch", 1))
+		err := p.setRunningJobState(job.ID, db.NewJobStateError("Input source number mismatch", 1))
 		if err != nil {
 			log.Println(err)
 		}
@@ -302,62 +540,80 @@ func (p *Pier) runJob(job *db.Job, service db.Service, inputSrc []string, limits
 		return
 	}
 
-	err2str := func(err error) string {
-		if err == nil {
-			return ""
-		}
-		p.updateJobDurationTime(*job)
-		return err.Error()
-	}
-
 	docker, found := p.docker[service.ConnectionID]
 	if !found {
 		log.Println("ERROR: runJob: connectionID not found; ", service.ConnectionID, docker)
 		return
 	}
 
+	provenance := newJobProvenance(userID, job.ID, steps, inputSrc, limits, timeouts)
+	p.saveJobProvenance(provenance)
+
 	var err error
-	var inputVolumes []dckr.Volume
+	var inputVolumes []db.VolumeID
+	// the volumes created after CancelJob removed the others must be removed here
+	stopped := func() bool {
+		if !p.isJobStopped(job.ID) {
+			return false
+		}
+		var volumes []db.JobVolume
+		for _, id := range inputVolumes {
+			volumes = append(volumes, db.JobVolume{VolumeID: id})
+		}
+		err := p.waitAndRemoveVolume(service.ConnectionID, volumes)
+		if err != nil {
+			log.Println(err)
+		}
+		return true
+	}
 	{
 		for i := range inputSrc {
-			err = p.db.SetJobState(job.ID, db.NewJobStateOk("Creating a new input volume #"+string(i+1), -1))
+			err = p.setRunningJobState(job.ID, db.NewJobStateOk("Creating a new input volume #"+string(i+1), -1))
 			if err != nil {
 				log.Println(err)
 			}
-			var curInputVolume dckr.Volume
-			curInputVolume, err = docker.client.NewVolume()
+			var curInputVolume db.VolumeID
+			curInputVolume, err = docker.backend.NewVolume()
 			inputVolumes = append(inputVolumes, curInputVolume)
 			if err != nil {
-				err = p.db.SetJobState(job.ID, db.NewJobStateError("Error while creating new input volume #"+string(i+1), 1))
+				err = p.setRunningJobState(job.ID, db.NewJobStateError("Error while creating new input volume #"+string(i+1), 1))
 				if err != nil {
 					log.Println(err)
 				}
 				p.updateJobDurationTime(*job)
 				return
 			}
-			err = p.db.AddJobVolume(job.ID, db.VolumeID(curInputVolume.ID), true, service.Input[i].Name, inputSrc[i])
+			err = p.db.AddJobVolume(job.ID, curInputVolume, true, service.Input[i].Name, inputSrc[i])
 			if err != nil {
 				log.Println(err)
 			}
+			if stopped() {
+				return
+			}
 		}
 	}
 
 	{
-		err = p.db.SetJobState(job.ID, db.NewJobStateOk("Performing data staging", -1))
+		err = p.setRunningJobState(job.ID, db.NewJobStateOk("Performing data staging", -1))
 		if err != nil {
 			log.Println(err)
 		}
 
 		for i := range inputSrc {
-			binds := []dckr.VolBind{
-				dckr.NewVolBind(inputVolumes[i].ID, "/volume", false),
-			}
-
-			if (strings.ToLower(service.Input[i].Type) == "string") && (service.Input[i].FileName != "") {
-				err = p.UploadFileIntoVolume(string(inputVolumes[i].ID), inputSrc[i], service.Input[i].FileName, limits, timeouts)
-
+			port := service.Input[i]
+			portType := inputType(port)
+
+			if inputSrc[i].Source == "" {
+				// an optional input without a value: the volume stays empty
+				continue
+			} else if inputSrc[i].Local {
+				// the values and the uploaded files are copied from the GEF host, whatever the port type
+				err = p.UploadFileIntoVolume(string(inputVolumes[i]), inputSrc[i].Source, port.FileName, limits, timeouts)
+				if stopped() {
+					return
+				}
 				if err != nil {
-					err = p.db.SetJobState(job.ID, db.NewJobStateError("String data staging #"+string(i+1)+" failed", 1))
+					err = p.setRunningJobState(job.ID, db.NewJobStateError(fmt.Sprintf("Data upload #%d failed", i+1), 1))
 					if err != nil {
 
 						log.Println(err)
@@ -365,48 +621,45 @@ func (p *Pier) runJob(job *db.Job, service db.Service, inputSrc []string, limits
 					p.updateJobDurationTime(*job)
 					return
 				}
-			} else if strings.ToLower(service.Input[i].Type) == "url" {
-				containerID, swarmServiceID, exitCode, output, err := docker.client.ExecuteImage(
-					string(docker.stageIn.id),
-					docker.stageIn.repoTag,
-					append(docker.stageIn.cmd, inputSrc[i]),
-					binds,
-					limits,
-					timeouts,
-					true)
-
-				dbErr := p.db.AddJobTask(job.ID, "Data staging #"+string(i+1), string(containerID), swarmServiceID, err2str(err), exitCode, output)
-				if dbErr != nil {
-					log.Println(dbErr)
+			} else if portType == InputTypeWebDAV {
+				err = p.stageInFromWebDAV(userID, job.ID, fmt.Sprintf("Data staging #%d", i+1), inputVolumes[i], inputSrc[i].Source, limits, timeouts)
+				if p.isJobStopped(job.ID) {
+					return
 				}
-
 				if err != nil {
-					err = p.db.SetJobState(job.ID, db.NewJobStateError("URL data staging #"+string(i+1)+" failed", 1))
+					err = p.setRunningJobState(job.ID, db.NewJobStateError(fmt.Sprintf("WebDAV data staging #%d failed", i+1), 1))
 					if err != nil {
 						log.Println(err)
 					}
 					p.updateJobDurationTime(*job)
 					return
 				}
+			} else if portType == InputTypeURL || portType == InputTypePID || portType == InputTypeURLList || portType == InputTypeFile {
+				// the sources of an urllist input are separated by new lines
+				for _, src := range strings.Split(inputSrc[i].Source, "\n") {
+					err = p.stageInFromURL(job.ID, fmt.Sprintf("Data staging #%d", i+1), inputVolumes[i], src, limits, timeouts)
+
+					if p.isJobStopped(job.ID) {
+						return
+					}
 
-				if exitCode != 0 {
-					msg := fmt.Sprintf("Data staging #"+string(i+1)+" failed (exitCode = %v)", exitCode)
-					err = p.db.SetJobState(job.ID, db.NewJobStateOk(msg, 1))
 					if err != nil {
-						log.Println(err)
+						err = p.setRunningJobState(job.ID, db.NewJobStateError(fmt.Sprintf("URL data staging #%d failed: %s", i+1, stageInFailure(err)), 1))
+						if err != nil {
+							log.Println(err)
+						}
+						p.updateJobDurationTime(*job)
+						return
 					}
-					p.updateJobDurationTime(*job)
-					return
-				}
-			} else if service.Input[i].Type == "" {
-				err = p.db.SetJobState(job.ID, db.NewJobStateError("Data staging #"+string(i+1)+" failed: input type not specified", 1))
-				if err != nil {
-					log.Println(err)
 				}
-				p.updateJobDurationTime(*job)
-				return
 			} else {
-				err = p.db.SetJobState(job.ID, db.NewJobStateError("Data staging #"+string(i+1)+" failed: input file name not specified", 1))
+				msg := fmt.Sprintf("Data staging #%d failed: unknown input type %q", i+1, port.Type)
+				if portType == "" {
+					msg = fmt.Sprintf("Data staging #%d failed: input type not specified", i+1)
+				} else if IsValueInput(port) {
+					msg = fmt.Sprintf("Data staging #%d failed: input file name not specified", i+1)
+				}
+				err = p.setRunningJobState(job.ID, db.NewJobStateError(msg, 1))
 				if err != nil {
 					log.Println(err)
 				}
@@ -416,63 +669,95 @@ func (p *Pier) runJob(job *db.Job, service db.Service, inputSrc []string, limits
 		}
 	}
 
-	var outputVolumes []dckr.Volume
-	{
-		for i := range service.Output {
-			err = p.db.SetJobState(job.ID, db.NewJobStateOk("Creating a new output volume #"+string(i+1), -1))
+	go p.startTimeOutTicker(job.ID, p.timeOuts.JobExecution)
+
+	stepInputVolumes := inputVolumes
+	for stepIndex, step := range steps {
+		stepName, taskName := stepNames(steps, stepIndex)
+
+		if p.isJobStopped(job.ID) {
+			return // cancelled between two steps
+		}
+
+		var outputVolumes []db.VolumeID
+		for i := range step.Output {
+			err = p.setRunningJobState(job.ID, db.NewJobStateOk(fmt.Sprintf("Creating a new output volume #%d for %s", i+1, stepName), -1))
 			if err != nil {
 				log.Println(err)
 			}
 
-			var curOutputVolume dckr.Volume
-			curOutputVolume, err = docker.client.NewVolume()
+			var curOutputVolume db.VolumeID
+			curOutputVolume, err = docker.backend.NewVolume()
 			outputVolumes = append(outputVolumes, curOutputVolume)
 			if err != nil {
-				err = p.db.SetJobState(job.ID, db.NewJobStateError("Error while creating new output volume #"+string(i+1), 1))
+				err = p.setRunningJobState(job.ID, db.NewJobStateError(fmt.Sprintf("Error while creating new output volume #%d for %s", i+1, stepName), 1))
 				if err != nil {
 					log.Println(err)
 				}
 				p.updateJobDurationTime(*job)
 				return
 			}
-			err = p.db.AddJobVolume(job.ID, db.VolumeID(curOutputVolume.ID), false, service.Output[i].Name, "")
+			err = p.db.AddJobVolume(job.ID, curOutputVolume, false, step.Output[i].Name, db.JobInput{})
 			if err != nil {
 				log.Println(err)
 			}
 		}
-	}
 
-	{
-		go p.startTimeOutTicker(job.ID, p.timeOuts.JobExecution)
-		err = p.db.SetJobState(job.ID, db.NewJobStateOk("Executing the service", -1))
+		err = p.setRunningJobState(job.ID, db.NewJobStateOk("Executing "+stepName, -1))
 		if err != nil {
 			log.Println(err)
 		}
 
-		var binds []dckr.VolBind
-		for i := range inputSrc {
-			binds = append(binds, dckr.NewVolBind(inputVolumes[i].ID, service.Input[i].Path, true))
+		var binds []VolumeBind
+		for i := range step.Input {
+			binds = append(binds, VolumeBind{VolumeID: stepInputVolumes[i], MountPoint: step.Input[i].Path, ReadOnly: true})
 		}
-		for i := range service.Output {
-			binds = append(binds, dckr.NewVolBind(outputVolumes[i].ID, service.Output[i].Path, false))
+		for i := range step.Output {
+			binds = append(binds, VolumeBind{VolumeID: outputVolumes[i], MountPoint: step.Output[i].Path})
 		}
 
-		containerID, swarmServiceID, exitCode, output, err := docker.client.ExecuteImage(
-			string(service.ImageID),
-			service.RepoTag,
-			service.Cmd,
+		stepProvenance := &provenance.Steps[stepIndex]
+		stepProvenance.TaskName = taskName
+		stepProvenance.InputVolumes = stepInputVolumes[:len(step.Input)]
+		stepProvenance.OutputVolumes = outputVolumes
+		stepProvenance.Started = time.Now()
+		p.saveJobProvenance(provenance)
+
+		exitCode, err := p.executeTask(job.ID, taskName, docker,
+			string(step.ImageID),
+			step.RepoTag,
+			step.Cmd,
 			binds,
 			limits,
-			timeouts,
-			true)
+			timeouts)
 
-		dbErr := p.db.AddJobTask(job.ID, "Service execution", string(containerID), swarmServiceID, err2str(err), exitCode, output)
-		if dbErr != nil {
-			log.Println(dbErr)
+		if err == errJobStopped {
+			// the output volumes of the step may have been created after CancelJob removed the others
+			var stepVolumes []db.JobVolume
+			for _, id := range outputVolumes {
+				stepVolumes = append(stepVolumes, db.JobVolume{VolumeID: id})
+			}
+			err = p.waitAndRemoveVolume(step.ConnectionID, stepVolumes)
+			if err != nil {
+				log.Println(err)
+			}
+			return
+		}
+
+		stepProvenance.Ended = time.Now()
+		stepProvenance.ExitCode = exitCode
+		p.saveJobProvenance(provenance)
+
+		if p.isJobStopped(job.ID) {
+			return
 		}
 
 		if err != nil {
-			err = p.db.SetJobState(job.ID, db.NewJobStateError("Service failed", 1))
+			msg := "Service failed"
+			if len(steps) > 1 {
+				msg = fmt.Sprintf("Workflow %s failed", stepName)
+			}
+			err = p.setRunningJobState(job.ID, db.NewJobStateError(msg, 1))
 			if err != nil {
 				log.Println(err)
 			}
@@ -481,23 +766,94 @@ func (p *Pier) runJob(job *db.Job, service db.Service, inputSrc []string, limits
 		}
 
 		if exitCode != 0 {
-			msg := fmt.Sprintf("Service failed (exitCode = %v)", exitCode)
-			err = p.db.SetJobState(job.ID, db.NewJobStateOk(msg, 1))
+			err = p.setRunningJobState(job.ID, db.NewJobStateOk(stepFailedStatus(steps, stepIndex, exitCode), 1))
 			if err != nil {
 				log.Println(err)
 			}
 			p.updateJobDurationTime(*job)
 			return
 		}
+
+		stepInputVolumes = outputVolumes
 	}
 
-	err = p.db.SetJobState(job.ID, db.NewJobStateOk("Ended successfully", 0))
+	err = p.setRunningJobState(job.ID, db.NewJobStateOk("Ended successfully", 0))
 	if err != nil {
 		log.Println(err)
 	}
 	p.updateJobDurationTime(*job)
 }
 
+// stepNames returns how a step of a job is called in the job status, and the name of its task
+func stepNames(steps []db.Service, stepIndex int) (string, string) {
+	if len(steps) == 1 {
+		return "the service", "Service execution"
+	}
+	step := steps[stepIndex]
+	return fmt.Sprintf("step #%d (%s)", stepIndex+1, step.Name), fmt.Sprintf("Step #%d: %s", stepIndex+1, step.Name)
+}
+
+// setRunningJobState sets the state of a job unless it was stopped meanwhile, so that runJob
+// does not overwrite the state set by stopJob
+func (p *Pier) setRunningJobState(jobID db.JobID, state db.JobState) error {
+	unlock := p.jobLocks.lock(jobID)
+	defer unlock()
+	if p.isJobStopped(jobID) {
+		return nil
+	}
+	return p.db.SetJobState(jobID, state)
+}
+
+// stepFailedStatus is the status of a job whose step has ended with a non-zero exit code
+func stepFailedStatus(steps []db.Service, stepIndex int, exitCode int) string {
+	if len(steps) == 1 {
+		return fmt.Sprintf("Service failed (exitCode = %v)", exitCode)
+	}
+	stepName, _ := stepNames(steps, stepIndex)
+	return fmt.Sprintf("Workflow %s failed (exitCode = %v)", stepName, exitCode)
+}
+
+// executeTask runs an image as a task of a job and waits for it to end. The task is recorded
+// before waiting, so that its container or swarm service can be found and terminated meanwhile;
+// the job state is checked under the job lock, so that no task starts once the job is stopped
+func (p *Pier) executeTask(jobID db.JobID, taskName string, docker dockerConnection, imgID string, imgRepoTag string, cmdArgs []string, binds []VolumeBind, limits def.LimitConfig, timeouts def.TimeoutConfig) (int, error) {
+	unlock := p.jobLocks.lock(jobID)
+	if p.isJobStopped(jobID) {
+		unlock()
+		return 0, errJobStopped
+	}
+	task, output, err := docker.backend.StartTask(imgID, imgRepoTag, cmdArgs, binds, limits, timeouts)
+	if output == nil {
+		output = &bytes.Buffer{}
+	}
+
+	taskID, dbErr := p.db.AddJobTask(jobID, taskName, task.ContainerID, task.ServiceID, "", db.TaskRunningExitCode, &bytes.Buffer{})
+	unlock()
+	if dbErr != nil {
+		log.Println(dbErr)
+	}
+
+	exitCode := 0
+	if err == nil {
+		exitCode, err = docker.backend.WaitTask(task)
+		if err != nil {
+			err = def.Err(err, "WaitTask failed")
+		} else {
+			err = docker.backend.TerminateTask(task)
+		}
+	}
+
+	taskError := ""
+	if err != nil {
+		taskError = err.Error()
+	}
+	dbErr = p.db.SetJobTaskResult(taskID, taskError, exitCode, output)
+	if dbErr != nil {
+		log.Println(dbErr)
+	}
+	return exitCode, err
+}
+
 func (p *Pier) waitAndRemoveVolume(connectionID db.ConnectionID, volumeIdList []db.JobVolume) error {
 	docker, found := p.docker[connectionID]
 	if !found {
@@ -505,12 +861,12 @@ func (p *Pier) waitAndRemoveVolume(connectionID db.ConnectionID, volumeIdList []
 	}
 	for i := range volumeIdList {
 		for {
-			err := docker.client.RemoveVolume(dckr.VolumeID(volumeIdList[i].VolumeID))
-			if err == nil || err == dckr.NoSuchVolume {
+			err := docker.backend.RemoveVolume(volumeIdList[i].VolumeID)
+			if err == nil || err == ErrNoSuchVolume {
 				break
 			}
 
-			if err != dckr.VolumeInUse {
+			if err != ErrVolumeInUse {
 				return def.Err(err, "Data volume cannot be removed")
 			}
 			time.Sleep(10 * time.Millisecond)
@@ -519,36 +875,151 @@ func (p *Pier) waitAndRemoveVolume(connectionID db.ConnectionID, volumeIdList []
 	return nil
 }
 
-// RemoveJob removes a job by ID
-func (p *Pier) RemoveJob(userID int64, jobID db.JobID) (db.Job, error) {
+// CancelJob stops a running job: its containers or swarm services are terminated
+// and its input and output volumes are removed
+func (p *Pier) CancelJob(userID int64, jobID db.JobID) (db.Job, error) {
 	job, err := p.db.GetJob(jobID)
 	if err != nil {
 		return job, def.Err(nil, "not found")
 	}
+	if job.State.Code != -1 {
+		return job, def.Err(nil, "The job is not running")
+	}
 
-	docker, found := p.docker[job.ConnectionID]
-	if !found {
-		return job, def.Err(nil, "Cannot find docker connection")
+	// set the state first, so that runJob stops when the current task is terminated;
+	// the job read with the state has all the tasks, since runJob cannot start new ones
+	job, err = p.stopJob(job.ID, db.NewJobStateCancelled())
+	if err != nil {
+		return job, err
+	}
+	err = p.db.RemoveQueuedJob(job.ID)
+	if err != nil {
+		return job, def.Err(err, "Cannot remove the job from the queue")
 	}
+	p.updateJobDurationTime(job)
 
-	if len(job.Tasks) > 0 {
-		theLastContainer := job.Tasks[len(job.Tasks)-1].ContainerID
-		theLastSwarmService := job.Tasks[len(job.Tasks)-1].SwarmServiceID
-		err = docker.client.TerminateContainerOrSwarmService(string(theLastContainer), theLastSwarmService)
-		if err != nil {
-			return job, def.Err(err, "Cannot remove a container/swarm service")
-		}
+	err = p.terminateJobTasks(job)
+	if err != nil {
+		return job, err
 	}
 
-	// Removing volumes
-	err = p.waitAndRemoveVolume(job.ConnectionID, job.InputVolume)
+	err = p.removeJobVolumes(job.ID)
+	if err != nil {
+		return job, err
+	}
+
+	return p.db.GetJob(jobID)
+}
+
+// RetryJob creates a new job executing again the service or workflow of an ended job,
+// with the same input sources; like a new job, it is subject to the storage quotas
+func (p *Pier) RetryJob(userID int64, jobID db.JobID, limits def.LimitConfig, timeouts def.TimeoutConfig) (db.Job, error) {
+	job, err := p.db.GetJob(jobID)
+	if err != nil {
+		return job, def.Err(nil, "not found")
+	}
+	if job.State.Code == -1 {
+		return job, def.Err(nil, "The job is still running")
+	}
+	err = p.checkStorageQuota(userID)
 	if err != nil {
 		return job, err
 	}
-	err = p.waitAndRemoveVolume(job.ConnectionID, job.OutputVolume)
+	return p.retryJob(userID, job, limits, timeouts, time.Now())
+}
+
+// retryJob queues a new attempt of a job, to be started not before a given time
+func (p *Pier) retryJob(userID int64, job db.Job, limits def.LimitConfig, timeouts def.TimeoutConfig, notBefore time.Time) (db.Job, error) {
+	sources, err := p.db.GetJobInputSources(job.ID)
+	if err != nil {
+		return job, def.Err(err, "Cannot get the job input sources")
+	}
+	steps, err := p.getJobServices(job)
 	if err != nil {
 		return job, err
 	}
+	// the sources are given in the order of the input ports
+	var inputSrc []db.JobInput
+	for _, port := range steps[0].Input {
+		src, ok := sources[port.Name]
+		if !ok {
+			return job, def.Err(nil, "The job has no source for the input %s", port.Name)
+		}
+		inputSrc = append(inputSrc, src)
+	}
+
+	retry := newJob(job.WorkflowID, steps)
+	retry.RetryOf = job.ID
+	retry.Attempt = job.Attempt + 1
+	retry.Name, retry.Description, retry.Labels = job.Name, job.Description, job.Labels
+	err = p.submitJob(userID, retry, inputSrc, limits, timeouts, notBefore)
+	return retry, err
+}
+
+// retryFailedJob automatically retries a failed job, as specified by the retry policy of
+// its service; jobs which were cancelled or have exceeded their timeout are not retried
+func (p *Pier) retryFailedJob(queuedJob db.QueuedJob, policy db.RetryPolicy) {
+	job, err := p.db.GetJob(queuedJob.JobID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if job.State.Code != 1 || job.Attempt >= policy.MaxAttempts {
+		return
+	}
+	if job.State.Error == JobTimeOutError || job.State.Error == JobTimeOutAndRemovalError {
+		return
+	}
+
+	delay := time.Duration(policy.Backoff) * time.Second
+	for i := 1; i < job.Attempt; i++ {
+		delay *= 2
+	}
+	retry, err := p.retryJob(queuedJob.UserID, job, queuedJob.Limits, queuedJob.Timeouts, time.Now().Add(delay))
+	if err != nil {
+		log.Println("ERROR: cannot retry job ", job.ID, ": ", err)
+		return
+	}
+	log.Println("Job ", job.ID, " failed, retrying as job ", retry.ID, " in ", delay)
+}
+
+// removeJobVolumes removes the input and output volumes of a job, including
+// those created by its tasks since the job was last read from the database
+func (p *Pier) removeJobVolumes(jobID db.JobID) error {
+	job, err := p.db.GetJob(jobID)
+	if err != nil {
+		return err
+	}
+	err = p.waitAndRemoveVolume(job.ConnectionID, job.InputVolume)
+	if err != nil {
+		return err
+	}
+	return p.waitAndRemoveVolume(job.ConnectionID, job.OutputVolume)
+}
+
+// RemoveJob removes a job by ID; a running job is cancelled first
+func (p *Pier) RemoveJob(userID int64, jobID db.JobID) (db.Job, error) {
+	job, err := p.db.GetJob(jobID)
+	if err != nil {
+		return job, def.Err(nil, "not found")
+	}
+
+	if job.State.Code == -1 {
+		job, err = p.CancelJob(userID, jobID)
+		if err != nil {
+			return job, err
+		}
+	} else {
+		err = p.terminateJobTasks(job)
+		if err != nil {
+			return job, err
+		}
+
+		err = p.removeJobVolumes(jobID)
+		if err != nil {
+			return job, err
+		}
+	}
 
 	// Removing the job from the list
 	err = p.db.RemoveJob(jobID)
@@ -565,17 +1036,11 @@ func (p *Pier) ImportImage(connectionID db.ConnectionID, userID int64, imageFile
 	if !found {
 		return db.Service{}, def.Err(nil, "Cannot find docker connection")
 	}
-	imageID, err := docker.client.ImportImageFromTar(imageFilePath)
+	image, err := docker.backend.ImportImage(imageFilePath)
 	if err != nil {
 		return db.Service{}, def.Err(err, "docker ImportImage failed")
 	}
 
-	image, err := docker.client.InspectImage(imageID)
-
-	if err != nil {
-		return db.Service{}, err
-	}
-
 	service := NewServiceFromImage(connectionID, image)
 	err = p.db.AddService(userID, service)
 	if err != nil {
@@ -645,7 +1110,7 @@ func (p *Pier) StartServiceBuildFromTar(buildID string, buildDir string, connect
 }
 
 // NewServiceFromImage extracts metadata and creates a valid GEF service
-func NewServiceFromImage(connectionID db.ConnectionID, image dckr.Image) db.Service {
+func NewServiceFromImage(connectionID db.ConnectionID, image Image) db.Service {
 	srv := db.Service{
 		ID:           db.ServiceID(uuid.New()),
 		ConnectionID: connectionID,
@@ -676,6 +1141,8 @@ func NewServiceFromImage(connectionID db.ConnectionID, image dckr.Image) db.Serv
 			addVecValue(&srv.Input, ks[1:], v)
 		case "output":
 			addVecValue(&srv.Output, ks[1:], v)
+		case "retry":
+			setRetryValue(&srv.Retry, ks[1:], v)
 		default:
 			log.Println("Unknown GEF service label: ", k, "=", v)
 		}
@@ -686,6 +1153,9 @@ func NewServiceFromImage(connectionID db.ConnectionID, image dckr.Image) db.Serv
 		for _, p := range srv.Input {
 			if p.Path != "" {
 				p.ID = fmt.Sprintf("input%d", len(in))
+				if IsValueInput(p) && p.FileName == "" {
+					p.FileName = p.ID
+				}
 				in = append(in, p)
 			}
 		}
@@ -727,6 +1197,58 @@ func addVecValue(vec *[]db.IOPort, ks []string, value string) {
 		(*vec)[id].Type = value
 	case "filename":
 		(*vec)[id].FileName = value
+	case "required":
+		required, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Println("ERROR: GEF service label: expecting a boolean for required, instead got: ", value)
+			return
+		}
+		(*vec)[id].Optional = !required
+	case "default":
+		(*vec)[id].Default = value
+	case "pattern":
+		_, err := regexp.Compile(value)
+		if err != nil {
+			log.Println("ERROR: GEF service label: bad regular expression for pattern: ", value, err)
+			return
+		}
+		(*vec)[id].Pattern = value
+	case "min", "max":
+		_, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Println("ERROR: GEF service label: expecting a number for", ks[1], ", instead got: ", value)
+			return
+		}
+		if ks[1] == "min" {
+			(*vec)[id].Min = value
+		} else {
+			(*vec)[id].Max = value
+		}
+	case "values":
+		(*vec)[id].Values = nil
+		for _, v := range strings.Split(value, ",") {
+			(*vec)[id].Values = append((*vec)[id].Values, strings.TrimSpace(v))
+		}
+	}
+}
 
+// setRetryValue is used by the NewServiceFromImage
+func setRetryValue(policy *db.RetryPolicy, ks []string, value string) {
+	if len(ks) != 1 {
+		log.Println("ERROR: GEF service label retry key error (need 'retry . key name')", ks)
+		return
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Println("ERROR: GEF service label: expecting a positive integer for retry.", ks[0], ", instead got: ", value)
+		return
+	}
+	switch ks[0] {
+	case "maxattempts":
+		policy.MaxAttempts = n
+	case "backoff":
+		policy.Backoff = n
+	default:
+		log.Println("Unknown GEF service retry label: ", ks[0], "=", value)
 	}
 }
@@ -0,0 +1,232 @@
+package pier
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProvDocument is a W3C PROV document, which can be serialized as PROV-JSON or as PROV-O Turtle.
+// The identifiers are qualified names; the gef prefix is bound to Namespace
+type ProvDocument struct {
+	Namespace string
+	records   []provRecord
+}
+
+// provRecord is an element (entity, activity or agent) or a relation between two elements
+type provRecord struct {
+	kind    string // "entity", "activity", "agent" or one of provRelations
+	id      string // the element identifier; empty for the relations
+	subject string // the first argument of a relation
+	object  string // the second argument of a relation
+	attrs   []provAttr
+}
+
+// provAttr is an attribute of an element; the value is a string, a number, a bool,
+// a time or a provRef
+type provAttr struct {
+	name  string
+	value interface{}
+}
+
+// provRef is a qualified name used as an attribute value
+type provRef string
+
+// provRelation describes a PROV relation: the names of its two arguments in PROV-JSON,
+// and the PROV-O property linking them
+type provRelation struct {
+	subject, object, property string
+}
+
+var provRelations = map[string]provRelation{
+	"used":              {"prov:activity", "prov:entity", "prov:used"},
+	"wasGeneratedBy":    {"prov:entity", "prov:activity", "prov:wasGeneratedBy"},
+	"wasAssociatedWith": {"prov:activity", "prov:agent", "prov:wasAssociatedWith"},
+	"wasInformedBy":     {"prov:informed", "prov:informant", "prov:wasInformedBy"},
+	"wasDerivedFrom":    {"prov:generatedEntity", "prov:usedEntity", "prov:wasDerivedFrom"},
+	"wasAttributedTo":   {"prov:entity", "prov:agent", "prov:wasAttributedTo"},
+	"hadMember":         {"prov:collection", "prov:entity", "prov:hadMember"},
+}
+
+// provTurtleProperties maps the PROV attributes to their PROV-O properties
+var provTurtleProperties = map[string]string{
+	"prov:type":      "a",
+	"prov:label":     "rdfs:label",
+	"prov:startTime": "prov:startedAtTime",
+	"prov:endTime":   "prov:endedAtTime",
+}
+
+func newProvDocument(namespace string) *ProvDocument {
+	return &ProvDocument{Namespace: namespace}
+}
+
+// element adds an entity, an activity or an agent; attributes with zero values are skipped
+func (d *ProvDocument) element(kind string, id string, attrs ...provAttr) {
+	d.records = append(d.records, provRecord{kind: kind, id: id})
+	d.records[len(d.records)-1].add(attrs...)
+}
+
+// add adds attributes to an element, skipping those with zero values
+func (r *provRecord) add(attrs ...provAttr) {
+	for _, a := range attrs {
+		switch v := a.value.(type) {
+		case string:
+			if v == "" {
+				continue
+			}
+		case provRef:
+			if v == "" {
+				continue
+			}
+		case time.Time:
+			if v.IsZero() {
+				continue
+			}
+		}
+		r.attrs = append(r.attrs, a)
+	}
+}
+
+// relate adds a relation between two elements
+func (d *ProvDocument) relate(kind string, subject string, object string) {
+	if _, ok := provRelations[kind]; !ok {
+		panic("unknown PROV relation: " + kind)
+	}
+	d.records = append(d.records, provRecord{kind: kind, subject: subject, object: object})
+}
+
+// find returns the element with the given identifier, nil if there is none
+func (d *ProvDocument) find(id string) *provRecord {
+	for i := range d.records {
+		if d.records[i].id == id {
+			return &d.records[i]
+		}
+	}
+	return nil
+}
+
+// JSON returns the document in the PROV-JSON format
+func (d *ProvDocument) JSON() map[string]interface{} {
+	doc := map[string]interface{}{
+		"prefix": map[string]string{
+			"gef":  d.Namespace,
+			"prov": "http://www.w3.org/ns/prov#",
+			"xsd":  "http://www.w3.org/2001/XMLSchema#",
+		},
+	}
+	counters := map[string]int{}
+	for _, r := range d.records {
+		id := r.id
+		attrs := map[string]interface{}{}
+		if relation, ok := provRelations[r.kind]; ok {
+			counters[r.kind]++
+			id = fmt.Sprintf("_:%s%d", r.kind, counters[r.kind])
+			attrs[relation.subject] = r.subject
+			attrs[relation.object] = r.object
+		}
+		for _, a := range r.attrs {
+			attrs[a.name] = provJSONValue(a)
+		}
+		section, ok := doc[r.kind].(map[string]interface{})
+		if !ok {
+			section = map[string]interface{}{}
+			doc[r.kind] = section
+		}
+		section[id] = attrs
+	}
+	return doc
+}
+
+func provJSONValue(a provAttr) interface{} {
+	switch v := a.value.(type) {
+	case time.Time:
+		if a.name == "prov:startTime" || a.name == "prov:endTime" {
+			return v.UTC().Format(time.RFC3339)
+		}
+		return map[string]string{"$": v.UTC().Format(time.RFC3339), "type": "xsd:dateTime"}
+	case provRef:
+		return map[string]string{"$": string(v), "type": "prov:QUALIFIED_NAME"}
+	}
+	return a.value
+}
+
+// Turtle returns the document in the Turtle syntax, using the PROV-O vocabulary
+func (d *ProvDocument) Turtle() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "@prefix gef: <%s> .\n", d.Namespace)
+	b.WriteString("@prefix prov: <http://www.w3.org/ns/prov#> .\n")
+	b.WriteString("@prefix rdfs: <http://www.w3.org/2000/01/rdf-schema#> .\n")
+	b.WriteString("@prefix xsd: <http://www.w3.org/2001/XMLSchema#> .\n")
+
+	for _, r := range d.records {
+		if r.id == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s a prov:%s", d.turtleName(r.id), strings.ToUpper(r.kind[:1])+r.kind[1:])
+		for _, a := range r.attrs {
+			property, ok := provTurtleProperties[a.name]
+			if !ok {
+				property = d.turtleName(a.name)
+			}
+			fmt.Fprintf(&b, " ;\n    %s %s", property, d.turtleValue(a.value))
+		}
+		b.WriteString(" .\n")
+	}
+
+	var relations []string
+	for _, r := range d.records {
+		if r.id != "" {
+			continue
+		}
+		relations = append(relations, fmt.Sprintf("%s %s %s .\n",
+			d.turtleName(r.subject), provRelations[r.kind].property, d.turtleName(r.object)))
+	}
+	if len(relations) > 0 {
+		sort.Strings(relations)
+		b.WriteString("\n")
+		for _, line := range relations {
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
+
+// turtleName writes a qualified name as a prefixed name, or as a full IRI if its local part
+// contains characters that prefixed names cannot have
+func (d *ProvDocument) turtleName(qname string) string {
+	parts := strings.SplitN(qname, ":", 2)
+	if len(parts) != 2 || strings.IndexFunc(parts[1], notTurtleLocalChar) < 0 {
+		return qname
+	}
+	if parts[0] == "gef" {
+		return "<" + d.Namespace + parts[1] + ">"
+	}
+	return "<" + qname + ">"
+}
+
+func notTurtleLocalChar(c rune) bool {
+	return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_')
+}
+
+func (d *ProvDocument) turtleValue(value interface{}) string {
+	switch v := value.(type) {
+	case provRef:
+		return d.turtleName(string(v))
+	case time.Time:
+		return turtleString(v.UTC().Format(time.RFC3339)) + "^^xsd:dateTime"
+	case string:
+		return turtleString(v)
+	case float64:
+		return turtleString(strconv.FormatFloat(v, 'f', -1, 64)) + "^^xsd:double"
+	}
+	return fmt.Sprint(value)
+}
+
+var turtleEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+func turtleString(s string) string {
+	return `"` + turtleEscaper.Replace(s) + `"`
+}
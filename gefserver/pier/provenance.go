@@ -0,0 +1,222 @@
+package pier
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// newJobProvenance starts the provenance record of a job about to run the steps
+func newJobProvenance(userID int64, jobID db.JobID, steps []db.Service, inputSrc []db.JobInput, limits def.LimitConfig, timeouts def.TimeoutConfig) db.JobProvenance {
+	provenance := db.JobProvenance{
+		JobID:    jobID,
+		UserID:   userID,
+		Started:  time.Now(),
+		Inputs:   inputSrc,
+		Limits:   limits,
+		Timeouts: timeouts,
+	}
+	for _, step := range steps {
+		provenance.Steps = append(provenance.Steps, db.ProvenanceStep{
+			ServiceID:   step.ID,
+			ServiceName: step.Name,
+			Version:     step.Version,
+			ImageID:     step.ImageID,
+			RepoTag:     step.RepoTag,
+			Command:     step.Cmd,
+		})
+	}
+	return provenance
+}
+
+// saveJobProvenance stores the provenance record; the job goes on if it cannot be stored
+func (p *Pier) saveJobProvenance(provenance db.JobProvenance) {
+	err := p.db.SetJobProvenance(provenance)
+	if err != nil {
+		log.Println("ERROR: cannot store the provenance of job", provenance.JobID, err)
+	}
+}
+
+// GetJobProvenance returns the provenance of a job as a W3C PROV document; namespace is the
+// IRI bound to the gef prefix, under which the jobs, volumes, services and users are named.
+// The jobs run before the provenance was recorded only describe their inputs, tasks and outputs
+func (p *Pier) GetJobProvenance(jobID db.JobID, namespace string) (*ProvDocument, error) {
+	job, err := p.db.GetJob(jobID)
+	if err != nil {
+		return nil, def.Err(err, "Cannot get the job")
+	}
+	record, err := p.db.GetJobProvenance(jobID)
+	if db.IsNoResultsError(err) {
+		record = db.JobProvenance{JobID: jobID}
+		record.UserID, err = p.db.GetJobOwner(jobID)
+		if err != nil && !db.IsNoResultsError(err) {
+			return nil, def.Err(err, "Cannot get the job owner")
+		}
+	}
+	if err != nil {
+		return nil, def.Err(err, "Cannot get the job provenance")
+	}
+	sources, err := p.db.GetJobInputSources(jobID)
+	if err != nil {
+		return nil, def.Err(err, "Cannot get the job input sources")
+	}
+	return buildJobProvenance(job, record, sources, namespace), nil
+}
+
+// buildJobProvenance describes a job; sources are the sources of its input volumes, by port name
+func buildJobProvenance(job db.Job, record db.JobProvenance, sources map[string]db.JobInput, namespace string) *ProvDocument {
+	doc := newProvDocument(namespace)
+	jobName := "gef:jobs/" + string(job.ID)
+	userName := ""
+	if record.UserID != 0 {
+		userName = fmt.Sprintf("gef:users/%d", record.UserID)
+		doc.element("agent", userName, provAttr{"prov:type", provRef("prov:Person")})
+	}
+
+	started := record.Started
+	if started.IsZero() {
+		started = job.Created
+	}
+	var ended time.Time
+	if job.State != nil && job.State.Code != -1 {
+		ended = job.Created.Add(time.Duration(job.Duration) * time.Second)
+	}
+	var retryOf provRef
+	if job.RetryOf != "" {
+		retryOf = provRef("gef:jobs/" + string(job.RetryOf))
+	}
+	doc.element("activity", jobName,
+		provAttr{"prov:label", job.Name},
+		provAttr{"prov:startTime", started},
+		provAttr{"prov:endTime", ended},
+		provAttr{"gef:attempt", job.Attempt},
+		provAttr{"gef:retryOf", retryOf})
+	if job.State != nil {
+		doc.find(jobName).add(
+			provAttr{"gef:status", job.State.Status},
+			provAttr{"gef:error", job.State.Error},
+			provAttr{"gef:code", job.State.Code})
+	}
+	if record.Limits != (def.LimitConfig{}) {
+		doc.find(jobName).add(
+			provAttr{"gef:cpuShares", record.Limits.CPUShares},
+			provAttr{"gef:cpuPeriod", record.Limits.CPUPeriod},
+			provAttr{"gef:cpuQuota", record.Limits.CPUQuota},
+			provAttr{"gef:memory", record.Limits.Memory},
+			provAttr{"gef:memorySwap", record.Limits.MemorySwap},
+			provAttr{"gef:maxStageInSize", record.Limits.MaxStageInSize})
+	}
+	if record.Timeouts != (def.TimeoutConfig{}) {
+		doc.find(jobName).add(
+			provAttr{"gef:dataStagingTimeout", record.Timeouts.DataStaging},
+			provAttr{"gef:fileDownloadTimeout", record.Timeouts.FileDownload},
+			provAttr{"gef:jobExecutionTimeout", record.Timeouts.JobExecution})
+	}
+	if userName != "" {
+		doc.relate("wasAssociatedWith", jobName, userName)
+	}
+
+	// the input volumes and the files staged into them
+	for _, v := range job.InputVolume {
+		source := ""
+		if src := sources[v.Name]; !src.Local {
+			// the path of an uploaded file on the GEF host means nothing to the readers
+			source = src.Source
+		}
+		volumeName := "gef:volumes/" + string(v.VolumeID)
+		doc.element("entity", volumeName,
+			provAttr{"prov:type", provRef("prov:Collection")},
+			provAttr{"gef:port", v.Name},
+			provAttr{"gef:source", source})
+		doc.relate("used", jobName, volumeName)
+	}
+	for i, f := range job.StagedFiles {
+		fileName := fmt.Sprintf("%s/inputs/%d", jobName, i+1)
+		doc.element("entity", fileName,
+			provAttr{"prov:label", f.Name},
+			provAttr{"gef:source", f.Source},
+			provAttr{"gef:url", f.URL},
+			provAttr{"gef:checksum", f.Checksum},
+			provAttr{"gef:size", f.Size},
+			provAttr{"gef:verified", f.Verified},
+			provAttr{"gef:cached", f.Cached},
+			provAttr{"gef:error", f.Error})
+		doc.relate("hadMember", "gef:volumes/"+string(f.VolumeID), fileName)
+	}
+
+	for _, v := range job.OutputVolume {
+		volumeName := "gef:volumes/" + string(v.VolumeID)
+		doc.element("entity", volumeName,
+			provAttr{"prov:type", provRef("prov:Collection")},
+			provAttr{"gef:port", v.Name})
+		if v.Size > 0 {
+			doc.find(volumeName).add(provAttr{"gef:size", v.Size})
+		}
+		doc.relate("wasGeneratedBy", volumeName, jobName)
+		if userName != "" {
+			doc.relate("wasAttributedTo", volumeName, userName)
+		}
+	}
+
+	// the tasks, in the order they were executed
+	steps := map[string]db.ProvenanceStep{}
+	for _, step := range record.Steps {
+		if !step.Started.IsZero() {
+			steps[step.TaskName] = step
+		}
+	}
+	services := map[db.ServiceID]bool{}
+	previousTask := ""
+	for _, task := range job.Tasks {
+		taskName := jobName + "/tasks/" + task.ID
+		doc.element("activity", taskName,
+			provAttr{"prov:label", task.Name},
+			provAttr{"gef:partOf", provRef(jobName)},
+			provAttr{"gef:containerID", string(task.ContainerID)},
+			provAttr{"gef:swarmServiceID", task.SwarmServiceID},
+			provAttr{"gef:error", task.Error})
+		if task.ExitCode != db.TaskRunningExitCode {
+			doc.find(taskName).add(provAttr{"gef:exitCode", task.ExitCode})
+		}
+		if previousTask != "" {
+			doc.relate("wasInformedBy", taskName, previousTask)
+		}
+		previousTask = taskName
+
+		step, ok := steps[task.Name]
+		if !ok {
+			continue
+		}
+		serviceName := "gef:services/" + string(step.ServiceID)
+		if !services[step.ServiceID] {
+			services[step.ServiceID] = true
+			doc.element("agent", serviceName,
+				provAttr{"prov:type", provRef("prov:SoftwareAgent")},
+				provAttr{"prov:label", step.ServiceName},
+				provAttr{"gef:version", step.Version},
+				provAttr{"gef:imageID", string(step.ImageID)},
+				provAttr{"gef:repoTag", step.RepoTag})
+		}
+		command, _ := json.Marshal(step.Command)
+		doc.find(taskName).add(
+			provAttr{"prov:startTime", step.Started},
+			provAttr{"prov:endTime", step.Ended},
+			provAttr{"gef:imageID", string(step.ImageID)},
+			provAttr{"gef:command", string(command)})
+		doc.relate("wasAssociatedWith", taskName, serviceName)
+		for _, v := range step.InputVolumes {
+			doc.relate("used", taskName, "gef:volumes/"+string(v))
+		}
+		for _, out := range step.OutputVolumes {
+			doc.relate("wasGeneratedBy", "gef:volumes/"+string(out), taskName)
+			for _, in := range step.InputVolumes {
+				doc.relate("wasDerivedFrom", "gef:volumes/"+string(out), "gef:volumes/"+string(in))
+			}
+		}
+	}
+	return doc
+}
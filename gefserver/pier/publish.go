@@ -0,0 +1,278 @@
+package pier
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// b2shareScriptsFolder is where the B2SHARE access image keeps its scripts
+const b2shareScriptsFolder = "/scripts_for_user_invocation"
+
+// b2shareInputFolder is where the B2SHARE access image expects the files to upload;
+// the scripts read them relative to the working directory, which is /
+const b2shareInputFolder = "/input_directory"
+
+// b2shareTokenFolder is where the publication tasks mount the volume holding the
+// access token of the user, which is kept off their command line
+const b2shareTokenFolder = "/b2share_access"
+
+// b2shareTokenFile is the name of the access token file in b2shareTokenFolder
+const b2shareTokenFile = "access_token.txt"
+
+// B2SharePublication describes where and how the results of a job are published
+type B2SharePublication struct {
+	URL         string                 // the B2SHARE instance
+	AccessToken string                 // the B2SHARE access token of the user
+	Metadata    map[string]interface{} // the metadata of the new record
+}
+
+// PublishJob stages the output volumes of a job out to a new B2SHARE record;
+// the publication runs in the background, its steps are added to the job tasks
+func (p *Pier) PublishJob(jobID db.JobID, target B2SharePublication, limits def.LimitConfig, timeouts def.TimeoutConfig) (db.Job, error) {
+	job, err := p.db.GetJob(jobID)
+	if err != nil {
+		return job, def.Err(err, "Cannot get the job")
+	}
+	if job.State.Code != 0 {
+		return job, def.Err(nil, "Only the jobs which ended successfully can be published")
+	}
+	if len(job.OutputVolume) == 0 {
+		return job, def.Err(nil, "The job has no output volumes")
+	}
+	if target.URL == "" || target.AccessToken == "" {
+		return job, def.Err(nil, "The B2SHARE URL and access token are required")
+	}
+	docker, found := p.docker[job.ConnectionID]
+	if !found {
+		return job, def.Err(nil, "Cannot find docker connection")
+	}
+	if docker.b2shareAccess.id == "" {
+		return job, def.Err(nil, "Publishing to B2SHARE is not available for this connection")
+	}
+
+	err = p.db.StartJobPublication(jobID, db.JobPublication{Status: "Publishing", Code: -1})
+	if err == db.ErrTransferInProgress {
+		return job, def.Err(nil, "The job is already being published")
+	} else if err != nil {
+		return job, def.Err(err, "Cannot set the job publication")
+	}
+	go p.publishJob(job, docker, target, limits, timeouts)
+
+	return p.db.GetJob(jobID)
+}
+
+// publishJob creates a B2SHARE deposition, uploads into it all the files of the
+// output volumes of a job and commits it, recording the new record on the job
+func (p *Pier) publishJob(job db.Job, docker dockerConnection, target B2SharePublication, limits def.LimitConfig, timeouts def.TimeoutConfig) {
+	publication := db.JobPublication{Status: "Published", Code: 0}
+	err := p.stageOutToB2Share(job, docker, target, &publication, limits, timeouts)
+	if err != nil {
+		log.Println("publishing job", job.ID, "failed:", err)
+		publication = db.JobPublication{Status: "Publishing failed", Error: err.Error(), Code: 1}
+	}
+	err = p.db.SetJobPublication(job.ID, publication)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (p *Pier) stageOutToB2Share(job db.Job, docker dockerConnection, target B2SharePublication, publication *db.JobPublication, limits def.LimitConfig, timeouts def.TimeoutConfig) error {
+	// list the files before creating the deposition, so that a failure leaves nothing behind
+	type volumeFile struct {
+		volumeID db.VolumeID
+		path     string
+	}
+	var files []volumeFile
+	for _, v := range job.OutputVolume {
+		items, err := p.ListFiles(v.VolumeID, "", limits, timeouts)
+		if err != nil {
+			return def.Err(err, "Cannot list the files of the output volume %s", v.Name)
+		}
+		for _, name := range volumeFilePaths(items) {
+			files = append(files, volumeFile{v.VolumeID, name})
+		}
+	}
+	if len(files) == 0 {
+		return def.Err(nil, "There are no output files to publish")
+	}
+
+	tokenVolume, err := p.newAccessTokenVolume(docker, target.AccessToken, limits, timeouts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := p.waitAndRemoveVolume(job.ConnectionID, []db.JobVolume{{VolumeID: tokenVolume}})
+		if err != nil {
+			log.Println("cannot remove the access token volume of job", job.ID, err)
+		}
+	}()
+	tokenBind := VolumeBind{VolumeID: tokenVolume, MountPoint: b2shareTokenFolder}
+	access := []string{"--access_token_file", path.Join(b2shareTokenFolder, b2shareTokenFile), "--target_url", strings.TrimRight(target.URL, "/")}
+
+	response, err := p.runPublicationTask(job.ID, "B2SHARE deposition", docker, "create_new_deposition.py", access, []VolumeBind{tokenBind}, limits, timeouts)
+	if err != nil {
+		return err
+	}
+	depositionID, _ := response["deposit_id"].(string)
+	if depositionID == "" {
+		return def.Err(nil, "B2SHARE did not return a deposition id")
+	}
+
+	for i, f := range files {
+		binds := []VolumeBind{{VolumeID: f.volumeID, MountPoint: b2shareInputFolder}, tokenBind}
+		args := append([]string{depositionID, f.path}, access...)
+		_, err = p.runPublicationTask(job.ID, fmt.Sprintf("B2SHARE upload #%d", i+1), docker, "load_file_into_deposition.py", args, binds, limits, timeouts)
+		if err != nil {
+			return err
+		}
+	}
+
+	metadata, err := json.Marshal(target.Metadata)
+	if err != nil {
+		return def.Err(err, "Cannot encode the record metadata")
+	}
+	args := append([]string{depositionID, string(metadata)}, access...)
+	response, err = p.runPublicationTask(job.ID, "B2SHARE commit", docker, "commit_deposition.py", args, []VolumeBind{tokenBind}, limits, timeouts)
+	if err != nil {
+		return err
+	}
+
+	if location, ok := response["location"].(string); ok {
+		publication.RecordURL = resolveURL(target.URL, location)
+	}
+	for _, key := range []string{"PID", "pid", "epic_pid"} {
+		if pid, ok := response[key].(string); ok {
+			publication.PID = pid
+			break
+		}
+	}
+	return nil
+}
+
+// newAccessTokenVolume creates a volume holding only a file with the B2SHARE access token;
+// the local copy of the file is removed as soon as the volume is filled
+func (p *Pier) newAccessTokenVolume(docker dockerConnection, token string, limits def.LimitConfig, timeouts def.TimeoutConfig) (db.VolumeID, error) {
+	tmpDir, _, err := def.NewRandomTmpDir(p.tmpDir, InputsTmpDir)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+	tokenFile := filepath.Join(tmpDir, b2shareTokenFile)
+	err = ioutil.WriteFile(tokenFile, []byte(token), 0600)
+	if err != nil {
+		return "", def.Err(err, "Cannot write the access token file")
+	}
+
+	volumeID, err := docker.backend.NewVolume()
+	if err != nil {
+		return "", def.Err(err, "Cannot create the access token volume")
+	}
+	err = copyFileIntoVolume(docker, volumeID, tokenFile, limits, timeouts)
+	if err != nil {
+		if rmErr := docker.backend.RemoveVolume(volumeID); rmErr != nil {
+			log.Println("cannot remove the access token volume", volumeID, rmErr)
+		}
+		return "", def.Err(err, "Cannot copy the access token into its volume")
+	}
+	return volumeID, nil
+}
+
+// runPublicationTask runs a script of the B2SHARE access image as a task of a job
+// and returns the JSON response of B2SHARE printed by the script
+func (p *Pier) runPublicationTask(jobID db.JobID, taskName string, docker dockerConnection, script string, args []string, binds []VolumeBind, limits def.LimitConfig, timeouts def.TimeoutConfig) (map[string]interface{}, error) {
+	cmd := append([]string{"python", path.Join(b2shareScriptsFolder, script)}, args...)
+	task, output, err := docker.backend.StartTask(docker.b2shareAccess.id, docker.b2shareAccess.repoTag, cmd, binds, limits, timeouts)
+	if output == nil {
+		output = &bytes.Buffer{}
+	}
+
+	taskID, dbErr := p.db.AddJobTask(jobID, taskName, task.ContainerID, task.ServiceID, "", db.TaskRunningExitCode, &bytes.Buffer{})
+	if dbErr != nil {
+		log.Println(dbErr)
+	}
+
+	exitCode := 0
+	if err == nil {
+		exitCode, err = docker.backend.WaitTask(task)
+		if err != nil {
+			err = def.Err(err, "WaitTask failed")
+		}
+		// the task is removed even when waiting failed, so that it does not keep the volumes mounted
+		if termErr := docker.backend.TerminateTask(task); err == nil {
+			err = termErr
+		} else if termErr != nil {
+			log.Println("cannot terminate the task", task.ContainerID, termErr)
+		}
+	}
+
+	var response map[string]interface{}
+	if err == nil && exitCode == 0 {
+		// the scripts exit with 0 even when B2SHARE answers with an error, so
+		// only the JSON response tells if the step has succeeded
+		response, err = parseB2ShareResponse(output.String())
+	} else if err == nil {
+		err = def.Err(nil, "%s failed with exit code %d", taskName, exitCode)
+	}
+
+	taskError := ""
+	if err != nil {
+		taskError = err.Error()
+	}
+	dbErr = p.db.SetJobTaskResult(taskID, taskError, exitCode, output)
+	if dbErr != nil {
+		log.Println(dbErr)
+	}
+	return response, err
+}
+
+// parseB2ShareResponse decodes the JSON object following the messages of a B2SHARE script
+func parseB2ShareResponse(output string) (map[string]interface{}, error) {
+	start := strings.Index(output, "{")
+	if start < 0 {
+		lines := strings.Split(strings.TrimSpace(output), "\n")
+		return nil, def.Err(nil, "B2SHARE request failed: %s", lines[len(lines)-1])
+	}
+	var response map[string]interface{}
+	err := json.NewDecoder(strings.NewReader(output[start:])).Decode(&response)
+	if err != nil {
+		return nil, def.Err(err, "Cannot decode the B2SHARE response")
+	}
+	return response, nil
+}
+
+// volumeFilePaths returns the paths of all the files of a volume file tree
+func volumeFilePaths(items []VolumeItem) []string {
+	var paths []string
+	for _, item := range items {
+		if item.IsFolder {
+			paths = append(paths, volumeFilePaths(item.FolderTree)...)
+		} else {
+			paths = append(paths, path.Join(item.Path, item.Name))
+		}
+	}
+	return paths
+}
+
+// resolveURL resolves a location returned by B2SHARE against the instance URL
+func resolveURL(baseURL string, location string) string {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return location
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	return base.ResolveReference(ref).String()
+}
@@ -0,0 +1,376 @@
+package pier
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// JobQueuedStatus is the status of a job waiting for a free worker
+const JobQueuedStatus = "Queued"
+
+// JobInterruptedError is the error of a job whose execution was interrupted by a server restart
+const JobInterruptedError = "Job execution interrupted by a server restart"
+
+// defaultWorkersPerConnection is used when the configuration does not specify the worker pool size
+const defaultWorkersPerConnection = 4
+
+// queuePollInterval is how often idle workers check the queue, in case a job
+// became admissible without them being woken up
+const queuePollInterval = 5 * time.Second
+
+// jobQueue dispatches the queued jobs to the workers of each docker connection
+type jobQueue struct {
+	sync.Mutex // serializes the admission of jobs, so that the caps are respected
+	wakeup     map[db.ConnectionID]chan struct{}
+}
+
+func newJobQueue() *jobQueue {
+	return &jobQueue{wakeup: make(map[db.ConnectionID]chan struct{})}
+}
+
+// notify wakes up an idle worker of every docker connection
+func (q *jobQueue) notify() {
+	q.Lock()
+	defer q.Unlock()
+	for _, wakeup := range q.wakeup {
+		select {
+		case wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// startWorkers starts the worker pool of a docker connection, unless already started
+func (p *Pier) startWorkers(connectionID db.ConnectionID) {
+	workers := p.config.WorkersPerConnection
+	if workers <= 0 {
+		workers = defaultWorkersPerConnection
+	}
+
+	p.queue.Lock()
+	defer p.queue.Unlock()
+	if _, started := p.queue.wakeup[connectionID]; started {
+		return
+	}
+	wakeup := make(chan struct{}, workers)
+	p.queue.wakeup[connectionID] = wakeup
+	for i := 0; i < workers; i++ {
+		go p.queueWorker(connectionID, wakeup)
+	}
+}
+
+// enqueueJob stores a job in the queue and wakes up the workers
+func (p *Pier) enqueueJob(userID int64, job db.Job, inputSrc []db.JobInput, limits def.LimitConfig, timeouts def.TimeoutConfig, notBefore time.Time) error {
+	err := p.db.AddQueuedJob(db.QueuedJob{
+		JobID:        job.ID,
+		UserID:       userID,
+		ConnectionID: job.ConnectionID,
+		Inputs:       inputSrc,
+		Limits:       limits,
+		Timeouts:     timeouts,
+		Enqueued:     time.Now(),
+		NotBefore:    notBefore,
+	})
+	if err != nil {
+		return def.Err(err, "could not add the job to the queue")
+	}
+	p.queue.notify()
+	return nil
+}
+
+// queueWorker executes, one at a time, the queued jobs of a docker connection
+func (p *Pier) queueWorker(connectionID db.ConnectionID, wakeup chan struct{}) {
+	for {
+		queuedJob, found, due := p.admitQueuedJob(connectionID)
+		if !found {
+			wait := queuePollInterval
+			if !due.IsZero() && time.Until(due) < wait {
+				// a delayed job, e.g. a retry, becomes due before the next poll
+				wait = time.Until(due)
+			}
+			select {
+			case <-wakeup:
+			case <-time.After(wait):
+			}
+			continue
+		}
+		p.runQueuedJob(queuedJob)
+		// a running slot is now free, maybe for a job of another connection
+		p.queue.notify()
+	}
+}
+
+// admitQueuedJob selects the oldest waiting job of a connection which is due and does not
+// exceed the global and per user caps on running jobs, and marks it as started. When no job
+// is admitted, it also returns when the next delayed job becomes due (zero if there is none)
+func (p *Pier) admitQueuedJob(connectionID db.ConnectionID) (db.QueuedJob, bool, time.Time) {
+	p.queue.Lock()
+	defer p.queue.Unlock()
+
+	if p.config.MaxRunningJobs > 0 {
+		running, err := p.db.CountRunningJobs()
+		if err != nil {
+			log.Println("ERROR: admitQueuedJob: ", err)
+			return db.QueuedJob{}, false, time.Time{}
+		}
+		if running >= int64(p.config.MaxRunningJobs) {
+			return db.QueuedJob{}, false, time.Time{}
+		}
+	}
+
+	waiting, err := p.db.ListQueuedJobs(connectionID, false)
+	if err != nil {
+		log.Println("ERROR: admitQueuedJob: ", err)
+		return db.QueuedJob{}, false, time.Time{}
+	}
+	var due time.Time
+	for _, queuedJob := range waiting {
+		if time.Now().Before(queuedJob.NotBefore) {
+			if due.IsZero() || queuedJob.NotBefore.Before(due) {
+				due = queuedJob.NotBefore
+			}
+			continue
+		}
+		if p.config.MaxRunningJobsPerUser > 0 {
+			running, err := p.db.CountUserRunningJobs(queuedJob.UserID)
+			if err != nil {
+				log.Println("ERROR: admitQueuedJob: ", err)
+				return db.QueuedJob{}, false, time.Time{}
+			}
+			if running >= int64(p.config.MaxRunningJobsPerUser) {
+				continue
+			}
+		}
+
+		err = p.db.SetQueuedJobStarted(queuedJob.JobID, true)
+		if err != nil {
+			log.Println("ERROR: admitQueuedJob: ", err)
+			return db.QueuedJob{}, false, time.Time{}
+		}
+		return queuedJob, true, time.Time{}
+	}
+	return db.QueuedJob{}, false, due
+}
+
+// runQueuedJob executes a job admitted from the queue and removes it from the queue when finished
+func (p *Pier) runQueuedJob(queuedJob db.QueuedJob) {
+	defer func() {
+		err := p.db.RemoveQueuedJob(queuedJob.JobID)
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+
+	job, err := p.db.GetJob(queuedJob.JobID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if job.State.Code != -1 {
+		return // cancelled while waiting
+	}
+
+	steps, err := p.getJobServices(job)
+	if err != nil {
+		err = p.db.SetJobState(job.ID, db.NewJobStateError(err.Error(), 1))
+		if err != nil {
+			log.Println(err)
+		}
+		p.updateJobDurationTime(job)
+		return
+	}
+
+	p.runJob(queuedJob.UserID, &job, steps, queuedJob.Inputs, queuedJob.Limits, queuedJob.Timeouts)
+	p.measureJobVolumes(job.ID, queuedJob.Limits, queuedJob.Timeouts)
+	p.retryFailedJob(queuedJob, steps[0].Retry)
+}
+
+// getJobServices returns the services executed by a job, in execution order
+func (p *Pier) getJobServices(job db.Job) ([]db.Service, error) {
+	if job.WorkflowID == "" {
+		service, err := p.db.GetService(job.ServiceID)
+		if err != nil {
+			return nil, def.Err(err, "cannot get job service %s", job.ServiceID)
+		}
+		return []db.Service{service}, nil
+	}
+
+	workflow, err := p.db.GetWorkflow(job.WorkflowID)
+	if err != nil {
+		return nil, def.Err(err, "cannot get job workflow %s", job.WorkflowID)
+	}
+	return p.getWorkflowServices(workflow)
+}
+
+// reconcileJobs deals with the jobs of a docker connection left unfinished by a previous run
+// of the server, when the connection is added. Waiting jobs stay in the queue. The jobs which
+// have started a step get the result of its task, as known to the backend: a task which is still
+// running is monitored again. The containers of the other interrupted jobs are terminated; jobs
+// interrupted before starting any service are queued again, the others are marked as failed.
+func (p *Pier) reconcileJobs(connectionID db.ConnectionID) error {
+	jobs, err := p.db.ListUnfinishedJobs()
+	if err != nil {
+		return def.Err(err, "cannot list unfinished jobs")
+	}
+
+	for _, job := range jobs {
+		if job.ConnectionID != connectionID {
+			continue
+		}
+		queuedJob, err := p.db.GetQueuedJob(job.ID)
+		if err != nil && !db.IsNoResultsError(err) {
+			return def.Err(err, "cannot get the queue entry of job %s", job.ID)
+		}
+		inQueue := err == nil
+		if inQueue && !queuedJob.Started {
+			continue
+		}
+		if inQueue && p.resumeJob(queuedJob, job) {
+			log.Println("Resuming interrupted job: ", job.ID)
+			continue
+		}
+
+		// the containers left behind are not monitored anymore
+		err = p.terminateJobTasks(job)
+		if err != nil {
+			log.Println(err)
+		}
+
+		if inQueue && len(job.Tasks) == 0 {
+			log.Println("Requeuing interrupted job: ", job.ID)
+			err = p.removeJobVolumes(job.ID)
+			if err != nil {
+				log.Println(err)
+			}
+			err = p.db.RemoveJobVolumes(job.ID)
+			if err != nil {
+				return def.Err(err, "cannot remove the volumes of job %s", job.ID)
+			}
+			err = p.db.SetJobState(job.ID, db.NewJobStateOk(JobQueuedStatus, -1))
+			if err != nil {
+				return def.Err(err, "cannot set the state of job %s", job.ID)
+			}
+			err = p.db.SetQueuedJobStarted(job.ID, false)
+			if err != nil {
+				return def.Err(err, "cannot requeue job %s", job.ID)
+			}
+			continue
+		}
+
+		log.Println("Marking interrupted job as failed: ", job.ID)
+		err = p.db.SetJobState(job.ID, db.NewJobStateError(JobInterruptedError, 1))
+		if err != nil {
+			return def.Err(err, "cannot set the state of job %s", job.ID)
+		}
+		p.updateJobDurationTime(job)
+		err = p.db.RemoveQueuedJob(job.ID)
+		if err != nil {
+			return def.Err(err, "cannot remove job %s from the queue", job.ID)
+		}
+	}
+	return nil
+}
+
+// resumeJob finishes, in the background, an interrupted job which has started a step; it
+// returns false if the job has not started any
+func (p *Pier) resumeJob(queuedJob db.QueuedJob, job db.Job) bool {
+	steps, err := p.getJobServices(job)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	// the task of the latest step started
+	stepIndex := -1
+	var stepTask db.Task
+	for _, task := range job.Tasks {
+		for i := stepIndex + 1; i < len(steps); i++ {
+			if _, taskName := stepNames(steps, i); task.Name == taskName {
+				stepIndex, stepTask = i, task
+			}
+		}
+	}
+	if stepIndex < 0 {
+		return false
+	}
+	go p.finishResumedJob(queuedJob, job, steps, stepIndex, stepTask)
+	return true
+}
+
+// finishResumedJob waits for the task of the latest step of an interrupted job, unless
+// it had already ended, and sets the job state from its result. The following steps of
+// a workflow are not executed: the job is then marked as interrupted.
+func (p *Pier) finishResumedJob(queuedJob db.QueuedJob, job db.Job, steps []db.Service, stepIndex int, task db.Task) {
+	defer func() {
+		err := p.db.RemoveQueuedJob(queuedJob.JobID)
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+
+	exitCode := task.ExitCode
+	var err error
+	if task.ExitCode == db.TaskRunningExitCode {
+		go p.startTimeOutTicker(job.ID, p.timeOuts.JobExecution)
+		exitCode, err = p.waitResumedTask(job.ConnectionID, task)
+	} else if task.Error != "" {
+		err = errors.New(task.Error)
+	}
+	if p.isJobStopped(job.ID) {
+		return // cancelled or timed out meanwhile
+	}
+
+	state := db.NewJobStateOk("Ended successfully", 0)
+	if err != nil || (exitCode == 0 && stepIndex < len(steps)-1) {
+		state = db.NewJobStateError(JobInterruptedError, 1)
+	} else if exitCode != 0 {
+		state = db.NewJobStateOk(stepFailedStatus(steps, stepIndex, exitCode), 1)
+	}
+	err = p.db.SetJobState(job.ID, state)
+	if err != nil {
+		log.Println(err)
+	}
+	p.updateJobDurationTime(job)
+	p.measureJobVolumes(job.ID, queuedJob.Limits, queuedJob.Timeouts)
+	p.retryFailedJob(queuedJob, steps[0].Retry)
+}
+
+// waitResumedTask waits for a task started by a previous run of the server to end, and records
+// its result like executeTask; an error is returned if the backend does not know the task anymore
+func (p *Pier) waitResumedTask(connectionID db.ConnectionID, task db.Task) (int, error) {
+	docker, found := p.docker[connectionID]
+	if !found {
+		return 0, def.Err(nil, "Cannot find docker connection")
+	}
+	ref := TaskRef{ContainerID: string(task.ContainerID), ServiceID: task.SwarmServiceID}
+
+	output := &bytes.Buffer{}
+	exitCode, err := docker.backend.WaitTask(ref)
+	if err != nil {
+		err = def.Err(err, "WaitTask failed")
+	} else {
+		// the console output written while the server was down is only kept by the backend
+		logErr := docker.backend.TaskLogs(context.Background(), ref, false, output)
+		if logErr != nil {
+			log.Println(logErr)
+		}
+		err = docker.backend.TerminateTask(ref)
+	}
+
+	taskError := ""
+	if err != nil {
+		taskError = err.Error()
+	}
+	dbErr := p.db.SetJobTaskResult(task.ID, taskError, exitCode, output)
+	if dbErr != nil {
+		log.Println(dbErr)
+	}
+	return exitCode, err
+}
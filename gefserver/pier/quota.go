@@ -0,0 +1,133 @@
+package pier
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// StorageUsage is the storage used by the job volumes of a user, and the user quota
+type StorageUsage struct {
+	Used        int64
+	Quota       int64 // 0 means no limit
+	Communities []CommunityUsage
+}
+
+// CommunityUsage is the storage used by the job volumes of the users having a role in
+// a community, and the community quota
+type CommunityUsage struct {
+	CommunityID int64
+	Community   string
+	Used        int64
+	Quota       int64 // 0 means no limit
+}
+
+// QuotaError is returned when a new job is refused because a storage quota is exhausted
+type QuotaError struct {
+	Community string // empty for the user quota
+	Used      int64
+	Quota     int64
+}
+
+func (e QuotaError) Error() string {
+	if e.Community == "" {
+		return fmt.Sprintf("Storage quota exceeded: the jobs use %d bytes, the quota is %d bytes", e.Used, e.Quota)
+	}
+	return fmt.Sprintf("Storage quota of community %s exceeded: the jobs use %d bytes, the quota is %d bytes",
+		e.Community, e.Used, e.Quota)
+}
+
+// GetStorageUsage returns the storage used by the job volumes of a user and of the
+// communities the user has a role in
+func (p *Pier) GetStorageUsage(userID int64) (StorageUsage, error) {
+	usage := StorageUsage{Quota: p.config.Quotas.User, Communities: []CommunityUsage{}}
+	var err error
+	usage.Used, err = p.db.GetUserStorageUsage(userID)
+	if err != nil {
+		return usage, def.Err(err, "Cannot get the storage usage of the user")
+	}
+
+	roles, err := p.db.GetUserRoles(userID)
+	if err != nil {
+		return usage, def.Err(err, "Cannot get the user roles")
+	}
+	seen := map[int64]bool{}
+	for _, r := range roles {
+		if r.CommunityID == 0 || seen[r.CommunityID] {
+			continue
+		}
+		seen[r.CommunityID] = true
+		used, err := p.db.GetCommunityStorageUsage(r.CommunityID)
+		if err != nil {
+			return usage, def.Err(err, "Cannot get the storage usage of community %s", r.CommunityName)
+		}
+		usage.Communities = append(usage.Communities, CommunityUsage{
+			CommunityID: r.CommunityID,
+			Community:   r.CommunityName,
+			Used:        used,
+			Quota:       p.config.Quotas.Communities[r.CommunityID],
+		})
+	}
+	return usage, nil
+}
+
+// checkStorageQuota returns a QuotaError if the user, or a community of the user,
+// has exhausted its storage quota
+func (p *Pier) checkStorageQuota(userID int64) error {
+	quotas := p.config.Quotas
+	if quotas.User == 0 && len(quotas.Communities) == 0 {
+		return nil
+	}
+	usage, err := p.GetStorageUsage(userID)
+	if err != nil {
+		return err
+	}
+	if usage.Quota > 0 && usage.Used >= usage.Quota {
+		return QuotaError{Used: usage.Used, Quota: usage.Quota}
+	}
+	for _, c := range usage.Communities {
+		if c.Quota > 0 && c.Used >= c.Quota {
+			return QuotaError{Community: c.Community, Used: c.Used, Quota: c.Quota}
+		}
+	}
+	return nil
+}
+
+// measureJobVolumes records the size of the files of the volumes of an ended job;
+// the volumes of the cancelled jobs are removed, and not measured
+func (p *Pier) measureJobVolumes(jobID db.JobID, limits def.LimitConfig, timeouts def.TimeoutConfig) {
+	job, err := p.db.GetJob(jobID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if job.State.Code == -1 || job.State.Code == 2 {
+		return
+	}
+	for _, v := range append(job.InputVolume, job.OutputVolume...) {
+		files, err := p.ListFiles(v.VolumeID, "", limits, timeouts)
+		if err != nil {
+			log.Println("cannot measure volume", v.VolumeID, "of job", job.ID, err)
+			continue
+		}
+		err = p.db.SetJobVolumeSize(v.VolumeID, volumeItemsSize(files))
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// volumeItemsSize adds up the sizes of the files of a folder tree
+func volumeItemsSize(items []VolumeItem) int64 {
+	var size int64
+	for _, item := range items {
+		if item.IsFolder {
+			size += volumeItemsSize(item.FolderTree)
+		} else {
+			size += item.Size
+		}
+	}
+	return size
+}
@@ -0,0 +1,120 @@
+package pier
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/stagein"
+)
+
+const stageInTmpDir = "stagein"
+
+// stageInFromURL resolves a PID or URL input and downloads the files it points to into
+// an input volume; the download is recorded as a job task, and each file as a staged file
+// of the job
+func (p *Pier) stageInFromURL(jobID db.JobID, taskName string, volumeID db.VolumeID, src string, limits def.LimitConfig, timeouts def.TimeoutConfig) error {
+	output := &bytes.Buffer{}
+	taskID, dbErr := p.db.AddJobTask(jobID, taskName, "", "", "", db.TaskRunningExitCode, output)
+	if dbErr != nil {
+		log.Println(dbErr)
+	}
+
+	err := p.stageInFiles(jobID, volumeID, src, output, limits, timeouts)
+	taskError, exitCode := "", 0
+	if err != nil {
+		taskError, exitCode = err.Error(), 1
+	}
+	dbErr = p.db.SetJobTaskResult(taskID, taskError, exitCode, output)
+	if dbErr != nil {
+		log.Println(dbErr)
+	}
+	return err
+}
+
+func (p *Pier) stageInFiles(jobID db.JobID, volumeID db.VolumeID, src string, output io.Writer, limits def.LimitConfig, timeouts def.TimeoutConfig) error {
+	stager := stagein.Stager{
+		HandleServer: p.config.HandleServer,
+		B2ShareURLs:  p.config.B2ShareURLs,
+		Client:       &http.Client{Timeout: time.Duration(timeouts.DataStaging * float64(time.Second))},
+	}
+	addStagedFile := func(file db.StagedFile) {
+		file.VolumeID, file.Source = volumeID, src
+		err := p.db.AddJobStagedFile(jobID, file)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	fmt.Fprintf(output, "resolving %s\n", src)
+	files, err := stager.Resolve(src)
+	if err != nil {
+		addStagedFile(db.StagedFile{Error: err.Error()})
+		return def.Err(err, "Cannot resolve %s", src)
+	}
+
+	tmpPath, _, err := def.NewRandomTmpDir(p.tmpDir, stageInTmpDir)
+	if err != nil {
+		return def.Err(err, "Cannot create a temporary folder")
+	}
+	defer os.RemoveAll(tmpPath)
+
+	for i, f := range files {
+		if p.isJobStopped(jobID) {
+			return def.Err(nil, "The job was stopped")
+		}
+		// each file gets its own folder, the names could be the same
+		folder := filepath.Join(tmpPath, fmt.Sprintf("%d", i))
+		err = os.Mkdir(folder, 0700)
+		if err != nil {
+			return def.Err(err, "Cannot create a temporary folder")
+		}
+
+		fmt.Fprintf(output, "downloading %s\n", f.URL)
+		result, cached, err := p.inputCache.fetch(stager, f, folder, limits.MaxStageInSize)
+		file := db.StagedFile{
+			URL:      result.URL,
+			Name:     result.Name,
+			Size:     result.Size,
+			Checksum: result.Checksum,
+			Verified: result.Verified,
+			Cached:   cached,
+		}
+		if err != nil {
+			file.Error = err.Error()
+			addStagedFile(file)
+			return def.Err(err, "Download of %s failed", f.URL)
+		}
+		verified := "not verified"
+		if result.Verified {
+			verified = "verified"
+		}
+		if cached {
+			verified += ", from the cache"
+		}
+		fmt.Fprintf(output, "%s: %d bytes, %s (%s)\n", result.Name, result.Size, result.Checksum, verified)
+
+		err = p.UploadFileIntoVolume(string(volumeID), filepath.Join(folder, result.Name), result.Name, limits, timeouts)
+		if err != nil {
+			file.Error = err.Error()
+			addStagedFile(file)
+			return def.Err(err, "Cannot copy %s into the volume", result.Name)
+		}
+		addStagedFile(file)
+		os.RemoveAll(folder)
+	}
+	return nil
+}
+
+// stageInFailure tells in one line which file could not be staged in, and why
+func stageInFailure(err error) string {
+	return strings.Replace(err.Error(), "\n\tcaused by: ", ": ", -1)
+}
@@ -4,8 +4,12 @@ import (
 	"archive/tar"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"path"
+	"strings"
 	"time"
 
 	"path/filepath"
@@ -14,7 +18,6 @@ import (
 
 	"github.com/EUDAT-GEF/GEF/gefserver/db"
 	"github.com/EUDAT-GEF/GEF/gefserver/def"
-	"github.com/EUDAT-GEF/GEF/gefserver/pier/internal/dckr"
 )
 
 // VolumeItem describes a folder content
@@ -27,8 +30,15 @@ type VolumeItem struct {
 	FolderTree []VolumeItem `json:"folderTree"`
 }
 
-// DownStreamContainerFile exported
-func (p *Pier) DownStreamContainerFile(volumeID string, fileLocation string, limits def.LimitConfig, timeouts def.TimeoutConfig, w http.ResponseWriter) error {
+// ETag returns an entity tag for the content of a volume file, derived from its
+// modification time and size
+func (item VolumeItem) ETag() string {
+	return fmt.Sprintf("\"%x-%x\"", item.Modified.Unix(), item.Size)
+}
+
+// DownStreamContainerFile streams a file of a volume, answering HEAD, range and
+// conditional requests
+func (p *Pier) DownStreamContainerFile(volumeID string, fileLocation string, limits def.LimitConfig, timeouts def.TimeoutConfig, w http.ResponseWriter, r *http.Request) error {
 	job, err := p.db.GetJobOwningVolume(string(volumeID))
 	if err != nil {
 		return err
@@ -39,11 +49,11 @@ func (p *Pier) DownStreamContainerFile(volumeID string, fileLocation string, lim
 	}
 
 	// Copy the file from the volume to a new container
-	binds := []dckr.VolBind{
-		dckr.NewVolBind(dckr.VolumeID(volumeID), "/root/volume", false),
+	binds := []VolumeBind{
+		{VolumeID: db.VolumeID(volumeID), MountPoint: "/root/volume"},
 	}
-	containerID, swarmServiceID, _, err := docker.client.StartImageOrSwarmService(
-		string(docker.copyToAndFromVolume.id),
+	task, _, err := docker.backend.StartTask(
+		docker.copyToAndFromVolume.id,
 		docker.copyToAndFromVolume.repoTag,
 		[]string{
 			docker.copyToAndFromVolume.cmd[0],
@@ -59,16 +69,16 @@ func (p *Pier) DownStreamContainerFile(volumeID string, fileLocation string, lim
 	}
 
 	// Stream the file from the container
-	tarStream, err := docker.client.GetTarStream(string(containerID), fileLocation)
+	tarStream, err := docker.backend.CopyFromTask(task, fileLocation)
 
 	if err != nil {
-		return def.Err(err, "GetTarStream failed")
+		return def.Err(err, "CopyFromTask failed")
 	}
 
 	tarBallReader := tar.NewReader(tarStream)
 	header, err := tarBallReader.Next()
 	defer func() {
-		err := docker.client.TerminateContainerOrSwarmService(string(containerID), swarmServiceID)
+		err := docker.backend.TerminateTask(task)
 		if err != nil {
 			log.Println("error while forcefully removing container in DownStreamContainerFile", err)
 		}
@@ -79,9 +89,16 @@ func (p *Pier) DownStreamContainerFile(volumeID string, fileLocation string, lim
 	filename := header.Name
 
 	if header.Typeflag == tar.TypeReg {
+		item := VolumeItem{Name: filename, Size: header.Size, Modified: header.ModTime}
 		w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
 		w.Header().Set("Content-Type", "application/octet-stream")
-		io.Copy(w, tarBallReader)
+		w.Header().Set("ETag", item.ETag())
+		// the tar stream can only be read forward, so multiple ranges (which
+		// could be out of order) are answered with the whole file
+		if strings.Contains(r.Header.Get("Range"), ",") {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, filename, item.Modified, &forwardSeeker{r: tarBallReader, size: item.Size})
 	} else {
 		http.Error(w, "Error", http.StatusInternalServerError)
 		return errors.New("internal error while reading tarball")
@@ -89,6 +106,119 @@ func (p *Pier) DownStreamContainerFile(volumeID string, fileLocation string, lim
 	return nil
 }
 
+// DownStreamContainerArchive streams a folder of a volume (or the whole volume, if the
+// folder location is empty) as a tar.gz or zip archive, converted on the fly from the
+// tar stream of the backend
+func (p *Pier) DownStreamContainerArchive(volumeID string, folderLocation string, format string, limits def.LimitConfig, timeouts def.TimeoutConfig, w http.ResponseWriter) error {
+	job, err := p.db.GetJobOwningVolume(string(volumeID))
+	if err != nil {
+		return err
+	}
+	docker, found := p.docker[job.ConnectionID]
+	if !found {
+		return def.Err(nil, "Cannot find docker connection")
+	}
+
+	folderLocation = path.Clean("/" + folderLocation)
+	rootName := path.Base(folderLocation)
+	if folderLocation == "/" {
+		rootName = volumeID
+	}
+
+	binds := []VolumeBind{
+		{VolumeID: db.VolumeID(volumeID), MountPoint: "/root/volume"},
+	}
+	task, _, err := docker.backend.StartTask(
+		docker.copyToAndFromVolume.id,
+		docker.copyToAndFromVolume.repoTag,
+		[]string{
+			"ls",
+		},
+		binds,
+		limits,
+		timeouts)
+	if err != nil {
+		return def.Err(err, "volume archiving container failed")
+	}
+	defer func() {
+		err := docker.backend.TerminateTask(task)
+		if err != nil {
+			log.Println("error while forcefully removing container in DownStreamContainerArchive", err)
+		}
+	}()
+
+	tarStream, err := docker.backend.CopyFromTask(task, path.Join("/root/volume", folderLocation))
+	if err != nil {
+		return def.Err(err, "CopyFromTask failed")
+	}
+
+	archive, contentType, err := newArchiveWriter(format, w)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+rootName+"."+format+"\"")
+	w.Header().Set("Content-Type", contentType)
+
+	tarBallReader := tar.NewReader(tarStream)
+	for {
+		header, err := tarBallReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return def.Err(err, "reading tarball failed")
+		}
+		err = archive.add(header, archiveEntryName(header.Name, rootName), tarBallReader)
+		if err != nil {
+			return def.Err(err, "writing archive failed")
+		}
+	}
+	return archive.Close()
+}
+
+// forwardSeeker makes a stream of known size seekable, as long as it is read forward:
+// seeking only moves the offset, the skipped bytes are discarded by the next Read
+type forwardSeeker struct {
+	r      io.Reader
+	size   int64
+	pos    int64 // bytes already consumed from r
+	offset int64 // offset of the next Read
+}
+
+func (s *forwardSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *forwardSeeker) Read(b []byte) (int, error) {
+	if s.offset < s.pos {
+		return 0, errors.New("cannot seek backwards in a stream")
+	}
+	if s.offset > s.pos {
+		n, err := io.CopyN(ioutil.Discard, s.r, s.offset-s.pos)
+		s.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.r.Read(b)
+	s.pos += int64(n)
+	s.offset = s.pos
+	return n, err
+}
+
 // UploadFileIntoVolume exported
 func (p *Pier) UploadFileIntoVolume(volumeID string, srcFileLocation string, dstFileName string, limits def.LimitConfig, timeouts def.TimeoutConfig) error {
 	job, err := p.db.GetJobOwningVolume(string(volumeID))
@@ -99,13 +229,17 @@ func (p *Pier) UploadFileIntoVolume(volumeID string, srcFileLocation string, dst
 	if !found {
 		return def.Err(nil, "Cannot find docker connection")
 	}
+	return copyFileIntoVolume(docker, db.VolumeID(volumeID), srcFileLocation, limits, timeouts)
+}
 
+// copyFileIntoVolume copies a local file into the root folder of a volume
+func copyFileIntoVolume(docker dockerConnection, volumeID db.VolumeID, srcFileLocation string, limits def.LimitConfig, timeouts def.TimeoutConfig) error {
 	// Copy the file from the volume to a new container
-	binds := []dckr.VolBind{
-		dckr.NewVolBind(dckr.VolumeID(volumeID), "/root/volume", false),
+	binds := []VolumeBind{
+		{VolumeID: volumeID, MountPoint: "/root/volume"},
 	}
-	containerID, swarmServiceID, _, err := docker.client.StartImageOrSwarmService(
-		string(docker.copyToAndFromVolume.id),
+	task, _, err := docker.backend.StartTask(
+		docker.copyToAndFromVolume.id,
 		docker.copyToAndFromVolume.repoTag,
 		[]string{
 			"ls",
@@ -118,18 +252,17 @@ func (p *Pier) UploadFileIntoVolume(volumeID string, srcFileLocation string, dst
 		return def.Err(err, "data uploading container failed")
 	}
 
-	err = docker.client.UploadFile2Container(string(containerID), srcFileLocation, "/root/volume")
-	if err != nil {
-		return def.Err(err, "data uploading failed")
-	}
+	copyErr := docker.backend.CopyToTask(task, srcFileLocation, "/root/volume")
 
-
-	err = docker.client.TerminateContainerOrSwarmService(string(containerID), swarmServiceID)
+	// the container is removed even when the copy fails, so that the volume can be removed
+	err = docker.backend.TerminateTask(task)
 	if err != nil {
 		log.Println("error while forcefully removing container in UploadFileIntoVolume", err)
 	}
 
-
+	if copyErr != nil {
+		return def.Err(copyErr, "data uploading failed")
+	}
 	return nil
 }
 
@@ -150,13 +283,13 @@ func (p *Pier) ListFiles(volumeID db.VolumeID, filePath string, limits def.Limit
 	}
 
 	// Bind the container with the volume
-	volumesToMount := []dckr.VolBind{
-		dckr.NewVolBind(dckr.VolumeID(volumeID), "/root/volume", false),
+	volumesToMount := []VolumeBind{
+		{VolumeID: volumeID, MountPoint: "/root/volume"},
 	}
 
 	// Execute our image (it should produce a JSON file with the list of files)
-	containerID, swarmServiceID, _, err := docker.client.StartImageOrSwarmService(
-		string(docker.fileList.id),
+	task, _, err := docker.backend.StartTask(
+		docker.fileList.id,
 		docker.fileList.repoTag,
 		[]string{
 			docker.fileList.cmd[0], filePath, "r",
@@ -170,32 +303,32 @@ func (p *Pier) ListFiles(volumeID db.VolumeID, filePath string, limits def.Limit
 	}
 
 	// Stop but do not remove the container
-	_, err = docker.client.WaitContainerOrSwarmService(string(containerID))
+	_, err = docker.backend.WaitTask(task)
 	if err != nil {
-		return volumeFileList, def.Err(err, "WaitContainerOrSwarmService failed")
+		return volumeFileList, def.Err(err, "WaitTask failed")
 	}
 
 	// Reading the JSON file
-	volumeFileList, err = p.readJSON(docker.client, string(containerID), "/root/_filelist.json")
+	volumeFileList, err = p.readJSON(docker.backend, task, "/root/_filelist.json")
 	if err != nil {
 		return volumeFileList, def.Err(err, "readJson failed")
 	}
 
 	// Remove a container/swarm service (it was stopped earlier)
-	err = docker.client.TerminateContainerOrSwarmService(string(containerID), swarmServiceID)
+	err = docker.backend.TerminateTask(task)
 	if err != nil {
-		return volumeFileList, def.Err(err, "TerminateContainerOrSwarmService failed")
+		return volumeFileList, def.Err(err, "TerminateTask failed")
 	}
 
 	return volumeFileList, err
 }
 
-// readJSON reads a JSON file with the list of files (in a volume) from a container
-func (p *Pier) readJSON(dockerClient dckr.Client, containerID string, filePath string) ([]VolumeItem, error) {
+// readJSON reads a JSON file with the list of files (in a volume) from a task
+func (p *Pier) readJSON(backend ExecutionBackend, task TaskRef, filePath string) ([]VolumeItem, error) {
 	var volumeFileList []VolumeItem
-	tarStream, err := dockerClient.GetTarStream(containerID, filePath)
+	tarStream, err := backend.CopyFromTask(task, filePath)
 	if err != nil {
-		return nil, def.Err(err, "GetTarStream(%s) failed", filePath)
+		return nil, def.Err(err, "CopyFromTask(%s) failed", filePath)
 	}
 
 	tarBallReader := tar.NewReader(tarStream)
@@ -0,0 +1,291 @@
+package pier
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+const webdavTmpDir = "webdav"
+
+// webdavClient accesses the files of a WebDAV server (e.g. B2DROP) with the credentials of a user
+type webdavClient struct {
+	account db.B2DropAccount
+	client  *http.Client
+}
+
+func newWebDAVClient(account db.B2DropAccount) webdavClient {
+	return webdavClient{account: account, client: http.DefaultClient}
+}
+
+func (c webdavClient) do(method string, fileURL string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, fileURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	req.SetBasicAuth(c.account.Username, c.account.Password)
+	return c.client.Do(req)
+}
+
+// download writes the content of a remote file into w
+func (c webdavClient) download(fileURL string, w io.Writer) error {
+	res, err := c.do("GET", fileURL, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", fileURL, res.Status)
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// upload creates or replaces a remote file
+func (c webdavClient) upload(fileURL string, content io.Reader, size int64) error {
+	res, err := c.do("PUT", fileURL, content, size)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return fmt.Errorf("PUT %s: %s", fileURL, res.Status)
+	}
+	return nil
+}
+
+// makeFolder creates a remote folder, if it does not exist
+func (c webdavClient) makeFolder(folderURL string) error {
+	res, err := c.do("MKCOL", strings.TrimRight(folderURL, "/")+"/", nil, 0)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	// 405 Method Not Allowed means that the folder already exists
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusMethodNotAllowed {
+		return fmt.Errorf("MKCOL %s: %s", folderURL, res.Status)
+	}
+	return nil
+}
+
+// webdavFileName returns the name of the file pointed to by a WebDAV URL
+func webdavFileName(fileURL string) string {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return path.Base(fileURL)
+	}
+	return path.Base(u.Path)
+}
+
+// joinURL adds a (not escaped) file path to a folder URL
+func joinURL(folderURL string, filePath string) string {
+	escaped := (&url.URL{Path: strings.Trim(filePath, "/")}).EscapedPath()
+	return strings.TrimRight(folderURL, "/") + "/" + escaped
+}
+
+// stageInFromWebDAV downloads a file from the B2DROP folder of a user into an input volume;
+// the download is recorded as a job task
+func (p *Pier) stageInFromWebDAV(userID int64, jobID db.JobID, taskName string, volumeID db.VolumeID, fileURL string, limits def.LimitConfig, timeouts def.TimeoutConfig) error {
+	output := &bytes.Buffer{}
+	taskID, dbErr := p.db.AddJobTask(jobID, taskName, "", "", "", db.TaskRunningExitCode, output)
+	if dbErr != nil {
+		log.Println(dbErr)
+	}
+
+	err := p.downloadIntoVolume(userID, volumeID, fileURL, output, limits, timeouts)
+	taskError, exitCode := "", 0
+	if err != nil {
+		taskError, exitCode = err.Error(), 1
+	}
+	dbErr = p.db.SetJobTaskResult(taskID, taskError, exitCode, output)
+	if dbErr != nil {
+		log.Println(dbErr)
+	}
+	return err
+}
+
+func (p *Pier) downloadIntoVolume(userID int64, volumeID db.VolumeID, fileURL string, output io.Writer, limits def.LimitConfig, timeouts def.TimeoutConfig) error {
+	account, err := p.db.GetB2DropAccount(userID)
+	if err != nil {
+		return def.Err(err, "The B2DROP credentials of the user are not available")
+	}
+
+	tmpPath, _, err := def.NewRandomTmpDir(p.tmpDir, webdavTmpDir)
+	if err != nil {
+		return def.Err(err, "Cannot create a temporary folder")
+	}
+	defer os.RemoveAll(tmpPath)
+
+	name := webdavFileName(fileURL)
+	fmt.Fprintf(output, "downloading %s\n", name)
+	filePath := filepath.Join(tmpPath, name)
+	file, err := os.Create(filePath)
+	if err != nil {
+		return def.Err(err, "Cannot create a temporary file")
+	}
+	err = newWebDAVClient(account).download(fileURL, file)
+	closeErr := file.Close()
+	if err != nil {
+		return def.Err(err, "Download failed")
+	}
+	if closeErr != nil {
+		return def.Err(closeErr, "Cannot write the temporary file")
+	}
+
+	return p.UploadFileIntoVolume(string(volumeID), filePath, name, limits, timeouts)
+}
+
+// StageOutToB2Drop copies the files of the output volumes of a job into a folder of the
+// B2DROP account of a user; the copy runs in the background and is recorded as a job task
+// and in the B2DropCopy field of the job
+func (p *Pier) StageOutToB2Drop(userID int64, jobID db.JobID, folderURL string, limits def.LimitConfig, timeouts def.TimeoutConfig) (db.Job, error) {
+	job, err := p.db.GetJob(jobID)
+	if err != nil {
+		return job, def.Err(err, "Cannot get the job")
+	}
+	if job.State.Code != 0 {
+		return job, def.Err(nil, "Only the results of the jobs which ended successfully can be copied")
+	}
+	if len(job.OutputVolume) == 0 {
+		return job, def.Err(nil, "The job has no output volumes")
+	}
+	account, err := p.db.GetB2DropAccount(userID)
+	if err != nil {
+		return job, def.Err(err, "The B2DROP credentials of the user are not available")
+	}
+	docker, found := p.docker[job.ConnectionID]
+	if !found {
+		return job, def.Err(nil, "Cannot find docker connection")
+	}
+
+	err = p.db.StartJobB2DropCopy(jobID, db.JobB2DropCopy{Status: "Copying to B2DROP", Code: -1, FolderURL: folderURL})
+	if err == db.ErrTransferInProgress {
+		return job, def.Err(nil, "The job results are already being copied to B2DROP")
+	} else if err != nil {
+		return job, def.Err(err, "Cannot set the job B2DROP copy")
+	}
+
+	go func() {
+		output := &bytes.Buffer{}
+		taskID, dbErr := p.db.AddJobTask(jobID, "B2DROP stage-out", "", "", "", db.TaskRunningExitCode, output)
+		if dbErr != nil {
+			log.Println(dbErr)
+		}
+
+		b2dropCopy := db.JobB2DropCopy{Status: "Copied to B2DROP", Code: 0, FolderURL: folderURL}
+		taskError, exitCode := "", 0
+		err := p.copyVolumesToWebDAV(newWebDAVClient(account), docker, job.OutputVolume, folderURL, output, limits, timeouts)
+		if err != nil {
+			log.Println("copying job", jobID, "to B2DROP failed:", err)
+			b2dropCopy = db.JobB2DropCopy{Status: "Copying to B2DROP failed", Error: err.Error(), Code: 1, FolderURL: folderURL}
+			taskError, exitCode = err.Error(), 1
+		}
+
+		dbErr = p.db.SetJobTaskResult(taskID, taskError, exitCode, output)
+		if dbErr != nil {
+			log.Println(dbErr)
+		}
+		dbErr = p.db.SetJobB2DropCopy(jobID, b2dropCopy)
+		if dbErr != nil {
+			log.Println(dbErr)
+		}
+	}()
+
+	return p.db.GetJob(jobID)
+}
+
+// copyVolumesToWebDAV streams the files of some volumes to a WebDAV folder, one
+// subfolder per volume (named after the volume) if there are several volumes
+func (p *Pier) copyVolumesToWebDAV(client webdavClient, docker dockerConnection, volumes []db.JobVolume, folderURL string, output io.Writer, limits def.LimitConfig, timeouts def.TimeoutConfig) error {
+	created := map[string]bool{}
+	makeFolders := func(folder string) error {
+		if folder == "." || folder == "/" || created[folder] {
+			return nil
+		}
+		parts := strings.Split(strings.Trim(folder, "/"), "/")
+		for i := range parts {
+			subfolder := path.Join(parts[:i+1]...)
+			if !created[subfolder] {
+				err := client.makeFolder(joinURL(folderURL, subfolder))
+				if err != nil {
+					return err
+				}
+				created[subfolder] = true
+			}
+		}
+		return nil
+	}
+
+	err := client.makeFolder(folderURL)
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes {
+		prefix := ""
+		if len(volumes) > 1 {
+			prefix = v.Name
+		}
+
+		binds := []VolumeBind{{VolumeID: v.VolumeID, MountPoint: "/root/volume"}}
+		task, _, err := docker.backend.StartTask(docker.copyToAndFromVolume.id, docker.copyToAndFromVolume.repoTag,
+			[]string{"ls"}, binds, limits, timeouts)
+		if err != nil {
+			return def.Err(err, "volume reading container failed")
+		}
+		err = p.copyTaskFolderToWebDAV(client, docker, task, folderURL, prefix, makeFolders, output)
+		terminateErr := docker.backend.TerminateTask(task)
+		if terminateErr != nil {
+			log.Println("error while forcefully removing container in copyVolumesToWebDAV", terminateErr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pier) copyTaskFolderToWebDAV(client webdavClient, docker dockerConnection, task TaskRef, folderURL string, prefix string, makeFolders func(string) error, output io.Writer) error {
+	tarStream, err := docker.backend.CopyFromTask(task, "/root/volume")
+	if err != nil {
+		return def.Err(err, "CopyFromTask failed")
+	}
+	tarBallReader := tar.NewReader(tarStream)
+	for {
+		header, err := tarBallReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return def.Err(err, "reading tarball failed")
+		}
+		// the entries are in the "volume" folder
+		name := path.Join(prefix, archiveEntryName(header.Name, "."))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = makeFolders(name)
+		case tar.TypeReg, tar.TypeRegA:
+			err = makeFolders(path.Dir(name))
+			if err == nil {
+				fmt.Fprintf(output, "uploading %s\n", name)
+				err = client.upload(joinURL(folderURL, name), tarBallReader, header.Size)
+			}
+		}
+		if err != nil {
+			return def.Err(err, "Upload failed")
+		}
+	}
+}
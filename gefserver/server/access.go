@@ -3,8 +3,7 @@ package server
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
-	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	"os"
@@ -15,7 +14,6 @@ import (
 	"github.com/EUDAT-GEF/GEF/gefserver/db"
 	"github.com/EUDAT-GEF/GEF/gefserver/def"
 	"github.com/gorilla/mux"
-	"golang.org/x/oauth2"
 )
 
 var (
@@ -23,6 +21,10 @@ var (
 	AccessTokenCookieKey  = "UIAccessToken"
 )
 
+// uiAccessTokenLifetime is how long the access tokens of the web UI sessions are valid,
+// as long as the session cookies
+const uiAccessTokenLifetime = 30 * 24 * time.Hour
+
 func init() {
 	if os.Getenv("GEF_B2ACCESS_CONSUMER_KEY") == "" {
 		log.Println("ERROR: GEF_B2ACCESS_CONSUMER_KEY environment variable not found")
@@ -50,10 +52,16 @@ func (s *Server) userHandler(w http.ResponseWriter, r *http.Request, e environme
 		Response{w}.ServerError("Get user roles error", err)
 		return
 	}
+	storage, err := s.pier.GetStorageUsage(user.ID)
+	if err != nil {
+		Response{w}.ServerError("Get storage usage error", err)
+		return
+	}
 	Response{w}.Ok(jmap(
 		"User", user,
 		"IsSuperAdmin", s.isSuperAdmin(user),
-		"Roles", roles))
+		"Roles", roles,
+		"Storage", storage))
 }
 
 func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request, e environment) {
@@ -62,6 +70,16 @@ func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request, e environ
 		Response{w}.ServerError("Cookie store error", err)
 		return
 	}
+	// the token of the session is not needed anymore
+	if accessToken, ok := session.Values[AccessTokenCookieKey].(string); ok {
+		token, err := s.db.GetTokenBySecret(accessToken)
+		if err == nil && token.Name == AccessTokenCookieKey {
+			err = s.db.DeleteUserToken(token.UserID, token.ID)
+		}
+		if err != nil && !db.IsNoResultsError(err) {
+			log.Println("cannot remove UI token:", err)
+		}
+	}
 	delete(session.Values, AccessTokenCookieKey)
 	session.Save(r, w)
 	http.Redirect(w, r, "/", 302)
@@ -80,8 +98,14 @@ func (s *Server) newTokenHandler(w http.ResponseWriter, r *http.Request, e envir
 	}
 	logParam("tokenName", tokenName)
 
+	scopes, serviceIDs, communityIDs, err := s.readTokenRestrictions(r)
+	if err != nil {
+		Response{w}.ClientError("invalid token restrictions", err)
+		return
+	}
+
 	expire := time.Now().AddDate(10, 0, 0) // 10 years from now on
-	token, err := s.db.NewUserToken(user.ID, tokenName, expire)
+	token, err := s.db.NewScopedUserToken(user.ID, tokenName, expire, scopes, serviceIDs, communityIDs)
 	if err != nil {
 		Response{w}.ServerError("cannot create new token", err)
 		return
@@ -89,6 +113,59 @@ func (s *Server) newTokenHandler(w http.ResponseWriter, r *http.Request, e envir
 	Response{w}.Created(jmap("Token", token))
 }
 
+// readTokenRestrictions reads the scopes, the services and the communities (given by name,
+// returned by ID) a new token is restricted to; each form value is a comma separated list,
+// and can be repeated
+func (s *Server) readTokenRestrictions(r *http.Request) ([]string, []db.ServiceID, []int64, error) {
+	list := func(name string) []string {
+		var items []string
+		for _, v := range r.Form[name] {
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+		}
+		logParam(name, strings.Join(items, ","))
+		return items
+	}
+
+	scopes := list("scopes")
+	for _, scope := range scopes {
+		known := false
+		for _, tokenScope := range db.TokenScopes {
+			known = known || tokenScope == scope
+		}
+		if !known {
+			return nil, nil, nil, def.Err(nil, "unknown scope: %s", scope)
+		}
+	}
+
+	var serviceIDs []db.ServiceID
+	for _, id := range list("serviceIDs") {
+		_, err := s.db.GetService(db.ServiceID(id))
+		if err != nil {
+			return nil, nil, nil, def.Err(err, "unknown service: %s", id)
+		}
+		serviceIDs = append(serviceIDs, db.ServiceID(id))
+	}
+
+	var communityIDs []int64
+	for _, name := range list("communities") {
+		community, err := s.db.GetCommunityByName(name)
+		if err != nil {
+			return nil, nil, nil, def.Err(err, "unknown community: %s", name)
+		}
+		communityIDs = append(communityIDs, community.ID)
+	}
+
+	if len(scopes) == 0 && (len(serviceIDs) > 0 || len(communityIDs) > 0) {
+		// a token without scopes could create new tokens without the restrictions
+		return nil, nil, nil, def.Err(nil, "the tokens restricted to services or communities need scopes")
+	}
+	return scopes, serviceIDs, communityIDs, nil
+}
+
 func (s *Server) listTokenHandler(w http.ResponseWriter, r *http.Request, e environment) {
 	allow, user := Authorization{s, w, r}.allowGetTokens()
 	if user == nil || !allow {
@@ -100,9 +177,6 @@ func (s *Server) listTokenHandler(w http.ResponseWriter, r *http.Request, e envi
 		Response{w}.ServerError("cannot list tokens", err)
 		return
 	}
-	for i := range tokens {
-		tokens[i].Secret = tokens[i].Secret[:8] + "..."
-	}
 	Response{w}.Ok(jmap("Tokens", tokens))
 }
 
@@ -133,6 +207,63 @@ func (s *Server) removeTokenHandler(w http.ResponseWriter, r *http.Request, e en
 	Response{w}.Ok("")
 }
 
+func (s *Server) getB2DropAccountHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	allow, user := Authorization{s, w, r}.allowManageB2DropAccount()
+	if user == nil || !allow {
+		return
+	}
+
+	account, err := s.db.GetB2DropAccount(user.ID)
+	if db.IsNoResultsError(err) {
+		Response{w}.Ok(jmap("B2DropAccount", nil))
+		return
+	}
+	if err != nil {
+		Response{w}.ServerError("cannot get the B2DROP account", err)
+		return
+	}
+	Response{w}.Ok(jmap("B2DropAccount", account))
+}
+
+func (s *Server) setB2DropAccountHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	allow, user := Authorization{s, w, r}.allowManageB2DropAccount()
+	if user == nil || !allow {
+		return
+	}
+
+	account := db.B2DropAccount{
+		UserID:   user.ID,
+		Username: r.FormValue("username"),
+		Password: r.FormValue("password"),
+	}
+	logParam("username", account.Username)
+	if account.Username == "" || account.Password == "" {
+		Response{w}.ClientError("the B2DROP username and password are required", nil)
+		return
+	}
+
+	err := s.db.SetB2DropAccount(account)
+	if err != nil {
+		Response{w}.ServerError("cannot set the B2DROP account", err)
+		return
+	}
+	Response{w}.Ok(jmap("B2DropAccount", account))
+}
+
+func (s *Server) removeB2DropAccountHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	allow, user := Authorization{s, w, r}.allowManageB2DropAccount()
+	if user == nil || !allow {
+		return
+	}
+
+	err := s.db.RemoveB2DropAccount(user.ID)
+	if err != nil {
+		Response{w}.ServerError("cannot remove the B2DROP account", err)
+		return
+	}
+	Response{w}.Ok("")
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 
 // role related handlers
@@ -151,6 +282,22 @@ func (s *Server) listRolesHandler(w http.ResponseWriter, r *http.Request, e envi
 	Response{w}.Ok(jmap("Roles", roles))
 }
 
+// listRoleGrantsHandler lists the roles of all the users, showing which were asserted
+// by an identity provider (Source) and which were granted by hand (empty Source)
+func (s *Server) listRoleGrantsHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	allow, _ := Authorization{s, w, r}.allowListRoleUsers()
+	if !allow {
+		return
+	}
+
+	grants, err := s.db.ListRoleGrants()
+	if err != nil {
+		Response{w}.ServerError("db error", err)
+		return
+	}
+	Response{w}.Ok(jmap("Grants", grants))
+}
+
 func (s *Server) listRoleUsersHandler(w http.ResponseWriter, r *http.Request, e environment) {
 	allow, _ := Authorization{s, w, r}.allowListRoleUsers()
 	if !allow {
@@ -246,91 +393,153 @@ func (s *Server) isSuperAdmin(user *db.User) bool {
 }
 
 func (s *Server) getCurrentUser(r *http.Request) (*db.User, error) {
-	accessToken := ""
+	user, _, err := s.getCurrentUserToken(r)
+	return user, err
+}
 
-	session, err := cookieStore.Get(r, sessionName)
-	if err != nil {
-		return nil, def.Err(err, "Cookie store error")
+// getCurrentUserToken returns the logged in user and the access token used to log in;
+// both are nil if the request has no token
+func (s *Server) getCurrentUserToken(r *http.Request) (*db.User, *db.Token, error) {
+	accessToken, err := s.getAccessToken(r)
+	if err != nil || accessToken == "" {
+		return nil, nil, err
 	}
 
-	accessTokenInterface := session.Values[AccessTokenCookieKey]
-	if accessTokenInterface != nil {
-		var ok bool
-		accessToken, ok = accessTokenInterface.(string)
-		if !ok {
-			return nil, def.Err(err, "Bad cookie value type")
-		}
-		// log.Println("\tuser authenticated by cookie")
+	token, err := s.db.GetTokenBySecret(accessToken)
+	if db.IsNoResultsError(err) || (err == nil && token.ID == 0) {
+		return nil, nil, def.AuthenticationErr("bad access token")
 	}
-	if accessToken == "" {
-		accessTokenList, ok := r.URL.Query()[AccessTokenQueryParam]
-		if !ok || len(accessTokenList) == 0 {
-			// no access_token
-			return nil, nil
-		}
-		if len(accessTokenList) > 1 {
-			return nil, def.Err(err, "too many access token parameters")
-		}
-		accessToken = accessTokenList[0]
-		if accessToken == "" {
-			return nil, nil // no user, no error
-		}
-		// log.Println("\tuser authenticated by access_token")
+	if err != nil {
+		return nil, nil, def.Err(err, "GetTokenBySecret error")
 	}
-
-	token, err := s.db.GetTokenBySecret(accessToken)
-	if err != nil || token.ID == 0 || token.Secret != accessToken {
-		return nil, def.Err(err, "bad access token")
+	if !token.Expire.IsZero() && time.Now().After(token.Expire) {
+		return nil, nil, def.AuthenticationErr("expired access token")
 	}
 
 	user, err := s.db.GetUserByID(token.UserID)
 	if err != nil || user.ID == 0 {
-		return nil, def.Err(err, "GetUserByID error")
+		return nil, nil, def.Err(err, "GetUserByID error")
 	}
 
-	return user, nil
+	return user, &token, nil
 }
 
-// getUserOrWriteError returns the logged in user or writes errors into the http stream
-func (s *Server) getUserOrWriteError(w http.ResponseWriter, r *http.Request) *db.User {
-	user, err := s.getCurrentUser(r)
+// getAccessToken returns the access token of a request: a bearer token in the Authorization
+// header, the token of the web UI session, or the access_token query parameter if the server
+// accepts tokens in the URLs; an empty string if the request has no token
+func (s *Server) getAccessToken(r *http.Request) (string, error) {
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		fields := strings.Fields(authorization)
+		if len(fields) > 0 && strings.EqualFold(fields[0], "Bearer") {
+			if len(fields) != 2 {
+				return "", def.AuthenticationErr("the Authorization header should be: Bearer <access token>")
+			}
+			return fields[1], nil
+		}
+	}
+
+	session, err := cookieStore.Get(r, sessionName)
 	if err != nil {
-		Response{w}.ServerError("User error", err)
-		return nil
+		return "", def.Err(err, "Cookie store error")
+	}
+	if accessTokenInterface := session.Values[AccessTokenCookieKey]; accessTokenInterface != nil {
+		accessToken, ok := accessTokenInterface.(string)
+		if !ok {
+			return "", def.Err(nil, "Bad cookie value type")
+		}
+		return accessToken, nil
+	}
+
+	accessTokenList := r.URL.Query()[AccessTokenQueryParam]
+	if len(accessTokenList) == 0 {
+		return "", nil
+	}
+	if s.rejectURLAccessTokens {
+		return "", def.AuthenticationErr("access tokens are not accepted in the URL, send them in the Authorization header")
+	}
+	if len(accessTokenList) > 1 {
+		return "", def.AuthenticationErr("too many access token parameters")
+	}
+	return accessTokenList[0], nil
+}
+
+// getUserOrWriteError returns the logged in user and the access token used to log in,
+// or writes errors into the http stream
+func (s *Server) getUserOrWriteError(w http.ResponseWriter, r *http.Request) (*db.User, *db.Token) {
+	user, token, err := s.getCurrentUserToken(r)
+	if !writeUserError(w, err) {
+		return nil, nil
 	}
 	if user == nil {
 		Response{w}.Unauthorized()
-		return nil
+		return nil, nil
 	}
-	return user
+	return user, token
 }
 
-///////////////////////////////////////////////////////////////////////////////
-
-var oauthCfg oauth2.Config
-var userInfoURL string
-
-func initB2Access(cfg def.B2AccessConfig) {
-	if !strings.HasSuffix(cfg.BaseURL, "/") {
-		cfg.BaseURL += "/"
+// writeUserError writes the error of getCurrentUserToken into the http stream,
+// returning false if there was one
+func writeUserError(w http.ResponseWriter, err error) bool {
+	if authErr, ok := err.(def.AuthenticationError); ok {
+		Response{w}.BadCredentials(authErr)
+		return false
 	}
-	oauthCfg = oauth2.Config{
-		ClientID:     os.Getenv("GEF_B2ACCESS_CONSUMER_KEY"),
-		ClientSecret: os.Getenv("GEF_B2ACCESS_SECRET_KEY"),
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  cfg.BaseURL + "oauth2-as/oauth2-authz",
-			TokenURL: cfg.BaseURL + "oauth2/token",
-		},
-		RedirectURL: cfg.RedirectURL,
-		Scopes:      []string{"USER_PROFILE", "GENERATE_USER_CERTIFICATE", "email", "profile"},
+	if err != nil {
+		Response{w}.ServerError("User error", err)
+		return false
 	}
-	userInfoURL = cfg.BaseURL + "oauth2/userinfo"
+	return true
 }
 
+///////////////////////////////////////////////////////////////////////////////
+
+// loginChooserTemplate is the page listing the identity providers the users can log in with
+var loginChooserTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>GEF login</title></head>
+<body>
+<h1>Log in to the GEF with</h1>
+<ul>
+{{range .}}<li><a href="login?provider={{.ID}}">{{.Name}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// oauthLoginHandler sends the users to the identity provider given by the provider parameter;
+// without it, the users choose one if several are configured
 func (s *Server) oauthLoginHandler(w http.ResponseWriter, r *http.Request, e environment) {
-	statebuf := make([]byte, 16)
-	rand.Read(statebuf)
-	state := base64.URLEncoding.EncodeToString(statebuf)
+	providerID := r.FormValue("provider")
+	logParam("provider", providerID)
+	if providerID == "" && len(s.loginProviders) > 1 {
+		type providerInfo struct{ ID, Name string }
+		var providers []providerInfo
+		for _, p := range s.loginProviders {
+			id, name := p.info()
+			providers = append(providers, providerInfo{id, name})
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := loginChooserTemplate.Execute(w, providers)
+		if err != nil {
+			log.Println("ERROR: cannot write the login page:", err)
+		}
+		return
+	}
+	if providerID == "" && len(s.loginProviders) == 1 {
+		providerID, _ = s.loginProviders[0].info()
+	}
+	provider := s.getLoginProvider(providerID)
+	if provider == nil {
+		Response{w}.ClientError("unknown identity provider", def.Err(nil, "%s", providerID))
+		return
+	}
+
+	state, nonce := randomURLString(), randomURLString()
+	url, err := provider.authCodeURL(state, nonce)
+	if err != nil {
+		Response{w}.ServerError("Identity provider error", err)
+		return
+	}
 
 	session, err := cookieStore.Get(r, sessionName)
 	if err != nil {
@@ -338,13 +547,85 @@ func (s *Server) oauthLoginHandler(w http.ResponseWriter, r *http.Request, e env
 		return
 	}
 	session.Values["state"] = state
+	session.Values["nonce"] = nonce
+	session.Values["provider"] = providerID
 	session.Save(r, w)
 
-	url := oauthCfg.AuthCodeURL(state)
 	http.Redirect(w, r, url, 302)
 }
 
+func (s *Server) getLoginProvider(providerID string) loginProvider {
+	for _, p := range s.loginProviders {
+		if id, _ := p.info(); id == providerID {
+			return p
+		}
+	}
+	return nil
+}
+
+func randomURLString() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return base64.URLEncoding.EncodeToString(buf)
+}
+
+// addLoginIdentity links the subject of a provider to a new user, or to the user having the
+// same email address. The login providers are trusted to verify the email addresses only
+// when configured to link the accounts, besides B2ACCESS for the accounts created before
+// the identities were recorded, which are not linked to any provider
+func (s *Server) addLoginIdentity(provider loginProvider, userInfo loginIdentity) (*db.User, error) {
+	providerID, providerName := provider.info()
+	user, err := s.db.GetUserByEmail(userInfo.Email)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		log.Println("new user: ", userInfo.Name, userInfo.Email)
+		now := time.Now()
+		_user, err := s.db.AddUser(db.User{
+			Name:    userInfo.Name,
+			Email:   userInfo.Email,
+			Created: now,
+			Updated: now,
+		})
+		if err != nil {
+			return nil, err
+		}
+		user = &_user
+	} else {
+		identities, err := s.db.ListUserIdentities(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		linkable := provider.linksAccounts() || (providerID == b2accessProviderID && len(identities) == 0)
+		for _, identity := range identities {
+			if identity.Provider == providerID {
+				linkable = false
+			}
+		}
+		if !linkable {
+			return nil, def.AuthenticationErr("the account of %s is not linked to %s", userInfo.Email, providerName)
+		}
+		log.Println("linking the account of", userInfo.Email, "to", providerID, userInfo.Subject)
+	}
+	err = s.db.AddUserIdentity(db.UserIdentity{UserID: user.ID, Provider: providerID, Subject: userInfo.Subject})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// oauthCallbackHandler is where B2ACCESS sends back the users
 func (s *Server) oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	s.loginCallback(w, r, b2accessProviderID)
+}
+
+// oidcCallbackHandler is where the OpenID Connect providers send back the users
+func (s *Server) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	s.loginCallback(w, r, mux.Vars(r)["providerID"])
+}
+
+func (s *Server) loginCallback(w http.ResponseWriter, r *http.Request, providerID string) {
 	session, err := cookieStore.Get(r, sessionName)
 	if err != nil {
 		Response{w}.ServerError("Cookie store error", err)
@@ -352,64 +633,60 @@ func (s *Server) oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// log.Println("received state: ", r.URL.Query().Get("state"))
-	if r.URL.Query().Get("state") != session.Values["state"] {
+	if r.URL.Query().Get("state") != session.Values["state"] || session.Values["provider"] != providerID {
 		Response{w}.ServerError("State mismatch, CSRF or cookies not enabled?", nil)
 		return
 	}
+	nonce, _ := session.Values["nonce"].(string)
+	// the state and the nonce are only used once
+	delete(session.Values, "state")
+	delete(session.Values, "nonce")
+	delete(session.Values, "provider")
+	session.Save(r, w)
 
-	// log.Println("received code: ", r.URL.Query().Get("code"))
-	tkn, err := oauthCfg.Exchange(oauth2.NoContext, r.URL.Query().Get("code"))
-	if err != nil {
-		Response{w}.ServerError("Error while getting access token", err)
+	if idpError := r.URL.Query().Get("error"); idpError != "" {
+		Response{w}.ClientError("Login refused by the identity provider",
+			def.Err(nil, "%s %s", idpError, r.URL.Query().Get("error_description")))
 		return
 	}
-
-	// log.Println("exchanged for token: ", tkn)
-	if !tkn.Valid() {
-		Response{w}.ServerError(fmt.Sprintf("Received invalid access token: %s", tkn), nil)
+	provider := s.getLoginProvider(providerID)
+	if provider == nil {
+		Response{w}.ClientError("unknown identity provider", def.Err(nil, "%s", providerID))
 		return
 	}
 
-	resp, err := oauthCfg.Client(oauth2.NoContext, tkn).Get(userInfoURL)
-	if err != nil {
-		Response{w}.ServerError("Error while getting user info", err)
+	// log.Println("received code: ", r.URL.Query().Get("code"))
+	userInfo, err := provider.identify(r.URL.Query().Get("code"), nonce)
+	if _, ok := err.(def.AuthenticationError); ok {
+		Response{w}.ClientError("Login failed", err)
 		return
 	}
-
-	// extract user info provided by B2ACCESS
-	type userInfoType struct {
-		Name  string `json:"name"`
-		Email string `json:"email"`
-	}
-	var userInfo userInfoType
-	err = json.NewDecoder(resp.Body).Decode(&userInfo)
 	if err != nil {
-		Response{w}.ServerError("Error while deserialising user info", err)
+		Response{w}.ServerError("Login failed", err)
 		return
 	}
+	if userInfo.Subject == "" || userInfo.Email == "" {
+		Response{w}.ClientError("Login failed", def.Err(nil, "the identity provider did not give a subject identifier and an email address"))
+		return
+	}
+	log.Println("login from", providerID, "of", userInfo.Subject, userInfo.Email, "entitlements:", userInfo.Entitlements)
 
-	// put user in the database if not already there
-	user, err := s.db.GetUserByEmail(userInfo.Email)
+	// the users are found by the subject identifier asserted by the provider
+	user, err := s.db.GetUserByIdentity(providerID, userInfo.Subject)
 	if err != nil {
 		Response{w}.ServerError("Database error while retrieving user info", err)
 		return
 	}
 	if user == nil {
-		// user not found
-		log.Println("new user: ", userInfo)
-		now := time.Now()
-		user = &db.User{
-			Name:    userInfo.Name,
-			Email:   userInfo.Email,
-			Created: now,
-			Updated: now,
+		user, err = s.addLoginIdentity(provider, userInfo)
+		if _, ok := err.(def.AuthenticationError); ok {
+			Response{w}.ClientError("Login failed", err)
+			return
 		}
-		_user, err := s.db.AddUser(*user)
 		if err != nil {
 			Response{w}.ServerError("Error while adding user to db", err)
 			return
 		}
-		user = &_user
 	}
 
 	// update user data if necessary
@@ -419,28 +696,35 @@ func (s *Server) oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		s.db.UpdateUser(*user)
 	}
 
-	// create access token for the UI if necessary
+	// the community roles follow the entitlements asserted by the identity provider
+	_, err = s.syncLoginRoles(*user, providerID, userInfo.Entitlements)
+	if err != nil {
+		Response{w}.ServerError("Error while synchronizing the user roles", err)
+		return
+	}
+
+	// create an access token for the UI session; the secrets are stored hashed, so the
+	// tokens of the previous sessions cannot be reused. The expired ones are removed
 	tokenList, err := s.db.GetUserTokens(user.ID)
 	if err != nil {
 		Response{w}.ServerError("Error while retrieving user tokens", err)
 		return
 	}
-	accessToken := ""
 	for _, token := range tokenList {
-		if token.Name == AccessTokenCookieKey {
-			accessToken = token.Secret
-			break
+		if token.Name == AccessTokenCookieKey && time.Now().After(token.Expire) {
+			err = s.db.DeleteUserToken(user.ID, token.ID)
+			if err != nil {
+				log.Println("cannot remove expired UI token:", err)
+			}
 		}
 	}
-	if accessToken == "" {
-		expire := time.Now().AddDate(100, 0, 0)
-		token, err := s.db.NewUserToken(user.ID, AccessTokenCookieKey, expire)
-		if err != nil {
-			Response{w}.ServerError("Error while creating user token", err)
-			return
-		}
-		accessToken = token.Secret
+	expire := time.Now().Add(uiAccessTokenLifetime)
+	token, err := s.db.NewUserToken(user.ID, AccessTokenCookieKey, expire)
+	if err != nil {
+		Response{w}.ServerError("Error while creating user token", err)
+		return
 	}
+	accessToken := token.Secret
 
 	session.Values[AccessTokenCookieKey] = accessToken
 	session.Save(r, w)
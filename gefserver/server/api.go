@@ -1,10 +1,14 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -28,10 +32,8 @@ const (
 const apiRootPath = "/api"
 const wuiRootPath = "/wui"
 
-const (
-	buildsTmpDir = "builds"
-	inputTmpDir  = "inputs"
-)
+// b2dropWebDAVPath is the WebDAV root of the user folders, relative to the B2DROP BaseURL
+const b2dropWebDAVPath = "remote.php/webdav"
 
 // Server is a master struct for serving HTTP API requests
 type Server struct {
@@ -42,8 +44,13 @@ type Server struct {
 	db                     *db.Db
 	tmpDir                 string
 	administration         def.AdminConfig
+	b2share                def.B2ShareConfig
+	b2dropWebDAVURL        string
 	limits                 def.LimitConfig
 	timeouts               def.TimeoutConfig
+	rejectURLAccessTokens  bool
+	loginProviders         []loginProvider
+	roleMappings           []roleMapping
 }
 
 // NewServer creates a new Server
@@ -52,6 +59,14 @@ func NewServer(cfg def.Configuration, pier *pier.Pier, database *db.Db) (*Server
 	if err != nil {
 		return nil, def.Err(err, "creating temporary directory failed")
 	}
+	loginProviders, err := newLoginProviders(cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+	roleMappings, err := newRoleMappings(cfg.Server.RoleMappings)
+	if err != nil {
+		return nil, err
+	}
 
 	server := &Server{
 		Server: http.Server{
@@ -65,8 +80,13 @@ func NewServer(cfg def.Configuration, pier *pier.Pier, database *db.Db) (*Server
 		db:                     database,
 		tmpDir:                 tmpDir,
 		administration:         cfg.Server.Administration,
+		b2share:                cfg.Server.B2Share,
+		b2dropWebDAVURL:        strings.TrimRight(cfg.Server.B2Drop.BaseURL, "/") + "/" + b2dropWebDAVPath,
 		limits:                 cfg.Limits,
 		timeouts:               cfg.Timeouts,
+		rejectURLAccessTokens:  cfg.Server.RejectURLAccessTokens,
+		loginProviders:         loginProviders,
+		roleMappings:           roleMappings,
 	}
 
 	routes := []struct {
@@ -83,11 +103,25 @@ func NewServer(cfg def.Configuration, pier *pier.Pier, database *db.Db) (*Server
 		{"GET /user/tokens", server.listTokenHandler, "access discovery"},
 		{"DELETE /user/tokens/{tokenID}", server.removeTokenHandler, "access management"},
 
+		{"GET /user/b2drop", server.getB2DropAccountHandler, "access discovery"},
+		{"PUT /user/b2drop", server.setB2DropAccountHandler, "access management"},
+		{"DELETE /user/b2drop", server.removeB2DropAccountHandler, "access management"},
+
 		{"GET /roles", server.listRolesHandler, "access discovery"},
+		{"GET /roles/grants", server.listRoleGrantsHandler, "access discovery"},
 		{"GET /roles/{roleID}", server.listRoleUsersHandler, "access discovery"},
 		{"POST /roles/{roleID}", server.newRoleUserHandler, "access management"},
 		{"DELETE /roles/{roleID}/{userID}", server.removeRoleUserHandler, "access management"},
 
+		{"GET /communities", server.listCommunitiesHandler, "access discovery"},
+		{"POST /communities", server.newCommunityHandler, "access management"},
+		{"GET /communities/{communityID}", server.inspectCommunityHandler, "access discovery"},
+		{"PUT /communities/{communityID}", server.editCommunityHandler, "access management"},
+		{"DELETE /communities/{communityID}", server.removeCommunityHandler, "access management"},
+		{"GET /communities/{communityID}/members", server.listCommunityMembersHandler, "access discovery"},
+		{"POST /communities/{communityID}/members", server.addCommunityMemberHandler, "access management"},
+		{"DELETE /communities/{communityID}/members/{userID}", server.removeCommunityMemberHandler, "access management"},
+
 		{"POST /builds", server.newBuildImageHandler, "build initialization"},
 		{"POST /builds/{buildID}", server.startBuildImageHandler, "build start"},
 		{"GET /builds/{buildID}", server.inspectBuildImageHandler, "build discovery"},
@@ -97,12 +131,32 @@ func NewServer(cfg def.Configuration, pier *pier.Pier, database *db.Db) (*Server
 		{"PUT /services/{serviceID}", server.editServiceHandler, "service modification"},
 		{"DELETE /services/{serviceID}", server.removeServiceHandler, "service removal"},
 
+		{"POST /workflows", server.newWorkflowHandler, "workflow creation"},
+		{"GET /workflows", server.listWorkflowsHandler, "workflow discovery"},
+		{"GET /workflows/{workflowID}", server.inspectWorkflowHandler, "workflow discovery"},
+		{"DELETE /workflows/{workflowID}", server.removeWorkflowHandler, "workflow removal"},
+
 		{"POST /jobs", server.executeServiceHandler, "data analysis"},
 		{"GET /jobs", server.listJobsHandler, "data discovery"},
 		{"GET /jobs/{jobID}", server.inspectJobHandler, "data discovery"},
+		{"PATCH /jobs/{jobID}", server.editJobHandler, "data annotation"},
 		{"DELETE /jobs/{jobID}", server.removeJobHandler, "data cleanup"},
+		{"POST /jobs/{jobID}/cancel", server.cancelJobHandler, "data analysis"},
+		{"POST /jobs/{jobID}/retry", server.retryJobHandler, "data analysis"},
+		{"GET /jobs/{jobID}/logs", server.jobLogsHandler, "data discovery"},
+		{"GET /jobs/{jobID}/provenance", server.jobProvenanceHandler, "data discovery"},
+		{"POST /jobs/{jobID}/publish", server.publishJobHandler, "data publication"},
+		{"POST /jobs/{jobID}/b2drop", server.stageOutToB2DropHandler, "data publication"},
 
 		{"GET /volumes/{volumeID}/{path:.*}", server.volumeContentHandler, "data retrieval"},
+		{"HEAD /volumes/{volumeID}/{path:.*}", server.volumeContentHandler, "data retrieval"},
+
+		{"GET /cache", server.inspectInputCacheHandler, "cache discovery"},
+		{"DELETE /cache", server.purgeInputCacheHandler, "cache cleanup"},
+		{"DELETE /cache/{entryID}", server.purgeInputCacheHandler, "cache cleanup"},
+
+		{"GET /janitor", server.janitorReportHandler, "data cleanup"},
+		{"POST /janitor", server.runJanitorHandler, "data cleanup"},
 	}
 
 	router := mux.NewRouter()
@@ -115,12 +169,11 @@ func NewServer(cfg def.Configuration, pier *pier.Pier, database *db.Db) (*Server
 	{
 		wuirouter.HandleFunc("/login", server.decorate(server.oauthLoginHandler, "user login")).Methods("GET")
 		wuirouter.HandleFunc("/b2access", server.oauthCallbackHandler).Methods("GET")
+		wuirouter.HandleFunc("/oidc/{providerID}", server.oidcCallbackHandler).Methods("GET")
 		wuirouter.HandleFunc("/logout", server.decorate(server.logoutHandler, "user logout")).Methods("GET")
 	}
 	router.PathPrefix("/").Handler(http.FileServer(singlePageAppDir("../webui/app/")))
 
-	initB2Access(cfg.Server.B2Access)
-
 	server.Server.Handler = router
 
 	return server, nil
@@ -156,7 +209,7 @@ func (s *Server) newBuildImageHandler(w http.ResponseWriter, r *http.Request, e
 		return
 	}
 
-	_, buildID, err := def.NewRandomTmpDir(s.tmpDir, buildsTmpDir)
+	_, buildID, err := def.NewRandomTmpDir(s.tmpDir, pier.BuildsTmpDir)
 	if err != nil {
 		Response{w}.ServerError("cannot create tmp subdir", err)
 		return
@@ -195,7 +248,7 @@ func (s *Server) startBuildImageHandler(w http.ResponseWriter, r *http.Request,
 	tarArchiveName := ""
 	vars := mux.Vars(r)
 	buildID := vars["buildID"]
-	buildDir := filepath.Join(s.tmpDir, buildsTmpDir, buildID)
+	buildDir := filepath.Join(s.tmpDir, pier.BuildsTmpDir, buildID)
 
 	connectionID, err := s.getConnectionIDParam(r)
 	if err != nil {
@@ -324,12 +377,26 @@ func (s *Server) listServicesHandler(w http.ResponseWriter, r *http.Request, e e
 	if !allow {
 		return
 	}
-	services, err := s.db.ListServices()
+	user, err := s.getCurrentUser(r)
+	if err != nil {
+		Response{w}.ServerError("User error", err)
+		return
+	}
+	filter, err := s.readServiceFilter(r, user)
+	if err != nil {
+		Response{w}.ClientError("bad listing parameters", err)
+		return
+	}
+	filter.Viewer, allow = Authorization{s, w, r}.viewer()
+	if !allow {
+		return
+	}
+	services, total, err := s.db.FilterServices(filter)
 	if err != nil {
 		Response{w}.ClientError("cannot get services", err)
 		return
 	}
-	Response{w}.Ok(jmap("Services", services))
+	Response{w}.Ok(jmap("Services", services, "Total", total, "Offset", filter.Offset, "Limit", filter.Limit))
 }
 
 func (s *Server) inspectServiceHandler(w http.ResponseWriter, r *http.Request, e environment) {
@@ -377,6 +444,18 @@ func (s *Server) editServiceHandler(w http.ResponseWriter, r *http.Request, e en
 		Response{w}.ClientError("cannot retrieve old version of the service", err)
 		return
 	}
+	if service.CommunityID != oldService.CommunityID {
+		if service.CommunityID != 0 {
+			_, err = s.db.GetCommunityByID(service.CommunityID)
+			if err != nil {
+				Response{w}.ClientError("cannot find the community of the service", err)
+				return
+			}
+		}
+		if !(Authorization{s, w, r}.allowServiceCommunity(service.CommunityID)) {
+			return
+		}
+	}
 
 	err = s.db.RemoveService(service.ID)
 	if err != nil {
@@ -426,27 +505,144 @@ func (s *Server) removeServiceHandler(w http.ResponseWriter, r *http.Request, e
 	Response{w}.Ok(jmap("Service", service))
 }
 
-func (s *Server) executeServiceHandler(w http.ResponseWriter, r *http.Request, e environment) {
-	input := r.FormValue("pid")
-	if input == "" {
-		vars := mux.Vars(r)
-		input = vars["pid"]
+func (s *Server) newWorkflowHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	allow, user := Authorization{s, w, r}.allowCreateWorkflow()
+	if user == nil || !allow {
+		return
 	}
 
-	serviceID := r.FormValue("serviceID")
-	if serviceID == "" {
-		vars := mux.Vars(r)
-		serviceID = vars["serviceID"]
+	decoder := json.NewDecoder(r.Body)
+	var workflow db.Workflow
+	err := decoder.Decode(&workflow)
+	if err != nil {
+		Response{w}.ClientError("cannot get workflow from JSON", err)
+		return
 	}
-	logParam("serviceID", serviceID)
+	defer r.Body.Close()
 
+	workflow, err = s.pier.AddWorkflow(user.ID, workflow)
+	if err != nil {
+		Response{w}.ClientError("cannot add workflow", err)
+		return
+	}
+
+	loc, err := urljoin(r, string(workflow.ID))
+	if err != nil {
+		Response{w}.ServerError("urljoin error", err)
+		return
+	}
+	Response{w}.Location(loc).Created(jmap("Location", loc, "Workflow", workflow))
+}
+
+func (s *Server) listWorkflowsHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	allow, _ := Authorization{s, w, r}.allowListWorkflows()
+	if !allow {
+		return
+	}
+	workflows, err := s.db.ListWorkflows()
+	if err != nil {
+		Response{w}.ClientError("cannot get workflows", err)
+		return
+	}
+	Response{w}.Ok(jmap("Workflows", workflows))
+}
+
+func (s *Server) inspectWorkflowHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	vars := mux.Vars(r)
+	workflowID := db.WorkflowID(vars["workflowID"])
+
+	allow, _ := Authorization{s, w, r}.allowInspectWorkflow(workflowID)
+	if !allow {
+		return
+	}
+
+	workflow, err := s.db.GetWorkflow(workflowID)
+	if err != nil {
+		Response{w}.ClientError("cannot get workflow", err)
+		return
+	}
+	Response{w}.Ok(jmap("Workflow", workflow))
+}
+
+func (s *Server) removeWorkflowHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	vars := mux.Vars(r)
+	workflowID := db.WorkflowID(vars["workflowID"])
+
+	allow, _ := Authorization{s, w, r}.allowRemoveWorkflow(workflowID)
+	if !allow {
+		return
+	}
+
+	workflow, err := s.db.GetWorkflow(workflowID)
+	if err != nil {
+		Response{w}.ClientError("cannot find workflow", err)
+		return
+	}
+
+	err = s.db.RemoveWorkflow(workflowID)
+	if err != nil {
+		Response{w}.ClientError("cannot remove workflow", err)
+		return
+	}
+	Response{w}.Ok(jmap("Workflow", workflow))
+}
+
+func (s *Server) executeServiceHandler(w http.ResponseWriter, r *http.Request, e environment) {
 	allow, user := Authorization{s, w, r}.allowCreateJob()
 	if !allow {
 		return
 	}
 
+	form, err := s.readJobForm(r, s.limits.MaxUploadSize)
+	submitted := false
+	defer func() {
+		if !submitted {
+			form.removeFiles()
+		}
+	}()
+	if err == errUploadTooLarge {
+		Response{w}.RequestTooLarge(fmt.Sprintf("the uploaded files exceed %d bytes", s.limits.MaxUploadSize))
+		return
+	} else if err != nil {
+		Response{w}.ClientError("cannot read the uploaded files", err)
+		return
+	}
+
+	name, description, labels, err := readJobMetadata(form)
+	if err != nil {
+		Response{w}.ClientError("invalid job metadata", err)
+		return
+	}
+
+	input := form.value("pid")
+
+	serviceID := form.value("serviceID")
+	logParam("serviceID", serviceID)
+
+	workflowID := form.value("workflowID")
+	logParam("workflowID", workflowID)
+
+	steps := []db.ServiceID{db.ServiceID(serviceID)}
+	if workflowID != "" {
+		// the inputs of a workflow are the inputs of its first service
+		workflow, err := s.db.GetWorkflow(db.WorkflowID(workflowID))
+		if err != nil {
+			Response{w}.ClientError("cannot get workflow", err)
+			return
+		}
+		if len(workflow.Steps) == 0 {
+			Response{w}.ClientError("workflow has no services", nil)
+			return
+		}
+		serviceID = string(workflow.Steps[0])
+		steps = workflow.Steps
+	}
+
 	if serviceID == "" {
-		Response{w}.ServerNewError("execute docker image: serviceID required")
+		Response{w}.ServerNewError("execute docker image: serviceID or workflowID required")
+		return
+	}
+	if !(Authorization{s, w, r}.allowJobServices(steps)) {
 		return
 	}
 
@@ -456,40 +652,37 @@ func (s *Server) executeServiceHandler(w http.ResponseWriter, r *http.Request, e
 		return
 	}
 
-	// getting multiple inputs
+	// getting multiple inputs; the uploaded files are staged as file inputs, the other values are checked
 	var allInputs []string
-	if input == "" {
-		for _, value := range service.Input {
-			inputName := "pid_" + value.ID
-			currentInput := r.FormValue(inputName)
-			if currentInput == "" {
-				vars := mux.Vars(r)
-				currentInput = vars[inputName]
-			}
-
-			// creating a temporary input file
-			if (strings.ToLower(value.Type) == "string") && (value.FileName != "") {
-				path, _, err := def.NewRandomTmpDir(s.tmpDir, inputTmpDir)
-				if err != nil {
-					Response{w}.ServerError("cannot create a temporary folder for an input file", err)
-					return
-				}
-				tmpFile, err := os.Create(filepath.Join(path, value.FileName))
-				if err != nil {
-					Response{w}.ServerError("cannot create a temporary input file", err)
-					return
-				}
-				defer tmpFile.Close()
-				_, err = tmpFile.WriteString(currentInput)
+	uploads := make(map[int]string)
+	ports := make([]db.IOPort, len(service.Input))
+	copy(ports, service.Input)
+	for i, port := range ports {
+		inputName := "pid_" + port.ID
+		uploaded, found := form.files[inputName]
+		if !found && i == 0 {
+			uploaded, found = form.files["pid"]
+		}
+		if found {
+			if port.FileName != "" {
+				renamed := filepath.Join(filepath.Dir(uploaded), port.FileName)
+				err = os.Rename(uploaded, renamed)
 				if err != nil {
-					Response{w}.ServerError("cannot write string data into a file", err)
+					Response{w}.ServerError("cannot rename the uploaded input file", err)
 					return
 				}
-				currentInput = filepath.Join(path, value.FileName)
+				uploaded = renamed
 			}
-			allInputs = append(allInputs, currentInput)
+			ports[i].Type = pier.InputTypeFile
+			uploads[i] = uploaded
+			allInputs = append(allInputs, "")
+		} else if input != "" && i == 0 {
+			allInputs = append(allInputs, input)
+		} else {
+			allInputs = append(allInputs, form.value(inputName))
 		}
-	} else {
+	}
+	if input != "" && len(ports) == 0 {
 		allInputs = append(allInputs, input)
 	}
 
@@ -498,11 +691,93 @@ func (s *Server) executeServiceHandler(w http.ResponseWriter, r *http.Request, e
 		return
 	}
 
-	job, err := s.pier.RunService(user.ID, service.ID, allInputs, s.limits, s.timeouts)
-	if err != nil {
+	var checkedPorts []db.IOPort
+	var values []string
+	for i, value := range allInputs {
+		if _, found := uploads[i]; found {
+			continue
+		}
+		if i < len(ports) {
+			checkedPorts = append(checkedPorts, ports[i])
+		}
+		values = append(values, value)
+	}
+	checked, invalid := pier.CheckInputs(checkedPorts, values)
+	if len(invalid) > 0 {
+		Response{w}.InvalidInputs(invalid)
+		return
+	}
+	allInputs = make([]string, len(ports))
+	for i := range ports {
+		if uploaded, found := uploads[i]; found {
+			allInputs[i] = uploaded
+		} else {
+			allInputs[i], checked = checked[0], checked[1:]
+		}
+	}
+
+	// the webdav inputs are files in the B2DROP folder of the user
+	for i, port := range ports {
+		if !pier.IsWebDAVInput(port) || allInputs[i] == "" {
+			continue
+		}
+		_, err = s.db.GetB2DropAccount(user.ID)
+		if err == nil {
+			allInputs[i], err = pier.WebDAVFileURL(s.b2dropWebDAVURL, allInputs[i])
+		} else if db.IsNoResultsError(err) {
+			err = errors.New("the B2DROP credentials of the user are not set")
+		}
+		if err != nil {
+			invalid = append(invalid, pier.InputError{ID: port.ID, Name: port.Name, Value: allInputs[i], Message: err.Error()})
+		}
+	}
+	if len(invalid) > 0 {
+		Response{w}.InvalidInputs(invalid)
+		return
+	}
+
+	// creating temporary input files
+	valueFiles := make(map[int]bool)
+	for i, port := range ports {
+		if !pier.IsValueInput(port) || allInputs[i] == "" {
+			continue
+		}
+		fileName := port.FileName
+		if fileName == "" {
+			fileName = port.ID
+		}
+		path, _, err := def.NewRandomTmpDir(s.tmpDir, pier.InputsTmpDir)
+		if err != nil {
+			Response{w}.ServerError("cannot create a temporary folder for an input file", err)
+			return
+		}
+		err = ioutil.WriteFile(filepath.Join(path, fileName), []byte(allInputs[i]), 0644)
+		if err != nil {
+			Response{w}.ServerError("cannot write string data into a file", err)
+			return
+		}
+		allInputs[i] = filepath.Join(path, fileName)
+		valueFiles[i] = true
+	}
+
+	// only the files created above for the request are copied from the GEF host
+	jobInputs := make([]db.JobInput, len(allInputs))
+	for i, src := range allInputs {
+		_, uploaded := uploads[i]
+		jobInputs[i] = db.JobInput{Source: src, Local: uploaded || valueFiles[i]}
+	}
+
+	// the metadata is stored with the job, before it is queued
+	job := db.Job{ServiceID: service.ID, WorkflowID: db.WorkflowID(workflowID), Name: name, Description: description, Labels: labels}
+	job, err = s.pier.StartJob(user.ID, job, jobInputs, s.limits, s.timeouts)
+	if quotaErr, ok := err.(pier.QuotaError); ok {
+		Response{w}.QuotaExceeded(quotaErr)
+		return
+	} else if err != nil {
 		Response{w}.ServerError("cannot read the requested file from the archive", err)
 		return
 	}
+	submitted = true
 
 	loc, err := urljoin(r, string(job.ID))
 	if err != nil {
@@ -512,19 +787,167 @@ func (s *Server) executeServiceHandler(w http.ResponseWriter, r *http.Request, e
 	Response{w}.Location(loc).Created(jmap("Location", loc, "jobID", job.ID))
 }
 
+var errUploadTooLarge = errors.New("upload too large")
+
+// maxFormValueSize limits the size of the values read from a multipart job form
+const maxFormValueSize = 10 << 20
+
+// jobForm holds the values and the uploaded files of a job request
+type jobForm struct {
+	r      *http.Request
+	values map[string]string
+	files  map[string]string // the paths of the uploaded files, by field name
+}
+
+// value returns a form value, also looking into the query and the route variables
+func (f jobForm) value(name string) string {
+	if v, ok := f.values[name]; ok && v != "" {
+		return v
+	}
+	if v := f.r.FormValue(name); v != "" {
+		return v
+	}
+	return mux.Vars(f.r)[name]
+}
+
+// removeFiles deletes the uploaded files, when the job was not created
+func (f jobForm) removeFiles() {
+	for _, path := range f.files {
+		err := os.RemoveAll(filepath.Dir(path))
+		if err != nil {
+			log.Println("ERROR: cannot remove uploaded file: ", err)
+		}
+	}
+}
+
+// readJobForm reads the values of a job request; the file parts of a multipart
+// request are streamed into temporary folders, failing with errUploadTooLarge
+// when they exceed maxUploadSize bytes all together (no limit if 0)
+func (s *Server) readJobForm(r *http.Request, maxUploadSize int64) (jobForm, error) {
+	form := jobForm{r: r, values: make(map[string]string), files: make(map[string]string)}
+	remaining := maxUploadSize
+
+	// the form is already parsed if the event system has read it
+	if r.MultipartForm != nil {
+		for name, values := range r.MultipartForm.Value {
+			form.values[name] = values[0]
+		}
+		for name, headers := range r.MultipartForm.File {
+			file, err := headers[0].Open()
+			if err != nil {
+				return form, err
+			}
+			n, err := s.saveUploadedFile(&form, name, headers[0].Filename, file, remaining)
+			file.Close()
+			if err != nil {
+				return form, err
+			}
+			remaining -= n
+		}
+		return form, nil
+	}
+
+	mr, err := r.MultipartReader()
+	if err == http.ErrNotMultipart {
+		return form, nil
+	} else if err != nil {
+		return form, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return form, err
+		}
+		if part.FileName() == "" {
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueSize))
+			if err != nil {
+				return form, err
+			}
+			form.values[part.FormName()] = string(value)
+			continue
+		}
+
+		log.Println("\tupload file " + part.FileName())
+		n, err := s.saveUploadedFile(&form, part.FormName(), part.FileName(), part, remaining)
+		if err != nil {
+			return form, err
+		}
+		remaining -= n
+	}
+	return form, nil
+}
+
+// saveUploadedFile copies an uploaded file into a new temporary folder, reading
+// at most remaining bytes if maxUploadSize is set, and returns its size
+func (s *Server) saveUploadedFile(form *jobForm, fieldName string, fileName string, src io.Reader, remaining int64) (int64, error) {
+	fileName = filepath.Base(fileName)
+	if fileName == "." || fileName == "/" || fileName == ".." {
+		fileName = fieldName
+	}
+	path, _, err := def.NewRandomTmpDir(s.tmpDir, pier.InputsTmpDir)
+	if err != nil {
+		return 0, err
+	}
+	dstPath := filepath.Join(path, fileName)
+	form.files[fieldName] = dstPath
+
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+	if s.limits.MaxUploadSize > 0 {
+		// one more byte to detect the excess
+		src = io.LimitReader(src, remaining+1)
+	}
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return n, err
+	}
+	if s.limits.MaxUploadSize > 0 && n > remaining {
+		return n, errUploadTooLarge
+	}
+	return n, nil
+}
+
 func (s *Server) listJobsHandler(w http.ResponseWriter, r *http.Request, e environment) {
 	allow, _ := Authorization{s, w, r}.allowListJobs()
 	if !allow {
 		return
 	}
 
-	jobs, err := s.db.ListJobs()
-
+	// the viewer is nil for the superadministrators using a token with the admin scope
+	viewer, allow := Authorization{s, w, r}.viewer()
+	if !allow {
+		return
+	}
+	user, err := s.getCurrentUser(r)
+	if err != nil {
+		Response{w}.ServerError("User error", err)
+		return
+	}
+	filter, err := s.readJobFilter(r, user, viewer == nil)
+	if err == errOthersJobs {
+		Response{w}.Forbidden(err.Error())
+		return
+	} else if err != nil {
+		Response{w}.ClientError("bad listing parameters", err)
+		return
+	}
+	if user == nil {
+		// the anonymous users own no jobs, and cannot list those of the other users
+		Response{w}.Ok(jmap("Jobs", []db.Job{}, "Total", int64(0), "Offset", filter.Offset, "Limit", filter.Limit))
+		return
+	}
+	filter.Viewer = viewer
+	jobs, total, err := s.db.FilterJobs(filter)
 	if err != nil {
 		Response{w}.ClientError("cannot get jobs", err)
 		return
 	}
-	Response{w}.Ok(jmap("Jobs", jobs))
+	Response{w}.Ok(jmap("Jobs", jobs, "Total", total, "Offset", filter.Offset, "Limit", filter.Limit))
 }
 
 func (s *Server) inspectJobHandler(w http.ResponseWriter, r *http.Request, e environment) {
@@ -543,21 +966,101 @@ func (s *Server) inspectJobHandler(w http.ResponseWriter, r *http.Request, e env
 	Response{w}.Ok(jmap("Job", job))
 }
 
-func (s *Server) removeJobHandler(w http.ResponseWriter, r *http.Request, e environment) {
+// jobProvenanceHandler returns the provenance of a job as PROV-JSON, or as PROV-O
+// Turtle if asked with format=turtle or with an Accept header of text/turtle
+func (s *Server) jobProvenanceHandler(w http.ResponseWriter, r *http.Request, e environment) {
 	vars := mux.Vars(r)
 	jobID := db.JobID(vars["jobID"])
-	allow, _ := Authorization{s, w, r}.allowRemoveJob(jobID)
+	allow, _ := Authorization{s, w, r}.allowInspectJob(jobID)
 	if !allow {
 		return
 	}
 
+	namespace, err := absoluteURL(r, "../../..")
+	if err != nil {
+		Response{w}.ServerError("cannot build the provenance namespace", err)
+		return
+	}
+	provenance, err := s.pier.GetJobProvenance(jobID, namespace+"/")
+	if err != nil {
+		Response{w}.ClientError("cannot get the job provenance", err)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/turtle") {
+		format = "turtle"
+	}
+	switch format {
+	case "", "json":
+		Response{w}.Ok(provenance.JSON())
+	case "turtle":
+		w.Header().Set("Content-Type", "text/turtle; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(provenance.Turtle()))
+	default:
+		Response{w}.ClientError("unknown provenance format: "+format, nil)
+	}
+}
+
+func (s *Server) editJobHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	vars := mux.Vars(r)
+	jobID := db.JobID(vars["jobID"])
+	allow, _ := Authorization{s, w, r}.allowEditJob(jobID)
+	if !allow {
+		return
+	}
+
+	var patch jobMetadataPatch
+	err := json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		Response{w}.ClientError("cannot get the job metadata from JSON", err)
+		return
+	}
+	defer r.Body.Close()
+
 	job, err := s.db.GetJob(jobID)
 	if err != nil {
-		Response{w}.ClientError(err.Error(), err)
+		Response{w}.ClientError("cannot get job", err)
+		return
+	}
+	if patch.Name != nil {
+		job.Name = *patch.Name
+	}
+	if patch.Description != nil {
+		job.Description = *patch.Description
+	}
+	if patch.Labels != nil {
+		job.Labels = patch.Labels
+	}
+	err = checkJobMetadata(job.Name, job.Description, job.Labels)
+	if err != nil {
+		Response{w}.ClientError("invalid job metadata", err)
 		return
 	}
 
-	err = s.db.RemoveJob(jobID)
+	err = s.db.SetJobMetadata(jobID, job.Name, job.Description, job.Labels)
+	if err != nil {
+		Response{w}.ServerError("cannot set the job metadata", err)
+		return
+	}
+	job, err = s.db.GetJob(jobID)
+	if err != nil {
+		Response{w}.ServerError("cannot get job", err)
+		return
+	}
+	Response{w}.Ok(jmap("Job", job))
+}
+
+func (s *Server) removeJobHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	vars := mux.Vars(r)
+	jobID := db.JobID(vars["jobID"])
+	allow, user := Authorization{s, w, r}.allowRemoveJob(jobID)
+	if !allow {
+		return
+	}
+
+	job, err := s.pier.RemoveJob(user.ID, jobID)
 	if err != nil {
 		Response{w}.ClientError(err.Error(), err)
 		return
@@ -565,6 +1068,164 @@ func (s *Server) removeJobHandler(w http.ResponseWriter, r *http.Request, e envi
 	Response{w}.Ok(jmap("Job", job))
 }
 
+func (s *Server) cancelJobHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	vars := mux.Vars(r)
+	jobID := db.JobID(vars["jobID"])
+	allow, user := Authorization{s, w, r}.allowCancelJob(jobID)
+	if !allow {
+		return
+	}
+
+	job, err := s.pier.CancelJob(user.ID, jobID)
+	if err != nil {
+		Response{w}.ClientError("cannot cancel job", err)
+		return
+	}
+	Response{w}.Ok(jmap("Job", job))
+}
+
+func (s *Server) retryJobHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	vars := mux.Vars(r)
+	jobID := db.JobID(vars["jobID"])
+	allow, user := Authorization{s, w, r}.allowRetryJob(jobID)
+	if !allow {
+		return
+	}
+
+	job, err := s.pier.RetryJob(user.ID, jobID, s.limits, s.timeouts)
+	if quotaErr, ok := err.(pier.QuotaError); ok {
+		Response{w}.QuotaExceeded(quotaErr)
+		return
+	} else if err != nil {
+		Response{w}.ClientError("cannot retry job", err)
+		return
+	}
+
+	loc, err := urljoin(r, "../../"+string(job.ID))
+	if err != nil {
+		Response{w}.ServerError("urljoin error", err)
+		return
+	}
+	Response{w}.Location(loc).Created(jmap("Location", loc, "jobID", job.ID))
+}
+
+// publishJobHandler starts publishing the output volumes of a job as a new B2SHARE
+// record; the progress is reported by the job tasks and its Publication field
+func (s *Server) publishJobHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	vars := mux.Vars(r)
+	jobID := db.JobID(vars["jobID"])
+	allow, _ := Authorization{s, w, r}.allowPublishJob(jobID)
+	if !allow {
+		return
+	}
+
+	target := pier.B2SharePublication{
+		URL:         r.FormValue("b2shareURL"),
+		AccessToken: r.FormValue("b2shareToken"),
+	}
+	if target.URL == "" {
+		target.URL = s.b2share.BaseURL
+	}
+	if metadata := r.FormValue("metadata"); metadata != "" {
+		err := json.Unmarshal([]byte(metadata), &target.Metadata)
+		if err != nil {
+			Response{w}.ClientError("the metadata must be a JSON object", err)
+			return
+		}
+	}
+
+	job, err := s.pier.PublishJob(jobID, target, s.limits, s.timeouts)
+	if err != nil {
+		Response{w}.ClientError("cannot publish job", err)
+		return
+	}
+	Response{w}.Ok(jmap("Job", job))
+}
+
+// stageOutToB2DropHandler starts copying the output volumes of a job into a folder
+// of the B2DROP account of the user
+func (s *Server) stageOutToB2DropHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	vars := mux.Vars(r)
+	jobID := db.JobID(vars["jobID"])
+	allow, user := Authorization{s, w, r}.allowPublishJob(jobID)
+	if user == nil || !allow {
+		return
+	}
+
+	folder := r.FormValue("folder")
+	if folder == "" {
+		folder = "GEF/" + string(jobID)
+	}
+	logParam("folder", folder)
+	folder = strings.TrimPrefix(path.Clean("/"+folder), "/")
+	if folder == "" {
+		Response{w}.ClientError("the B2DROP folder cannot be the root folder", nil)
+		return
+	}
+	folderURL, err := pier.WebDAVFileURL(s.b2dropWebDAVURL, folder)
+	if err != nil {
+		Response{w}.ClientError("bad B2DROP folder", err)
+		return
+	}
+
+	job, err := s.pier.StageOutToB2Drop(user.ID, jobID, folderURL, s.limits, s.timeouts)
+	if err != nil {
+		Response{w}.ClientError("cannot copy the job results to B2DROP", err)
+		return
+	}
+	Response{w}.Ok(jmap("Job", job))
+}
+
+// jobLogsHandler sends the console output of a job's tasks as Server-Sent Events.
+// Each event id is a position in the output: clients reconnecting with the
+// Last-Event-ID header (as browsers do automatically) resume where they stopped.
+func (s *Server) jobLogsHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	vars := mux.Vars(r)
+	jobID := db.JobID(vars["jobID"])
+	allow, _ := Authorization{s, w, r}.allowInspectJob(jobID)
+	if !allow {
+		return
+	}
+
+	follow := r.FormValue("follow") == "true"
+	var from pier.LogPosition
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		_, err := fmt.Sscanf(lastEventID, "%d:%d", &from.Task, &from.Offset)
+		if err != nil {
+			Response{w}.ClientError("bad Last-Event-ID header", err)
+			return
+		}
+	}
+
+	_, err := s.db.GetJob(jobID)
+	if err != nil {
+		Response{w}.ClientError("cannot get job", err)
+		return
+	}
+
+	stream, ok := newEventStream(w, s.Server.WriteTimeout)
+	if !ok {
+		Response{w}.ServerNewError("streaming is not supported")
+		return
+	}
+	job, err := s.pier.StreamJobLogs(r.Context(), jobID, from, follow, jobLogStream{stream})
+	if err != nil {
+		log.Println("\tlog streaming stopped:", err)
+		return
+	}
+	stream.Event("", "end", jmap("State", job.State))
+}
+
+// jobLogStream sends the console output of a job as "output" events
+type jobLogStream struct {
+	eventStream
+}
+
+func (s jobLogStream) Output(task db.Task, chunk []byte, next pier.LogPosition) error {
+	id := fmt.Sprintf("%d:%d", next.Task, next.Offset)
+	return s.Event(id, "output", db.LatestOutput{Name: task.Name, ConsoleOutput: string(chunk)})
+}
+
 func (s *Server) volumeContentHandler(w http.ResponseWriter, r *http.Request, e environment) {
 	vars := mux.Vars(r)
 	volumeID := vars["volumeID"]
@@ -580,17 +1241,24 @@ func (s *Server) volumeContentHandler(w http.ResponseWriter, r *http.Request, e
 
 	fileLocation := vars["path"]
 	_, hasContent := r.URL.Query()["content"]
-	fileName := filepath.Base(fileLocation)
+	archive := r.URL.Query().Get("archive")
 
-	if hasContent { // Download a file from a volume
-		err := s.pier.DownStreamContainerFile(vars["volumeID"], filepath.Join("/root/volume/", fileLocation), s.limits, s.timeouts, w)
+	if archive != "" { // Download a folder or a whole volume as an archive
+		if !pier.IsArchiveFormat(archive) {
+			Response{w}.ClientError("unknown archive format, use tar.gz or zip", nil)
+			return
+		}
+		err := s.pier.DownStreamContainerArchive(volumeID, fileLocation, archive, s.limits, s.timeouts, w)
+		if err != nil {
+			Response{w}.ServerError("downloading volume archive failed", err)
+			return
+		}
+	} else if hasContent { // Download a file from a volume
+		err := s.pier.DownStreamContainerFile(vars["volumeID"], filepath.Join("/root/volume/", fileLocation), s.limits, s.timeouts, w, r)
 		if err != nil {
 			Response{w}.ServerError("downloading volume files failed", err)
 			return
 		}
-
-		Response{w}.Header().Set("Content-Type", r.Header.Get("Content-Type"))
-		Response{w}.Header().Set("Content-Disposition", "attachment; filename="+fileName)
 	} else { // Return of list of files in a specific location in a volume
 		volumeFiles, err := s.pier.ListFiles(db.VolumeID(vars["volumeID"]), fileLocation, s.limits, s.timeouts)
 		if err != nil {
@@ -600,3 +1268,72 @@ func (s *Server) volumeContentHandler(w http.ResponseWriter, r *http.Request, e
 		Response{w}.Ok(jmap("volumeID", vars["volumeID"], "volumeContent", volumeFiles))
 	}
 }
+
+func (s *Server) inspectInputCacheHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	allow, _ := Authorization{s, w, r}.allowManageInputCache()
+	if !allow {
+		return
+	}
+
+	cache, err := s.pier.GetInputCache()
+	if err != nil {
+		Response{w}.ServerError("cannot list the input cache", err)
+		return
+	}
+	Response{w}.Ok(jmap("InputCache", cache))
+}
+
+// purgeInputCacheHandler removes a file of the input cache, or all of them if no entryID is given
+func (s *Server) purgeInputCacheHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	allow, _ := Authorization{s, w, r}.allowManageInputCache()
+	if !allow {
+		return
+	}
+
+	entryID := mux.Vars(r)["entryID"]
+	err := s.pier.PurgeInputCache(entryID)
+	if db.IsNoResultsError(err) {
+		Response{w}.ClientError("unknown input cache entry", err)
+		return
+	}
+	if err != nil {
+		Response{w}.ServerError("cannot purge the input cache", err)
+		return
+	}
+	cache, err := s.pier.GetInputCache()
+	if err != nil {
+		Response{w}.ServerError("cannot list the input cache", err)
+		return
+	}
+	Response{w}.Ok(jmap("InputCache", cache))
+}
+
+// janitorReportHandler lists what the janitor would remove now, without removing anything
+func (s *Server) janitorReportHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	allow, _ := Authorization{s, w, r}.allowRunJanitor()
+	if !allow {
+		return
+	}
+
+	report, err := s.pier.RunJanitor(true)
+	if err != nil {
+		Response{w}.ServerError("cannot run the janitor", err)
+		return
+	}
+	Response{w}.Ok(jmap("Janitor", report))
+}
+
+// runJanitorHandler removes the expired jobs and the leftovers right away
+func (s *Server) runJanitorHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	allow, _ := Authorization{s, w, r}.allowRunJanitor()
+	if !allow {
+		return
+	}
+
+	report, err := s.pier.RunJanitor(false)
+	if err != nil {
+		Response{w}.ServerError("cannot run the janitor", err)
+		return
+	}
+	Response{w}.Ok(jmap("Janitor", report))
+}
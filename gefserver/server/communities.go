@@ -0,0 +1,297 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/gorilla/mux"
+)
+
+func (s *Server) listCommunitiesHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	allow, _ := Authorization{s, w, r}.allowListCommunities()
+	if !allow {
+		return
+	}
+
+	communities, err := s.db.ListCommunities()
+	if err != nil {
+		Response{w}.ServerError("db error", err)
+		return
+	}
+	Response{w}.Ok(jmap("Communities", communities))
+}
+
+func (s *Server) inspectCommunityHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	allow, _ := Authorization{s, w, r}.allowListCommunities()
+	if !allow {
+		return
+	}
+
+	community, ok := s.getCommunityParam(w, r)
+	if !ok {
+		return
+	}
+	roles, err := s.db.ListCommunityRoles(community.ID)
+	if err != nil {
+		Response{w}.ServerError("db error", err)
+		return
+	}
+	Response{w}.Ok(jmap("Community", community, "Roles", roles))
+}
+
+// newCommunityHandler creates a community with its Administrator and Member roles;
+// the administration of the community can be delegated to the user given by adminEmail
+func (s *Server) newCommunityHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	allow, _ := Authorization{s, w, r}.allowCreateCommunity()
+	if !allow {
+		return
+	}
+
+	name := r.FormValue("name")
+	logParam("name", name)
+	if name == "" {
+		Response{w}.ClientError("the community name is required", nil)
+		return
+	}
+	_, err := s.db.GetCommunityByName(name)
+	if err == nil {
+		Response{w}.ClientError("a community is already named "+name, nil)
+		return
+	} else if !db.IsNoResultsError(err) {
+		Response{w}.ServerError("db error", err)
+		return
+	}
+
+	var admin *db.User
+	if adminEmail := r.FormValue("adminEmail"); adminEmail != "" {
+		logParam("adminEmail", adminEmail)
+		admin, err = s.db.GetUserByEmail(adminEmail)
+		if err != nil {
+			Response{w}.ServerError("db error", err)
+			return
+		}
+		if admin == nil {
+			Response{w}.ClientError("User not found", nil)
+			return
+		}
+	}
+
+	community, err := s.db.AddCommunity(name, r.FormValue("description"), true)
+	if err != nil {
+		Response{w}.ServerError("db error", err)
+		return
+	}
+	if admin != nil {
+		role, err := s.db.GetRoleByName(db.CommunityAdminRoleName, community.ID)
+		if err != nil {
+			Response{w}.ServerError("db error", err)
+			return
+		}
+		err = s.db.AddRoleToUser(admin.ID, role.ID)
+		if err != nil {
+			Response{w}.ServerError("db error", err)
+			return
+		}
+	}
+
+	loc, err := urljoin(r, strconv.FormatInt(community.ID, 10))
+	if err != nil {
+		Response{w}.ServerError("cannot create URL", err)
+		return
+	}
+	Response{w}.Location(loc).Created(jmap("Location", loc, "Community", community))
+}
+
+// editCommunityHandler changes the name or the description of a community. Only the
+// superadministrators rename a community, and neither to nor from a community name of the
+// role mappings, which refer to the communities by name; the tokens and the quotas refer
+// to them by ID
+func (s *Server) editCommunityHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	community, ok := s.getCommunityParam(w, r)
+	if !ok {
+		return
+	}
+	allow, _ := Authorization{s, w, r}.allowManageCommunity(community.ID)
+	if !allow {
+		return
+	}
+
+	// the parameters which are not given keep their values
+	name, description := r.FormValue("name"), r.FormValue("description")
+	if _, ok := r.Form["name"]; ok && name != community.Name {
+		logParam("name", name)
+		allow, _ := Authorization{s, w, r}.allowRenameCommunity()
+		if !allow {
+			return
+		}
+		if name == "" {
+			Response{w}.ClientError("the community name cannot be empty", nil)
+			return
+		}
+		for _, m := range s.roleMappings {
+			if m.community == community.Name || m.community == name {
+				Response{w}.ClientError("the role mappings refer to the community "+m.community, nil)
+				return
+			}
+		}
+		community.Name = name
+	}
+	if _, ok := r.Form["description"]; ok {
+		community.Description = description
+	}
+	err := s.db.UpdateCommunity(community)
+	if err != nil {
+		Response{w}.ClientError("cannot update community", err)
+		return
+	}
+	Response{w}.Ok(jmap("Community", community))
+}
+
+// removeCommunityHandler removes a community with its roles; the services of the
+// community must be removed or made public first
+func (s *Server) removeCommunityHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	allow, _ := Authorization{s, w, r}.allowRemoveCommunity()
+	if !allow {
+		return
+	}
+
+	community, ok := s.getCommunityParam(w, r)
+	if !ok {
+		return
+	}
+	err := s.db.RemoveCommunity(community.ID)
+	if err != nil {
+		Response{w}.ClientError("cannot remove community", err)
+		return
+	}
+	Response{w}.Ok(jmap("Community", community))
+}
+
+// listCommunityMembersHandler lists the roles of the users in a community
+func (s *Server) listCommunityMembersHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	community, ok := s.getCommunityParam(w, r)
+	if !ok {
+		return
+	}
+	allow, _ := Authorization{s, w, r}.allowManageCommunity(community.ID)
+	if !allow {
+		return
+	}
+
+	members, err := s.db.ListCommunityMembers(community.ID)
+	if err != nil {
+		Response{w}.ServerError("db error", err)
+		return
+	}
+	Response{w}.Ok(jmap("Members", members))
+}
+
+// addCommunityMemberHandler gives a role of a community (Member by default) to the user
+// with the given userEmail
+func (s *Server) addCommunityMemberHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	community, ok := s.getCommunityParam(w, r)
+	if !ok {
+		return
+	}
+	allow, _ := Authorization{s, w, r}.allowManageCommunity(community.ID)
+	if !allow {
+		return
+	}
+
+	roleName := r.FormValue("role")
+	if roleName == "" {
+		roleName = db.CommunityMemberRoleName
+	}
+	logParam("role", roleName)
+	role, err := s.db.GetRoleByName(roleName, community.ID)
+	if db.IsNoResultsError(err) {
+		Response{w}.ClientError("the community has no role named "+roleName, nil)
+		return
+	} else if err != nil {
+		Response{w}.ServerError("db error", err)
+		return
+	}
+
+	userEmail := r.FormValue("userEmail")
+	logParam("userEmail", userEmail)
+	user, err := s.db.GetUserByEmail(userEmail)
+	if err != nil {
+		Response{w}.ServerError("db error", err)
+		return
+	}
+	if user == nil {
+		Response{w}.ClientError("User not found", nil)
+		return
+	}
+
+	err = s.db.AddRoleToUser(user.ID, role.ID)
+	if err != nil {
+		Response{w}.ServerError("db error", err)
+		return
+	}
+	Response{w}.Ok(jmap("User", user, "Role", role))
+}
+
+// removeCommunityMemberHandler takes a role of a community (given by the role parameter,
+// all of them by default) from a user
+func (s *Server) removeCommunityMemberHandler(w http.ResponseWriter, r *http.Request, e environment) {
+	community, ok := s.getCommunityParam(w, r)
+	if !ok {
+		return
+	}
+	allow, _ := Authorization{s, w, r}.allowManageCommunity(community.ID)
+	if !allow {
+		return
+	}
+
+	userID, err := strconv.ParseInt(mux.Vars(r)["userID"], 10, 64)
+	if err != nil {
+		Response{w}.ClientError("userID must be an int", err)
+		return
+	}
+	roleName := r.FormValue("role")
+	logParam("role", roleName)
+
+	roles, err := s.db.ListCommunityRoles(community.ID)
+	if err != nil {
+		Response{w}.ServerError("db error", err)
+		return
+	}
+	found := false
+	for _, role := range roles {
+		if roleName != "" && role.Name != roleName {
+			continue
+		}
+		found = true
+		err = s.db.DeleteRoleFromUser(userID, role.ID)
+		if err != nil {
+			Response{w}.ServerError("db error", err)
+			return
+		}
+	}
+	if !found {
+		Response{w}.ClientError("the community has no role named "+roleName, nil)
+		return
+	}
+	Response{w}.Ok("")
+}
+
+// getCommunityParam returns the community given by the communityID of the route,
+// or writes errors into the http stream
+func (s *Server) getCommunityParam(w http.ResponseWriter, r *http.Request) (db.Community, bool) {
+	communityID, err := strconv.ParseInt(mux.Vars(r)["communityID"], 10, 64)
+	if err != nil {
+		Response{w}.ClientError("communityID must be an int", err)
+		return db.Community{}, false
+	}
+	community, err := s.db.GetCommunityByID(communityID)
+	if db.IsNoResultsError(err) {
+		Response{w}.ClientError("community not found", err)
+		return db.Community{}, false
+	} else if err != nil {
+		Response{w}.ServerError("db error", err)
+		return db.Community{}, false
+	}
+	return community, true
+}
@@ -64,11 +64,16 @@ func (s *Server) decorate(apifn func(http.ResponseWriter, *http.Request, environ
 
 		var sysStatistics statistics
 
-		sysStatistics.UserRunningJobs = 0
 		if user != nil {
-			sysStatistics.UserRunningJobs = s.db.CountUserRunningJobs(user.ID)
+			sysStatistics.UserRunningJobs, err = s.db.CountUserRunningJobs(user.ID)
+			if err != nil {
+				log.Println("ERROR: cannot count the running jobs of the user: ", err)
+			}
+		}
+		sysStatistics.TotalRunningJobs, err = s.db.CountRunningJobs()
+		if err != nil {
+			log.Println("ERROR: cannot count the running jobs: ", err)
 		}
-		sysStatistics.TotalRunningJobs = s.db.CountRunningJobs()
 
 		allow, closefn, retEnv := sendEvent(actionType, user, userEnv, sysStatistics, r)
 		if !allow {
@@ -6,10 +6,12 @@ import (
 	"log"
 	"os"
 	"path"
+	"time"
 
 	"net/http"
 	"net/url"
 
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
 	"github.com/gorilla/sessions"
 )
 
@@ -49,6 +51,12 @@ func (w Response) ClientError(message string, err error) {
 	http.Error(w, str, 400)
 }
 
+// InvalidInputs sets a 400 error listing the invalid input values
+func (w Response) InvalidInputs(invalid []pier.InputError) {
+	log.Println("\tERROR: invalid inputs:", invalid)
+	setCodeAndBody(w, 400, jmap("Error", "invalid inputs", "InvalidInputs", invalid))
+}
+
 // Unauthorized sets a 401 error
 func (w Response) Unauthorized() {
 	str := fmt.Sprintf("Authentication required, please log in.")
@@ -56,6 +64,14 @@ func (w Response) Unauthorized() {
 	http.Error(w, str, 401)
 }
 
+// BadCredentials sets a 401 error, for requests with an invalid access token
+func (w Response) BadCredentials(err error) {
+	str := fmt.Sprintf("Authentication failed: %s", err.Error())
+	log.Println("\t" + str)
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	http.Error(w, str, 401)
+}
+
 // Forbidden sets a 403 error
 func (w Response) Forbidden(msg string) {
 	str := fmt.Sprintf("Access forbidden: " + msg)
@@ -63,6 +79,12 @@ func (w Response) Forbidden(msg string) {
 	http.Error(w, str, 403)
 }
 
+// QuotaExceeded sets a 403 error, for a job refused because a storage quota is exhausted
+func (w Response) QuotaExceeded(quota pier.QuotaError) {
+	log.Println("\tERROR:", quota.Error())
+	setCodeAndBody(w, 403, jmap("Error", quota.Error(), "Quota", quota))
+}
+
 // DirectiveError sets a 403 error
 func (w Response) DirectiveError() {
 	str := fmt.Sprintf("API denied by directive ERROR\n")
@@ -70,6 +92,13 @@ func (w Response) DirectiveError() {
 	http.Error(w, str, 403)
 }
 
+// RequestTooLarge sets a 413 error
+func (w Response) RequestTooLarge(message string) {
+	str := fmt.Sprintf("ERROR: %s", message)
+	log.Println("\t" + str)
+	http.Error(w, str, 413)
+}
+
 // ServerError sets a 500/server error
 func (w Response) ServerError(message string, err error) {
 	errstr := ""
@@ -133,6 +162,70 @@ func setCodeAndBody(w Response, code int, body interface{}) {
 	log.Println(" -> HTTP", code, ",", contentType, ",", len(data), "bytes")
 }
 
+// eventStream sends Server-Sent Events. A stream can last longer than the write timeout
+// of the server: the write deadline is pushed back before each event instead
+type eventStream struct {
+	w          http.ResponseWriter
+	flusher    http.Flusher
+	controller *http.ResponseController
+	timeout    time.Duration
+}
+
+// newEventStream starts an event stream response, if the connection can be flushed;
+// timeout is the time allowed to write each event, 0 for no limit
+func newEventStream(w http.ResponseWriter, timeout time.Duration) (eventStream, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return eventStream{}, false
+	}
+	es := eventStream{w, flusher, http.NewResponseController(w), timeout}
+	err := es.extendWriteDeadline()
+	if err != nil {
+		log.Println("ERROR: cannot extend the write deadline of the event stream:", err)
+		return eventStream{}, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+	log.Println(" -> HTTP 200 , text/event-stream")
+	return es, true
+}
+
+// extendWriteDeadline gives the stream the time to write one more event
+func (es eventStream) extendWriteDeadline() error {
+	deadline := time.Time{}
+	if es.timeout > 0 {
+		deadline = time.Now().Add(es.timeout)
+	}
+	return es.controller.SetWriteDeadline(deadline)
+}
+
+// Event sends an event with an optional id; the data is encoded
+// as JSON, which always fits in a single data line
+func (es eventStream) Event(id string, name string, data interface{}) error {
+	bs, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	err = es.extendWriteDeadline()
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		_, err = fmt.Fprintf(es.w, "id: %s\n", id)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(es.w, "event: %s\ndata: %s\n\n", name, bs)
+	if err != nil {
+		return err
+	}
+	es.flusher.Flush()
+	return nil
+}
+
 func jmap(kv ...interface{}) map[string]interface{} {
 	if len(kv) == 0 {
 		log.Println("ERROR: jsonmap: empty call")
@@ -169,3 +262,18 @@ func urljoin(r *http.Request, suffix string) (string, error) {
 	url.Path = path.Join(url.Path, suffix)
 	return url.String(), err
 }
+
+// absoluteURL is like urljoin, but returns an absolute URL, with the scheme and the host
+// the request was sent to
+func absoluteURL(r *http.Request, suffix string) (string, error) {
+	loc, err := urljoin(r, suffix)
+	if err != nil {
+		return "", err
+	}
+	url, err := url.Parse(loc)
+	url.Scheme, url.Host = "http", r.Host
+	if r.TLS != nil {
+		url.Scheme = "https"
+	}
+	return url.String(), err
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// limits of the metadata set by the owners of the jobs
+const (
+	maxJobNameLength        = 255
+	maxJobDescriptionLength = 4096
+	maxJobLabels            = 32
+	maxJobLabelValueLength  = 255
+)
+
+// jobLabelKeyPattern is the syntax of the label keys: up to 63 letters, digits
+// and ._/- characters, starting and ending with a letter or a digit
+var jobLabelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]{0,61}[A-Za-z0-9])?$`)
+
+// jobMetadataPatch is the body of a job edit request; the missing fields are left unchanged,
+// and the labels, if present, replace all the labels of the job
+type jobMetadataPatch struct {
+	Name        *string
+	Description *string
+	Labels      map[string]string
+}
+
+// readJobMetadata reads the name, the description and the labels (as a JSON object) given
+// with a new job
+func readJobMetadata(form jobForm) (string, string, map[string]string, error) {
+	name, description := form.value("name"), form.value("description")
+	var labels map[string]string
+	if v := form.value("labels"); v != "" {
+		err := json.Unmarshal([]byte(v), &labels)
+		if err != nil {
+			return name, description, nil, def.Err(err, "the labels should be a JSON object with string values")
+		}
+	}
+	return name, description, labels, checkJobMetadata(name, description, labels)
+}
+
+// checkJobMetadata checks the name, the description and the labels of a job
+func checkJobMetadata(name string, description string, labels map[string]string) error {
+	if utf8.RuneCountInString(name) > maxJobNameLength {
+		return def.Err(nil, "the job name is longer than %d characters", maxJobNameLength)
+	}
+	if utf8.RuneCountInString(description) > maxJobDescriptionLength {
+		return def.Err(nil, "the job description is longer than %d characters", maxJobDescriptionLength)
+	}
+	if len(labels) > maxJobLabels {
+		return def.Err(nil, "a job cannot have more than %d labels", maxJobLabels)
+	}
+	for key, value := range labels {
+		if !jobLabelKeyPattern.MatchString(key) {
+			return def.Err(nil, "invalid label key: %q", key)
+		}
+		if utf8.RuneCountInString(value) > maxJobLabelValueLength {
+			return def.Err(nil, "the value of label %s is longer than %d characters", key, maxJobLabelValueLength)
+		}
+	}
+	return nil
+}
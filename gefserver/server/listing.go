@@ -0,0 +1,158 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// jobStateCodes maps the names accepted by the state filter of the job listing to the state codes
+var jobStateCodes = map[string]int{"running": -1, "succeeded": 0, "failed": 1, "cancelled": 2}
+
+// errOthersJobs refuses the job listings of other users to the users who are not superadministrators
+var errOthersJobs = errors.New("only the superadministrators can list the jobs of other users")
+
+// listingParams reads the query parameters of a listing, keeping the first error
+type listingParams struct {
+	values url.Values
+	err    error
+}
+
+func (p *listingParams) setErr(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// nonNegativeInt reads an integer parameter, 0 if missing
+func (p *listingParams) nonNegativeInt(name string) int {
+	v := p.values.Get(name)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		p.setErr(def.Err(err, "the %s parameter should be a non negative integer", name))
+		return 0
+	}
+	return n
+}
+
+// boolean reads a boolean parameter, returning the default value if missing
+func (p *listingParams) boolean(name string, defaultValue bool) bool {
+	v := p.values.Get(name)
+	if v == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		p.setErr(def.Err(err, "the %s parameter should be true or false", name))
+		return defaultValue
+	}
+	return b
+}
+
+// time reads a time parameter in the RFC 3339 format, the zero time if missing
+func (p *listingParams) time(name string) time.Time {
+	v := p.values.Get(name)
+	if v == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		p.setErr(def.Err(err, "the %s parameter should be a RFC 3339 time", name))
+	}
+	return t
+}
+
+// sort reads the sort parameter, checking it against the sort keys
+func (p *listingParams) sort(keys map[string]string) string {
+	v := p.values.Get("sort")
+	if _, ok := keys[strings.TrimPrefix(v, "-")]; v != "" && !ok {
+		p.setErr(def.Err(nil, "unknown sort key: %s", v))
+		return ""
+	}
+	return v
+}
+
+// owner returns the owner selected by the owner and mine parameters, 0 for any owner
+func (p *listingParams) owner(user *db.User, mineByDefault bool) int64 {
+	if v := p.values.Get("owner"); v != "" {
+		ownerID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			p.setErr(def.Err(err, "the owner parameter should be a user ID"))
+		}
+		return ownerID
+	}
+	if !p.boolean("mine", mineByDefault) {
+		return 0
+	}
+	if user == nil {
+		p.setErr(def.Err(nil, "mine=true requires a logged in user"))
+		return 0
+	}
+	return user.ID
+}
+
+// readJobFilter reads the filters, the sort order and the page of the job listing;
+// the users who are not superadministrators, or whose token has not the admin scope, only
+// see their own jobs: they get errOthersJobs if they set mine=false, or the owner to another user
+func (s *Server) readJobFilter(r *http.Request, user *db.User, superAdmin bool) (db.JobFilter, error) {
+	p := listingParams{values: r.URL.Query()}
+	filter := db.JobFilter{
+		OwnerID:       p.owner(user, user != nil && !superAdmin),
+		ServiceID:     db.ServiceID(p.values.Get("serviceID")),
+		Name:          p.values.Get("name"),
+		ConnectionID:  db.ConnectionID(p.nonNegativeInt("connectionID")),
+		CreatedAfter:  p.time("createdAfter"),
+		CreatedBefore: p.time("createdBefore"),
+		Sort:          p.sort(db.JobSortKeys),
+		Limit:         p.nonNegativeInt("limit"),
+		Offset:        p.nonNegativeInt("offset"),
+	}
+	if states := p.values.Get("state"); states != "" {
+		for _, name := range strings.Split(states, ",") {
+			code, ok := jobStateCodes[name]
+			if !ok {
+				p.setErr(def.Err(nil, "unknown job state: %s", name))
+			}
+			filter.States = append(filter.States, code)
+		}
+	}
+	for _, label := range p.values["label"] {
+		if filter.Labels == nil {
+			filter.Labels = map[string]string{}
+		}
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		filter.Labels[kv[0]] = kv[1]
+	}
+	if p.err == nil && !superAdmin && (user == nil || filter.OwnerID != user.ID) &&
+		(p.values.Get("owner") != "" || p.values.Get("mine") != "") {
+		return filter, errOthersJobs
+	}
+	return filter, p.err
+}
+
+// readServiceFilter reads the filters, the sort order and the page of the service listing
+func (s *Server) readServiceFilter(r *http.Request, user *db.User) (db.ServiceFilter, error) {
+	p := listingParams{values: r.URL.Query()}
+	filter := db.ServiceFilter{
+		OwnerID:      p.owner(user, false),
+		ConnectionID: db.ConnectionID(p.nonNegativeInt("connectionID")),
+		Name:         p.values.Get("name"),
+		CommunityID:  int64(p.nonNegativeInt("communityID")),
+		Sort:         p.sort(db.ServiceSortKeys),
+		Limit:        p.nonNegativeInt("limit"),
+		Offset:       p.nonNegativeInt("offset"),
+	}
+	return filter, p.err
+}
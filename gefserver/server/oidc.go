@@ -0,0 +1,527 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // the hashes of the ID token signatures
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"golang.org/x/oauth2"
+)
+
+// b2accessProviderID names B2ACCESS among the login providers
+const b2accessProviderID = "b2access"
+
+// oidcClockSkew is how much the clocks of the GEF and of the identity providers may differ
+const oidcClockSkew = 2 * time.Minute
+
+// oidcClient is used for the requests to the identity providers, besides the token exchange
+var oidcClient = &http.Client{Timeout: 30 * time.Second}
+
+var providerIDRegexp = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// loginIdentity is what an identity provider asserts about the user logging in
+type loginIdentity struct {
+	Subject      string
+	Email        string
+	Name         string
+	Entitlements []string
+}
+
+// loginProvider is an identity provider the users can log in with
+type loginProvider interface {
+	// info returns the identifier of the provider, used in the URLs, and its display name
+	info() (id string, name string)
+	// authCodeURL returns where the users are sent to authenticate
+	authCodeURL(state string, nonce string) (string, error)
+	// identify exchanges the authorization code returned by the provider for the user identity;
+	// the rejected credentials are reported as def.AuthenticationError
+	identify(code string, nonce string) (loginIdentity, error)
+	// linksAccounts tells if the users can log in for the first time with the provider
+	// to an existing account having their email address
+	linksAccounts() bool
+}
+
+// newLoginProviders returns the configured identity providers, B2ACCESS first
+func newLoginProviders(cfg def.ServerConfig) ([]loginProvider, error) {
+	var providers []loginProvider
+	if cfg.B2Access.BaseURL != "" {
+		providers = append(providers, newB2AccessProvider(cfg.B2Access))
+	}
+	ids := map[string]bool{b2accessProviderID: true}
+	for _, pcfg := range cfg.OIDCProviders {
+		if !providerIDRegexp.MatchString(pcfg.ID) {
+			return nil, def.Err(nil, "invalid OpenID Connect provider ID: '%s'", pcfg.ID)
+		}
+		if ids[pcfg.ID] {
+			return nil, def.Err(nil, "duplicate OpenID Connect provider ID: %s", pcfg.ID)
+		}
+		ids[pcfg.ID] = true
+		if pcfg.Issuer == "" || pcfg.ClientID == "" || pcfg.RedirectURL == "" {
+			return nil, def.Err(nil, "the OpenID Connect provider %s needs an Issuer, a ClientID and a RedirectURL", pcfg.ID)
+		}
+		providers = append(providers, newOIDCProvider(pcfg))
+	}
+	return providers, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// b2accessProvider logs in the users with B2ACCESS, reading their details from the userinfo endpoint
+type b2accessProvider struct {
+	config      oauth2.Config
+	userInfoURL string
+}
+
+func newB2AccessProvider(cfg def.B2AccessConfig) *b2accessProvider {
+	if !strings.HasSuffix(cfg.BaseURL, "/") {
+		cfg.BaseURL += "/"
+	}
+	return &b2accessProvider{
+		config: oauth2.Config{
+			ClientID:     os.Getenv("GEF_B2ACCESS_CONSUMER_KEY"),
+			ClientSecret: os.Getenv("GEF_B2ACCESS_SECRET_KEY"),
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  cfg.BaseURL + "oauth2-as/oauth2-authz",
+				TokenURL: cfg.BaseURL + "oauth2/token",
+			},
+			RedirectURL: cfg.RedirectURL,
+			Scopes:      []string{"USER_PROFILE", "GENERATE_USER_CERTIFICATE", "email", "profile"},
+		},
+		userInfoURL: cfg.BaseURL + "oauth2/userinfo",
+	}
+}
+
+func (p *b2accessProvider) info() (string, string) {
+	return b2accessProviderID, "B2ACCESS"
+}
+
+func (p *b2accessProvider) authCodeURL(state string, nonce string) (string, error) {
+	return p.config.AuthCodeURL(state), nil
+}
+
+func (p *b2accessProvider) identify(code string, nonce string) (loginIdentity, error) {
+	tkn, err := p.config.Exchange(oauth2.NoContext, code)
+	if err != nil {
+		return loginIdentity{}, def.Err(err, "Error while getting access token")
+	}
+	if !tkn.Valid() {
+		return loginIdentity{}, def.AuthenticationErr("Received invalid access token")
+	}
+	claims, err := getUserInfoClaims(p.config.Client(oauth2.NoContext, tkn), p.userInfoURL)
+	if err != nil {
+		return loginIdentity{}, err
+	}
+	return identityFromClaims(claims, def.OIDCClaimsConfig{}), nil
+}
+
+// linksAccounts is false: only the accounts created before the identities were
+// recorded, all by B2ACCESS, are linked at the first login
+func (p *b2accessProvider) linksAccounts() bool {
+	return false
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// oidcProvider logs in the users with an OpenID Connect provider, verifying the ID tokens
+// with the keys it publishes. The discovery document and the keys are fetched when first needed
+type oidcProvider struct {
+	cfg          def.OIDCProviderConfig
+	clientSecret string
+
+	mutex    sync.Mutex
+	metadata *oidcMetadata
+	keys     map[string]crypto.PublicKey // by key ID
+}
+
+// oidcMetadata is the part of the discovery document used by the GEF
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func newOIDCProvider(cfg def.OIDCProviderConfig) *oidcProvider {
+	if cfg.Name == "" {
+		cfg.Name = cfg.ID
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"email", "profile"}
+	}
+	return &oidcProvider{cfg: cfg, clientSecret: os.Getenv(cfg.ClientSecretEnv)}
+}
+
+func (p *oidcProvider) info() (string, string) {
+	return p.cfg.ID, p.cfg.Name
+}
+
+func (p *oidcProvider) authCodeURL(state string, nonce string) (string, error) {
+	config, _, err := p.oauthConfig()
+	if err != nil {
+		return "", err
+	}
+	return config.AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", nonce)), nil
+}
+
+func (p *oidcProvider) identify(code string, nonce string) (loginIdentity, error) {
+	config, metadata, err := p.oauthConfig()
+	if err != nil {
+		return loginIdentity{}, err
+	}
+	tkn, err := config.Exchange(oauth2.NoContext, code)
+	if err != nil {
+		return loginIdentity{}, def.Err(err, "Error while getting the tokens from %s", p.cfg.Name)
+	}
+	idToken, _ := tkn.Extra("id_token").(string)
+	if idToken == "" {
+		return loginIdentity{}, def.AuthenticationErr("%s did not return an ID token", p.cfg.Name)
+	}
+	claims, err := p.verifyIDToken(idToken, nonce)
+	if err != nil {
+		return loginIdentity{}, err
+	}
+
+	// the providers may only give the user details at the userinfo endpoint
+	missing := claimString(claims, p.cfg.Claims.Email, "email") == "" || claims["email_verified"] == nil
+	if missing && metadata.UserInfoEndpoint != "" {
+		userInfo, err := getUserInfoClaims(config.Client(oauth2.NoContext, tkn), metadata.UserInfoEndpoint)
+		if err != nil {
+			return loginIdentity{}, err
+		}
+		if userInfo["sub"] != claims["sub"] {
+			return loginIdentity{}, def.AuthenticationErr("The userinfo of %s is about another user", p.cfg.Name)
+		}
+		for k, v := range userInfo {
+			if _, ok := claims[k]; !ok {
+				claims[k] = v
+			}
+		}
+	}
+	if verified, _ := claims["email_verified"].(bool); !verified {
+		return loginIdentity{}, def.AuthenticationErr("%s has not verified the email address", p.cfg.Name)
+	}
+	return identityFromClaims(claims, p.cfg.Claims), nil
+}
+
+func (p *oidcProvider) linksAccounts() bool {
+	return p.cfg.LinkAccounts
+}
+
+// oauthConfig returns the OAuth2 configuration of the provider, read from its discovery document
+func (p *oidcProvider) oauthConfig() (oauth2.Config, *oidcMetadata, error) {
+	metadata, err := p.discover()
+	if err != nil {
+		return oauth2.Config{}, nil, err
+	}
+	return oauth2.Config{
+		ClientID:     p.cfg.ClientID,
+		ClientSecret: p.clientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  metadata.AuthorizationEndpoint,
+			TokenURL: metadata.TokenEndpoint,
+		},
+		RedirectURL: p.cfg.RedirectURL,
+		Scopes:      append([]string{"openid"}, p.cfg.Scopes...),
+	}, metadata, nil
+}
+
+func (p *oidcProvider) discover() (*oidcMetadata, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+	var metadata oidcMetadata
+	err := getJSON(strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", &metadata)
+	if err != nil {
+		return nil, def.Err(err, "Cannot read the discovery document of %s", p.cfg.Name)
+	}
+	if metadata.Issuer != p.cfg.Issuer {
+		return nil, def.Err(nil, "The discovery document of %s is for another issuer: %s", p.cfg.Name, metadata.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, def.Err(nil, "The discovery document of %s misses endpoints", p.cfg.Name)
+	}
+	p.metadata = &metadata
+	return p.metadata, nil
+}
+
+// publicKey returns the key the provider signs with; the keys are fetched again
+// when the key ID is unknown, as the providers rotate them
+func (p *oidcProvider) publicKey(keyID string) (crypto.PublicKey, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if key, ok := p.keys[keyID]; ok {
+		return key, nil
+	}
+
+	var jwks struct{ Keys []jsonWebKey }
+	err := getJSON(p.metadata.JWKSURI, &jwks)
+	if err != nil {
+		return nil, def.Err(err, "Cannot read the keys of %s", p.cfg.Name)
+	}
+	p.keys = map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, def.Err(err, "Invalid key %s of %s", jwk.Kid, p.cfg.Name)
+		}
+		if key != nil {
+			p.keys[jwk.Kid] = key
+		}
+	}
+	key, ok := p.keys[keyID]
+	if !ok && keyID == "" && len(p.keys) == 1 {
+		// the ID tokens may not name the key if there is only one
+		for _, key = range p.keys {
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, def.AuthenticationErr("Unknown key %s of %s", keyID, p.cfg.Name)
+	}
+	return key, nil
+}
+
+// verifyIDToken checks the signature, the issuer, the audience, the expiration time and
+// the nonce of an ID token, and returns its claims
+func (p *oidcProvider) verifyIDToken(idToken string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, def.AuthenticationErr("Malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, def.AuthenticationErr("Malformed ID token header: %s", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, def.AuthenticationErr("Malformed ID token signature: %s", err)
+	}
+	key, err := p.publicKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, def.AuthenticationErr("Invalid ID token signature: %s", err)
+	}
+
+	var claims map[string]interface{}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, def.AuthenticationErr("Malformed ID token claims: %s", err)
+	}
+	if claims["iss"] != p.metadata.Issuer {
+		return nil, def.AuthenticationErr("The ID token was issued by %v", claims["iss"])
+	}
+	if !audienceContains(claims["aud"], p.cfg.ClientID) {
+		return nil, def.AuthenticationErr("The ID token was issued for another client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.cfg.ClientID {
+		return nil, def.AuthenticationErr("The ID token was issued for another client")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || time.Unix(int64(exp), 0).Add(oidcClockSkew).Before(time.Now()) {
+		return nil, def.AuthenticationErr("The ID token has expired")
+	}
+	if claims["nonce"] != nonce {
+		return nil, def.AuthenticationErr("The ID token was issued for another login")
+	}
+	return claims, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// jsonWebKey is a public key of a JSON Web Key Set (RFC 7517)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey returns the RSA or EC key, nil for the other key types
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	number := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, def.Err(err, "invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := number(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := number(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[jwk.Crv]
+		if !ok {
+			return nil, def.Err(nil, "unknown curve: %s", jwk.Crv)
+		}
+		x, err := number(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := number(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+// verifyJWTSignature checks a JWS signature made with one of the RS, PS and ES algorithms (RFC 7518)
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if len(alg) != 5 || hashes[alg[2:]] == 0 {
+		return def.Err(nil, "unsupported signature algorithm: %s", alg)
+	}
+	hash := hashes[alg[2:]]
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		case "PS":
+			return rsa.VerifyPSS(k, hash, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] == "ES" && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(k, digest, r, s) {
+				return def.Err(nil, "ECDSA verification failed")
+			}
+			return nil
+		}
+	}
+	return def.Err(nil, "the key cannot verify %s signatures", alg)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// audienceContains tells if the aud claim, a string or an array of strings, contains the client
+func audienceContains(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, v := range a {
+			if v == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// identityFromClaims maps the claims to the user details; the entitlements claim
+// can be a string or an array of strings
+func identityFromClaims(claims map[string]interface{}, cfg def.OIDCClaimsConfig) loginIdentity {
+	identity := loginIdentity{
+		Email: claimString(claims, cfg.Email, "email"),
+		Name:  claimString(claims, cfg.Name, "name"),
+	}
+	identity.Subject, _ = claims["sub"].(string)
+	entitlementsClaim := cfg.Entitlements
+	if entitlementsClaim == "" {
+		entitlementsClaim = "eduperson_entitlement"
+	}
+	switch v := claims[entitlementsClaim].(type) {
+	case string:
+		identity.Entitlements = []string{v}
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				identity.Entitlements = append(identity.Entitlements, s)
+			}
+		}
+	}
+	return identity
+}
+
+func claimString(claims map[string]interface{}, name string, defaultName string) string {
+	if name == "" {
+		name = defaultName
+	}
+	s, _ := claims[name].(string)
+	return s
+}
+
+func getUserInfoClaims(client *http.Client, userInfoURL string) (map[string]interface{}, error) {
+	resp, err := client.Get(userInfoURL)
+	if err != nil {
+		return nil, def.Err(err, "Error while getting user info")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, def.Err(nil, "Error while getting user info: %s", resp.Status)
+	}
+	var claims map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&claims)
+	if err != nil {
+		return nil, def.Err(err, "Error while deserialising user info")
+	}
+	return claims, nil
+}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
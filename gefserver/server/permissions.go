@@ -12,18 +12,155 @@ type Authorization struct {
 	r *http.Request
 }
 
-// allowSuperAdmin returns the logged in user or writes errors into the http stream
-// First returned value is true if the user is superadmin
-func (a Authorization) getUserInfo() (bool, *db.User) {
-	user := a.s.getUserOrWriteError(a.w, a.r)
+// getUserInfo returns the logged in user and the access token used to log in, or writes errors
+// into the http stream; the user is nil if the token cannot be used for the scope (db.Token.HasScope).
+// First returned value is true if the user is superadmin, and the token has the admin scope
+func (a Authorization) getUserInfo(scope string) (bool, *db.User, *db.Token) {
+	user, token := a.s.getUserOrWriteError(a.w, a.r)
 	if user == nil {
+		return false, nil, nil
+	}
+	if !token.HasScope(scope) {
+		a.forbidScope(scope)
+		return false, nil, nil
+	}
+	return a.s.isSuperAdmin(user) && token.HasScope(db.AdminScope), user, token
+}
+
+// getJobUserInfo is getUserInfo for the actions on a job, checking that the token
+// can be used with the service of the job
+func (a Authorization) getJobUserInfo(scope string, jobID db.JobID) (bool, *db.User) {
+	superAdmin, user, token := a.getUserInfo(scope)
+	if user == nil || !a.tokenAllowsJob(token, jobID) {
 		return false, nil
 	}
-	return a.s.isSuperAdmin(user), user
+	return superAdmin, user
+}
+
+// getServiceUserInfo is getUserInfo for the actions on a service, checking that the token
+// can be used with the service
+func (a Authorization) getServiceUserInfo(scope string, serviceID db.ServiceID) (bool, *db.User) {
+	superAdmin, user, token := a.getUserInfo(scope)
+	if user == nil {
+		return false, nil
+	}
+	if !token.AllowsService(serviceID) {
+		Response{a.w}.Forbidden("This access token cannot be used with this service")
+		return false, nil
+	}
+	return superAdmin, user
+}
+
+// allowAnybody allows the anonymous requests, and those authenticated with an access token
+// which can be used for the scope and, if jobID is not empty, with the service of the job
+func (a Authorization) allowAnybody(scope string, jobID db.JobID) (allow bool, user *db.User) {
+	user, token, err := a.s.getCurrentUserToken(a.r)
+	if !writeUserError(a.w, err) {
+		return false, nil
+	}
+	if token == nil {
+		return true, nil
+	}
+	if !token.HasScope(scope) {
+		a.forbidScope(scope)
+		return false, nil
+	}
+	if jobID != "" && !a.tokenAllowsJob(token, jobID) {
+		return false, nil
+	}
+	return true, user
+}
+
+func (a Authorization) forbidScope(scope string) {
+	if scope == "" {
+		Response{a.w}.Forbidden("This access token is restricted to some scopes, this requires an unrestricted token")
+		return
+	}
+	Response{a.w}.Forbidden("This access token does not have the " + scope + " scope")
+}
+
+// tokenAllowsJob tells if the token can be used with the service of a job, or writes
+// errors into the http stream
+func (a Authorization) tokenAllowsJob(token *db.Token, jobID db.JobID) bool {
+	if len(token.ServiceIDs) == 0 {
+		return true
+	}
+	job, err := a.s.db.GetJob(jobID)
+	if err != nil {
+		Response{a.w}.ClientError("cannot get job", err)
+		return false
+	}
+	if !token.AllowsService(job.ServiceID) {
+		Response{a.w}.Forbidden("This access token cannot be used with the service of the job")
+		return false
+	}
+	return true
+}
+
+// hasCommunityRole tells if the user has one of the roles in a community the token
+// can be used with
+func (a Authorization) hasCommunityRole(user *db.User, token *db.Token, roleNames ...string) bool {
+	return a.hasRoleInCommunity(user, token, 0, roleNames...)
+}
+
+// hasRoleInCommunity tells if the user has one of the roles in a given community (any
+// community if communityID is 0), and the token can be used with that community
+func (a Authorization) hasRoleInCommunity(user *db.User, token *db.Token, communityID int64, roleNames ...string) bool {
+	roles, err := a.s.db.GetUserRoles(user.ID)
+	if err != nil {
+		return false
+	}
+	for _, r := range roles {
+		if communityID != 0 && r.CommunityID != communityID {
+			continue
+		}
+		for _, name := range roleNames {
+			if r.Name == name && token.AllowsCommunity(r.CommunityID) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// viewer returns what the current user can see of the services and the jobs of the
+// communities, or writes errors into the http stream; the viewer is nil for the
+// superadministrators, who see everything
+func (a Authorization) viewer() (viewer *db.Viewer, ok bool) {
+	user, token, err := a.s.getCurrentUserToken(a.r)
+	if !writeUserError(a.w, err) {
+		return nil, false
+	}
+	if user == nil {
+		return &db.Viewer{}, true
+	}
+	if a.s.isSuperAdmin(user) && token.HasScope(db.AdminScope) {
+		return nil, true
+	}
+	return &db.Viewer{UserID: user.ID, CommunityIDs: token.CommunityIDs}, true
+}
+
+// allowSeeService tells if the current user can see a service, or writes errors
+// into the http stream
+func (a Authorization) allowSeeService(serviceID db.ServiceID) bool {
+	viewer, ok := a.viewer()
+	if !ok {
+		return false
+	}
+	visible, err := a.s.db.CanSeeService(viewer, serviceID)
+	if err != nil {
+		Response{a.w}.ServerError("db error", err)
+		return false
+	}
+	if !visible {
+		Response{a.w}.Forbidden("Service " + string(serviceID) + " can only be used by the members of its community")
+		return false
+	}
+	return true
 }
 
 func (a Authorization) allowCreateToken() (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user, _ = a.getUserInfo("")
 	if user == nil || allow {
 		return
 	}
@@ -32,8 +169,18 @@ func (a Authorization) allowCreateToken() (allow bool, user *db.User) {
 	return
 }
 
+func (a Authorization) allowManageB2DropAccount() (allow bool, user *db.User) {
+	allow, user, _ = a.getUserInfo("")
+	if user == nil || allow {
+		return
+	}
+	// allow any logged in user to manage their own B2DROP credentials
+	allow = true
+	return
+}
+
 func (a Authorization) allowGetTokens() (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user, _ = a.getUserInfo("")
 	if user == nil || allow {
 		return
 	}
@@ -43,7 +190,7 @@ func (a Authorization) allowGetTokens() (allow bool, user *db.User) {
 }
 
 func (a Authorization) allowDeleteToken(token db.Token) (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user, _ = a.getUserInfo("")
 	if user == nil || allow {
 		return
 	}
@@ -57,7 +204,7 @@ func (a Authorization) allowDeleteToken(token db.Token) (allow bool, user *db.Us
 }
 
 func (a Authorization) allowListRoles() (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user, _ = a.getUserInfo("")
 	if user == nil || allow {
 		return
 	}
@@ -67,7 +214,7 @@ func (a Authorization) allowListRoles() (allow bool, user *db.User) {
 }
 
 func (a Authorization) allowListRoleUsers() (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user, _ = a.getUserInfo(db.AdminScope)
 	if user == nil || allow {
 		return
 	}
@@ -77,7 +224,7 @@ func (a Authorization) allowListRoleUsers() (allow bool, user *db.User) {
 }
 
 func (a Authorization) allowNewRoleUser() (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user, _ = a.getUserInfo(db.AdminScope)
 	if user == nil || allow {
 		return
 	}
@@ -87,7 +234,7 @@ func (a Authorization) allowNewRoleUser() (allow bool, user *db.User) {
 }
 
 func (a Authorization) allowDeleteRoleUser() (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user, _ = a.getUserInfo(db.AdminScope)
 	if user == nil || allow {
 		return
 	}
@@ -96,19 +243,34 @@ func (a Authorization) allowDeleteRoleUser() (allow bool, user *db.User) {
 	return
 }
 
+func (a Authorization) allowManageInputCache() (allow bool, user *db.User) {
+	allow, user, _ = a.getUserInfo(db.AdminScope)
+	if user == nil || allow {
+		return
+	}
+	// only superadmins can inspect and purge the input data cache
+	Response{a.w}.Forbidden("Only superadministrators can manage the input cache")
+	return
+}
+
+func (a Authorization) allowRunJanitor() (allow bool, user *db.User) {
+	allow, user, _ = a.getUserInfo(db.AdminScope)
+	if user == nil || allow {
+		return
+	}
+	// only superadmins can see and trigger the removal of the expired jobs
+	Response{a.w}.Forbidden("Only superadministrators can run the janitor")
+	return
+}
+
 func (a Authorization) allowCreateBuild() (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user, token := a.getUserInfo(db.ServicesWriteScope)
 	if user == nil || allow {
 		return
 	}
-	roles, err := a.s.db.GetUserRoles(user.ID)
-	if err == nil {
-		for _, r := range roles {
-			if r.Name == db.CommunityAdminRoleName {
-				allow = true // community admins can create builds
-				return
-			}
-		}
+	if a.hasCommunityRole(user, token, db.CommunityAdminRoleName) {
+		allow = true // community admins can create builds
+		return
 	}
 	// only community admins can create builds
 	Response{a.w}.Forbidden("Only community administrators can create builds")
@@ -116,18 +278,13 @@ func (a Authorization) allowCreateBuild() (allow bool, user *db.User) {
 }
 
 func (a Authorization) allowUploadIntoBuild() (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user, token := a.getUserInfo(db.ServicesWriteScope)
 	if user == nil || allow {
 		return
 	}
-	roles, err := a.s.db.GetUserRoles(user.ID)
-	if err == nil {
-		for _, r := range roles {
-			if r.Name == db.CommunityAdminRoleName {
-				allow = true // community admins can upload data into builds
-				return
-			}
-		}
+	if a.hasCommunityRole(user, token, db.CommunityAdminRoleName) {
+		allow = true // community admins can upload data into builds
+		return
 	}
 	// only community admins can upload data into builds
 	Response{a.w}.Forbidden("Only community administrators can upload data into builds")
@@ -135,18 +292,13 @@ func (a Authorization) allowUploadIntoBuild() (allow bool, user *db.User) {
 }
 
 func (a Authorization) allowInspectBuild() (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user, token := a.getUserInfo(db.ServicesWriteScope)
 	if user == nil || allow {
 		return
 	}
-	roles, err := a.s.db.GetUserRoles(user.ID)
-	if err == nil {
-		for _, r := range roles {
-			if r.Name == db.CommunityAdminRoleName {
-				allow = true // community admins can inspect builds
-				return
-			}
-		}
+	if a.hasCommunityRole(user, token, db.CommunityAdminRoleName) {
+		allow = true // community admins can inspect builds
+		return
 	}
 	// only community admins can inspect builds
 	Response{a.w}.Forbidden("Only community administrators can inspect builds")
@@ -159,12 +311,14 @@ func (a Authorization) allowListServices() (allow bool, user *db.User) {
 }
 
 func (a Authorization) allowInspectService(serviceID db.ServiceID) (allow bool, user *db.User) {
-	allow = true // anybody can inspect a service
+	// anybody can inspect a public service, only the community members can inspect
+	// the services of a community
+	allow = a.allowSeeService(serviceID)
 	return
 }
 
 func (a Authorization) allowEditService(serviceID db.ServiceID) (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user = a.getServiceUserInfo(db.ServicesWriteScope, serviceID)
 	if user == nil || allow {
 		return
 	}
@@ -176,8 +330,25 @@ func (a Authorization) allowEditService(serviceID db.ServiceID) (allow bool, use
 	return
 }
 
+// allowServiceCommunity checks that the current user can move a service into a community
+// (0 for the public services), writing errors into the http stream
+func (a Authorization) allowServiceCommunity(communityID int64) bool {
+	superAdmin, user, token := a.getUserInfo(db.ServicesWriteScope)
+	if user == nil {
+		return false
+	}
+	if superAdmin || communityID == 0 {
+		return true
+	}
+	if a.hasRoleInCommunity(user, token, communityID, db.CommunityMemberRoleName, db.CommunityAdminRoleName) {
+		return true // community members and admins can give services to their community
+	}
+	Response{a.w}.Forbidden("A service can only be given to a community by its members and administrators")
+	return false
+}
+
 func (a Authorization) allowRemoveService(serviceID db.ServiceID) (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user = a.getServiceUserInfo(db.ServicesWriteScope, serviceID)
 	if user == nil || allow {
 		return
 	}
@@ -189,36 +360,117 @@ func (a Authorization) allowRemoveService(serviceID db.ServiceID) (allow bool, u
 	return
 }
 
+func (a Authorization) allowCreateWorkflow() (allow bool, user *db.User) {
+	allow, user, token := a.getUserInfo(db.ServicesWriteScope)
+	if user == nil || allow {
+		return
+	}
+	if a.hasCommunityRole(user, token, db.CommunityMemberRoleName, db.CommunityAdminRoleName) {
+		allow = true // community members and admins can chain services into workflows
+		return
+	}
+	Response{a.w}.Forbidden("Only community members and administrators can create workflows")
+	return
+}
+
+func (a Authorization) allowListWorkflows() (allow bool, user *db.User) {
+	allow = true // anybody can see the list of workflows
+	return
+}
+
+func (a Authorization) allowInspectWorkflow(workflowID db.WorkflowID) (allow bool, user *db.User) {
+	allow = true // anybody can inspect a workflow
+	return
+}
+
+func (a Authorization) allowRemoveWorkflow(workflowID db.WorkflowID) (allow bool, user *db.User) {
+	allow, user, _ = a.getUserInfo(db.ServicesWriteScope)
+	if user == nil || allow {
+		return
+	}
+	if a.s.db.IsWorkflowOwner(user.ID, workflowID) {
+		allow = true // a workflow's owner can remove the workflow
+		return
+	}
+	Response{a.w}.Forbidden("A workflow can only be removed by its owner")
+	return
+}
+
 func (a Authorization) allowCreateJob() (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user, token := a.getUserInfo(db.JobsCreateScope)
 	if user == nil || allow {
 		return
 	}
-	roles, err := a.s.db.GetUserRoles(user.ID)
-	if err == nil {
-		for _, r := range roles {
-			if r.Name == db.CommunityMemberRoleName || r.Name == db.CommunityAdminRoleName {
-				allow = true // community members and admins can create jobs
-				return
-			}
-		}
+	if a.hasCommunityRole(user, token, db.CommunityMemberRoleName, db.CommunityAdminRoleName) {
+		allow = true // community members and admins can create jobs
+		return
 	}
 	Response{a.w}.Forbidden("Only community members and administrators can create jobs")
 	return
 }
 
+// allowJobServices checks that the access token of a new job can be used with the services
+// the job runs, and that the user can see them, writing errors into the http stream
+func (a Authorization) allowJobServices(serviceIDs []db.ServiceID) bool {
+	_, token, err := a.s.getCurrentUserToken(a.r)
+	if !writeUserError(a.w, err) {
+		return false
+	}
+	for _, id := range serviceIDs {
+		if token != nil && !token.AllowsService(id) {
+			Response{a.w}.Forbidden("This access token cannot be used with service " + string(id))
+			return false
+		}
+		if !a.allowSeeService(id) {
+			return false
+		}
+	}
+	return true
+}
+
 func (a Authorization) allowListJobs() (allow bool, user *db.User) {
-	allow = true // anybody can see the list of jobs
-	return
+	// anybody can see the list of jobs, with a token allowing it if one is given
+	return a.allowAnybody(db.JobsReadScope, "")
 }
 
 func (a Authorization) allowInspectJob(jobID db.JobID) (allow bool, user *db.User) {
-	allow = true // anybody can inspect a job (metadata only)
+	// anybody can inspect a job (metadata only), with a token allowing it if one is given;
+	// the jobs of the community services are only seen by their owners and the community members
+	allow, user = a.allowAnybody(db.JobsReadScope, jobID)
+	if !allow {
+		return
+	}
+	viewer, ok := a.viewer()
+	if !ok {
+		return false, nil
+	}
+	visible, err := a.s.db.CanSeeJob(viewer, jobID)
+	if err != nil {
+		Response{a.w}.ServerError("db error", err)
+		return false, nil
+	}
+	if !visible {
+		Response{a.w}.Forbidden("The jobs of a community service can only be inspected by their owners and the community members")
+		return false, nil
+	}
+	return
+}
+
+func (a Authorization) allowEditJob(jobID db.JobID) (allow bool, user *db.User) {
+	allow, user = a.getJobUserInfo(db.JobsWriteScope, jobID)
+	if user == nil || allow {
+		return
+	}
+	if a.s.db.IsJobOwner(user.ID, jobID) {
+		allow = true // a job's owner can edit the job metadata
+		return
+	}
+	Response{a.w}.Forbidden("A job can only be edited by its owner")
 	return
 }
 
 func (a Authorization) allowRemoveJob(jobID db.JobID) (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user = a.getJobUserInfo(db.JobsWriteScope, jobID)
 	if user == nil || allow {
 		return
 	}
@@ -230,8 +482,47 @@ func (a Authorization) allowRemoveJob(jobID db.JobID) (allow bool, user *db.User
 	return
 }
 
+func (a Authorization) allowCancelJob(jobID db.JobID) (allow bool, user *db.User) {
+	allow, user = a.getJobUserInfo(db.JobsWriteScope, jobID)
+	if user == nil || allow {
+		return
+	}
+	if a.s.db.IsJobOwner(user.ID, jobID) {
+		allow = true // a job's owner can cancel the job
+		return
+	}
+	Response{a.w}.Forbidden("A job can only be cancelled by its owner")
+	return
+}
+
+func (a Authorization) allowRetryJob(jobID db.JobID) (allow bool, user *db.User) {
+	allow, user = a.getJobUserInfo(db.JobsCreateScope, jobID)
+	if user == nil || allow {
+		return
+	}
+	if a.s.db.IsJobOwner(user.ID, jobID) {
+		allow = true // a job's owner can retry the job
+		return
+	}
+	Response{a.w}.Forbidden("A job can only be retried by its owner")
+	return
+}
+
+func (a Authorization) allowPublishJob(jobID db.JobID) (allow bool, user *db.User) {
+	allow, user = a.getJobUserInfo(db.JobsWriteScope, jobID)
+	if user == nil || allow {
+		return
+	}
+	if a.s.db.IsJobOwner(user.ID, jobID) {
+		allow = true // a job's owner can publish the job results
+		return
+	}
+	Response{a.w}.Forbidden("A job can only be published by its owner")
+	return
+}
+
 func (a Authorization) allowGetJobData(jobID db.JobID) (allow bool, user *db.User) {
-	allow, user = a.getUserInfo()
+	allow, user = a.getJobUserInfo(db.VolumesReadScope, jobID)
 	if user == nil || allow {
 		return
 	}
@@ -242,3 +533,51 @@ func (a Authorization) allowGetJobData(jobID db.JobID) (allow bool, user *db.Use
 	Response{a.w}.Forbidden("Job data can only be retrieved by its owner")
 	return
 }
+
+func (a Authorization) allowListCommunities() (allow bool, user *db.User) {
+	allow = true // anybody can see the list of communities
+	return
+}
+
+func (a Authorization) allowCreateCommunity() (allow bool, user *db.User) {
+	allow, user, _ = a.getUserInfo(db.AdminScope)
+	if user == nil || allow {
+		return
+	}
+	// only superadmins can create communities
+	Response{a.w}.Forbidden("Only superadministrators can create communities")
+	return
+}
+
+func (a Authorization) allowRemoveCommunity() (allow bool, user *db.User) {
+	allow, user, _ = a.getUserInfo(db.AdminScope)
+	if user == nil || allow {
+		return
+	}
+	// only superadmins can remove communities
+	Response{a.w}.Forbidden("Only superadministrators can remove communities")
+	return
+}
+
+func (a Authorization) allowRenameCommunity() (allow bool, user *db.User) {
+	allow, user, _ = a.getUserInfo(db.AdminScope)
+	if user == nil || allow {
+		return
+	}
+	// the access tokens and the role mappings refer to the communities by name
+	Response{a.w}.Forbidden("Only superadministrators can rename communities")
+	return
+}
+
+func (a Authorization) allowManageCommunity(communityID int64) (allow bool, user *db.User) {
+	allow, user, token := a.getUserInfo(db.AdminScope)
+	if user == nil || allow {
+		return
+	}
+	if a.hasRoleInCommunity(user, token, communityID, db.CommunityAdminRoleName) {
+		allow = true // community admins can edit their community and manage its members
+		return
+	}
+	Response{a.w}.Forbidden("A community can only be managed by its administrators")
+	return
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"log"
+	"regexp"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+// roleMapping gives a community role to the users an identity provider asserts an entitlement of
+type roleMapping struct {
+	provider    string
+	entitlement *regexp.Regexp
+	community   string
+	role        string
+}
+
+func newRoleMappings(cfgs []def.RoleMappingConfig) ([]roleMapping, error) {
+	var mappings []roleMapping
+	for _, cfg := range cfgs {
+		entitlement, err := regexp.Compile("^(?:" + cfg.Entitlement + ")$")
+		if err != nil {
+			return nil, def.Err(err, "invalid role mapping entitlement: %s", cfg.Entitlement)
+		}
+		role := cfg.Role
+		if role == "" {
+			role = db.CommunityMemberRoleName
+		}
+		if role != db.CommunityMemberRoleName && role != db.CommunityAdminRoleName {
+			return nil, def.Err(nil, "invalid role mapping role: %s", cfg.Role)
+		}
+		if cfg.Community == "" {
+			return nil, def.Err(nil, "the role mapping of %s needs a community", cfg.Entitlement)
+		}
+		mappings = append(mappings, roleMapping{cfg.Provider, entitlement, cfg.Community, role})
+	}
+	return mappings, nil
+}
+
+// syncLoginRoles gives the user the roles mapped from the entitlements asserted by an identity
+// provider, and removes the roles the provider gave before but does not assert anymore
+func (s *Server) syncLoginRoles(user db.User, providerID string, entitlements []string) (db.RoleSync, error) {
+	var roleIDs []int64
+	for _, m := range s.roleMappings {
+		if m.provider != "" && m.provider != providerID {
+			continue
+		}
+		matched := false
+		for _, e := range entitlements {
+			matched = matched || m.entitlement.MatchString(e)
+		}
+		if !matched {
+			continue
+		}
+		community, err := s.db.GetCommunityByName(m.community)
+		if db.IsNoResultsError(err) {
+			log.Println("ERROR: the role mapping community does not exist:", m.community)
+			continue
+		}
+		if err != nil {
+			return db.RoleSync{}, def.Err(err, "Cannot get the community %s", m.community)
+		}
+		role, err := s.db.GetRoleByName(m.role, community.ID)
+		if err != nil {
+			return db.RoleSync{}, def.Err(err, "Cannot get the role %s of %s", m.role, m.community)
+		}
+		roleIDs = append(roleIDs, role.ID)
+	}
+
+	sync, err := s.db.SyncUserRoles(user.ID, providerID, roleIDs)
+	if err != nil {
+		return sync, def.Err(err, "Cannot synchronize the roles")
+	}
+	if len(sync.Added) > 0 || len(sync.Removed) > 0 {
+		log.Println("roles of", user.Email, "from", providerID, "added:", sync.Added, "removed:", sync.Removed)
+	}
+	return sync, nil
+}
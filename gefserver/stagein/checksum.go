@@ -0,0 +1,79 @@
+package stagein
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"strings"
+)
+
+// defaultChecksumAlgorithm is used when no checksum (or no checksum in a known format) is expected
+const defaultChecksumAlgorithm = "sha256"
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// the names also used for the algorithms, e.g. "sha2" by iRODS and B2SAFE
+var checksumAliases = map[string]string{
+	"sha-1":   "sha1",
+	"sha2":    "sha256",
+	"sha-256": "sha256",
+	"sha-512": "sha512",
+}
+
+// checksum is an expected checksum; value is nil if nothing is expected
+type checksum struct {
+	algorithm string
+	value     []byte
+}
+
+// parseChecksum decodes a checksum given as "algorithm:value", with an hex or base64
+// value, or as a bare hex value whose length tells the algorithm; the checksums in
+// another format are not verified
+func parseChecksum(s string) checksum {
+	s = strings.TrimSpace(s)
+	algorithm, value := "", s
+	if i := strings.Index(s, ":"); i >= 0 {
+		algorithm, value = strings.ToLower(s[:i]), s[i+1:]
+		if alias, found := checksumAliases[algorithm]; found {
+			algorithm = alias
+		}
+	}
+	newHash, found := checksumAlgorithms[algorithm]
+	if algorithm == "" {
+		for name, h := range checksumAlgorithms {
+			if len(value) == 2*h().Size() {
+				algorithm, newHash, found = name, h, true
+			}
+		}
+	}
+	if !found || value == "" {
+		return checksum{algorithm: defaultChecksumAlgorithm}
+	}
+
+	size := newHash().Size()
+	if decoded, err := hex.DecodeString(value); err == nil && len(decoded) == size {
+		return checksum{algorithm, decoded}
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(value); err == nil && len(decoded) == size {
+		return checksum{algorithm, decoded}
+	}
+	return checksum{algorithm: defaultChecksumAlgorithm}
+}
+
+func (c checksum) newHash() hash.Hash {
+	return checksumAlgorithms[c.algorithm]()
+}
+
+func (c checksum) matches(sum []byte) bool {
+	return bytes.Equal(c.value, sum)
+}
@@ -0,0 +1,340 @@
+// Package stagein resolves the PIDs and URLs given as job inputs into the files they
+// point to (expanding the B2SHARE records into their files) and downloads these files,
+// verifying their checksums when the PID record or B2SHARE provides them
+package stagein
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultHandleServer is the handle server used when none is configured
+const DefaultHandleServer = "https://hdl.handle.net"
+
+var pidRegexp = regexp.MustCompile(`^\d+(\.\d+)*/\S+$`)
+
+var pidPrefixes = []string{"hdl:", "http://hdl.handle.net/", "https://hdl.handle.net/"}
+
+// the handle record value types holding a checksum of the file pointed to by the PID
+var checksumTypes = []string{"CHECKSUM", "EUDAT/CHECKSUM"}
+
+// File is a file to be downloaded
+type File struct {
+	Name     string // the name of the file, used unless the server sends another one
+	URL      string
+	Checksum string // the expected checksum, as "algorithm:value"; empty if unknown
+}
+
+// Result describes a downloaded file
+type Result struct {
+	Name     string // the name of the file in the download folder
+	URL      string
+	Size     int64  // the number of bytes downloaded
+	Checksum string // the checksum of the downloaded content, as "algorithm:hex value"
+	Verified bool   // true if the checksum matches the expected one
+	// ETag and LastModified are the validators sent by the server, if any
+	ETag         string
+	LastModified string
+	NotModified  bool // true if nothing was downloaded, the file has not changed
+}
+
+// Validators tell which version of a file was downloaded before
+type Validators struct {
+	ETag         string
+	LastModified string
+}
+
+// Stager resolves and downloads the input files of the jobs
+type Stager struct {
+	HandleServer string   // resolves the PIDs, DefaultHandleServer if empty
+	B2ShareURLs  []string // the B2SHARE instances whose record URLs are expanded into the record files
+	Client       *http.Client
+}
+
+func (s Stager) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+// PID returns the PID given as source, without its prefix, or an empty string
+// if the source is not a PID
+func PID(src string) string {
+	for _, prefix := range pidPrefixes {
+		if strings.HasPrefix(src, prefix) {
+			src = strings.TrimPrefix(src, prefix)
+			break
+		}
+	}
+	if !pidRegexp.MatchString(src) {
+		return ""
+	}
+	return src
+}
+
+// Resolve returns the files a PID or a URL points to: the single file of a plain
+// URL, or all the files of a B2SHARE record
+func (s Stager) Resolve(src string) ([]File, error) {
+	src = strings.TrimSpace(src)
+	fileURL, checksum := src, ""
+	if pid := PID(src); pid != "" {
+		var err error
+		fileURL, checksum, err = s.resolvePID(pid)
+		if err != nil {
+			return nil, err
+		}
+	} else if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return nil, fmt.Errorf("neither a PID nor a URL: %s", src)
+	}
+
+	if s.isB2ShareRecord(fileURL) {
+		return s.b2shareRecordFiles(fileURL)
+	}
+	return []File{{Name: urlFileName(fileURL), URL: fileURL, Checksum: checksum}}, nil
+}
+
+// resolvePID returns the URL and the checksum (if any) of the handle record of a PID
+func (s Stager) resolvePID(pid string) (string, string, error) {
+	server := s.HandleServer
+	if server == "" {
+		server = DefaultHandleServer
+	}
+	recordURL := strings.TrimRight(server, "/") + "/api/handles/" + pid
+
+	var record struct {
+		Values []struct {
+			Type string
+			Data struct {
+				Value json.RawMessage
+			}
+		}
+	}
+	err := s.getJSON(recordURL, &record)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot resolve the PID %s: %s", pid, err)
+	}
+
+	fileURL, checksum := "", ""
+	for _, v := range record.Values {
+		var value string
+		if json.Unmarshal(v.Data.Value, &value) != nil {
+			continue
+		}
+		if v.Type == "URL" && fileURL == "" {
+			fileURL = value
+		}
+		for _, t := range checksumTypes {
+			if v.Type == t && checksum == "" {
+				checksum = value
+			}
+		}
+	}
+	if fileURL == "" {
+		return "", "", fmt.Errorf("the PID %s has no URL", pid)
+	}
+	return fileURL, checksum, nil
+}
+
+func (s Stager) isB2ShareRecord(fileURL string) bool {
+	for _, prefix := range s.B2ShareURLs {
+		if strings.HasPrefix(fileURL, strings.TrimRight(prefix, "/")+"/") {
+			return strings.Contains(fileURL, "/records/")
+		}
+	}
+	return false
+}
+
+// b2shareRecordFiles lists the files of a B2SHARE record, with their checksums
+func (s Stager) b2shareRecordFiles(recordURL string) ([]File, error) {
+	if !strings.Contains(recordURL, "/api/records/") {
+		recordURL = strings.Replace(recordURL, "/records/", "/api/records/", 1)
+	}
+	var record struct {
+		Links struct {
+			Files string `json:"files"`
+		} `json:"links"`
+	}
+	err := s.getJSON(recordURL, &record)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get the B2SHARE record %s: %s", recordURL, err)
+	}
+	if record.Links.Files == "" {
+		return nil, fmt.Errorf("the B2SHARE record %s has no files", recordURL)
+	}
+
+	var bucket struct {
+		Contents []struct {
+			Key      string `json:"key"`
+			Checksum string `json:"checksum"`
+			Links    struct {
+				Self string `json:"self"`
+			} `json:"links"`
+		} `json:"contents"`
+	}
+	err = s.getJSON(record.Links.Files, &bucket)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get the files of the B2SHARE record %s: %s", recordURL, err)
+	}
+	var files []File
+	for _, f := range bucket.Contents {
+		files = append(files, File{Name: f.Key, URL: f.Links.Self, Checksum: f.Checksum})
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("the B2SHARE record %s has no files", recordURL)
+	}
+	return files, nil
+}
+
+func (s Stager) getJSON(jsonURL string, v interface{}) error {
+	req, err := http.NewRequest("GET", jsonURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := s.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", jsonURL, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// Download writes a file into a folder, named as the server tells or as the file name;
+// downloads larger than maxSize bytes (if not 0) fail, and so do the downloads whose
+// checksum does not match the expected one
+func (s Stager) Download(f File, folder string, maxSize int64) (Result, error) {
+	return s.DownloadIfModified(f, folder, maxSize, Validators{})
+}
+
+// DownloadIfModified downloads a file like Download, unless the server tells that it
+// has not changed since the download which returned the validators
+func (s Stager) DownloadIfModified(f File, folder string, maxSize int64, validators Validators) (Result, error) {
+	result := Result{Name: f.Name, URL: f.URL}
+	req, err := http.NewRequest("GET", f.URL, nil)
+	if err != nil {
+		return result, err
+	}
+	if validators.ETag != "" {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+	res, err := s.client().Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified && validators != (Validators{}) {
+		result.NotModified = true
+		return result, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("GET %s: %s", f.URL, res.Status)
+	}
+	result.ETag = res.Header.Get("ETag")
+	result.LastModified = res.Header.Get("Last-Modified")
+	if name := dispositionFileName(res.Header.Get("Content-Disposition")); name != "" {
+		result.Name = name
+	}
+	result.Name = safeFileName(result.Name)
+	if maxSize > 0 && res.ContentLength > maxSize {
+		return result, fmt.Errorf("the file is too large (%d bytes, the limit is %d)", res.ContentLength, maxSize)
+	}
+
+	file, err := os.Create(filepath.Join(folder, result.Name))
+	if err != nil {
+		return result, err
+	}
+	expected := parseChecksum(f.Checksum)
+	hash := expected.newHash()
+	body := io.Reader(res.Body)
+	if maxSize > 0 {
+		body = io.LimitReader(body, maxSize+1)
+	}
+	result.Size, err = io.Copy(io.MultiWriter(file, hash), body)
+	closeErr := file.Close()
+	if err != nil {
+		return result, err
+	}
+	if closeErr != nil {
+		return result, closeErr
+	}
+	if maxSize > 0 && result.Size > maxSize {
+		return result, fmt.Errorf("the file is too large (more than %d bytes)", maxSize)
+	}
+	return result, verify(f, expected, hash.Sum(nil), &result)
+}
+
+// Verify checks the checksum of a local copy of a file
+func Verify(f File, filePath string) (Result, error) {
+	result := Result{Name: filepath.Base(filePath), URL: f.URL}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return result, err
+	}
+	defer file.Close()
+	expected := parseChecksum(f.Checksum)
+	hash := expected.newHash()
+	result.Size, err = io.Copy(hash, file)
+	if err != nil {
+		return result, err
+	}
+	return result, verify(f, expected, hash.Sum(nil), &result)
+}
+
+// verify sets the checksum of a result and tells if it does not match the expected one
+func verify(f File, expected checksum, sum []byte, result *Result) error {
+	result.Checksum = expected.algorithm + ":" + fmt.Sprintf("%x", sum)
+	if expected.value != nil {
+		if !expected.matches(sum) {
+			return fmt.Errorf("checksum mismatch: expected %s, got %s", f.Checksum, result.Checksum)
+		}
+		result.Verified = true
+	}
+	return nil
+}
+
+// urlFileName returns the last element of the path of a URL
+func urlFileName(fileURL string) string {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return path.Base(fileURL)
+	}
+	return path.Base(u.Path)
+}
+
+// dispositionFileName returns the file name of a Content-Disposition header, if any
+func dispositionFileName(disposition string) string {
+	if disposition == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(disposition)
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+// safeFileName makes sure that a name given by a remote server cannot point outside
+// of the download folder
+func safeFileName(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == ".." || name == "/" || name == "" {
+		return "download"
+	}
+	return name
+}
@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+)
+
+// revalidatingServer serves files with an ETag, answering the conditional requests
+type revalidatingServer struct {
+	sync.Mutex
+	files     map[string]string
+	downloads int // the number of files sent
+}
+
+func (s *revalidatingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	content, found := s.files[strings.TrimPrefix(r.URL.Path, "/")]
+	s.Unlock()
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum([]byte(content))))
+	if r.Header.Get("If-None-Match") != w.Header().Get("ETag") {
+		s.Lock()
+		s.downloads++
+		s.Unlock()
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte(content)))
+}
+
+func (s *revalidatingServer) set(name string, content string) {
+	s.Lock()
+	defer s.Unlock()
+	s.files[name] = content
+}
+
+func TestFakeInputCache(t *testing.T) {
+	files := &revalidatingServer{files: map[string]string{
+		"a.txt": "aaaaaaaaaa",
+		"b.txt": "bbbbbbbbbb",
+		"c.txt": "cccccccccc",
+	}}
+	fileServer := httptest.NewServer(files)
+	defer fileServer.Close()
+
+	cacheFolder, err := ioutil.TempDir("", "inputcache")
+	CheckErr(t, err)
+	defer os.RemoveAll(cacheFolder)
+
+	g := newTestGEF(t, func(config *def.Configuration, _ db.Db) {
+		config.Pier.InputCacheFolder = cacheFolder
+		config.Pier.InputCacheSize = 25
+	}, map[string]fake.Handler{"clone_test": printInputs})
+	defer g.close()
+	p := g.pier
+	_, userToken := AddUserWithToken(t, g.db, name1, email1)
+	service := g.buildService(t, g.admin.ID, "./clone_test")
+
+	runJob := func(name string) db.Job {
+		job, err := p.RunService(g.admin.ID, service.ID, remoteInputs(fileServer.URL+"/"+name), g.config.Limits, g.config.Timeouts)
+		CheckErr(t, err)
+		job = g.waitJob(t, job.ID)
+		ExpectEquals(t, job.State.Error, "")
+		return job
+	}
+
+	job := runJob("a.txt")
+	Expect(t, !job.StagedFiles[0].Cached)
+	ExpectEquals(t, files.downloads, 1)
+
+	// the copy is used while the file does not change
+	job = runJob("a.txt")
+	Expect(t, job.StagedFiles[0].Cached)
+	ExpectEquals(t, files.downloads, 1)
+	ExpectEquals(t, job.Tasks[1].ConsoleOutput, "a.txt: aaaaaaaaaa\n")
+	Expect(t, strings.Contains(job.Tasks[0].ConsoleOutput, "from the cache"))
+
+	files.set("a.txt", "AAAAAAAAAA")
+	job = runJob("a.txt")
+	Expect(t, !job.StagedFiles[0].Cached)
+	ExpectEquals(t, files.downloads, 2)
+	ExpectEquals(t, job.Tasks[1].ConsoleOutput, "a.txt: AAAAAAAAAA\n")
+
+	// only two files fit, the least recently used one is evicted
+	runJob("b.txt")
+	runJob("a.txt")
+	runJob("c.txt")
+	cache, err := p.GetInputCache()
+	CheckErr(t, err)
+	ExpectEquals(t, len(cache.Entries), 2)
+	ExpectEquals(t, cache.Entries[0].URL, fileServer.URL+"/a.txt")
+	ExpectEquals(t, cache.Entries[0].Hits, 1)
+	ExpectEquals(t, cache.Entries[1].URL, fileServer.URL+"/c.txt")
+	ExpectEquals(t, cache.Size, int64(20))
+	cached, err := ioutil.ReadDir(cacheFolder)
+	CheckErr(t, err)
+	ExpectEquals(t, len(cached), 2)
+
+	// the administration endpoints
+	cacheURL := g.serve(t) + "/api/cache"
+
+	res, _ := sendForm(t, "GET", gefurl(cacheURL, userToken.Secret), nil)
+	ExpectEquals(t, res.StatusCode, 403)
+	res, body := sendForm(t, "GET", gefurl(cacheURL, g.adminToken.Secret), nil)
+	ExpectEquals(t, res.StatusCode, 200)
+	var listed struct{ InputCache pier.InputCache }
+	CheckErr(t, json.Unmarshal(body, &listed))
+	ExpectEquals(t, len(listed.InputCache.Entries), 2)
+	ExpectEquals(t, listed.InputCache.MaxSize, int64(25))
+
+	res, _ = sendForm(t, "DELETE", gefurl(cacheURL+"/unknown", g.adminToken.Secret), nil)
+	ExpectEquals(t, res.StatusCode, 400)
+	res, body = sendForm(t, "DELETE", gefurl(cacheURL+"/"+listed.InputCache.Entries[0].ID, g.adminToken.Secret), nil)
+	ExpectEquals(t, res.StatusCode, 200)
+	CheckErr(t, json.Unmarshal(body, &listed))
+	ExpectEquals(t, len(listed.InputCache.Entries), 1)
+	_, err = os.Stat(filepath.Join(cacheFolder, cache.Entries[0].ID))
+	Expect(t, os.IsNotExist(err))
+
+	res, body = sendForm(t, "DELETE", gefurl(cacheURL, g.adminToken.Secret), nil)
+	ExpectEquals(t, res.StatusCode, 200)
+	CheckErr(t, json.Unmarshal(body, &listed))
+	ExpectEquals(t, len(listed.InputCache.Entries), 0)
+	cached, err = ioutil.ReadDir(cacheFolder)
+	CheckErr(t, err)
+	ExpectEquals(t, len(cached), 0)
+}
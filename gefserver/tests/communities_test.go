@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+)
+
+func TestFakeCommunities(t *testing.T) {
+	g := newTestGEF(t, func(config *def.Configuration, _ db.Db) {
+		config.Server.RoleMappings = []def.RoleMappingConfig{
+			{Entitlement: ".*", Community: "EUDAT"},
+			{Entitlement: ".*", Community: "Philologists"},
+		}
+	}, nil)
+	defer g.close()
+	database, rootToken := g.db, g.adminToken
+	admin, adminToken := AddUserWithToken(t, database, name1, email1)
+	member, memberToken := AddUserWithToken(t, database, name2, email2)
+	_, outsiderToken := AddUserWithToken(t, database, "outsider", "outsider@example.com")
+	serverURL := g.serve(t)
+	communitiesURL := serverURL + "/api/communities"
+
+	// only the superadministrators create communities, and delegate their administration
+	values := url.Values{"name": {"Linguists"}, "description": {"text analysis"}, "adminEmail": {email1}}
+	res, _ := sendForm(t, "POST", gefurl(communitiesURL, adminToken.Secret), values)
+	ExpectEquals(t, res.StatusCode, 403)
+	res, body := sendForm(t, "POST", gefurl(communitiesURL, rootToken.Secret), values)
+	ExpectEquals(t, res.StatusCode, 201)
+	var created struct{ Community db.Community }
+	CheckErr(t, json.Unmarshal(body, &created))
+	ExpectEquals(t, created.Community.Name, "Linguists")
+	res, _ = sendForm(t, "POST", gefurl(communitiesURL, rootToken.Secret), values)
+	ExpectEquals(t, res.StatusCode, 400)
+	communityURL := fmt.Sprintf("%s/%d", communitiesURL, created.Community.ID)
+	membersURL := communityURL + "/members"
+
+	res, body = sendWithAuthorization(t, "GET", communitiesURL, "")
+	ExpectEquals(t, res.StatusCode, 200)
+	var listed struct{ Communities []db.Community }
+	CheckErr(t, json.Unmarshal(body, &listed))
+	ExpectEquals(t, len(listed.Communities), 2) // with the EUDAT community
+	res, body = sendWithAuthorization(t, "GET", communityURL, "")
+	ExpectEquals(t, res.StatusCode, 200)
+	var inspected struct{ Roles []db.Role }
+	CheckErr(t, json.Unmarshal(body, &inspected))
+	ExpectEquals(t, len(inspected.Roles), 2)
+
+	// the community administrators manage the members and edit their community
+	res, _ = sendForm(t, "POST", gefurl(membersURL, outsiderToken.Secret), url.Values{"userEmail": {email2}})
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendForm(t, "POST", gefurl(membersURL, adminToken.Secret), url.Values{"userEmail": {email2}})
+	ExpectEquals(t, res.StatusCode, 200)
+	res, _ = sendForm(t, "POST", gefurl(membersURL, adminToken.Secret), url.Values{"userEmail": {email2}, "role": {"Owner"}})
+	ExpectEquals(t, res.StatusCode, 400)
+	res, body = sendWithAuthorization(t, "GET", gefurl(membersURL, adminToken.Secret), "")
+	ExpectEquals(t, res.StatusCode, 200)
+	var members struct{ Members []db.RoleGrant }
+	CheckErr(t, json.Unmarshal(body, &members))
+	ExpectEquals(t, len(members.Members), 2)
+	res, _ = sendWithAuthorization(t, "GET", gefurl(membersURL, memberToken.Secret), "")
+	ExpectEquals(t, res.StatusCode, 403)
+
+	res, _ = sendForm(t, "PUT", gefurl(communityURL, adminToken.Secret), url.Values{"description": {"corpora"}})
+	ExpectEquals(t, res.StatusCode, 200)
+	community, err := database.GetCommunityByID(created.Community.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, community, db.Community{ID: created.Community.ID, Name: "Linguists", Description: "corpora"})
+	res, _ = sendForm(t, "PUT", gefurl(communityURL, memberToken.Secret), url.Values{"description": {"none"}})
+	ExpectEquals(t, res.StatusCode, 403)
+
+	// the role mappings refer to the communities by name: only the superadministrators rename
+	// them, and not to or from the names of the role mappings. The tokens and the quotas refer
+	// to the communities by ID, and are not affected
+	restricted, err := database.NewScopedUserToken(admin.ID, "restricted", time.Now().Add(time.Hour),
+		[]string{db.AdminScope}, nil, []int64{created.Community.ID})
+	CheckErr(t, err)
+	res, _ = sendForm(t, "PUT", gefurl(communityURL, adminToken.Secret), url.Values{"name": {"Linguistics"}})
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendForm(t, "PUT", gefurl(communityURL, adminToken.Secret), url.Values{"name": {"Linguists"}, "description": {"corpora"}})
+	ExpectEquals(t, res.StatusCode, 200)
+	res, _ = sendForm(t, "PUT", gefurl(communityURL, rootToken.Secret), url.Values{"name": {"Philologists"}})
+	ExpectEquals(t, res.StatusCode, 400)
+	eudat, err := database.GetCommunityByName("EUDAT")
+	CheckErr(t, err)
+	res, _ = sendForm(t, "PUT", gefurl(fmt.Sprintf("%s/%d", communitiesURL, eudat.ID), rootToken.Secret), url.Values{"name": {"EUDAT2"}})
+	ExpectEquals(t, res.StatusCode, 400)
+	res, _ = sendForm(t, "PUT", gefurl(communityURL, rootToken.Secret), url.Values{"name": {"Linguistics"}})
+	ExpectEquals(t, res.StatusCode, 200)
+	community, err = database.GetCommunityByID(created.Community.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, community, db.Community{ID: created.Community.ID, Name: "Linguistics", Description: "corpora"})
+	res, _ = sendForm(t, "PUT", gefurl(communityURL, restricted.Secret), url.Values{"description": {"corpora"}})
+	ExpectEquals(t, res.StatusCode, 200)
+
+	// the services given to a community, and their jobs, are only seen by its members
+	state := db.NewJobStateOk("done", 0)
+	for _, id := range []db.ServiceID{"public", "private"} {
+		CheckErr(t, database.AddService(admin.ID, db.Service{ID: id, Name: string(id), Created: time.Now()}))
+		CheckErr(t, database.AddJob(admin.ID, db.Job{ID: db.JobID("job_" + id), ServiceID: id, Created: time.Now(), State: &state}))
+	}
+	service, err := database.GetService("private")
+	CheckErr(t, err)
+	service.CommunityID = created.Community.ID
+	res, _ = sendJSON(t, "PUT", gefurl(serverURL+"/api/services/private", outsiderToken.Secret), service)
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendJSON(t, "PUT", gefurl(serverURL+"/api/services/private", adminToken.Secret), service)
+	ExpectEquals(t, res.StatusCode, 200)
+
+	total := func(listURL string, token string) float64 {
+		authorization := ""
+		if token != "" {
+			authorization = "Bearer " + token
+		}
+		res, body := sendWithAuthorization(t, "GET", listURL, authorization)
+		ExpectEquals(t, res.StatusCode, 200)
+		var list struct{ Total float64 }
+		CheckErr(t, json.Unmarshal(body, &list))
+		return list.Total
+	}
+	ExpectEquals(t, total(serverURL+"/api/services", ""), float64(1))
+	ExpectEquals(t, total(serverURL+"/api/services", outsiderToken.Secret), float64(1))
+	ExpectEquals(t, total(serverURL+"/api/services", memberToken.Secret), float64(2))
+	ExpectEquals(t, total(serverURL+"/api/services", rootToken.Secret), float64(2))
+	ExpectEquals(t, total(serverURL+"/api/jobs?mine=false", rootToken.Secret), float64(2))
+
+	res, _ = sendWithAuthorization(t, "GET", gefurl(serverURL+"/api/services/private", outsiderToken.Secret), "")
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendWithAuthorization(t, "GET", gefurl(serverURL+"/api/services/private", memberToken.Secret), "")
+	ExpectEquals(t, res.StatusCode, 200)
+	res, _ = sendWithAuthorization(t, "GET", serverURL+"/api/jobs/job_private", "")
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendWithAuthorization(t, "GET", gefurl(serverURL+"/api/jobs/job_private", memberToken.Secret), "")
+	ExpectEquals(t, res.StatusCode, 200)
+
+	// the members who leave the community do not see its services anymore
+	res, _ = sendWithAuthorization(t, "DELETE", gefurl(fmt.Sprintf("%s/%d", membersURL, member.ID), adminToken.Secret), "")
+	ExpectEquals(t, res.StatusCode, 200)
+	ExpectEquals(t, total(serverURL+"/api/services", memberToken.Secret), float64(1))
+
+	// the communities are removed by the superadministrators, once they have no services
+	res, _ = sendWithAuthorization(t, "DELETE", gefurl(communityURL, adminToken.Secret), "")
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendWithAuthorization(t, "DELETE", gefurl(communityURL, rootToken.Secret), "")
+	ExpectEquals(t, res.StatusCode, 400)
+	CheckErr(t, database.RemoveService("private"))
+	res, _ = sendWithAuthorization(t, "DELETE", gefurl(communityURL, rootToken.Secret), "")
+	ExpectEquals(t, res.StatusCode, 200)
+	res, _ = sendWithAuthorization(t, "GET", communityURL, "")
+	ExpectEquals(t, res.StatusCode, 400)
+}
@@ -0,0 +1,83 @@
+package tests
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+)
+
+// download sends a request for a volume file and returns the response with its body
+func download(t *testing.T, method string, url string, headers map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, nil)
+	CheckErr(t, err)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	CheckErr(t, err)
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	CheckErr(t, err)
+	return res, string(data)
+}
+
+func TestFakeVolumeFileRanges(t *testing.T) {
+	g := newTestGEF(t, nil, map[string]fake.Handler{"clone_test": func(task *fake.Task) int {
+		CheckErr(t, task.WriteFile("/mydata/output/data.nc", []byte("0123456789")))
+		return 0
+	}})
+	defer g.close()
+	user, token := AddUserWithToken(t, g.db, name1, email1)
+	service := g.buildService(t, user.ID, "./clone_test")
+
+	job, err := g.pier.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), g.config.Limits, g.config.Timeouts)
+	CheckErr(t, err)
+	job = g.waitJob(t, job.ID)
+	ExpectEquals(t, job.State.Error, "")
+
+	serverURL := g.serve(t)
+	fileURL := gefurlFileContent(serverURL+"/api/volumes/"+string(job.OutputVolume[0].VolumeID)+"/data.nc", token.Secret)
+
+	res, body := download(t, "GET", fileURL, nil)
+	ExpectEquals(t, res.StatusCode, 200)
+	ExpectEquals(t, body, "0123456789")
+	ExpectEquals(t, res.Header.Get("Content-Length"), "10")
+	ExpectEquals(t, res.Header.Get("Accept-Ranges"), "bytes")
+	etag := res.Header.Get("ETag")
+	Expect(t, etag != "")
+	Expect(t, res.Header.Get("Last-Modified") != "")
+
+	res, body = download(t, "HEAD", fileURL, nil)
+	ExpectEquals(t, res.StatusCode, 200)
+	ExpectEquals(t, body, "")
+	ExpectEquals(t, res.Header.Get("Content-Length"), "10")
+	ExpectEquals(t, res.Header.Get("ETag"), etag)
+
+	// resuming a download
+	res, body = download(t, "GET", fileURL, map[string]string{"Range": "bytes=4-", "If-Range": etag})
+	ExpectEquals(t, res.StatusCode, http.StatusPartialContent)
+	ExpectEquals(t, body, "456789")
+	ExpectEquals(t, res.Header.Get("Content-Range"), "bytes 4-9/10")
+
+	res, body = download(t, "GET", fileURL, map[string]string{"Range": "bytes=2-3"})
+	ExpectEquals(t, res.StatusCode, http.StatusPartialContent)
+	ExpectEquals(t, body, "23")
+
+	// the file changed since the first part was downloaded
+	res, body = download(t, "GET", fileURL, map[string]string{"Range": "bytes=4-", "If-Range": `"other"`})
+	ExpectEquals(t, res.StatusCode, 200)
+	ExpectEquals(t, body, "0123456789")
+
+	// multiple ranges are answered with the whole file
+	res, body = download(t, "GET", fileURL, map[string]string{"Range": "bytes=6-7,0-1"})
+	ExpectEquals(t, res.StatusCode, 200)
+	ExpectEquals(t, body, "0123456789")
+
+	res, _ = download(t, "GET", fileURL, map[string]string{"Range": "bytes=20-"})
+	ExpectEquals(t, res.StatusCode, http.StatusRequestedRangeNotSatisfiable)
+
+	res, _ = download(t, "GET", fileURL, map[string]string{"If-None-Match": etag})
+	ExpectEquals(t, res.StatusCode, http.StatusNotModified)
+}
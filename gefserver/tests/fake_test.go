@@ -0,0 +1,493 @@
+package tests
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+)
+
+// newFakeBackend returns an in-memory backend simulating the clone_test service
+func newFakeBackend() *fake.Backend {
+	backend := fake.NewBackend()
+	backend.Handle("clone_test", func(task *fake.Task) int {
+		task.Printf("'/test.txt' -> '/mydata/output/test.txt'\n")
+		err := task.WriteFile("/mydata/output/test.txt", []byte("test"))
+		if err != nil {
+			task.Printf("%s\n", err)
+			return 1
+		}
+		return 0
+	})
+	return backend
+}
+
+func TestFakeExecution(t *testing.T) {
+	config, err := def.ReadConfigFile(configFilePath)
+	CheckErr(t, err)
+
+	// overwrite this because when testing we're in a different working directory
+	config.Pier.InternalServicesFolder = internalServicesFolder
+	stageInServer := newStageInServer(nil, nil)
+	defer stageInServer.Close()
+	config.Pier.HandleServer = stageInServer.URL
+
+	db, dbfile, err := db.InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(dbfile)
+	user, _ := AddUserWithToken(t, db, name1, email1)
+
+	p, err := pier.NewPier(&db, config.Pier, config.TmpDir, config.Timeouts)
+	CheckErr(t, err)
+
+	connID, err := p.AddConnection(0, def.DockerConfig{}, newFakeBackend())
+	CheckErr(t, err)
+
+	service, err := p.BuildService(connID, user.ID, "./clone_test")
+	CheckErr(t, err)
+	ExpectEquals(t, service.Name, "Test Clone")
+	ExpectEquals(t, len(service.Input), 1)
+	ExpectEquals(t, len(service.Output), 1)
+
+	job, err := p.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	jobid := job.ID
+
+	for job.State.Code == -1 {
+		job, err = db.GetJob(jobid)
+		CheckErr(t, err)
+	}
+
+	if job.State.Error != "" {
+		for i, t := range job.Tasks {
+			log.Println("task ", i, ":", t)
+		}
+	}
+	ExpectEquals(t, job.State.Error, "")
+	ExpectEquals(t, len(job.Tasks), 2)
+	ExpectEquals(t, job.Tasks[1].ConsoleOutput, "'/test.txt' -> '/mydata/output/test.txt'\n")
+
+	files, err := p.ListFiles(job.OutputVolume[0].VolumeID, "", config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	ExpectEquals(t, len(files), 1)
+	ExpectEquals(t, files[0].Name, "test.txt")
+
+	_, err = p.RemoveJob(user.ID, jobid)
+	CheckErr(t, err)
+}
+
+func TestFakeJobCancellation(t *testing.T) {
+	config, err := def.ReadConfigFile(configFilePath)
+	CheckErr(t, err)
+
+	// overwrite this because when testing we're in a different working directory
+	config.Pier.InternalServicesFolder = internalServicesFolder
+	stageInServer := newStageInServer(nil, nil)
+	defer stageInServer.Close()
+	config.Pier.HandleServer = stageInServer.URL
+
+	db, dbfile, err := db.InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(dbfile)
+	user, _ := AddUserWithToken(t, db, name1, email1)
+
+	p, err := pier.NewPier(&db, config.Pier, config.TmpDir, config.Timeouts)
+	CheckErr(t, err)
+
+	backend := newFakeBackend()
+	started := make(chan struct{})
+	backend.Handle("clone_test", func(task *fake.Task) int {
+		close(started)
+		<-task.Stopped() // runs until terminated
+		return 0
+	})
+	connID, err := p.AddConnection(0, def.DockerConfig{}, backend)
+	CheckErr(t, err)
+
+	service, err := p.BuildService(connID, user.ID, "./clone_test")
+	CheckErr(t, err)
+
+	job, err := p.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	<-started
+
+	job, err = p.CancelJob(user.ID, job.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, job.State.Code, 2)
+
+	for _, v := range append(job.InputVolume, job.OutputVolume...) {
+		ExpectEquals(t, backend.RemoveVolume(v.VolumeID), pier.ErrNoSuchVolume)
+	}
+}
+
+func TestFakeVolumeArchive(t *testing.T) {
+	config, err := def.ReadConfigFile(configFilePath)
+	CheckErr(t, err)
+
+	// overwrite this because when testing we're in a different working directory
+	config.Pier.InternalServicesFolder = internalServicesFolder
+	stageInServer := newStageInServer(nil, nil)
+	defer stageInServer.Close()
+	config.Pier.HandleServer = stageInServer.URL
+
+	db, dbfile, err := db.InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(dbfile)
+	user, _ := AddUserWithToken(t, db, name1, email1)
+
+	p, err := pier.NewPier(&db, config.Pier, config.TmpDir, config.Timeouts)
+	CheckErr(t, err)
+
+	backend := fake.NewBackend()
+	backend.Handle("clone_test", func(task *fake.Task) int {
+		CheckErr(t, task.WriteFile("/mydata/output/a.txt", []byte("first")))
+		CheckErr(t, task.WriteFile("/mydata/output/sub/b.txt", []byte("second")))
+		return 0
+	})
+	connID, err := p.AddConnection(0, def.DockerConfig{}, backend)
+	CheckErr(t, err)
+	service, err := p.BuildService(connID, user.ID, "./clone_test")
+	CheckErr(t, err)
+
+	job, err := p.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	for job.State.Code == -1 {
+		job, err = db.GetJob(job.ID)
+		CheckErr(t, err)
+	}
+	ExpectEquals(t, job.State.Error, "")
+	volumeID := string(job.OutputVolume[0].VolumeID)
+
+	// the whole volume as tar.gz
+	w := httptest.NewRecorder()
+	CheckErr(t, p.DownStreamContainerArchive(volumeID, "", pier.ArchiveTarGz, config.Limits, config.Timeouts, w))
+	ExpectEquals(t, w.Header().Get("Content-Type"), "application/gzip")
+	ExpectEquals(t, w.Header().Get("Content-Disposition"), "attachment; filename=\""+volumeID+".tar.gz\"")
+	gz, err := gzip.NewReader(w.Body)
+	CheckErr(t, err)
+	files := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		CheckErr(t, err)
+		data, err := ioutil.ReadAll(tr)
+		CheckErr(t, err)
+		files[header.Name] = string(data)
+	}
+	ExpectEquals(t, files, map[string]string{volumeID + "/a.txt": "first", volumeID + "/sub/b.txt": "second"})
+
+	// a folder as zip
+	w = httptest.NewRecorder()
+	CheckErr(t, p.DownStreamContainerArchive(volumeID, "sub", pier.ArchiveZip, config.Limits, config.Timeouts, w))
+	ExpectEquals(t, w.Header().Get("Content-Type"), "application/zip")
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	CheckErr(t, err)
+	ExpectEquals(t, len(zr.File), 1)
+	ExpectEquals(t, zr.File[0].Name, "sub/b.txt")
+	f, err := zr.File[0].Open()
+	CheckErr(t, err)
+	data, err := ioutil.ReadAll(f)
+	CheckErr(t, err)
+	ExpectEquals(t, string(data), "second")
+}
+
+// waitForJob waits for a job to end, failing the test after a deadline
+func waitForJob(t *testing.T, d db.Db, jobID db.JobID) db.Job {
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		job, err := d.GetJob(jobID)
+		CheckErr(t, err)
+		if job.State.Code != -1 {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s did not end: %s", jobID, job.State.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFakeWorkflow(t *testing.T) {
+	config, err := def.ReadConfigFile(configFilePath)
+	CheckErr(t, err)
+
+	// overwrite this because when testing we're in a different working directory
+	config.Pier.InternalServicesFolder = internalServicesFolder
+	stageInServer := newStageInServer(nil, nil)
+	defer stageInServer.Close()
+	config.Pier.HandleServer = stageInServer.URL
+
+	database, dbfile, err := db.InitDbForTesting()
+	CheckErr(t, err)
+	defer database.Close()
+	defer os.Remove(dbfile)
+	user, _ := AddUserWithToken(t, database, name1, email1)
+
+	p, err := pier.NewPier(&database, config.Pier, config.TmpDir, config.Timeouts)
+	CheckErr(t, err)
+
+	// the second service copies the output of the first one, or fails if told so
+	backend := newFakeBackend()
+	var mutex sync.Mutex
+	failCopy := false
+	copies := 0
+	backend.Handle("timeout_test", func(task *fake.Task) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		copies++
+		if failCopy {
+			task.Printf("failed\n")
+			return 3
+		}
+		data, err := task.ReadFile("/root/input/test.txt")
+		if err != nil {
+			task.Printf("%s\n", err)
+			return 1
+		}
+		if err := task.WriteFile("/root/output/copy.txt", append([]byte("copy of "), data...)); err != nil {
+			task.Printf("%s\n", err)
+			return 1
+		}
+		return 0
+	})
+	connID, err := p.AddConnection(0, def.DockerConfig{}, backend)
+	CheckErr(t, err)
+	clone, err := p.BuildService(connID, user.ID, "./clone_test")
+	CheckErr(t, err)
+	copier, err := p.BuildService(connID, user.ID, "./timeout_test")
+	CheckErr(t, err)
+
+	// the steps run in sequence, each one reading the output of the previous one
+	workflow, err := p.AddWorkflow(user.ID, db.Workflow{Name: "chain", Steps: []db.ServiceID{clone.ID, copier.ID}})
+	CheckErr(t, err)
+	job, err := p.RunWorkflow(user.ID, workflow.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	job = waitForJob(t, database, job.ID)
+	ExpectEquals(t, job.State.Error, "")
+	ExpectEquals(t, job.State.Code, 0)
+	ExpectEquals(t, len(job.Tasks), 3)
+	ExpectEquals(t, len(job.OutputVolume), 2)
+	files, err := p.ListFiles(job.OutputVolume[1].VolumeID, "", config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	ExpectEquals(t, len(files), 1)
+	ExpectEquals(t, files[0].Name, "copy.txt")
+	chain := job
+
+	// a failing step stops the workflow
+	mutex.Lock()
+	failCopy, copies = true, 0
+	mutex.Unlock()
+	workflow, err = p.AddWorkflow(user.ID, db.Workflow{Name: "failing", Steps: []db.ServiceID{copier.ID, clone.ID}})
+	CheckErr(t, err)
+	cloneCalls := 0
+	backend.Handle("clone_test", func(task *fake.Task) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		cloneCalls++
+		return 0
+	})
+	job, err = p.RunWorkflow(user.ID, workflow.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	job = waitForJob(t, database, job.ID)
+	ExpectEquals(t, job.State.Code, 1)
+	ExpectEquals(t, job.State.Status, "Workflow step #1 (Executing apt-get update command) failed (exitCode = 3)")
+	ExpectEquals(t, len(job.Tasks), 2)
+	mutex.Lock()
+	ExpectEquals(t, copies, 1)
+	ExpectEquals(t, cloneCalls, 0)
+	mutex.Unlock()
+
+	// a service edited after the workflow was added cannot break the chain of volumes
+	edited, err := database.GetService(copier.ID)
+	CheckErr(t, err)
+	edited.Input = append(edited.Input, db.IOPort{ID: "input1", Name: "second input", Path: "/root/input2"})
+	CheckErr(t, database.RemoveService(edited.ID))
+	CheckErr(t, database.AddService(user.ID, edited))
+	_, err = p.RunWorkflow(user.ID, chain.WorkflowID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
+	Expect(t, err != nil)
+	_, err = p.RetryJob(user.ID, chain.ID, config.Limits, config.Timeouts)
+	Expect(t, err != nil)
+}
+
+func TestFakeCancellationBetweenSteps(t *testing.T) {
+	config, err := def.ReadConfigFile(configFilePath)
+	CheckErr(t, err)
+
+	// overwrite this because when testing we're in a different working directory
+	config.Pier.InternalServicesFolder = internalServicesFolder
+	stageInServer := newStageInServer(nil, nil)
+	defer stageInServer.Close()
+	config.Pier.HandleServer = stageInServer.URL
+
+	database, dbfile, err := db.InitDbForTesting()
+	CheckErr(t, err)
+	defer database.Close()
+	defer os.Remove(dbfile)
+	user, _ := AddUserWithToken(t, database, name1, email1)
+
+	p, err := pier.NewPier(&database, config.Pier, config.TmpDir, config.Timeouts)
+	CheckErr(t, err)
+
+	// the job is held when it creates the output volume of its second step
+	backend := newFakeBackend()
+	var mutex sync.Mutex
+	firstStepDone, secondStepRun := false, false
+	backend.Handle("clone_test", func(task *fake.Task) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		firstStepDone = true
+		return 0
+	})
+	backend.Handle("timeout_test", func(task *fake.Task) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		secondStepRun = true
+		return 0
+	})
+	betweenSteps, release := make(chan struct{}), make(chan struct{})
+	backend.OnNewVolume(func() {
+		mutex.Lock()
+		hold := firstStepDone && betweenSteps != nil
+		if hold {
+			close(betweenSteps)
+			betweenSteps = nil
+		}
+		mutex.Unlock()
+		if hold {
+			<-release
+		}
+	})
+	held := betweenSteps
+	connID, err := p.AddConnection(0, def.DockerConfig{}, backend)
+	CheckErr(t, err)
+	clone, err := p.BuildService(connID, user.ID, "./clone_test")
+	CheckErr(t, err)
+	copier, err := p.BuildService(connID, user.ID, "./timeout_test")
+	CheckErr(t, err)
+	workflow, err := p.AddWorkflow(user.ID, db.Workflow{Name: "chain", Steps: []db.ServiceID{clone.ID, copier.ID}})
+	CheckErr(t, err)
+
+	job, err := p.RunWorkflow(user.ID, workflow.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	<-held
+	job, err = p.CancelJob(user.ID, job.ID)
+	CheckErr(t, err)
+	close(release)
+
+	// the second step is not started, and its output volume, recorded once created, is removed too
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		volumes, err := backend.ListVolumes()
+		CheckErr(t, err)
+		job, err = database.GetJob(job.ID)
+		CheckErr(t, err)
+		if len(volumes) == 0 && len(job.OutputVolume) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("volumes left after the cancellation: %v", volumes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ExpectEquals(t, job.State.Code, 2)
+	ExpectEquals(t, len(job.Tasks), 2)
+	mutex.Lock()
+	ExpectEquals(t, secondStepRun, false)
+	mutex.Unlock()
+}
+
+func TestFakeCancellationWhileCreatingInputs(t *testing.T) {
+	config, err := def.ReadConfigFile(configFilePath)
+	CheckErr(t, err)
+
+	// overwrite this because when testing we're in a different working directory
+	config.Pier.InternalServicesFolder = internalServicesFolder
+	stageInServer := newStageInServer(nil, nil)
+	defer stageInServer.Close()
+	config.Pier.HandleServer = stageInServer.URL
+
+	database, dbfile, err := db.InitDbForTesting()
+	CheckErr(t, err)
+	defer database.Close()
+	defer os.Remove(dbfile)
+	user, _ := AddUserWithToken(t, database, name1, email1)
+
+	p, err := pier.NewPier(&database, config.Pier, config.TmpDir, config.Timeouts)
+	CheckErr(t, err)
+
+	// the job is held when it creates its input volume
+	backend := newFakeBackend()
+	var mutex sync.Mutex
+	serviceRun := false
+	backend.Handle("clone_test", func(task *fake.Task) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		serviceRun = true
+		return 0
+	})
+	connID, err := p.AddConnection(0, def.DockerConfig{}, backend)
+	CheckErr(t, err)
+	service, err := p.BuildService(connID, user.ID, "./clone_test")
+	CheckErr(t, err)
+	held, release := make(chan struct{}), make(chan struct{})
+	backend.OnNewVolume(func() {
+		mutex.Lock()
+		hold := held != nil
+		if hold {
+			close(held)
+			held = nil
+		}
+		mutex.Unlock()
+		if hold {
+			<-release
+		}
+	})
+	creating := held
+
+	job, err := p.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	<-creating
+	job, err = p.CancelJob(user.ID, job.ID)
+	CheckErr(t, err)
+	close(release)
+
+	// the input volume, created after the cancellation removed the recorded ones, is removed too
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		volumes, err := backend.ListVolumes()
+		CheckErr(t, err)
+		job, err = database.GetJob(job.ID)
+		CheckErr(t, err)
+		if len(volumes) == 0 && len(job.InputVolume) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("volumes left after the cancellation: %v", volumes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ExpectEquals(t, job.State.Code, 2)
+	ExpectEquals(t, len(job.Tasks), 0)
+	mutex.Lock()
+	ExpectEquals(t, serviceRun, false)
+	mutex.Unlock()
+}
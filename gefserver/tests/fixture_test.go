@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+	"github.com/EUDAT-GEF/GEF/gefserver/server"
+)
+
+// testGEF is a GEF instance for the tests: a test database with a superadministrator, a pier
+// with a single connection to a fake backend, and a stand-in for the handle server, for
+// B2SHARE and for the data servers (see newStageInServer), serving the files and checksums
+// put in stageInFiles and stageInChecksums
+type testGEF struct {
+	config           def.Configuration
+	db               db.Db
+	pier             *pier.Pier
+	backend          *fake.Backend
+	connID           db.ConnectionID
+	admin            db.User
+	adminToken       db.Token
+	stageIn          *httptest.Server
+	stageInFiles     map[string]string
+	stageInChecksums map[string]string
+	closers          []func()
+}
+
+// newTestGEF creates a GEF instance for a test, running the given handlers on the fake
+// backend; setup, if not nil, can change the configuration and fill the database before the
+// pier is created
+func newTestGEF(t *testing.T, setup func(config *def.Configuration, database db.Db), handlers map[string]fake.Handler) *testGEF {
+	g := &testGEF{
+		stageInFiles:     make(map[string]string),
+		stageInChecksums: make(map[string]string),
+	}
+	g.stageIn = newStageInServer(g.stageInFiles, g.stageInChecksums)
+	g.closers = append(g.closers, g.stageIn.Close)
+
+	config, err := def.ReadConfigFile(configFilePath)
+	CheckErr(t, err)
+	// overwrite this because when testing we're in a different working directory
+	config.Pier.InternalServicesFolder = internalServicesFolder
+	config.Pier.HandleServer = g.stageIn.URL
+	g.config = config
+
+	database, dbfile, err := db.InitDbForTesting()
+	CheckErr(t, err)
+	g.db = database
+	g.closers = append(g.closers, func() {
+		database.Close()
+		os.Remove(dbfile)
+	})
+	g.admin, g.adminToken = AddUserWithToken(t, database, "admin", "admin@example.com")
+	SetSuperAdmin(t, database, g.admin.ID)
+
+	if setup != nil {
+		setup(&g.config, g.db)
+	}
+
+	g.pier, err = pier.NewPier(&g.db, g.config.Pier, g.config.TmpDir, g.config.Timeouts)
+	CheckErr(t, err)
+	g.backend = fake.NewBackend()
+	for name, handler := range handlers {
+		g.backend.Handle(name, handler)
+	}
+	g.connID, err = g.pier.AddConnection(0, def.DockerConfig{}, g.backend)
+	CheckErr(t, err)
+	return g
+}
+
+// buildService builds a service on the fake backend, owned by a user
+func (g *testGEF) buildService(t *testing.T, userID int64, dir string) db.Service {
+	service, err := g.pier.BuildService(g.connID, userID, dir)
+	CheckErr(t, err)
+	return service
+}
+
+// waitJob waits for a job to end and to leave the queue; its volumes are measured, by a
+// task of their own, in between
+func (g *testGEF) waitJob(t *testing.T, jobID db.JobID) db.Job {
+	waitForJob(t, g.db, jobID)
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		_, err := g.db.GetQueuedJob(jobID)
+		if db.IsNoResultsError(err) {
+			break
+		}
+		CheckErr(t, err)
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is still in the queue", jobID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	job, err := g.db.GetJob(jobID)
+	CheckErr(t, err)
+	return job
+}
+
+// serve starts the API server, with its timeouts, and returns its URL
+func (g *testGEF) serve(t *testing.T) string {
+	s, err := server.NewServer(g.config, g.pier, &g.db)
+	CheckErr(t, err)
+	srv := httptest.NewUnstartedServer(s.Server.Handler)
+	srv.Config.ReadTimeout = s.Server.ReadTimeout
+	srv.Config.WriteTimeout = s.Server.WriteTimeout
+	srv.Start()
+	g.closers = append(g.closers, srv.Close)
+	return srv.URL
+}
+
+// close stops the servers and removes the database
+func (g *testGEF) close() {
+	for i := len(g.closers) - 1; i >= 0; i-- {
+		g.closers[i]()
+	}
+}
+
+// printInputs is a handler printing the name and the content of the input files
+func printInputs(task *fake.Task) int {
+	for _, name := range task.ListFiles("/mydata/input") {
+		content, err := task.ReadFile("/mydata/input/" + name)
+		if err != nil {
+			task.Printf("%s\n", err)
+			return 1
+		}
+		task.Printf("%s: %s\n", name, content)
+	}
+	return 0
+}
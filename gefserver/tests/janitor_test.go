@@ -0,0 +1,200 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+)
+
+func TestFakeJanitor(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gef_janitor")
+	CheckErr(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// the successful jobs expire right away, except those of the superadmins,
+	// and the failed ones are kept forever; the leftovers are removed after a second
+	g := newTestGEF(t, func(config *def.Configuration, _ db.Db) {
+		config.TmpDir = tmpDir
+		config.Pier.Retention = def.RetentionConfig{
+			Jobs: def.JobRetention{Succeeded: 1e-9, Failed: 0, Cancelled: 1e-9},
+			Roles: map[string]def.JobRetention{
+				db.SuperAdminRoleName: {Succeeded: 0, Failed: 0, Cancelled: 0},
+			},
+			TmpFiles:    1,
+			LeftoverAge: 1,
+		}
+	}, map[string]fake.Handler{"clone_test": func(task *fake.Task) int {
+		for _, name := range task.ListFiles("/mydata/input") {
+			if name == "fail.txt" {
+				return 1
+			}
+		}
+		return 0
+	}})
+	defer g.close()
+	database, backend, connID, config, p := g.db, g.backend, g.connID, g.config, g.pier
+	admin := g.admin
+	user, userToken := AddUserWithToken(t, database, name1, email1)
+	service := g.buildService(t, admin.ID, "./clone_test")
+
+	runJob := func(userID int64, name string) db.Job {
+		job, err := p.RunService(userID, service.ID, remoteInputs(g.stageIn.URL+"/files/"+name), config.Limits, config.Timeouts)
+		CheckErr(t, err)
+		return g.waitJob(t, job.ID)
+	}
+	expired := runJob(user.ID, "a.txt")
+	ExpectEquals(t, expired.State.Code, 0)
+	adminJob := runJob(admin.ID, "a.txt")
+	failed := runJob(user.ID, "fail.txt")
+	ExpectEquals(t, failed.State.Code, 1)
+
+	// a volume which does not belong to any job and a task which was not terminated
+	orphan, err := backend.NewVolume()
+	CheckErr(t, err)
+	task, _, err := backend.StartTask(string(service.ImageID), service.RepoTag, nil, nil, config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	_, err = backend.WaitTask(task)
+	CheckErr(t, err)
+
+	// stale and recent temporary folders
+	old := time.Now().Add(-2 * time.Hour)
+	staleBuild := filepath.Join(tmpDir, pier.BuildsTmpDir, "stale")
+	staleInput := filepath.Join(tmpDir, pier.InputsTmpDir, "stale")
+	recentBuild := filepath.Join(tmpDir, pier.BuildsTmpDir, "recent")
+	for _, dir := range []string{staleBuild, staleInput, recentBuild} {
+		CheckErr(t, os.MkdirAll(dir, 0700))
+	}
+	CheckErr(t, os.Chtimes(staleBuild, old, old))
+	CheckErr(t, os.Chtimes(staleInput, old, old))
+
+	// the uploads of a job waiting in the queue, for a retry not due yet, are kept
+	queuedInput := filepath.Join(tmpDir, pier.InputsTmpDir, "queued")
+	CheckErr(t, os.MkdirAll(queuedInput, 0700))
+	upload := filepath.Join(queuedInput, "upload.txt")
+	CheckErr(t, ioutil.WriteFile(upload, []byte("uploaded"), 0600))
+	CheckErr(t, os.Chtimes(upload, old, old))
+	CheckErr(t, os.Chtimes(queuedInput, old, old))
+	queuedState := db.NewJobStateOk(pier.JobQueuedStatus, -1)
+	queued := db.Job{ID: "queued_job", ConnectionID: connID, ServiceID: service.ID, Attempt: 2, Created: time.Now(), State: &queuedState}
+	CheckErr(t, database.AddJob(user.ID, queued))
+	CheckErr(t, database.AddQueuedJob(db.QueuedJob{
+		JobID:        queued.ID,
+		UserID:       user.ID,
+		ConnectionID: connID,
+		Inputs:       []db.JobInput{{Source: upload, Local: true}},
+		Enqueued:     time.Now(),
+		NotBefore:    time.Now().Add(time.Hour),
+	}))
+
+	// the job durations are counted in whole seconds, so a job may seem to end up to
+	// a second after it did
+	time.Sleep(time.Second)
+
+	// a dry run removes nothing, the leftovers are only pending
+	report, err := p.RunJanitor(true)
+	CheckErr(t, err)
+	ExpectEquals(t, len(report.Jobs), 1)
+	ExpectEquals(t, report.Jobs[0].ID, expired.ID)
+	ExpectEquals(t, report.Jobs[0].UserID, user.ID)
+	ExpectEquals(t, report.Volumes, []pier.Leftover{{ConnectionID: connID, ID: string(orphan), Pending: true}})
+	ExpectEquals(t, report.Tasks, []pier.Leftover{{ConnectionID: connID, ID: task.ContainerID, Pending: true}})
+	ExpectEquals(t, report.TmpDirs, []string{staleBuild, staleInput})
+	_, err = database.GetJob(expired.ID)
+	CheckErr(t, err)
+
+	// the dry runs do not record the leftovers they find
+	time.Sleep(time.Second)
+	report, err = p.RunJanitor(true)
+	CheckErr(t, err)
+	ExpectEquals(t, report.Volumes, []pier.Leftover{{ConnectionID: connID, ID: string(orphan), Pending: true}})
+	ExpectEquals(t, report.Tasks, []pier.Leftover{{ConnectionID: connID, ID: task.ContainerID, Pending: true}})
+
+	janitorURL := g.serve(t) + "/api/janitor"
+
+	res, _ := sendForm(t, "GET", gefurl(janitorURL, userToken.Secret), nil)
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendForm(t, "POST", gefurl(janitorURL, userToken.Secret), nil)
+	ExpectEquals(t, res.StatusCode, 403)
+
+	// the first run removes the expired jobs and records the leftovers, without removing them
+	res, body := sendForm(t, "POST", gefurl(janitorURL, g.adminToken.Secret), nil)
+	ExpectEquals(t, res.StatusCode, 200)
+	var listed struct{ Janitor pier.JanitorReport }
+	CheckErr(t, json.Unmarshal(body, &listed))
+	Expect(t, !listed.Janitor.DryRun)
+	ExpectEquals(t, len(listed.Janitor.Jobs), 1)
+	ExpectEquals(t, len(listed.Janitor.Errors), 0)
+	ExpectEquals(t, listed.Janitor.Volumes, []pier.Leftover{{ConnectionID: connID, ID: string(orphan), Pending: true}})
+	ExpectEquals(t, listed.Janitor.Tasks, []pier.Leftover{{ConnectionID: connID, ID: task.ContainerID, Pending: true}})
+	volumes, err := backend.ListVolumes()
+	CheckErr(t, err)
+	orphanLeft := false
+	for _, id := range volumes {
+		orphanLeft = orphanLeft || id == orphan
+	}
+	Expect(t, orphanLeft)
+
+	// found for longer than their age, the leftovers are not pending anymore
+	time.Sleep(time.Second)
+	res, body = sendForm(t, "GET", gefurl(janitorURL, g.adminToken.Secret), nil)
+	ExpectEquals(t, res.StatusCode, 200)
+	CheckErr(t, json.Unmarshal(body, &listed))
+	Expect(t, listed.Janitor.DryRun)
+	ExpectEquals(t, len(listed.Janitor.Jobs), 0)
+	ExpectEquals(t, listed.Janitor.Volumes, []pier.Leftover{{ConnectionID: connID, ID: string(orphan)}})
+	ExpectEquals(t, listed.Janitor.Tasks, []pier.Leftover{{ConnectionID: connID, ID: task.ContainerID}})
+
+	res, body = sendForm(t, "POST", gefurl(janitorURL, g.adminToken.Secret), nil)
+	ExpectEquals(t, res.StatusCode, 200)
+	CheckErr(t, json.Unmarshal(body, &listed))
+	Expect(t, !listed.Janitor.DryRun)
+	ExpectEquals(t, len(listed.Janitor.Errors), 0)
+	ExpectEquals(t, listed.Janitor.Volumes, []pier.Leftover{{ConnectionID: connID, ID: string(orphan)}})
+
+	_, err = database.GetJob(expired.ID)
+	Expect(t, db.IsNoResultsError(err))
+	_, err = database.GetJob(adminJob.ID)
+	CheckErr(t, err)
+	_, err = database.GetJob(failed.ID)
+	CheckErr(t, err)
+
+	// only the volumes of the kept jobs are left
+	volumes, err = backend.ListVolumes()
+	CheckErr(t, err)
+	left := map[db.VolumeID]bool{}
+	for _, id := range volumes {
+		left[id] = true
+	}
+	kept := map[db.VolumeID]bool{}
+	for _, job := range []db.Job{adminJob, failed} {
+		for _, v := range append(job.InputVolume, job.OutputVolume...) {
+			kept[v.VolumeID] = true
+		}
+	}
+	ExpectEquals(t, left, kept)
+	tasks, err := backend.ListStoppedTasks()
+	CheckErr(t, err)
+	ExpectEquals(t, len(tasks), 0)
+
+	for _, dir := range []string{staleBuild, staleInput} {
+		_, err = os.Stat(dir)
+		Expect(t, os.IsNotExist(err))
+	}
+	for _, path := range []string{recentBuild, upload} {
+		_, err = os.Stat(path)
+		CheckErr(t, err)
+	}
+
+	// nothing is left to remove
+	report, err = p.RunJanitor(false)
+	CheckErr(t, err)
+	ExpectEquals(t, len(report.Jobs)+len(report.Volumes)+len(report.Tasks)+len(report.TmpDirs), 0)
+}
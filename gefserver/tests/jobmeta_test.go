@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+)
+
+func TestFakeJobMetadata(t *testing.T) {
+	g := newTestGEF(t, nil, nil)
+	defer g.close()
+	database, stageInServer := g.db, g.stageIn
+	user1, token1 := AddUserWithToken(t, database, name1, email1)
+	user2, token2 := AddUserWithToken(t, database, name2, email2)
+	MakeMember(t, database, "EUDAT", user1.ID)
+	MakeMember(t, database, "EUDAT", user2.ID)
+	service := g.buildService(t, g.admin.ID, "./clone_test")
+	serverURL := g.serve(t)
+	jobsURL := gefurl(serverURL+"/api/jobs", token1.Secret)
+
+	values := map[string]string{
+		"serviceID":   string(service.ID),
+		"pid":         stageInServer.URL + "/files/a.txt",
+		"name":        "first run",
+		"description": "with the default parameters",
+		"labels":      `{"project": "alpha", "batch": "1"}`,
+	}
+	res, body := postFiles(t, jobsURL, values, nil)
+	ExpectEquals(t, res.StatusCode, 201)
+	var created struct{ JobID db.JobID }
+	CheckErr(t, json.Unmarshal(body, &created))
+	job, err := database.GetJob(created.JobID)
+	CheckErr(t, err)
+	ExpectEquals(t, job.Name, "first run")
+	ExpectEquals(t, job.Description, "with the default parameters")
+	ExpectEquals(t, job.Labels, map[string]string{"project": "alpha", "batch": "1"})
+	for job.State.Code == -1 {
+		job, err = database.GetJob(created.JobID)
+		CheckErr(t, err)
+	}
+
+	for _, labels := range []string{`["alpha"]`, `{"-project": "alpha"}`, `{"project": 1}`} {
+		values["labels"] = labels
+		res, _ = postFiles(t, jobsURL, values, nil)
+		ExpectEquals(t, res.StatusCode, 400)
+	}
+
+	// only the given fields are changed
+	jobURL := serverURL + "/api/jobs/" + string(job.ID)
+	res, body = sendJSON(t, "PATCH", gefurl(jobURL, token1.Secret), map[string]interface{}{"Name": "renamed"})
+	ExpectEquals(t, res.StatusCode, 200)
+	var edited struct{ Job db.Job }
+	CheckErr(t, json.Unmarshal(body, &edited))
+	ExpectEquals(t, edited.Job.Name, "renamed")
+	ExpectEquals(t, edited.Job.Description, "with the default parameters")
+	ExpectEquals(t, edited.Job.Labels, map[string]string{"project": "alpha", "batch": "1"})
+
+	res, body = sendJSON(t, "PATCH", gefurl(jobURL, token1.Secret), map[string]interface{}{"Labels": map[string]string{"project": "beta"}})
+	ExpectEquals(t, res.StatusCode, 200)
+	edited.Job = db.Job{}
+	CheckErr(t, json.Unmarshal(body, &edited))
+	ExpectEquals(t, edited.Job.Labels, map[string]string{"project": "beta"})
+
+	res, _ = sendJSON(t, "PATCH", gefurl(jobURL, token2.Secret), map[string]interface{}{"Name": "not mine"})
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendJSON(t, "PATCH", gefurl(jobURL, token1.Secret), map[string]interface{}{"Labels": map[string]string{"a b": "c"}})
+	ExpectEquals(t, res.StatusCode, 400)
+
+	// a retry keeps the metadata
+	res, body = sendForm(t, "POST", gefurl(jobURL+"/retry", token1.Secret), nil)
+	ExpectEquals(t, res.StatusCode, 201)
+	CheckErr(t, json.Unmarshal(body, &created))
+	retry, err := database.GetJob(created.JobID)
+	CheckErr(t, err)
+	ExpectEquals(t, retry.Name, "renamed")
+	ExpectEquals(t, retry.Labels, map[string]string{"project": "beta"})
+
+	var list struct {
+		Jobs  []db.Job
+		Total int64
+	}
+	for query, total := range map[string]int64{
+		"&label=project=beta":  2,
+		"&label=project":       2,
+		"&label=project=alpha": 0,
+		"&name=RENAMED":        2,
+		"&name=first":          0,
+	} {
+		res, body = sendForm(t, "GET", jobsURL+query, nil)
+		ExpectEquals(t, res.StatusCode, 200)
+		CheckErr(t, json.Unmarshal(body, &list))
+		ExpectEquals(t, list.Total, total)
+	}
+}
+
+func sendJSON(t *testing.T, method string, url string, value interface{}) (*http.Response, []byte) {
+	data, err := json.Marshal(value)
+	CheckErr(t, err)
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	CheckErr(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	CheckErr(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	CheckErr(t, err)
+	return res, body
+}
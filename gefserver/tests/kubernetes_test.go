@@ -0,0 +1,509 @@
+package tests
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
+)
+
+// kubeTestJob is the part of a Kubernetes Job checked by the tests
+type kubeTestJob struct {
+	Metadata struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		BackoffLimit int `json:"backoffLimit"`
+		Template     struct {
+			Spec struct {
+				RestartPolicy string `json:"restartPolicy"`
+				Containers    []struct {
+					Image        string   `json:"image"`
+					Command      []string `json:"command"`
+					Args         []string `json:"args"`
+					VolumeMounts []struct {
+						Name      string `json:"name"`
+						MountPath string `json:"mountPath"`
+						ReadOnly  bool   `json:"readOnly"`
+					} `json:"volumeMounts"`
+					Resources struct {
+						Requests map[string]string `json:"requests"`
+						Limits   map[string]string `json:"limits"`
+					} `json:"resources"`
+				} `json:"containers"`
+				Volumes []struct {
+					Name                  string `json:"name"`
+					PersistentVolumeClaim struct {
+						ClaimName string `json:"claimName"`
+					} `json:"persistentVolumeClaim"`
+				} `json:"volumes"`
+			} `json:"spec"`
+		} `json:"template"`
+	} `json:"spec"`
+}
+
+// fakeKubeAPI simulates the Kubernetes API server: the Jobs end as soon
+// as they are created, with the exit code and log returned by run, or keep
+// running if the exit code is negative; the commands run in the pods of the
+// running Jobs through pods/exec are simulated by exec
+type fakeKubeAPI struct {
+	sync.Mutex
+	token  string
+	claims map[string]json.RawMessage
+	jobs   map[string]json.RawMessage
+	exits  map[string]int
+	logs   map[string]string
+	run    func(job kubeTestJob) (int, string)
+	exec   func(job kubeTestJob, command []string, stdin io.Reader, stdout io.Writer) int
+}
+
+func newFakeKubeAPI(token string) *fakeKubeAPI {
+	return &fakeKubeAPI{
+		token:  token,
+		claims: make(map[string]json.RawMessage),
+		jobs:   make(map[string]json.RawMessage),
+		exits:  make(map[string]int),
+		logs:   make(map[string]string),
+		run:    func(job kubeTestJob) (int, string) { return 0, "" },
+		exec: func(job kubeTestJob, command []string, stdin io.Reader, stdout io.Writer) int {
+			return 0
+		},
+	}
+}
+
+func (api *fakeKubeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.Lock()
+	defer api.Unlock()
+	if r.Header.Get("Authorization") != "Bearer "+api.token {
+		http.Error(w, `{"message":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	const claims = "/api/v1/namespaces/gef/persistentvolumeclaims"
+	const jobs = "/apis/batch/v1/namespaces/gef/jobs"
+	const pods = "/api/v1/namespaces/gef/pods"
+	p := r.URL.Path
+	switch {
+	case r.Method == "POST" && p == claims:
+		var claim kubeTestJob // only the metadata is needed
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &claim)
+		api.claims[claim.Metadata.Name] = body
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+
+	case r.Method == "DELETE" && strings.HasPrefix(p, claims+"/"):
+		name := strings.TrimPrefix(p, claims+"/")
+		if _, found := api.claims[name]; !found {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		delete(api.claims, name)
+		w.Write([]byte(`{}`))
+
+	case r.Method == "POST" && p == jobs:
+		var job kubeTestJob
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &job)
+		api.jobs[job.Metadata.Name] = body
+		api.exits[job.Metadata.Name], api.logs[job.Metadata.Name] = api.run(job)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+
+	case r.Method == "GET" && strings.HasPrefix(p, jobs+"/"):
+		name := strings.TrimPrefix(p, jobs+"/")
+		body, found := api.jobs[name]
+		if !found {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		var job map[string]interface{}
+		json.Unmarshal(body, &job)
+		if api.exits[name] < 0 {
+			job["status"] = map[string]int{"active": 1}
+		} else if api.exits[name] == 0 {
+			job["status"] = map[string]int{"succeeded": 1}
+		} else {
+			job["status"] = map[string]int{"failed": 1}
+		}
+		json.NewEncoder(w).Encode(job)
+
+	case r.Method == "DELETE" && strings.HasPrefix(p, jobs+"/"):
+		name := strings.TrimPrefix(p, jobs+"/")
+		if _, found := api.jobs[name]; !found {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		delete(api.jobs, name)
+		w.Write([]byte(`{}`))
+
+	case r.Method == "GET" && p == pods:
+		name := strings.TrimPrefix(r.URL.Query().Get("labelSelector"), "eudat.gef.task=")
+		items := []interface{}{}
+		if _, found := api.jobs[name]; found {
+			phase, state := "Succeeded", map[string]interface{}{
+				"terminated": map[string]int{"exitCode": api.exits[name]},
+			}
+			if api.exits[name] < 0 {
+				phase, state = "Running", map[string]interface{}{"running": map[string]string{}}
+			} else if api.exits[name] > 0 {
+				phase = "Failed"
+			}
+			items = append(items, map[string]interface{}{
+				"metadata": map[string]string{"name": name + "-pod"},
+				"status": map[string]interface{}{
+					"phase":             phase,
+					"containerStatuses": []interface{}{map[string]interface{}{"state": state}},
+				},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+
+	case r.Method == "GET" && strings.HasPrefix(p, pods+"/") && strings.HasSuffix(p, "-pod/log"):
+		name := strings.TrimSuffix(strings.TrimPrefix(p, pods+"/"), "-pod/log")
+		w.Write([]byte(api.logs[name]))
+
+	case r.Method == "GET" && strings.HasPrefix(p, pods+"/") && strings.HasSuffix(p, "-pod/exec"):
+		name := strings.TrimSuffix(strings.TrimPrefix(p, pods+"/"), "-pod/exec")
+		body, found := api.jobs[name]
+		if !found || api.exits[name] >= 0 {
+			http.Error(w, `{"message":"container not running"}`, http.StatusBadRequest)
+			return
+		}
+		var job kubeTestJob
+		json.Unmarshal(body, &job)
+		api.serveExec(w, r, job)
+
+	default:
+		http.Error(w, `{"message":"unexpected request"}`, http.StatusBadRequest)
+	}
+}
+
+// serveExec answers a pods/exec request with the WebSocket protocol of the API server
+func (api *fakeKubeAPI) serveExec(w http.ResponseWriter, r *http.Request, job kubeTestJob) {
+	const protocol = "v4.channel.k8s.io"
+	if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Sec-WebSocket-Protocol") != protocol {
+		http.Error(w, `{"message":"upgrade request required"}`, http.StatusBadRequest)
+		return
+	}
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	accept := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\nSec-WebSocket-Protocol: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(accept[:]), protocol)
+	rw.Flush()
+
+	// the stdin stream goes to the command until the client closes the connection
+	stdin, stdinWriter := io.Pipe()
+	defer stdin.Close()
+	go func() {
+		for {
+			opcode, payload, err := readClientFrame(rw.Reader)
+			if err != nil || opcode == 0x8 {
+				stdinWriter.Close()
+				return
+			}
+			if len(payload) > 0 && payload[0] == 0 {
+				if _, err := stdinWriter.Write(payload[1:]); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	var stdout bytes.Buffer
+	exitCode := api.exec(job, r.URL.Query()["command"], stdin, &stdout)
+	for data := stdout.Bytes(); len(data) > 0; {
+		chunk := data
+		if len(chunk) > 100000 {
+			chunk = chunk[:100000]
+		}
+		writeServerFrame(rw, 0x2, append([]byte{1}, chunk...))
+		data = data[len(chunk):]
+	}
+	status := `{"metadata":{},"status":"Success"}`
+	if exitCode != 0 {
+		status = fmt.Sprintf(`{"metadata":{},"status":"Failure","message":"command terminated with non-zero exit code %d"}`, exitCode)
+	}
+	writeServerFrame(rw, 0x2, append([]byte{3}, status...))
+	writeServerFrame(rw, 0x8, nil)
+	rw.Flush()
+}
+
+// writeServerFrame writes an unmasked WebSocket frame
+func writeServerFrame(w io.Writer, opcode byte, payload []byte) {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(n))
+		header = append(append(header, 127), size[:]...)
+	}
+	w.Write(header)
+	w.Write(payload)
+}
+
+// readClientFrame reads a WebSocket frame, which the clients must mask
+func readClientFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[1]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("unmasked client frame")
+	}
+	size := uint64(header[1] & 0x7F)
+	if size == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	} else if size == 127 {
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return header[0] & 0x0F, payload, nil
+}
+
+func newKubernetesTestBackend(t *testing.T, api *fakeKubeAPI, images map[string]string) (pier.ExecutionBackend, func()) {
+	server := httptest.NewServer(api)
+	tokenFile, err := ioutil.TempFile("", "gef_kube_token")
+	CheckErr(t, err)
+	tokenFile.WriteString(api.token + "\n")
+	tokenFile.Close()
+
+	backend, err := pier.NewKubernetesBackend(def.DockerConfig{
+		Type:     def.KubernetesConnectionType,
+		Endpoint: server.URL,
+		Kubernetes: def.KubernetesConfig{
+			Namespace:    "gef",
+			TokenPath:    tokenFile.Name(),
+			StorageClass: "fast",
+			Images:       images,
+		},
+	})
+	CheckErr(t, err)
+	return backend, func() {
+		server.Close()
+		os.Remove(tokenFile.Name())
+	}
+}
+
+func TestKubernetesBackend(t *testing.T) {
+	api := newFakeKubeAPI("secret")
+	backend, cleanup := newKubernetesTestBackend(t, api, nil)
+	defer cleanup()
+
+	// volumes
+	input, err := backend.NewVolume()
+	CheckErr(t, err)
+	output, err := backend.NewVolume()
+	CheckErr(t, err)
+	ExpectEquals(t, len(api.claims), 2)
+	var claim struct {
+		Spec struct {
+			StorageClassName string `json:"storageClassName"`
+			Resources        struct {
+				Requests map[string]string `json:"requests"`
+			} `json:"resources"`
+		} `json:"spec"`
+	}
+	CheckErr(t, json.Unmarshal(api.claims[string(input)], &claim))
+	ExpectEquals(t, claim.Spec.StorageClassName, "fast")
+	ExpectEquals(t, claim.Spec.Resources.Requests["storage"], "1Gi")
+
+	// a task
+	var started kubeTestJob
+	api.run = func(job kubeTestJob) (int, string) {
+		started = job
+		return 3, "hello\n"
+	}
+	binds := []pier.VolumeBind{
+		{VolumeID: input, MountPoint: "/mydata/input", ReadOnly: true},
+		{VolumeID: output, MountPoint: "/mydata/output"},
+	}
+	limits := def.LimitConfig{CPUShares: 1024, CPUPeriod: 100000, CPUQuota: 50000, Memory: 400024000}
+	task, out, err := backend.StartTask("registry.example.com/clone:1", "", []string{"/clone", "-v"}, binds, limits, def.TimeoutConfig{})
+	CheckErr(t, err)
+
+	container := started.Spec.Template.Spec.Containers[0]
+	ExpectEquals(t, container.Image, "registry.example.com/clone:1")
+	ExpectEquals(t, strings.Join(container.Args, " "), "/clone -v")
+	ExpectEquals(t, len(container.Command), 0)
+	ExpectEquals(t, started.Spec.BackoffLimit, 0)
+	ExpectEquals(t, started.Spec.Template.Spec.RestartPolicy, "Never")
+	ExpectEquals(t, container.Resources.Limits["cpu"], "500m")
+	ExpectEquals(t, container.Resources.Requests["cpu"], "500m")
+	ExpectEquals(t, container.Resources.Limits["memory"], "400024000")
+	ExpectEquals(t, len(container.VolumeMounts), 2)
+	ExpectEquals(t, container.VolumeMounts[0].MountPath, "/mydata/input")
+	ExpectEquals(t, container.VolumeMounts[0].ReadOnly, true)
+	ExpectEquals(t, started.Spec.Template.Spec.Volumes[1].PersistentVolumeClaim.ClaimName, string(output))
+
+	exitCode, err := backend.WaitTask(task)
+	CheckErr(t, err)
+	ExpectEquals(t, exitCode, 3)
+	ExpectEquals(t, out.String(), "hello\n")
+
+	// copying a file out of a volume, bigger than a command argument or an environment
+	// variable can be (128 KiB)
+	content := bytes.Repeat([]byte("0123456789abcdef"), 300*1024/16)
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	tw.WriteHeader(&tar.Header{Name: "result.txt", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+	tw.Write(content)
+	tw.Close()
+	var helper kubeTestJob
+	var command []string
+	api.run = func(job kubeTestJob) (int, string) {
+		helper = job
+		return -1, ""
+	}
+	api.exec = func(job kubeTestJob, cmd []string, stdin io.Reader, stdout io.Writer) int {
+		ExpectEquals(t, job.Metadata.Name, helper.Metadata.Name)
+		command = cmd
+		stdout.Write(tarball.Bytes())
+		return 0
+	}
+	stream, err := backend.CopyFromTask(task, "/mydata/output/result.txt")
+	CheckErr(t, err)
+	ExpectEquals(t, helper.Spec.Template.Spec.Containers[0].Image, "busybox")
+	ExpectEquals(t, strings.Join(command[4:], " "), "/mydata/output result.txt")
+	_, found := api.jobs[helper.Metadata.Name]
+	ExpectEquals(t, found, false)
+	tr := tar.NewReader(stream)
+	header, err := tr.Next()
+	CheckErr(t, err)
+	ExpectEquals(t, header.Name, "result.txt")
+	data, err := ioutil.ReadAll(tr)
+	CheckErr(t, err)
+	ExpectEquals(t, bytes.Equal(data, content), true)
+
+	// files outside volumes are recreated by the task command
+	_, err = backend.CopyFromTask(task, "_filelist.json")
+	CheckErr(t, err)
+	ExpectEquals(t, helper.Spec.Template.Spec.Containers[0].Image, "registry.example.com/clone:1")
+	ExpectEquals(t, strings.Join(helper.Spec.Template.Spec.Containers[0].Command[3:], " "), "sh /clone -v")
+	ExpectEquals(t, strings.Join(command[4:], " "), "/root _filelist.json")
+
+	// a failed copy
+	api.exec = func(job kubeTestJob, cmd []string, stdin io.Reader, stdout io.Writer) int {
+		return 1
+	}
+	_, err = backend.CopyFromTask(task, "/mydata/output/missing.txt")
+	ExpectNotNil(t, err)
+	_, found = api.jobs[helper.Metadata.Name]
+	ExpectEquals(t, found, false)
+
+	// copying a file into a volume
+	srcFile, err := ioutil.TempFile("", "gef_kube_upload")
+	CheckErr(t, err)
+	defer os.Remove(srcFile.Name())
+	srcFile.Write(content)
+	srcFile.Close()
+	var received []byte
+	api.exec = func(job kubeTestJob, cmd []string, stdin io.Reader, stdout io.Writer) int {
+		command = cmd
+		var size int
+		fmt.Sscan(cmd[4], &size)
+		received = make([]byte, size)
+		if _, err := io.ReadFull(stdin, received); err != nil {
+			return 1
+		}
+		return 0
+	}
+	CheckErr(t, backend.CopyToTask(task, srcFile.Name(), "/mydata/output"))
+	ExpectEquals(t, helper.Spec.Template.Spec.Containers[0].Image, "busybox")
+	ExpectEquals(t, command[5], "/mydata/output/"+filepath.Base(srcFile.Name()))
+	ExpectEquals(t, bytes.Equal(received, content), true)
+	_, found = api.jobs[helper.Metadata.Name]
+	ExpectEquals(t, found, false)
+	ExpectNotNil(t, backend.CopyToTask(task, srcFile.Name(), "/mydata/input"))
+	ExpectNotNil(t, backend.CopyToTask(task, srcFile.Name(), "/tmp"))
+
+	// cleanup
+	CheckErr(t, backend.TerminateTask(task))
+	ExpectEquals(t, len(api.jobs), 0)
+	CheckErr(t, backend.TerminateTask(task))
+	CheckErr(t, backend.RemoveVolume(input))
+	CheckErr(t, backend.RemoveVolume(output))
+	ExpectEquals(t, backend.RemoveVolume(output), pier.ErrNoSuchVolume)
+}
+
+func TestKubernetesImages(t *testing.T) {
+	api := newFakeKubeAPI("secret")
+	backend, cleanup := newKubernetesTestBackend(t, api, map[string]string{"clone_test": "registry.example.com/clone:1"})
+	defer cleanup()
+
+	// the configured image replaces the build of the folder
+	image, err := backend.BuildImage("./clone_test")
+	CheckErr(t, err)
+	ExpectEquals(t, image.ID, "registry.example.com/clone:1")
+	ExpectEquals(t, image.Labels["eudat.gef.service.name"], "Test Clone")
+	ExpectEquals(t, strings.Join(image.Cmd, " "), "cp -vr /test.txt /mydata/output/")
+
+	// the other folders can only refer to a published image
+	dir, err := ioutil.TempDir("", "gef_kube_build")
+	CheckErr(t, err)
+	defer os.RemoveAll(dir)
+	dockerfile := "FROM registry.example.com/tool:2\n" +
+		"LABEL \"eudat.gef.service.name\"=\"Tool\" \\\n" +
+		"      \"eudat.gef.service.version\"=\"2\"\n" +
+		"CMD [\"/tool\"]\n"
+	CheckErr(t, ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644))
+	image, err = backend.BuildImage(dir)
+	CheckErr(t, err)
+	ExpectEquals(t, image.ID, "registry.example.com/tool:2")
+	ExpectEquals(t, image.Labels["eudat.gef.service.version"], "2")
+	service := pier.NewServiceFromImage(1, image)
+	ExpectEquals(t, service.Name, "Tool")
+
+	CheckErr(t, ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile+"RUN make\n"), 0644))
+	_, err = backend.BuildImage(dir)
+	ExpectNotNil(t, err)
+
+	// the API server rejects a wrong token
+	api.token = "other"
+	_, err = backend.NewVolume()
+	ExpectNotNil(t, err)
+}
@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+)
+
+func TestFakeListing(t *testing.T) {
+	g := newTestGEF(t, nil, map[string]fake.Handler{"clone_test": func(task *fake.Task) int {
+		for _, name := range task.ListFiles("/mydata/input") {
+			if name == "fail.txt" {
+				return 1
+			}
+		}
+		return 0
+	}})
+	defer g.close()
+	database, admin, adminToken := g.db, g.admin, g.adminToken
+	user1, token1 := AddUserWithToken(t, database, name1, email1)
+	user2, _ := AddUserWithToken(t, database, name2, email2)
+	service := g.buildService(t, admin.ID, "./clone_test")
+
+	runJob := func(userID int64, name string) db.Job {
+		job, err := g.pier.RunService(userID, service.ID, remoteInputs(g.stageIn.URL+"/files/"+name), g.config.Limits, g.config.Timeouts)
+		CheckErr(t, err)
+		return g.waitJob(t, job.ID)
+	}
+	runJob(user1.ID, "a.txt")
+	failed := runJob(user1.ID, "fail.txt")
+	other := runJob(user2.ID, "a.txt")
+
+	serverURL := g.serve(t)
+
+	type jobList struct {
+		Jobs   []db.Job
+		Total  int64
+		Offset int
+		Limit  int
+	}
+	listJobs := func(token string, query string) jobList {
+		res, body := sendForm(t, "GET", gefurl(serverURL+"/api/jobs", token)+query, nil)
+		ExpectEquals(t, res.StatusCode, 200)
+		var list jobList
+		CheckErr(t, json.Unmarshal(body, &list))
+		ExpectEquals(t, int64(len(list.Jobs)), list.Total)
+		return list
+	}
+
+	// the users see only their own jobs, the superadministrators see all of them
+	ExpectEquals(t, listJobs(token1.Secret, "").Total, int64(2))
+	ExpectEquals(t, listJobs(token1.Secret, fmt.Sprintf("&owner=%d", user1.ID)).Total, int64(2))
+	ExpectEquals(t, listJobs(adminToken.Secret, "").Total, int64(3))
+	ExpectEquals(t, listJobs(adminToken.Secret, "&mine=true").Total, int64(0))
+	ExpectEquals(t, listJobs("", "?serviceID="+string(service.ID)).Total, int64(0))
+	for _, query := range []string{"&mine=false", fmt.Sprintf("&owner=%d", user2.ID)} {
+		res, _ := sendForm(t, "GET", gefurl(serverURL+"/api/jobs", token1.Secret)+query, nil)
+		ExpectEquals(t, res.StatusCode, 403)
+	}
+	res, _ := sendForm(t, "GET", serverURL+fmt.Sprintf("/api/jobs?owner=%d", user2.ID), nil)
+	ExpectEquals(t, res.StatusCode, 403)
+
+	// the tokens of the superadministrators without the admin scope only list their own jobs
+	readToken, err := database.NewScopedUserToken(admin.ID, "reader", time.Now().Add(time.Hour), []string{db.JobsReadScope}, nil, nil)
+	CheckErr(t, err)
+	ExpectEquals(t, listJobs(readToken.Secret, "").Total, int64(0))
+	for _, query := range []string{"&mine=false", fmt.Sprintf("&owner=%d", user2.ID)} {
+		res, _ := sendForm(t, "GET", gefurl(serverURL+"/api/jobs", readToken.Secret)+query, nil)
+		ExpectEquals(t, res.StatusCode, 403)
+	}
+
+	list := listJobs(token1.Secret, "&state=failed")
+	ExpectEquals(t, list.Jobs[0].ID, failed.ID)
+	list = listJobs(adminToken.Secret, fmt.Sprintf("&owner=%d", user2.ID))
+	ExpectEquals(t, list.Jobs[0].ID, other.ID)
+	ExpectEquals(t, listJobs(token1.Secret, "&state=running,cancelled").Total, int64(0))
+
+	// the newest first
+	res, body := sendForm(t, "GET", gefurl(serverURL+"/api/jobs", adminToken.Secret)+"&limit=1&offset=0", nil)
+	ExpectEquals(t, res.StatusCode, 200)
+	CheckErr(t, json.Unmarshal(body, &list))
+	ExpectEquals(t, list.Total, int64(3))
+	ExpectEquals(t, len(list.Jobs), 1)
+	ExpectEquals(t, list.Jobs[0].ID, other.ID)
+	ExpectEquals(t, list.Limit, 1)
+
+	for _, query := range []string{"&sort=ID", "&limit=-1", "&state=lost", "&createdAfter=yesterday", "&mine=maybe"} {
+		res, _ = sendForm(t, "GET", gefurl(serverURL+"/api/jobs", token1.Secret)+query, nil)
+		ExpectEquals(t, res.StatusCode, 400)
+	}
+	res, _ = sendForm(t, "GET", serverURL+"/api/jobs?mine=true", nil)
+	ExpectEquals(t, res.StatusCode, 400)
+
+	var services struct {
+		Services []db.Service
+		Total    int64
+	}
+	res, body = sendForm(t, "GET", serverURL+"/api/services?name=clone", nil)
+	ExpectEquals(t, res.StatusCode, 200)
+	CheckErr(t, json.Unmarshal(body, &services))
+	ExpectEquals(t, services.Total, int64(1))
+	ExpectEquals(t, services.Services[0].ID, service.ID)
+	res, body = sendForm(t, "GET", gefurl(serverURL+"/api/services", token1.Secret)+"&mine=true", nil)
+	ExpectEquals(t, res.StatusCode, 200)
+	CheckErr(t, json.Unmarshal(body, &services))
+	ExpectEquals(t, services.Total, int64(0))
+}
@@ -0,0 +1,35 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+)
+
+func TestFakeJobLogsStream(t *testing.T) {
+	g := newTestGEF(t, func(config *def.Configuration, _ db.Db) {
+		config.Server.WriteTimeoutSecs = 1
+	}, map[string]fake.Handler{"clone_test": func(task *fake.Task) int {
+		task.Printf("started\n")
+		time.Sleep(1500 * time.Millisecond)
+		task.Printf("ended\n")
+		return 0
+	}})
+	defer g.close()
+	user, token := AddUserWithToken(t, g.db, name1, email1)
+	service := g.buildService(t, user.ID, "./clone_test")
+	serverURL := g.serve(t)
+
+	job, err := g.pier.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), g.config.Limits, g.config.Timeouts)
+	CheckErr(t, err)
+
+	// the followed logs are streamed for longer than the write timeout of the server
+	res, body := sendWithAuthorization(t, "GET", serverURL+"/api/jobs/"+string(job.ID)+"/logs?follow=true", "Bearer "+token.Secret)
+	ExpectEquals(t, res.StatusCode, 200)
+	Expect(t, strings.Contains(string(body), `"ConsoleOutput":"ended\n"`))
+	Expect(t, strings.Contains(string(body), "event: end"))
+}
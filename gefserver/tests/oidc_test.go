@@ -0,0 +1,419 @@
+package tests
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
+	"github.com/EUDAT-GEF/GEF/gefserver/server"
+)
+
+// mockOIDCServer is an OpenID Connect provider returning an ID token with the claims
+// set by the test, signed with key (or with signingKey, if set)
+type mockOIDCServer struct {
+	*httptest.Server
+	t          *testing.T
+	key        *rsa.PrivateKey
+	signingKey *rsa.PrivateKey
+	claims     map[string]interface{}
+	userInfo   map[string]interface{}
+}
+
+func newMockOIDCServer(t *testing.T) *mockOIDCServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	CheckErr(t, err)
+	m := &mockOIDCServer{t: t, key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"userinfo_endpoint":      m.URL + "/userinfo",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "mock-access-token",
+			"token_type":   "Bearer",
+			"id_token":     m.idToken(),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer mock-access-token" {
+			http.Error(w, "", 401)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.userInfo)
+	})
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockOIDCServer) idToken() string {
+	key := m.key
+	if m.signingKey != nil {
+		key = m.signingKey
+	}
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		CheckErr(m.t, err)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(map[string]string{"alg": "RS256", "kid": "key1", "typ": "JWT"}) + "." + encode(m.claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	CheckErr(m.t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// oidcBrowser logs in to the GEF with the mock provider, keeping the session cookies
+type oidcBrowser struct {
+	t      *testing.T
+	client *http.Client
+	gefURL string
+	idp    *mockOIDCServer
+}
+
+func newOIDCBrowser(t *testing.T, gefURL string, idp *mockOIDCServer) *oidcBrowser {
+	jar, err := cookiejar.New(nil)
+	CheckErr(t, err)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &oidcBrowser{t, client, gefURL, idp}
+}
+
+func (b *oidcBrowser) get(url string) (*http.Response, string) {
+	res, err := b.client.Get(url)
+	CheckErr(b.t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	CheckErr(b.t, err)
+	return res, string(body)
+}
+
+// login goes to the provider, which sends back the user with a code; the ID token has
+// the given claims added to, or removed (if nil) from the valid ones
+func (b *oidcBrowser) login(claims map[string]interface{}) *http.Response {
+	t := b.t
+	res, _ := b.get(b.gefURL + "/wui/login?provider=mock")
+	ExpectEquals(t, res.StatusCode, 302)
+	location, err := url.Parse(res.Header.Get("Location"))
+	CheckErr(t, err)
+	ExpectEquals(t, location.Scheme+"://"+location.Host+location.Path, b.idp.URL+"/authorize")
+	query := location.Query()
+	ExpectEquals(t, query.Get("client_id"), "gef")
+	ExpectEquals(t, query.Get("scope"), "openid email profile")
+
+	b.idp.claims = map[string]interface{}{
+		"iss":   b.idp.URL,
+		"sub":   "user-1",
+		"aud":   "gef",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": query.Get("nonce"),
+
+		"email_verified": true,
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(b.idp.claims, k)
+		} else {
+			b.idp.claims[k] = v
+		}
+	}
+	res, _ = b.get(b.gefURL + "/wui/oidc/mock?code=good-code&state=" + url.QueryEscape(query.Get("state")))
+	return res
+}
+
+func TestFakeOIDCLogin(t *testing.T) {
+	config, err := def.ReadConfigFile(configFilePath)
+	CheckErr(t, err)
+
+	// overwrite this because when testing we're in a different working directory
+	config.Pier.InternalServicesFolder = internalServicesFolder
+	idp := newMockOIDCServer(t)
+	defer idp.Close()
+	config.Server.OIDCProviders = []def.OIDCProviderConfig{{
+		ID:          "mock",
+		Name:        "Mock IdP",
+		Issuer:      idp.URL,
+		ClientID:    "gef",
+		RedirectURL: "https://gef.example.org/wui/oidc/mock",
+		Claims:      def.OIDCClaimsConfig{Entitlements: "groups"},
+	}}
+
+	database, dbfile, err := db.InitDbForTesting()
+	CheckErr(t, err)
+	defer database.Close()
+	defer os.Remove(dbfile)
+
+	p, err := pier.NewPier(&database, config.Pier, config.TmpDir, config.Timeouts)
+	CheckErr(t, err)
+	s, err := server.NewServer(config, p, &database)
+	CheckErr(t, err)
+	srv := httptest.NewServer(s.Server.Handler)
+	defer srv.Close()
+
+	browser := newOIDCBrowser(t, srv.URL, idp)
+	get := browser.get
+	login := browser.login
+
+	// the users choose between B2ACCESS and the OpenID Connect providers
+	res, body := get(srv.URL + "/wui/login")
+	ExpectEquals(t, res.StatusCode, 200)
+	Expect(t, strings.Contains(body, `href="login?provider=b2access"`))
+	Expect(t, strings.Contains(body, `href="login?provider=mock">Mock IdP<`))
+	res, _ = get(srv.URL + "/wui/login?provider=nosuchprovider")
+	ExpectEquals(t, res.StatusCode, 400)
+
+	res = login(map[string]interface{}{
+		"email":  "alice@example.org",
+		"name":   "Alice",
+		"groups": []string{"urn:geant:eudat.eu:group:EUDAT#b2access"},
+	})
+	ExpectEquals(t, res.StatusCode, 302)
+	ExpectEquals(t, res.Header.Get("Location"), "/")
+	user, err := database.GetUserByEmail("alice@example.org")
+	CheckErr(t, err)
+	ExpectNotNil(t, user)
+	ExpectEquals(t, user.Name, "Alice")
+
+	// the session is logged in
+	res, body = get(srv.URL + "/api/user")
+	ExpectEquals(t, res.StatusCode, 200)
+	var current struct{ User db.User }
+	CheckErr(t, json.Unmarshal([]byte(body), &current))
+	ExpectEquals(t, current.User.ID, user.ID)
+
+	// the ID tokens which are not for this login, or not valid, are refused
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	CheckErr(t, err)
+	for _, claims := range []map[string]interface{}{
+		{"email": "eve@example.org", "nonce": "replayed"},
+		{"email": "eve@example.org", "aud": "another-client"},
+		{"email": "eve@example.org", "aud": []string{"gef", "another-client"}, "azp": "another-client"},
+		{"email": "eve@example.org", "iss": "https://evil.example.org"},
+		{"email": "eve@example.org", "exp": time.Now().Add(-time.Hour).Unix()},
+		{"email": "eve@example.org", "email_verified": false},
+		{"email": "eve@example.org", "email_verified": nil},
+		{"email": "eve@example.org", "sub": nil},
+		{"email": "eve@example.org", "signed by": "another key"},
+	} {
+		if claims["signed by"] != nil {
+			idp.signingKey = otherKey
+		}
+		res = login(claims)
+		ExpectEquals(t, res.StatusCode, 400)
+		idp.signingKey = nil
+	}
+	user, err = database.GetUserByEmail("eve@example.org")
+	CheckErr(t, err)
+	Expect(t, user == nil)
+
+	// the callback without a login in progress is refused
+	res, _ = get(srv.URL + "/wui/oidc/mock?code=good-code&state=forged")
+	ExpectEquals(t, res.StatusCode, 500)
+
+	// the user details can come from the userinfo endpoint
+	idp.userInfo = map[string]interface{}{"sub": "user-2", "email": "bob@example.org", "name": "Bob"}
+	res = login(map[string]interface{}{"sub": "user-2"})
+	ExpectEquals(t, res.StatusCode, 302)
+	user, err = database.GetUserByEmail("bob@example.org")
+	CheckErr(t, err)
+	ExpectNotNil(t, user)
+	ExpectEquals(t, user.Name, "Bob")
+
+	idp.userInfo["sub"] = "someone-else"
+	res = login(map[string]interface{}{"sub": "user-2"})
+	ExpectEquals(t, res.StatusCode, 400)
+
+	// the users are found by their subject identifier, even when their email address changes
+	res = login(map[string]interface{}{"email": "alice@wonderland.org", "name": "Alice"})
+	ExpectEquals(t, res.StatusCode, 302)
+	res, body = get(srv.URL + "/api/user")
+	ExpectEquals(t, res.StatusCode, 200)
+	CheckErr(t, json.Unmarshal([]byte(body), &current))
+	ExpectEquals(t, current.User.Email, "alice@example.org")
+
+	// the existing accounts are not taken over by the other subjects with the same email address
+	carol, _ := AddUserWithToken(t, database, "Carol", "carol@example.org")
+	res = login(map[string]interface{}{"sub": "user-3", "email": "carol@example.org"})
+	ExpectEquals(t, res.StatusCode, 400)
+	res = login(map[string]interface{}{"sub": "user-4", "email": "alice@example.org"})
+	ExpectEquals(t, res.StatusCode, 400)
+
+	// unless the provider is configured to link them, once per account
+	config.Server.OIDCProviders[0].LinkAccounts = true
+	s, err = server.NewServer(config, p, &database)
+	CheckErr(t, err)
+	linkingSrv := httptest.NewServer(s.Server.Handler)
+	defer linkingSrv.Close()
+	linking := newOIDCBrowser(t, linkingSrv.URL, idp)
+	res = linking.login(map[string]interface{}{"sub": "user-3", "email": "carol@example.org"})
+	ExpectEquals(t, res.StatusCode, 302)
+	identities, err := database.ListUserIdentities(carol.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, identities, []db.UserIdentity{{UserID: carol.ID, Provider: "mock", Subject: "user-3"}})
+	res = linking.login(map[string]interface{}{"sub": "user-4", "email": "alice@example.org"})
+	ExpectEquals(t, res.StatusCode, 400)
+}
+
+func TestFakeOIDCRoleMapping(t *testing.T) {
+	config, err := def.ReadConfigFile(configFilePath)
+	CheckErr(t, err)
+
+	// overwrite this because when testing we're in a different working directory
+	config.Pier.InternalServicesFolder = internalServicesFolder
+	idp := newMockOIDCServer(t)
+	defer idp.Close()
+	config.Server.OIDCProviders = []def.OIDCProviderConfig{{
+		ID:          "mock",
+		Issuer:      idp.URL,
+		ClientID:    "gef",
+		RedirectURL: "https://gef.example.org/wui/oidc/mock",
+	}}
+	config.Server.RoleMappings = []def.RoleMappingConfig{
+		{Provider: "mock", Entitlement: `urn:geant:eudat\.eu:group:EUDAT(:.*)?#b2access`, Community: "EUDAT"},
+		{Provider: "mock", Entitlement: `urn:geant:eudat\.eu:group:EUDAT:admins#b2access`, Community: "EUDAT", Role: "Administrator"},
+		{Provider: "b2access", Entitlement: ".*", Community: "EUDAT", Role: "Administrator"},
+		{Entitlement: ".*", Community: "NoSuchCommunity"},
+	}
+
+	database, dbfile, err := db.InitDbForTesting()
+	CheckErr(t, err)
+	defer database.Close()
+	defer os.Remove(dbfile)
+	admin, adminToken := AddUserWithToken(t, database, "admin", "admin@example.com")
+	SetSuperAdmin(t, database, admin.ID)
+	community, err := database.GetCommunityByName("EUDAT")
+	CheckErr(t, err)
+	member, err := database.GetRoleByName(db.CommunityMemberRoleName, community.ID)
+	CheckErr(t, err)
+	communityAdmin, err := database.GetRoleByName(db.CommunityAdminRoleName, community.ID)
+	CheckErr(t, err)
+
+	p, err := pier.NewPier(&database, config.Pier, config.TmpDir, config.Timeouts)
+	CheckErr(t, err)
+	for _, mapping := range []def.RoleMappingConfig{
+		{Entitlement: "(", Community: "EUDAT"},
+		{Entitlement: ".*", Community: "EUDAT", Role: "SuperAdministrator"},
+		{Entitlement: ".*"},
+	} {
+		invalid := config
+		invalid.Server.RoleMappings = []def.RoleMappingConfig{mapping}
+		_, err = server.NewServer(invalid, p, &database)
+		Expect(t, err != nil)
+	}
+	s, err := server.NewServer(config, p, &database)
+	CheckErr(t, err)
+	srv := httptest.NewServer(s.Server.Handler)
+	defer srv.Close()
+	browser := newOIDCBrowser(t, srv.URL, idp)
+
+	roleIDs := func(user *db.User) map[int64]bool {
+		roles, err := database.GetUserRoles(user.ID)
+		CheckErr(t, err)
+		ids := map[int64]bool{}
+		for _, r := range roles {
+			ids[r.ID] = true
+		}
+		return ids
+	}
+
+	// the entitlements give the roles at login
+	res := browser.login(map[string]interface{}{
+		"email":                 "alice@example.org",
+		"eduperson_entitlement": []string{"urn:geant:eudat.eu:group:EUDAT:admins#b2access", "urn:other"},
+	})
+	ExpectEquals(t, res.StatusCode, 302)
+	user, err := database.GetUserByEmail("alice@example.org")
+	CheckErr(t, err)
+	ExpectEquals(t, roleIDs(user), map[int64]bool{member.ID: true, communityAdmin.ID: true})
+
+	// the report shows where the roles come from, to the superadministrators only
+	grantsURL := srv.URL + "/api/roles/grants"
+	res, _ = browser.get(grantsURL)
+	ExpectEquals(t, res.StatusCode, 403)
+	res, body := sendWithAuthorization(t, "GET", grantsURL, "Bearer "+adminToken.Secret)
+	ExpectEquals(t, res.StatusCode, 200)
+	var report struct{ Grants []db.RoleGrant }
+	CheckErr(t, json.Unmarshal(body, &report))
+	sources := map[string]string{}
+	for _, g := range report.Grants {
+		sources[g.UserEmail+" "+g.RoleName] = g.Source
+	}
+	ExpectEquals(t, sources, map[string]string{
+		"admin@example.com " + db.SuperAdminRoleName:      "",
+		"alice@example.org " + db.CommunityMemberRoleName: "mock",
+		"alice@example.org " + db.CommunityAdminRoleName:  "mock",
+	})
+
+	// the roles granted by hand stay when the entitlements are gone, the others are removed
+	res, _ = sendForm(t, "POST", gefurl(fmt.Sprintf("%s/api/roles/%d", srv.URL, member.ID), adminToken.Secret),
+		url.Values{"userEmail": {"alice@example.org"}})
+	ExpectEquals(t, res.StatusCode, 200)
+	res = browser.login(map[string]interface{}{"email": "alice@example.org"})
+	ExpectEquals(t, res.StatusCode, 302)
+	ExpectEquals(t, roleIDs(user), map[int64]bool{member.ID: true})
+	res, body = sendWithAuthorization(t, "GET", grantsURL, "Bearer "+adminToken.Secret)
+	ExpectEquals(t, res.StatusCode, 200)
+	report.Grants = nil
+	CheckErr(t, json.Unmarshal(body, &report))
+	sources = map[string]string{}
+	for _, g := range report.Grants {
+		sources[g.UserEmail+" "+g.RoleName] = g.Source
+	}
+	ExpectEquals(t, sources, map[string]string{
+		"admin@example.com " + db.SuperAdminRoleName:      "",
+		"alice@example.org " + db.CommunityMemberRoleName: "",
+	})
+
+	// the entitlements asserted again give back the removed roles
+	res = browser.login(map[string]interface{}{
+		"email":                 "alice@example.org",
+		"eduperson_entitlement": []string{"urn:geant:eudat.eu:group:EUDAT:admins#b2access"},
+	})
+	ExpectEquals(t, res.StatusCode, 302)
+	ExpectEquals(t, roleIDs(user), map[int64]bool{member.ID: true, communityAdmin.ID: true})
+}
@@ -1,8 +1,10 @@
 package tests
 
 import (
+	"context"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -74,7 +76,7 @@ func TestClient(t *testing.T) {
 		return
 	}
 
-	job, err := pier.RunService(user.ID, service.ID, []string{testPIDbinary}, config.Limits, config.Timeouts)
+	job, err := pier.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
 	CheckErr(t, err)
 	for job.State.Code == -1 {
 		job, err = db.GetJob(job.ID)
@@ -123,7 +125,7 @@ func TestExecution(t *testing.T) {
 	CheckErr(t, err)
 	log.Print("test service built: ", service.ID, " ", service.ImageID)
 
-	job, err := p.RunService(user.ID, service.ID, []string{testPIDbinary}, config.Limits, config.Timeouts)
+	job, err := p.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
 	CheckErr(t, err)
 
 	log.Print("test job: ", job.ID)
@@ -174,7 +176,7 @@ func TestJobTimeOut(t *testing.T) {
 	CheckErr(t, err)
 	log.Print("test service built: ", service.ID, " ", service.ImageID)
 
-	timedOutjob, err := p.RunService(user.ID, service.ID, []string{testPIDbinary}, config.Limits, config.Timeouts)
+	timedOutjob, err := p.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
 	CheckErr(t, err)
 
 	log.Print("test timed out job: ", timedOutjob.ID)
@@ -188,6 +190,167 @@ func TestJobTimeOut(t *testing.T) {
 	ExpectEquals(t, timedOutjob.State.Error, pier.JobTimeOutError)
 }
 
+func TestJobCancellation(t *testing.T) {
+	cancelledStatus := db.JobCancelledStatus
+
+	config, err := def.ReadConfigFile(configFilePath)
+	CheckErr(t, err)
+
+	// overwrite this because when testing we're in a different working directory
+	config.Pier.InternalServicesFolder = internalServicesFolder
+
+	db, dbfile, err := db.InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(dbfile)
+	user, _ := AddUserWithToken(t, db, name1, email1)
+
+	p, err := pier.NewPier(&db, config.Pier, config.TmpDir, config.Timeouts)
+	CheckErr(t, err)
+
+	connID, err := p.AddDockerConnection(0, config.Docker)
+	CheckErr(t, err)
+
+	service, err := p.BuildService(connID, user.ID, "./timeout_test")
+	CheckErr(t, err)
+	log.Print("test service built: ", service.ID, " ", service.ImageID)
+
+	job, err := p.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
+	CheckErr(t, err)
+
+	// wait for the service to start executing
+	for len(job.Tasks) < 2 && job.State.Code == -1 {
+		time.Sleep(100 * time.Millisecond)
+		job, err = db.GetJob(job.ID)
+		CheckErr(t, err)
+	}
+	ExpectEquals(t, job.State.Code, -1)
+
+	job, err = p.CancelJob(user.ID, job.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, job.State.Status, cancelledStatus)
+
+	// the job must keep its cancelled state after the service container is gone
+	time.Sleep(2 * time.Second)
+	job, err = db.GetJob(job.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, job.State.Status, cancelledStatus)
+
+	_, err = p.CancelJob(user.ID, job.ID)
+	Expect(t, err != nil)
+
+	_, err = p.RemoveJob(user.ID, job.ID)
+	CheckErr(t, err)
+}
+
+func TestJobRetry(t *testing.T) {
+	config, err := def.ReadConfigFile(configFilePath)
+	CheckErr(t, err)
+
+	// overwrite this because when testing we're in a different working directory
+	config.Pier.InternalServicesFolder = internalServicesFolder
+
+	db, dbfile, err := db.InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(dbfile)
+	user, _ := AddUserWithToken(t, db, name1, email1)
+
+	p, err := pier.NewPier(&db, config.Pier, config.TmpDir, config.Timeouts)
+	CheckErr(t, err)
+
+	connID, err := p.AddDockerConnection(0, config.Docker)
+	CheckErr(t, err)
+
+	service, err := p.BuildService(connID, user.ID, "./clone_test")
+	CheckErr(t, err)
+	log.Print("test service built: ", service.ID, " ", service.ImageID)
+
+	job, err := p.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
+	CheckErr(t, err)
+
+	_, err = p.RetryJob(user.ID, job.ID, config.Limits, config.Timeouts)
+	Expect(t, err != nil) // the job is still running
+
+	for job.State.Code == -1 {
+		job, err = db.GetJob(job.ID)
+		CheckErr(t, err)
+	}
+
+	retry, err := p.RetryJob(user.ID, job.ID, config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	ExpectEquals(t, retry.RetryOf, job.ID)
+	ExpectEquals(t, retry.Attempt, 2)
+
+	for retry.State.Code == -1 {
+		retry, err = db.GetJob(retry.ID)
+		CheckErr(t, err)
+	}
+	ExpectEquals(t, retry.State.Error, "")
+	ExpectEquals(t, len(retry.InputVolume), len(job.InputVolume))
+
+	_, err = p.RemoveJob(user.ID, retry.ID)
+	CheckErr(t, err)
+	_, err = p.RemoveJob(user.ID, job.ID)
+	CheckErr(t, err)
+}
+
+// logCollector is a pier.LogStream keeping the output of each task
+type logCollector struct {
+	output map[string]string
+	last   pier.LogPosition
+}
+
+func (c *logCollector) Output(task db.Task, chunk []byte, next pier.LogPosition) error {
+	c.output[task.Name] += string(chunk)
+	c.last = next
+	return nil
+}
+
+func TestJobLogs(t *testing.T) {
+	config, err := def.ReadConfigFile(configFilePath)
+	CheckErr(t, err)
+
+	// overwrite this because when testing we're in a different working directory
+	config.Pier.InternalServicesFolder = internalServicesFolder
+
+	db, dbfile, err := db.InitDbForTesting()
+	CheckErr(t, err)
+	defer db.Close()
+	defer os.Remove(dbfile)
+	user, _ := AddUserWithToken(t, db, name1, email1)
+
+	p, err := pier.NewPier(&db, config.Pier, config.TmpDir, config.Timeouts)
+	CheckErr(t, err)
+
+	connID, err := p.AddDockerConnection(0, config.Docker)
+	CheckErr(t, err)
+
+	service, err := p.BuildService(connID, user.ID, "./clone_test")
+	CheckErr(t, err)
+	log.Print("test service built: ", service.ID, " ", service.ImageID)
+
+	job, err := p.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
+	CheckErr(t, err)
+
+	// following returns only when the job has ended
+	logs := &logCollector{output: make(map[string]string)}
+	job, err = p.StreamJobLogs(context.Background(), job.ID, pier.LogPosition{}, true, logs)
+	CheckErr(t, err)
+	ExpectNotEquals(t, job.State.Code, -1)
+	ExpectEquals(t, job.State.Error, "")
+	Expect(t, strings.Contains(logs.output["Service execution"], "test.txt"))
+
+	// resuming from the last position sends nothing more
+	resumed := &logCollector{output: make(map[string]string)}
+	_, err = p.StreamJobLogs(context.Background(), job.ID, logs.last, false, resumed)
+	CheckErr(t, err)
+	ExpectEquals(t, len(resumed.output), 0)
+
+	_, err = p.RemoveJob(user.ID, job.ID)
+	CheckErr(t, err)
+}
+
 func TestMultipleInputsAndOutputs(t *testing.T) {
 	config, err := def.ReadConfigFile(configFilePath)
 	CheckErr(t, err)
@@ -211,7 +374,9 @@ func TestMultipleInputsAndOutputs(t *testing.T) {
 	CheckErr(t, err)
 	log.Print("test service built: ", service.ID, " ", service.ImageID)
 
-	multiIntputsjob, err := p.RunService(user.ID, service.ID, []string{"./inputs_test/input1.txt", testPIDtext}, config.Limits, config.Timeouts)
+	inputs := remoteInputs("./inputs_test/input1.txt", testPIDtext)
+	inputs[0].Local = true
+	multiIntputsjob, err := p.RunService(user.ID, service.ID, inputs, config.Limits, config.Timeouts)
 	CheckErr(t, err)
 
 	for multiIntputsjob.State.Code == -1 {
@@ -278,3 +443,12 @@ func SetSuperAdmin(t *testing.T, d db.Db, userID int64) {
 	CheckErr(t, err)
 	Expect(t, d.HasSuperAdminRole(userID))
 }
+
+// remoteInputs returns job inputs which are not files created on the GEF host
+func remoteInputs(sources ...string) []db.JobInput {
+	inputs := make([]db.JobInput, len(sources))
+	for i, src := range sources {
+		inputs[i] = db.JobInput{Source: src}
+	}
+	return inputs
+}
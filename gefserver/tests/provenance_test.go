@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+)
+
+func TestFakeJobProvenance(t *testing.T) {
+	g := newTestGEF(t, nil, nil)
+	defer g.close()
+	database, stageInServer := g.db, g.stageIn
+	user, token := AddUserWithToken(t, database, name1, email1)
+	MakeMember(t, database, "EUDAT", user.ID)
+	service := g.buildService(t, g.admin.ID, "./clone_test")
+	serverURL := g.serve(t)
+
+	values := map[string]string{"serviceID": string(service.ID), "pid": stageInServer.URL + "/files/a.txt"}
+	res, body := postFiles(t, gefurl(serverURL+"/api/jobs", token.Secret), values, nil)
+	ExpectEquals(t, res.StatusCode, 201)
+	var created struct{ JobID db.JobID }
+	CheckErr(t, json.Unmarshal(body, &created))
+	job, err := database.GetJob(created.JobID)
+	CheckErr(t, err)
+	for job.State.Code == -1 {
+		job, err = database.GetJob(created.JobID)
+		CheckErr(t, err)
+	}
+	ExpectEquals(t, job.State.Code, 0)
+
+	provenanceURL := serverURL + "/api/jobs/" + string(job.ID) + "/provenance"
+	res, body = sendForm(t, "GET", provenanceURL, nil)
+	ExpectEquals(t, res.StatusCode, 200)
+	ExpectEquals(t, res.Header.Get("Content-Type"), "application/json; charset=utf-8")
+	var doc struct {
+		Prefix   map[string]string
+		Entity   map[string]map[string]interface{}
+		Activity map[string]map[string]interface{}
+		Agent    map[string]map[string]interface{}
+		Used     map[string]map[string]string
+	}
+	CheckErr(t, json.Unmarshal(body, &doc))
+	ExpectEquals(t, doc.Prefix["gef"], serverURL+"/api/")
+
+	jobName := "gef:jobs/" + string(job.ID)
+	ExpectNotNil(t, doc.Activity[jobName])
+	ExpectEquals(t, doc.Activity[jobName]["gef:code"], float64(0))
+	ExpectEquals(t, doc.Agent[fmt.Sprintf("gef:users/%d", user.ID)]["prov:type"],
+		map[string]interface{}{"$": "prov:Person", "type": "prov:QUALIFIED_NAME"})
+
+	serviceAgent := doc.Agent["gef:services/"+string(service.ID)]
+	ExpectNotNil(t, serviceAgent)
+	ExpectEquals(t, serviceAgent["gef:imageID"], string(service.ImageID))
+	ExpectEquals(t, serviceAgent["gef:version"], service.Version)
+
+	// the staged file, with its resolved URL and checksum
+	file := doc.Entity[jobName+"/inputs/1"]
+	ExpectNotNil(t, file)
+	ExpectEquals(t, file["gef:url"], stageInServer.URL+"/files/a.txt")
+	ExpectEquals(t, file["gef:checksum"], job.StagedFiles[0].Checksum)
+
+	// the task executing the service used the input volume
+	var executions []map[string]interface{}
+	for _, task := range job.Tasks {
+		activity := doc.Activity[jobName+"/tasks/"+task.ID]
+		ExpectNotNil(t, activity)
+		if task.Name == "Service execution" {
+			executions = append(executions, activity)
+		}
+	}
+	ExpectEquals(t, len(executions), 1)
+	ExpectNotNil(t, executions[0]["prov:startTime"])
+	ExpectEquals(t, executions[0]["gef:exitCode"], float64(0))
+	inputUsed := false
+	for _, relation := range doc.Used {
+		if relation["prov:entity"] == "gef:volumes/"+string(job.InputVolume[0].VolumeID) &&
+			strings.HasPrefix(relation["prov:activity"], jobName+"/tasks/") {
+			inputUsed = true
+		}
+	}
+	ExpectEquals(t, inputUsed, true)
+
+	for _, req := range []*http.Request{
+		newRequest(t, provenanceURL+"?format=turtle", ""),
+		newRequest(t, provenanceURL, "text/turtle"),
+	} {
+		res, err := http.DefaultClient.Do(req)
+		CheckErr(t, err)
+		res.Body.Close()
+		ExpectEquals(t, res.StatusCode, 200)
+		ExpectEquals(t, res.Header.Get("Content-Type"), "text/turtle; charset=utf-8")
+	}
+	res, body = sendForm(t, "GET", provenanceURL+"?format=turtle", nil)
+	turtle := string(body)
+	ExpectEquals(t, strings.Contains(turtle, "@prefix prov: <http://www.w3.org/ns/prov#> ."), true)
+	ExpectEquals(t, strings.Contains(turtle, "<"+serverURL+"/api/jobs/"+string(job.ID)+"> a prov:Activity"), true)
+	ExpectEquals(t, strings.Contains(turtle, " prov:wasGeneratedBy "), true)
+
+	res, _ = sendForm(t, "GET", provenanceURL+"?format=xml", nil)
+	ExpectEquals(t, res.StatusCode, 400)
+}
+
+func newRequest(t *testing.T, url string, accept string) *http.Request {
+	req, err := http.NewRequest("GET", url, nil)
+	CheckErr(t, err)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	return req
+}
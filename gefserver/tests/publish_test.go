@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+)
+
+func TestFakePublishJob(t *testing.T) {
+	// the job runs until it is released, to be published while running
+	release := make(chan struct{})
+	g := newTestGEF(t, nil, map[string]fake.Handler{"clone_test": func(task *fake.Task) int {
+		<-release
+		CheckErr(t, task.WriteFile("/mydata/output/results.csv", []byte("a,b")))
+		CheckErr(t, task.WriteFile("/mydata/output/plots/plot.png", []byte("png")))
+		return 0
+	}})
+	defer g.close()
+	p, backend, config := g.pier, g.backend, g.config
+	user, _ := AddUserWithToken(t, g.db, name1, email1)
+	service := g.buildService(t, user.ID, "./clone_test")
+
+	target := pier.B2SharePublication{
+		URL:         "https://b2share.example.com",
+		AccessToken: "secret",
+		Metadata:    map[string]interface{}{"title": "Results", "open_access": true},
+	}
+
+	job, err := p.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	_, err = p.PublishJob(job.ID, target, config.Limits, config.Timeouts)
+	Expect(t, err != nil) // not ended yet
+
+	close(release)
+	job = waitForJob(t, g.db, job.ID)
+	ExpectEquals(t, job.State.Error, "")
+	executionTasks := len(job.Tasks)
+	jobVolumes, err := backend.ListVolumes()
+	CheckErr(t, err)
+
+	job, err = p.PublishJob(job.ID, target, config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	ExpectEquals(t, job.Publication.Code, -1)
+	job = waitForPublication(t, g.db, job.ID)
+	ExpectEquals(t, job.Publication.Error, "")
+	ExpectEquals(t, job.Publication.RecordURL, "https://b2share.example.com/record/1")
+	ExpectEquals(t, job.Publication.PID, "11304/fake-record")
+	// the job state is not changed by its publication
+	ExpectEquals(t, job.State.Code, 0)
+
+	// deposition, two uploads and commit
+	tasks := job.Tasks[executionTasks:]
+	ExpectEquals(t, len(tasks), 4)
+	ExpectEquals(t, tasks[0].Name, "B2SHARE deposition")
+	ExpectEquals(t, tasks[1].Name, "B2SHARE upload #1")
+	ExpectEquals(t, tasks[3].Name, "B2SHARE commit")
+	for _, task := range tasks {
+		ExpectEquals(t, task.Error, "")
+	}
+	// the volume holding the access token is removed after the publication
+	volumes, err := backend.ListVolumes()
+	CheckErr(t, err)
+	ExpectEquals(t, volumes, jobVolumes)
+
+	// a B2SHARE error is reported by the task, the scripts still exit with 0
+	backend.Handle("B2SHARE_access_image", func(task *fake.Task) int {
+		// the token is given in a file, never on the command line
+		tokenFile := ""
+		for i, arg := range task.Args() {
+			Expect(t, !strings.Contains(arg, target.AccessToken))
+			if arg == "--access_token_file" && i+1 < len(task.Args()) {
+				tokenFile = task.Args()[i+1]
+			}
+		}
+		token, err := task.ReadFile(tokenFile)
+		CheckErr(t, err)
+		ExpectEquals(t, string(token), target.AccessToken)
+		task.Printf("That did not work as expected! Server returned HTTP status code 401.\n")
+		return 0
+	})
+	job, err = p.PublishJob(job.ID, target, config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	job = waitForPublication(t, g.db, job.ID)
+	ExpectEquals(t, job.Publication.Code, 1)
+	ExpectEquals(t, job.Publication.RecordURL, "")
+	failed := job.Tasks[len(job.Tasks)-1]
+	ExpectEquals(t, failed.Name, "B2SHARE deposition")
+	Expect(t, failed.Error != "")
+	volumes, err = backend.ListVolumes()
+	CheckErr(t, err)
+	ExpectEquals(t, volumes, jobVolumes)
+}
+
+// waitForPublication waits for the publication of a job to end, failing the test after a deadline
+func waitForPublication(t *testing.T, d db.Db, jobID db.JobID) db.Job {
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		job, err := d.GetJob(jobID)
+		CheckErr(t, err)
+		if job.Publication != nil && job.Publication.Code != -1 {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the publication of job %s did not end", jobID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
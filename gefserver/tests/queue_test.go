@@ -0,0 +1,282 @@
+package tests
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+)
+
+// expectNoStart checks that no task of a service is started for a while
+func expectNoStart(t *testing.T, started chan struct{}) {
+	select {
+	case <-started:
+		t.Fatal("a job was started beyond the limits")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestFakeQueueLimits(t *testing.T) {
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	g := newTestGEF(t, func(config *def.Configuration, _ db.Db) {
+		// more workers than jobs allowed to run
+		config.Pier.WorkersPerConnection = 3
+		config.Pier.MaxRunningJobs = 2
+		config.Pier.MaxRunningJobsPerUser = 1
+	}, map[string]fake.Handler{"clone_test": func(task *fake.Task) int {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		started <- struct{}{}
+		<-release
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return 0
+	}})
+	defer g.close()
+	database := g.db
+	user1, _ := AddUserWithToken(t, database, name1, email1)
+	user2, _ := AddUserWithToken(t, database, name2, email2)
+	user3, _ := AddUserWithToken(t, database, "user3", "user3@example.com")
+	service := g.buildService(t, user1.ID, "./clone_test")
+
+	run := func(userID int64) db.JobID {
+		job, err := g.pier.RunService(userID, service.ID, remoteInputs(testPIDbinary), g.config.Limits, g.config.Timeouts)
+		CheckErr(t, err)
+		return job.ID
+	}
+	first := run(user1.ID)
+	<-started
+	// the second job of user1 waits for the first one, the job of user2 does not
+	second := run(user1.ID)
+	other := run(user2.ID)
+	<-started
+	expectNoStart(t, started)
+	// all the jobs allowed to run are running
+	last := run(user3.ID)
+	expectNoStart(t, started)
+
+	for _, jobID := range []db.JobID{second, last} {
+		job, err := database.GetJob(jobID)
+		CheckErr(t, err)
+		ExpectEquals(t, job.State.Status, pier.JobQueuedStatus)
+	}
+	job, err := database.GetJob(other)
+	CheckErr(t, err)
+	Expect(t, len(job.Tasks) > 0)
+
+	close(release)
+	for _, jobID := range []db.JobID{first, second, other, last} {
+		job := waitForJob(t, database, jobID)
+		ExpectEquals(t, job.State.Code, 0)
+	}
+	mutex.Lock()
+	ExpectEquals(t, maxRunning, 2)
+	mutex.Unlock()
+}
+
+func TestFakeQueueWorkers(t *testing.T) {
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	g := newTestGEF(t, func(config *def.Configuration, _ db.Db) {
+		config.Pier.WorkersPerConnection = 2
+		config.Pier.MaxRunningJobs = 0
+		config.Pier.MaxRunningJobsPerUser = 0
+	}, map[string]fake.Handler{"clone_test": func(task *fake.Task) int {
+		started <- struct{}{}
+		<-release
+		return 0
+	}})
+	defer g.close()
+	database := g.db
+	user, _ := AddUserWithToken(t, database, name1, email1)
+	service := g.buildService(t, user.ID, "./clone_test")
+
+	// without limits, the jobs of a connection are only limited by its workers
+	var jobs []db.JobID
+	for i := 0; i < 3; i++ {
+		job, err := g.pier.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), g.config.Limits, g.config.Timeouts)
+		CheckErr(t, err)
+		jobs = append(jobs, job.ID)
+	}
+	<-started
+	<-started
+	expectNoStart(t, started)
+
+	release <- struct{}{}
+	<-started
+	close(release)
+	for _, jobID := range jobs {
+		job := waitForJob(t, database, jobID)
+		ExpectEquals(t, job.State.Code, 0)
+	}
+}
+
+func TestFakeReconcile(t *testing.T) {
+	g := newTestGEF(t, nil, nil)
+	defer g.close()
+	database, p, config := g.db, g.pier, g.config
+	user, _ := AddUserWithToken(t, database, name1, email1)
+
+	// the jobs below are left by a previous run of the server on this connection,
+	// which the pier finds when the connection is added
+	connection := def.DockerConfig{Endpoint: "fake://reconcile"}
+	connID, err := database.AddConnection(0, connection)
+	CheckErr(t, err)
+
+	backend := newFakeBackend()
+	release := make(chan struct{})
+	backend.Handle("clone_test", func(task *fake.Task) int {
+		<-release
+		task.Printf("resumed\n")
+		return 0
+	})
+	backend.Handle("timeout_test", func(task *fake.Task) int {
+		return 3
+	})
+
+	addService := func(folder string) db.Service {
+		img, err := backend.BuildImage(folder)
+		CheckErr(t, err)
+		service := db.Service{ID: db.ServiceID(img.ID), Name: folder, ImageID: db.ImageID(img.ID), RepoTag: img.RepoTag, Created: time.Now()}
+		CheckErr(t, database.AddService(user.ID, service))
+		return service
+	}
+	waiting, failing := addService("./clone_test"), addService("./timeout_test")
+
+	interrupted := func(jobID db.JobID, service db.Service, containerID string) db.JobID {
+		state := db.NewJobStateOk("Executing the service", -1)
+		CheckErr(t, database.AddJob(user.ID, db.Job{ID: jobID, ConnectionID: connID, ServiceID: service.ID, Created: time.Now(), State: &state}))
+		CheckErr(t, database.AddQueuedJob(db.QueuedJob{JobID: jobID, UserID: user.ID, ConnectionID: connID,
+			Limits: config.Limits, Timeouts: config.Timeouts, Enqueued: time.Now(), Started: true}))
+		if containerID == "" {
+			task, _, err := backend.StartTask(string(service.ImageID), service.RepoTag, nil, nil, config.Limits, config.Timeouts)
+			CheckErr(t, err)
+			containerID = task.ContainerID
+		}
+		_, err := database.AddJobTask(jobID, "Service execution", containerID, "", "", db.TaskRunningExitCode, &bytes.Buffer{})
+		CheckErr(t, err)
+		return jobID
+	}
+	running := interrupted("running", waiting, "")
+	failed := interrupted("failed", failing, "")
+	gone := interrupted("gone", failing, "removed_container")
+
+	_, err = p.AddConnection(0, connection, backend)
+	CheckErr(t, err)
+
+	// the task still running is monitored again
+	job, err := database.GetJob(running)
+	CheckErr(t, err)
+	ExpectEquals(t, job.State.Code, -1)
+	close(release)
+	job = waitForJob(t, database, running)
+	ExpectEquals(t, job.State.Code, 0)
+	ExpectEquals(t, job.State.Status, "Ended successfully")
+	ExpectEquals(t, job.Tasks[0].ExitCode, 0)
+	ExpectEquals(t, job.Tasks[0].ConsoleOutput, "resumed\n")
+
+	// the task which ended meanwhile gives the result of the job
+	job = waitForJob(t, database, failed)
+	ExpectEquals(t, job.State.Code, 1)
+	ExpectEquals(t, job.State.Status, "Service failed (exitCode = 3)")
+	ExpectEquals(t, job.Tasks[0].ExitCode, 3)
+
+	// the task unknown to the backend was interrupted
+	job = waitForJob(t, database, gone)
+	ExpectEquals(t, job.State.Code, 1)
+	ExpectEquals(t, job.State.Error, pier.JobInterruptedError)
+
+	// and the jobs leave the queue
+	deadline := time.Now().Add(20 * time.Second)
+	for _, jobID := range []db.JobID{running, failed, gone} {
+		for {
+			_, err = database.GetQueuedJob(jobID)
+			if db.IsNoResultsError(err) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("job %s is still in the queue: %v", jobID, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestFakeQueueRetry(t *testing.T) {
+	// the service always fails
+	var mutex sync.Mutex
+	var starts []time.Time
+	g := newTestGEF(t, nil, map[string]fake.Handler{"retry_test": func(task *fake.Task) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		starts = append(starts, time.Now())
+		return 1
+	}})
+	defer g.close()
+	database, p, config := g.db, g.pier, g.config
+	user, _ := AddUserWithToken(t, database, name1, email1)
+	service := g.buildService(t, user.ID, "./retry_test")
+	ExpectEquals(t, service.Retry, db.RetryPolicy{MaxAttempts: 3, Backoff: 1})
+
+	job, err := p.RunService(user.ID, service.ID, remoteInputs(testPIDbinary), config.Limits, config.Timeouts)
+	CheckErr(t, err)
+
+	// the retries are new jobs, each one retrying the previous attempt
+	jobs := []db.Job{waitForJob(t, database, job.ID)}
+	deadline := time.Now().Add(20 * time.Second)
+	for len(jobs) < 3 {
+		all, err := database.ListJobs()
+		CheckErr(t, err)
+		for _, retry := range all {
+			if retry.RetryOf == jobs[len(jobs)-1].ID {
+				jobs = append(jobs, waitForJob(t, database, retry.ID))
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d attempts of the job", len(jobs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, attempt := range jobs {
+		ExpectEquals(t, attempt.Attempt, i+1)
+		ExpectEquals(t, attempt.State.Code, 1)
+	}
+
+	// no attempt after the last one allowed by the policy
+	for {
+		_, err = database.GetQueuedJob(jobs[2].ID)
+		if db.IsNoResultsError(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is still in the queue: %v", jobs[2].ID, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	all, err := database.ListJobs()
+	CheckErr(t, err)
+	ExpectEquals(t, len(all), 3)
+
+	// the delay starts at the backoff and doubles; the workers do not wait for their next poll
+	mutex.Lock()
+	defer mutex.Unlock()
+	ExpectEquals(t, len(starts), 3)
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second} {
+		elapsed := starts[i+1].Sub(starts[i])
+		if elapsed < delay || elapsed > delay+time.Second {
+			t.Errorf("attempt #%d started %v after the previous one, expected %v", i+2, elapsed, delay)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+)
+
+func TestFakeStorageQuota(t *testing.T) {
+	var user1, user2 db.User
+	var token1, token2 db.Token
+	var community db.Community
+	g := newTestGEF(t, func(config *def.Configuration, database db.Db) {
+		user1, token1 = AddUserWithToken(t, database, name1, email1)
+		user2, token2 = AddUserWithToken(t, database, name2, email2)
+		var err error
+		community, err = database.AddCommunity("community1", "quota test community", true)
+		CheckErr(t, err)
+		member, err := database.GetRoleByName(db.CommunityMemberRoleName, community.ID)
+		CheckErr(t, err)
+		CheckErr(t, database.AddRoleToUser(user1.ID, member.ID))
+		CheckErr(t, database.AddRoleToUser(user2.ID, member.ID))
+		// each job uses 15 bytes: 5 for the input file, 10 for the output file
+		config.Pier.Quotas = def.QuotaConfig{User: 20, Communities: map[int64]int64{community.ID: 40}}
+	}, map[string]fake.Handler{"clone_test": func(task *fake.Task) int {
+		CheckErr(t, task.WriteFile("/mydata/output/out.txt", []byte("0123456789")))
+		return 0
+	}})
+	defer g.close()
+	database, p, config, stageInServer := g.db, g.pier, g.config, g.stageIn
+	service := g.buildService(t, g.admin.ID, "./clone_test")
+
+	// the volumes are measured before the job leaves the queue
+	waitJob := func(jobID db.JobID) db.Job {
+		job := g.waitJob(t, jobID)
+		ExpectEquals(t, job.State.Error, "")
+		return job
+	}
+
+	job, err := p.RunService(user1.ID, service.ID, remoteInputs(stageInServer.URL+"/files/a.txt"), config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	job = waitJob(job.ID)
+	ExpectEquals(t, job.InputVolume[0].Size, int64(5))
+	ExpectEquals(t, job.OutputVolume[0].Size, int64(10))
+
+	serverURL := g.serve(t)
+	values := map[string]string{"serviceID": string(service.ID), "pid": stageInServer.URL + "/files/a.txt"}
+	submit := func(token string) db.JobID {
+		res, body := postFiles(t, gefurl(serverURL+"/api/jobs", token), values, nil)
+		ExpectEquals(t, res.StatusCode, 201)
+		var created struct{ JobID db.JobID }
+		CheckErr(t, json.Unmarshal(body, &created))
+		waitJob(created.JobID)
+		return created.JobID
+	}
+	refused := func(res int, body []byte) pier.QuotaError {
+		ExpectEquals(t, res, 403)
+		var exceeded struct {
+			Error string
+			Quota pier.QuotaError
+		}
+		CheckErr(t, json.Unmarshal(body, &exceeded))
+		Expect(t, exceeded.Error != "")
+		return exceeded.Quota
+	}
+
+	// 15 bytes used out of 20
+	submit(token1.Secret)
+
+	// the user quota is exhausted, for new jobs and for retries
+	res, body := postFiles(t, gefurl(serverURL+"/api/jobs", token1.Secret), values, nil)
+	ExpectEquals(t, refused(res.StatusCode, body), pier.QuotaError{Used: 30, Quota: 20})
+	res, body = sendForm(t, "POST", gefurl(serverURL+"/api/jobs/"+string(job.ID)+"/retry", token1.Secret), nil)
+	ExpectEquals(t, refused(res.StatusCode, body), pier.QuotaError{Used: 30, Quota: 20})
+
+	// another member of the community can still create a job, until the community quota is exhausted
+	submit(token2.Secret)
+	res, body = postFiles(t, gefurl(serverURL+"/api/jobs", token2.Secret), values, nil)
+	ExpectEquals(t, refused(res.StatusCode, body), pier.QuotaError{Community: "community1", Used: 45, Quota: 40})
+
+	// the quota is kept by community ID, and still applies once the community is renamed
+	community.Name = "renamed"
+	CheckErr(t, database.UpdateCommunity(community))
+	res, body = postFiles(t, gefurl(serverURL+"/api/jobs", token2.Secret), values, nil)
+	ExpectEquals(t, refused(res.StatusCode, body), pier.QuotaError{Community: "renamed", Used: 45, Quota: 40})
+
+	res, body = sendForm(t, "GET", gefurl(serverURL+"/api/user", token2.Secret), nil)
+	ExpectEquals(t, res.StatusCode, 200)
+	var current struct{ Storage pier.StorageUsage }
+	CheckErr(t, json.Unmarshal(body, &current))
+	ExpectEquals(t, current.Storage, pier.StorageUsage{
+		Used:        15,
+		Quota:       20,
+		Communities: []pier.CommunityUsage{{CommunityID: community.ID, Community: "renamed", Used: 45, Quota: 40}},
+	})
+
+	// removing a job frees its storage
+	_, err = p.RemoveJob(user1.ID, job.ID)
+	CheckErr(t, err)
+	usage, err := p.GetStorageUsage(user1.ID)
+	CheckErr(t, err)
+	ExpectEquals(t, usage.Used, int64(15))
+	submit(token1.Secret)
+}
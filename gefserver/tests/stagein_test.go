@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+)
+
+// newStageInServer starts a stand-in for the handle server, for B2SHARE and for the
+// servers of the data files. The PID 11304/name resolves to /files/name, with the checksum
+// given for name, if any; the B2SHARE record /records/name lists the files /files/name/...
+// with their MD5; the files not given contain their own name
+func newStageInServer(files map[string]string, checksums map[string]string) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+
+	mux.HandleFunc("/api/handles/", func(w http.ResponseWriter, r *http.Request) {
+		pid := strings.TrimPrefix(r.URL.Path, "/api/handles/")
+		name := path.Base(pid)
+		values := []map[string]interface{}{
+			{"index": 1, "type": "URL", "data": map[string]string{"format": "string", "value": srv.URL + "/files/" + name}},
+		}
+		if checksum, found := checksums[name]; found {
+			values = append(values, map[string]interface{}{
+				"index": 2, "type": "CHECKSUM", "data": map[string]string{"format": "string", "value": checksum}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"responseCode": 1, "handle": pid, "values": values})
+	})
+	mux.HandleFunc("/api/records/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/records/")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"links": map[string]string{"files": srv.URL + "/bucket/" + name}})
+	})
+	mux.HandleFunc("/bucket/", func(w http.ResponseWriter, r *http.Request) {
+		prefix := strings.TrimPrefix(r.URL.Path, "/bucket/") + "/"
+		contents := []map[string]interface{}{}
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if strings.HasPrefix(name, prefix) {
+				contents = append(contents, map[string]interface{}{
+					"key":      strings.TrimPrefix(name, prefix),
+					"checksum": fmt.Sprintf("md5:%x", md5.Sum([]byte(files[name]))),
+					"links":    map[string]string{"self": srv.URL + "/files/" + name},
+				})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"contents": contents})
+	})
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/files/")
+		content, found := files[name]
+		if !found {
+			content = name
+		}
+		w.Write([]byte(content))
+	})
+	return srv
+}
+
+func TestFakeStageIn(t *testing.T) {
+	data := "some data"
+	sha256Sum := sha256.Sum256([]byte(data))
+	files := map[string]string{
+		"data.txt":       data,
+		"corrupted.txt":  "other data",
+		"large.txt":      strings.Repeat("x", 100),
+		"rec1/a.txt":     "first",
+		"rec1/sub/b.txt": "second",
+	}
+	checksums := map[string]string{
+		"data.txt":      fmt.Sprintf("md5:%x", md5.Sum([]byte(data))),
+		"corrupted.txt": "sha2:" + base64.StdEncoding.EncodeToString(sha256Sum[:]),
+	}
+	g := newTestGEF(t, func(config *def.Configuration, _ db.Db) {
+		config.Pier.B2ShareURLs = []string{config.Pier.HandleServer}
+		config.Limits.MaxStageInSize = 50
+	}, map[string]fake.Handler{"clone_test": printInputs})
+	defer g.close()
+	for name, content := range files {
+		g.stageInFiles[name] = content
+	}
+	for name, checksum := range checksums {
+		g.stageInChecksums[name] = checksum
+	}
+	stageInServer := g.stageIn
+	user, _ := AddUserWithToken(t, g.db, name1, email1)
+	service := g.buildService(t, user.ID, "./clone_test")
+
+	runJob := func(src string) db.Job {
+		job, err := g.pier.RunService(user.ID, service.ID, remoteInputs(src), g.config.Limits, g.config.Timeouts)
+		CheckErr(t, err)
+		return g.waitJob(t, job.ID)
+	}
+
+	// a PID, with the checksum in its record
+	job := runJob("hdl:11304/data.txt")
+	ExpectEquals(t, job.State.Error, "")
+	ExpectEquals(t, job.Tasks[1].ConsoleOutput, "data.txt: some data\n")
+	ExpectEquals(t, len(job.StagedFiles), 1)
+	staged := job.StagedFiles[0]
+	ExpectEquals(t, staged.Source, "hdl:11304/data.txt")
+	ExpectEquals(t, staged.URL, stageInServer.URL+"/files/data.txt")
+	ExpectEquals(t, staged.Name, "data.txt")
+	ExpectEquals(t, staged.Size, int64(len(data)))
+	ExpectEquals(t, staged.Checksum, checksums["data.txt"])
+	Expect(t, staged.Verified)
+	ExpectEquals(t, staged.VolumeID, job.InputVolume[0].VolumeID)
+
+	// a URL, no checksum to verify
+	job = runJob(stageInServer.URL + "/files/plain.txt")
+	ExpectEquals(t, job.State.Error, "")
+	ExpectEquals(t, job.StagedFiles[0].Checksum, fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("plain.txt"))))
+	Expect(t, !job.StagedFiles[0].Verified)
+
+	// a B2SHARE record, expanded into its files
+	job = runJob(stageInServer.URL + "/records/rec1")
+	ExpectEquals(t, job.State.Error, "")
+	ExpectEquals(t, job.Tasks[1].ConsoleOutput, "a.txt: first\nb.txt: second\n")
+	ExpectEquals(t, len(job.StagedFiles), 2)
+	ExpectEquals(t, job.StagedFiles[1].Name, "b.txt")
+	Expect(t, job.StagedFiles[0].Verified && job.StagedFiles[1].Verified)
+
+	// the failures tell which file and why
+	job = runJob("11304/corrupted.txt")
+	ExpectEquals(t, len(job.Tasks), 1)
+	Expect(t, strings.HasPrefix(job.State.Error, "URL data staging #1 failed: Download of "+stageInServer.URL+"/files/corrupted.txt failed: checksum mismatch"))
+	Expect(t, strings.HasPrefix(job.StagedFiles[0].Error, "checksum mismatch: expected "+checksums["corrupted.txt"]))
+
+	job = runJob(stageInServer.URL + "/files/large.txt")
+	ExpectEquals(t, len(job.Tasks), 1)
+	ExpectEquals(t, job.StagedFiles[0].Name, "large.txt")
+	ExpectEquals(t, job.StagedFiles[0].Error, "the file is too large (100 bytes, the limit is 50)")
+	Expect(t, strings.Contains(job.State.Error, "large.txt failed: the file is too large"))
+}
@@ -0,0 +1,234 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+	"github.com/EUDAT-GEF/GEF/gefserver/server"
+)
+
+func TestFakeAccessTokens(t *testing.T) {
+	config, err := def.ReadConfigFile(configFilePath)
+	CheckErr(t, err)
+
+	// overwrite this because when testing we're in a different working directory
+	config.Pier.InternalServicesFolder = internalServicesFolder
+
+	database, dbfile, err := db.InitDbForTesting()
+	CheckErr(t, err)
+	defer database.Close()
+	defer os.Remove(dbfile)
+	user, token := AddUserWithToken(t, database, name1, email1)
+	expired, err := database.NewUserToken(user.ID, "expired", time.Now().Add(-time.Hour))
+	CheckErr(t, err)
+
+	p, err := pier.NewPier(&database, config.Pier, config.TmpDir, config.Timeouts)
+	CheckErr(t, err)
+	newServer := func(config def.Configuration) *httptest.Server {
+		s, err := server.NewServer(config, p, &database)
+		CheckErr(t, err)
+		return httptest.NewServer(s.Server.Handler)
+	}
+	srv := newServer(config)
+	defer srv.Close()
+	tokensURL := srv.URL + "/api/user/tokens"
+
+	// the bearer tokens and, by default, the tokens in the URL are accepted
+	res, _ := sendWithAuthorization(t, "GET", tokensURL, "Bearer "+token.Secret)
+	ExpectEquals(t, res.StatusCode, 200)
+	res, _ = sendWithAuthorization(t, "GET", gefurl(tokensURL, token.Secret), "")
+	ExpectEquals(t, res.StatusCode, 200)
+
+	for _, authorization := range []string{"Bearer wrong", "Bearer", "Bearer " + expired.Secret} {
+		res, _ = sendWithAuthorization(t, "GET", tokensURL, authorization)
+		ExpectEquals(t, res.StatusCode, 401)
+		ExpectEquals(t, res.Header.Get("WWW-Authenticate"), `Bearer error="invalid_token"`)
+	}
+	res, _ = sendWithAuthorization(t, "GET", tokensURL, "")
+	ExpectEquals(t, res.StatusCode, 401)
+
+	// the secret of a new token is only returned once
+	res, body := sendWithAuthorization(t, "POST", tokensURL+"?tokenName=script", "Bearer "+token.Secret)
+	ExpectEquals(t, res.StatusCode, 201)
+	var created struct{ Token db.Token }
+	CheckErr(t, json.Unmarshal(body, &created))
+	Expect(t, created.Token.Secret != "")
+	res, body = sendWithAuthorization(t, "GET", tokensURL, "Bearer "+created.Token.Secret)
+	ExpectEquals(t, res.StatusCode, 200)
+	var listed struct{ Tokens []db.Token }
+	CheckErr(t, json.Unmarshal(body, &listed))
+	ExpectEquals(t, len(listed.Tokens), 3)
+	for _, t2 := range listed.Tokens {
+		ExpectEquals(t, t2.Secret, "")
+	}
+
+	// the tokens in the URL can be refused
+	config.Server.RejectURLAccessTokens = true
+	strictSrv := newServer(config)
+	defer strictSrv.Close()
+	res, _ = sendWithAuthorization(t, "GET", gefurl(strictSrv.URL+"/api/user/tokens", token.Secret), "")
+	ExpectEquals(t, res.StatusCode, 401)
+	res, _ = sendWithAuthorization(t, "GET", strictSrv.URL+"/api/user/tokens", "Bearer "+token.Secret)
+
+	ExpectEquals(t, res.StatusCode, 200)
+}
+func TestFakeScopedTokens(t *testing.T) {
+	config, err := def.ReadConfigFile(configFilePath)
+	CheckErr(t, err)
+
+	// overwrite this because when testing we're in a different working directory
+	config.Pier.InternalServicesFolder = internalServicesFolder
+	stageInServer := newStageInServer(nil, nil)
+	defer stageInServer.Close()
+	config.Pier.HandleServer = stageInServer.URL
+
+	database, dbfile, err := db.InitDbForTesting()
+	CheckErr(t, err)
+	defer database.Close()
+	defer os.Remove(dbfile)
+	admin, adminToken := AddUserWithToken(t, database, "admin", "admin@example.com")
+	SetSuperAdmin(t, database, admin.ID)
+	user, token := AddUserWithToken(t, database, name1, email1)
+	MakeMember(t, database, "EUDAT", user.ID)
+
+	p, err := pier.NewPier(&database, config.Pier, config.TmpDir, config.Timeouts)
+	CheckErr(t, err)
+	connID, err := p.AddConnection(0, def.DockerConfig{}, fake.NewBackend())
+	CheckErr(t, err)
+	service, err := p.BuildService(connID, admin.ID, "./clone_test")
+	CheckErr(t, err)
+	otherService, err := p.BuildService(connID, admin.ID, "./timeout_test")
+	CheckErr(t, err)
+
+	s, err := server.NewServer(config, p, &database)
+	CheckErr(t, err)
+	srv := httptest.NewServer(s.Server.Handler)
+	defer srv.Close()
+	tokensURL := srv.URL + "/api/user/tokens"
+
+	newToken := func(secret string, values url.Values) (*http.Response, db.Token) {
+		res, body := sendForm(t, "POST", gefurl(tokensURL, secret), values)
+		var created struct{ Token db.Token }
+		if res.StatusCode == 201 {
+			CheckErr(t, json.Unmarshal(body, &created))
+		}
+		return res, created.Token
+	}
+
+	// the unknown scopes, services and communities are refused, as are the restrictions without scopes
+	for _, values := range []url.Values{
+		{"tokenName": {"bot"}, "scopes": {"jobs:fly"}},
+		{"tokenName": {"bot"}, "scopes": {"jobs:read"}, "serviceIDs": {"nosuchservice"}},
+		{"tokenName": {"bot"}, "scopes": {"jobs:read"}, "communities": {"nosuchcommunity"}},
+		{"tokenName": {"bot"}, "serviceIDs": {string(service.ID)}},
+	} {
+		res, _ := newToken(token.Secret, values)
+		ExpectEquals(t, res.StatusCode, 400)
+	}
+
+	res, bot := newToken(token.Secret, url.Values{
+		"tokenName":  {"bot"},
+		"scopes":     {"jobs:create,jobs:read", "volumes:read"},
+		"serviceIDs": {string(service.ID)},
+	})
+	ExpectEquals(t, res.StatusCode, 201)
+	ExpectEquals(t, bot.Scopes, []string{"jobs:create", "jobs:read", "volumes:read"})
+	ExpectEquals(t, bot.ServiceIDs, []db.ServiceID{service.ID})
+
+	// a scoped token cannot manage the tokens
+	res, _ = newToken(bot.Secret, url.Values{"tokenName": {"escalated"}})
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendWithAuthorization(t, "GET", tokensURL, "Bearer "+bot.Secret)
+	ExpectEquals(t, res.StatusCode, 403)
+	res, body := sendWithAuthorization(t, "GET", tokensURL, "Bearer "+token.Secret)
+	ExpectEquals(t, res.StatusCode, 200)
+	var listed struct{ Tokens []db.Token }
+	CheckErr(t, json.Unmarshal(body, &listed))
+	ExpectEquals(t, len(listed.Tokens), 2)
+	for _, t2 := range listed.Tokens {
+		if t2.ID == bot.ID {
+			ExpectEquals(t, t2.Scopes, bot.Scopes)
+		}
+	}
+
+	// the communities are given by name, and kept by ID
+	eudat, err := database.GetCommunityByName("EUDAT")
+	CheckErr(t, err)
+	res, communityBot := newToken(token.Secret, url.Values{"tokenName": {"community bot"}, "scopes": {"jobs:read"}, "communities": {"EUDAT"}})
+	ExpectEquals(t, res.StatusCode, 201)
+	ExpectEquals(t, communityBot.CommunityIDs, []int64{eudat.ID})
+
+	// neither can a token restricted to communities only, although it has no scopes
+	member, err := database.NewScopedUserToken(user.ID, "member", time.Now().Add(time.Hour), nil, nil, []int64{eudat.ID})
+	CheckErr(t, err)
+	res, _ = newToken(member.Secret, url.Values{"tokenName": {"escalated"}})
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendWithAuthorization(t, "GET", tokensURL, "Bearer "+member.Secret)
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendWithAuthorization(t, "DELETE", tokensURL+"/"+strconv.FormatInt(bot.ID, 10), "Bearer "+member.Secret)
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendForm(t, "PUT", gefurl(srv.URL+"/api/user/b2drop", member.Secret), url.Values{"username": {"u"}, "password": {"p"}})
+	ExpectEquals(t, res.StatusCode, 403)
+
+	// the token can only run the services it is restricted to
+	values := map[string]string{"serviceID": string(otherService.ID), "pid": stageInServer.URL + "/files/a.txt"}
+	res, _ = postFiles(t, gefurl(srv.URL+"/api/jobs", bot.Secret), values, nil)
+	ExpectEquals(t, res.StatusCode, 403)
+	values["serviceID"] = string(service.ID)
+	res, body = postFiles(t, gefurl(srv.URL+"/api/jobs", bot.Secret), values, nil)
+	ExpectEquals(t, res.StatusCode, 201)
+	var created struct{ JobID db.JobID }
+	CheckErr(t, json.Unmarshal(body, &created))
+	job, err := database.GetJob(created.JobID)
+	CheckErr(t, err)
+	for job.State.Code == -1 {
+		job, err = database.GetJob(created.JobID)
+		CheckErr(t, err)
+	}
+	jobURL := srv.URL + "/api/jobs/" + string(job.ID)
+
+	// it can read the job and its results, but not change or remove the job
+	res, _ = sendWithAuthorization(t, "GET", jobURL, "Bearer "+bot.Secret)
+	ExpectEquals(t, res.StatusCode, 200)
+	res, _ = sendWithAuthorization(t, "GET", srv.URL+"/api/volumes/"+string(job.OutputVolume[0].VolumeID)+"/", "Bearer "+bot.Secret)
+	ExpectEquals(t, res.StatusCode, 200)
+	res, _ = sendWithAuthorization(t, "POST", jobURL+"/cancel", "Bearer "+bot.Secret)
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendWithAuthorization(t, "DELETE", jobURL, "Bearer "+bot.Secret)
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendWithAuthorization(t, "DELETE", jobURL, "Bearer "+token.Secret)
+	ExpectEquals(t, res.StatusCode, 200)
+
+	// the administration needs the admin scope, even for the superadmins
+	res, reader := newToken(adminToken.Secret, url.Values{"tokenName": {"reader"}, "scopes": {"jobs:read"}})
+	ExpectEquals(t, res.StatusCode, 201)
+	res, _ = sendWithAuthorization(t, "GET", srv.URL+"/api/janitor", "Bearer "+reader.Secret)
+	ExpectEquals(t, res.StatusCode, 403)
+	res, _ = sendWithAuthorization(t, "GET", srv.URL+"/api/janitor", "Bearer "+adminToken.Secret)
+	ExpectEquals(t, res.StatusCode, 200)
+}
+
+func sendWithAuthorization(t *testing.T, method string, url string, authorization string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	CheckErr(t, err)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	res, err := http.DefaultClient.Do(req)
+	CheckErr(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	CheckErr(t, err)
+	return res, body
+}
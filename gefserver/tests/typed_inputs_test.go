@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+)
+
+const typedInputsDockerfile = `FROM alpine:3.6
+LABEL "eudat.gef.service.name"="Typed inputs"
+LABEL "eudat.gef.service.input.1.name"="Iterations" \
+      "eudat.gef.service.input.1.path"="/root/n" \
+      "eudat.gef.service.input.1.type"="integer" \
+      "eudat.gef.service.input.1.filename"="n.txt" \
+      "eudat.gef.service.input.1.default"="10" \
+      "eudat.gef.service.input.1.min"="1" \
+      "eudat.gef.service.input.1.max"="100"
+LABEL "eudat.gef.service.input.2.name"="Documents" \
+      "eudat.gef.service.input.2.path"="/root/docs" \
+      "eudat.gef.service.input.2.type"="urllist"
+LABEL "eudat.gef.service.input.3.name"="Language" \
+      "eudat.gef.service.input.3.path"="/root/lang" \
+      "eudat.gef.service.input.3.type"="enum" \
+      "eudat.gef.service.input.3.values"="en, de" \
+      "eudat.gef.service.input.3.required"="false"
+LABEL "eudat.gef.service.input.4.name"="Identifier" \
+      "eudat.gef.service.input.4.path"="/root/id" \
+      "eudat.gef.service.input.4.type"="string" \
+      "eudat.gef.service.input.4.pattern"="[a-z]+-[0-9]+"
+LABEL "eudat.gef.service.output.1.name"="Output" \
+      "eudat.gef.service.output.1.path"="/root/output"
+CMD ["/run"]
+`
+
+func TestTypedInputLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "typed_inputs")
+	CheckErr(t, err)
+	defer os.RemoveAll(dir)
+	CheckErr(t, ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(typedInputsDockerfile), 0644))
+
+	dockerfile, err := pier.ReadDockerfile(dir)
+	CheckErr(t, err)
+	service := pier.NewServiceFromImage(1, pier.Image{Labels: dockerfile.Labels})
+	ExpectEquals(t, len(service.Input), 4)
+
+	ExpectEquals(t, service.Input[0], db.IOPort{ID: "input0", Name: "Iterations", Path: "/root/n", Type: "integer",
+		FileName: "n.txt", Default: "10", Min: "1", Max: "100"})
+	ExpectEquals(t, service.Input[1].Type, pier.InputTypeURLList)
+	ExpectEquals(t, service.Input[2].Values, []string{"en", "de"})
+	ExpectEquals(t, service.Input[2].Optional, true)
+	// the values are written into a file named after the port, if not specified
+	ExpectEquals(t, service.Input[2].FileName, "input2")
+	ExpectEquals(t, service.Input[3].Pattern, "[a-z]+-[0-9]+")
+	ExpectEquals(t, service.Input[3].Optional, false)
+}
+
+func TestCheckInputs(t *testing.T) {
+	ports := []db.IOPort{
+		{ID: "input0", Type: "integer", Default: "10", Min: "1", Max: "100"},
+		{ID: "input1", Type: "urllist"},
+		{ID: "input2", Type: "enum", Optional: true, Values: []string{"en", "de"}},
+		{ID: "input3", Type: "string", Pattern: "[a-z]+-[0-9]+"},
+		{ID: "input4", Type: "float", Optional: true, Min: "0.5"},
+		{ID: "input5", Type: "boolean", Optional: true},
+		{ID: "input6", Type: "pid", Optional: true},
+	}
+
+	values, invalid := pier.CheckInputs(ports, []string{"", " http://example.com/a \n 11304/b ", "", "doc-12", "0.75", "1", "hdl:11304/c"})
+	ExpectEquals(t, len(invalid), 0)
+	ExpectEquals(t, values, []string{"10", "http://example.com/a\n11304/b", "", "doc-12", "0.75", "true", "hdl:11304/c"})
+
+	_, invalid = pier.CheckInputs(ports, []string{"1000", "ftp://example.com/a", "fr", "doc", "0.1", "maybe", "http://example.com"})
+	ExpectEquals(t, len(invalid), len(ports))
+	for i, e := range invalid {
+		ExpectEquals(t, e.ID, ports[i].ID)
+		Expect(t, e.Message != "")
+	}
+	ExpectEquals(t, invalid[0].Message, "must be at most 100")
+	ExpectEquals(t, invalid[2].Message, "not one of: en, de")
+
+	_, invalid = pier.CheckInputs(ports, []string{"2.5"})
+	ExpectEquals(t, len(invalid), 3)
+	ExpectEquals(t, invalid[0].Message, "not an integer")
+	ExpectEquals(t, invalid[1].Message, "a value is required")
+	ExpectEquals(t, invalid[2].ID, "input3")
+}
+
+func TestFakeTypedInputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "typed_inputs")
+	CheckErr(t, err)
+	defer os.RemoveAll(dir)
+	CheckErr(t, ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(typedInputsDockerfile), 0644))
+
+	g := newTestGEF(t, nil, map[string]fake.Handler{filepath.Base(dir): func(task *fake.Task) int {
+		n, err := task.ReadFile("/root/n/n.txt")
+		if err != nil {
+			task.Printf("%s\n", err)
+			return 1
+		}
+		task.Printf("n=%s docs=%s lang=%d id=%d\n", n,
+			strings.Join(task.ListFiles("/root/docs"), ","),
+			len(task.ListFiles("/root/lang")),
+			len(task.ListFiles("/root/id")))
+		return 0
+	}})
+	defer g.close()
+	stageInServer := g.stageIn
+	user, _ := AddUserWithToken(t, g.db, name1, email1)
+	service := g.buildService(t, user.ID, dir)
+
+	// the server writes the values into files named after the ports
+	valueFile := filepath.Join(dir, "n.txt")
+	CheckErr(t, ioutil.WriteFile(valueFile, []byte("3"), 0644))
+	inputs, invalid := pier.CheckInputs(service.Input, []string{"3", stageInServer.URL + "/files/a.txt " + stageInServer.URL + "/files/b.txt", "", ""})
+	ExpectEquals(t, len(invalid), 1)
+	ExpectEquals(t, invalid[0].ID, "input3")
+	inputs[0] = valueFile
+	jobInputs := remoteInputs(inputs...)
+	jobInputs[0].Local = true
+
+	job, err := g.pier.RunService(user.ID, service.ID, jobInputs, g.config.Limits, g.config.Timeouts)
+	CheckErr(t, err)
+	job = waitForJob(t, g.db, job.ID)
+	ExpectEquals(t, job.State.Error, "")
+	// two stage-in tasks for the url list, then the service
+	ExpectEquals(t, len(job.Tasks), 3)
+	ExpectEquals(t, job.Tasks[2].ConsoleOutput, "n=3 docs=a.txt,b.txt lang=0 id=0\n")
+}
@@ -0,0 +1,175 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+)
+
+// postFiles posts a multipart form with some values and files (by field name)
+func postFiles(t *testing.T, url string, values map[string]string, files map[string]string) (*http.Response, []byte) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for k, v := range values {
+		CheckErr(t, writer.WriteField(k, v))
+	}
+	for k, content := range files {
+		part, err := writer.CreateFormFile(k, k+".txt")
+		CheckErr(t, err)
+		_, err = part.Write([]byte(content))
+		CheckErr(t, err)
+	}
+	CheckErr(t, writer.Close())
+
+	req, err := http.NewRequest("POST", url, body)
+	CheckErr(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	res, err := http.DefaultClient.Do(req)
+	CheckErr(t, err)
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	CheckErr(t, err)
+	return res, data
+}
+
+func TestFakeJobUploads(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gef_uploads")
+	CheckErr(t, err)
+	defer os.RemoveAll(tmpDir)
+	g := newTestGEF(t, func(config *def.Configuration, _ db.Db) {
+		config.TmpDir = tmpDir
+		config.Limits.MaxUploadSize = 20
+	}, map[string]fake.Handler{"clone_test": printInputs})
+	defer g.close()
+	database, config, token := g.db, g.config, g.adminToken
+	service := g.buildService(t, g.admin.ID, "./clone_test")
+	serverURL := g.serve(t)
+	jobsURL := gefurl(serverURL+"/api/jobs", token.Secret)
+	values := map[string]string{"serviceID": string(service.ID)}
+
+	// a file uploaded for an url input
+	res, body := postFiles(t, jobsURL, values, map[string]string{"pid_input0": "some data"})
+	ExpectEquals(t, res.StatusCode, 201)
+	var created struct{ JobID db.JobID }
+	CheckErr(t, json.Unmarshal(body, &created))
+	job, err := database.GetJob(created.JobID)
+	CheckErr(t, err)
+	for job.State.Code == -1 {
+		job, err = database.GetJob(created.JobID)
+		CheckErr(t, err)
+	}
+	ExpectEquals(t, job.State.Error, "")
+	// the file is copied into the volume, no data staging task is needed
+	ExpectEquals(t, len(job.Tasks), 1)
+	ExpectEquals(t, job.Tasks[0].ConsoleOutput, "pid_input0.txt: some data\n")
+
+	uploads := filepath.Join(config.TmpDir, "inputs")
+	uploaded, err := ioutil.ReadDir(uploads)
+	CheckErr(t, err)
+	ExpectEquals(t, len(uploaded), 1)
+
+	// too large uploads are rejected and removed
+	res, _ = postFiles(t, jobsURL, values, map[string]string{"pid_input0": strings.Repeat("x", 21)})
+	ExpectEquals(t, res.StatusCode, http.StatusRequestEntityTooLarge)
+	uploaded, err = ioutil.ReadDir(uploads)
+	CheckErr(t, err)
+	ExpectEquals(t, len(uploaded), 1)
+
+	// invalid values are all listed
+	values["pid_input0"] = "not a url"
+	res, body = postFiles(t, jobsURL, values, nil)
+	ExpectEquals(t, res.StatusCode, 400)
+	var invalid struct{ InvalidInputs []pier.InputError }
+	CheckErr(t, json.Unmarshal(body, &invalid))
+	ExpectEquals(t, len(invalid.InvalidInputs), 1)
+	ExpectEquals(t, invalid.InvalidInputs[0].ID, "input0")
+	ExpectEquals(t, invalid.InvalidInputs[0].Message, "not a URL or a PID")
+}
+
+const fileInputDockerfile = `FROM alpine:3.6
+LABEL "eudat.gef.service.name"="File input"
+LABEL "eudat.gef.service.input.1.name"="Document" \
+      "eudat.gef.service.input.1.path"="/root/doc" \
+      "eudat.gef.service.input.1.type"="file"
+CMD ["/run"]
+`
+
+func TestFakeFileInputs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gef_uploads")
+	CheckErr(t, err)
+	defer os.RemoveAll(tmpDir)
+	dir, err := ioutil.TempDir("", "file_input")
+	CheckErr(t, err)
+	defer os.RemoveAll(dir)
+	CheckErr(t, ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(fileInputDockerfile), 0644))
+
+	g := newTestGEF(t, func(config *def.Configuration, _ db.Db) {
+		config.TmpDir = tmpDir
+	}, map[string]fake.Handler{filepath.Base(dir): func(task *fake.Task) int {
+		for _, name := range task.ListFiles("/root/doc") {
+			data, err := task.ReadFile("/root/doc/" + name)
+			if err != nil {
+				task.Printf("%s\n", err)
+				return 1
+			}
+			task.Printf("%s: %s\n", name, data)
+		}
+		return 0
+	}})
+	defer g.close()
+	g.stageInFiles["a.txt"] = "downloaded"
+	database, p, config, stageInServer := g.db, g.pier, g.config, g.stageIn
+	user, token := g.admin, g.adminToken
+	service := g.buildService(t, user.ID, dir)
+	serverURL := g.serve(t)
+	jobsURL := gefurl(serverURL+"/api/jobs", token.Secret)
+	values := map[string]string{"serviceID": string(service.ID)}
+
+	// a file input is an uploaded file, or a URL or a PID to download
+	run := func(values map[string]string, files map[string]string) db.Job {
+		res, body := postFiles(t, jobsURL, values, files)
+		ExpectEquals(t, res.StatusCode, 201)
+		var created struct{ JobID db.JobID }
+		CheckErr(t, json.Unmarshal(body, &created))
+		return waitForJob(t, database, created.JobID)
+	}
+	job := run(values, map[string]string{"pid_input0": "uploaded"})
+	ExpectEquals(t, job.State.Error, "")
+	ExpectEquals(t, job.Tasks[len(job.Tasks)-1].ConsoleOutput, "pid_input0.txt: uploaded\n")
+
+	values["pid_input0"] = stageInServer.URL + "/files/a.txt"
+	job = run(values, nil)
+	ExpectEquals(t, job.State.Error, "")
+	ExpectEquals(t, job.Tasks[len(job.Tasks)-1].ConsoleOutput, "a.txt: downloaded\n")
+
+	// not a path on the GEF host
+	values["pid_input0"] = "/etc/hostname"
+	res, body := postFiles(t, jobsURL, values, nil)
+	ExpectEquals(t, res.StatusCode, 400)
+	var invalid struct{ InvalidInputs []pier.InputError }
+	CheckErr(t, json.Unmarshal(body, &invalid))
+	ExpectEquals(t, len(invalid.InvalidInputs), 1)
+	ExpectEquals(t, invalid.InvalidInputs[0].Message, "not an uploaded file, a URL or a PID")
+
+	// the pier only copies the inputs flagged as files created for the job on the GEF host
+	hostFile := filepath.Join(dir, "host.txt")
+	CheckErr(t, ioutil.WriteFile(hostFile, []byte("host file"), 0644))
+	job, err = p.RunService(user.ID, service.ID, remoteInputs(hostFile), config.Limits, config.Timeouts)
+	CheckErr(t, err)
+	job = waitForJob(t, database, job.ID)
+	Expect(t, strings.HasPrefix(job.State.Error, "URL data staging #1 failed"))
+	for _, task := range job.Tasks {
+		Expect(t, !strings.Contains(task.ConsoleOutput, "host file"))
+	}
+}
@@ -0,0 +1,192 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/EUDAT-GEF/GEF/gefserver/db"
+	"github.com/EUDAT-GEF/GEF/gefserver/def"
+	"github.com/EUDAT-GEF/GEF/gefserver/pier/fake"
+)
+
+const webdavDockerfile = `FROM alpine:3.6
+LABEL "eudat.gef.service.name"="WebDAV input"
+LABEL "eudat.gef.service.input.1.name"="Document" \
+      "eudat.gef.service.input.1.path"="/root/in" \
+      "eudat.gef.service.input.1.type"="webdav"
+LABEL "eudat.gef.service.output.1.name"="Output" \
+      "eudat.gef.service.output.1.path"="/root/out"
+CMD ["/run"]
+`
+
+// webdavStandIn is a minimal in-memory WebDAV server, standing in for B2DROP
+type webdavStandIn struct {
+	sync.Mutex
+	username, password string
+	files              map[string]string // file path -> content
+	folders            map[string]bool
+}
+
+func (s *webdavStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username != s.username || password != s.password {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	const root = "/remote.php/webdav/"
+	if !strings.HasPrefix(r.URL.Path, root) {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, root), "/")
+
+	s.Lock()
+	defer s.Unlock()
+	switch r.Method {
+	case "GET":
+		content, found := s.files[name]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	case "PUT":
+		if dir := filepath.Dir(name); dir != "." && !s.folders[dir] {
+			http.Error(w, "no parent folder", http.StatusConflict)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		s.files[name] = string(data)
+		w.WriteHeader(http.StatusCreated)
+	case "MKCOL":
+		if s.folders[name] {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.folders[name] = true
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *webdavStandIn) file(name string) string {
+	s.Lock()
+	defer s.Unlock()
+	return s.files[name]
+}
+
+func sendForm(t *testing.T, method string, url string, values url.Values) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, strings.NewReader(values.Encode()))
+	CheckErr(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := http.DefaultClient.Do(req)
+	CheckErr(t, err)
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	CheckErr(t, err)
+	return res, data
+}
+
+func TestFakeB2DropStaging(t *testing.T) {
+	dav := &webdavStandIn{username: "user", password: "app-password",
+		files: map[string]string{"data/in.txt": "some text"}, folders: map[string]bool{"data": true}}
+	davServer := httptest.NewServer(dav)
+	defer davServer.Close()
+
+	dir, err := ioutil.TempDir("", "webdav_input")
+	CheckErr(t, err)
+	defer os.RemoveAll(dir)
+	CheckErr(t, ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(webdavDockerfile), 0644))
+
+	g := newTestGEF(t, func(config *def.Configuration, _ db.Db) {
+		config.Server.B2Drop.BaseURL = davServer.URL + "/"
+	}, map[string]fake.Handler{filepath.Base(dir): func(task *fake.Task) int {
+		data, err := task.ReadFile("/root/in/in.txt")
+		if err != nil {
+			task.Printf("%s\n", err)
+			return 1
+		}
+		CheckErr(t, task.WriteFile("/root/out/out.txt", []byte(strings.ToUpper(string(data)))))
+		CheckErr(t, task.WriteFile("/root/out/sub/b.txt", []byte("b")))
+		return 0
+	}})
+	defer g.close()
+	database, user, token := g.db, g.admin, g.adminToken
+	service := g.buildService(t, user.ID, dir)
+	serverURL := g.serve(t)
+	jobsURL := gefurl(serverURL+"/api/jobs", token.Secret)
+	accountURL := gefurl(serverURL+"/api/user/b2drop", token.Secret)
+	values := map[string]string{"serviceID": string(service.ID), "pid_input0": "/data/in.txt"}
+
+	// no credentials yet
+	res, body := postFiles(t, jobsURL, values, nil)
+	ExpectEquals(t, res.StatusCode, 400)
+
+	res, _ = sendForm(t, "PUT", accountURL, url.Values{"username": {"user"}, "password": {"app-password"}})
+	ExpectEquals(t, res.StatusCode, 200)
+	res, body = sendForm(t, "GET", accountURL, nil)
+	ExpectEquals(t, res.StatusCode, 200)
+	Expect(t, strings.Contains(string(body), `"Username":"user"`))
+	Expect(t, !strings.Contains(string(body), "app-password"))
+
+	// only the files of the B2DROP folder can be staged in
+	values["pid_input0"] = "http://example.com/remote.php/webdav/data/in.txt"
+	res, _ = postFiles(t, jobsURL, values, nil)
+	ExpectEquals(t, res.StatusCode, 400)
+
+	values["pid_input0"] = "/data/in.txt"
+	res, body = postFiles(t, jobsURL, values, nil)
+	ExpectEquals(t, res.StatusCode, 201)
+	var created struct{ JobID db.JobID }
+	CheckErr(t, json.Unmarshal(body, &created))
+	job, err := database.GetJob(created.JobID)
+	CheckErr(t, err)
+	for job.State.Code == -1 {
+		job, err = database.GetJob(created.JobID)
+		CheckErr(t, err)
+	}
+	ExpectEquals(t, job.State.Error, "")
+	ExpectEquals(t, len(job.Tasks), 2)
+	ExpectEquals(t, job.Tasks[0].ConsoleOutput, "downloading in.txt\n")
+
+	// stage-out, which keeps the B2SHARE record of the job
+	published := db.JobPublication{Status: "Published", RecordURL: "https://b2share.example.com/record/1"}
+	CheckErr(t, database.SetJobPublication(job.ID, published))
+	res, _ = sendForm(t, "POST", gefurl(serverURL+"/api/jobs/"+string(job.ID)+"/b2drop", token.Secret), url.Values{"folder": {"results/run1"}})
+	ExpectEquals(t, res.StatusCode, 200)
+	job, err = database.GetJob(job.ID)
+	CheckErr(t, err)
+	for job.B2DropCopy.Code == -1 {
+		job, err = database.GetJob(job.ID)
+		CheckErr(t, err)
+	}
+	ExpectEquals(t, job.B2DropCopy.Error, "")
+	ExpectEquals(t, job.B2DropCopy.FolderURL, davServer.URL+"/remote.php/webdav/results/run1")
+	ExpectEquals(t, *job.Publication, published)
+	ExpectEquals(t, dav.file("results/run1/out.txt"), "SOME TEXT")
+	ExpectEquals(t, dav.file("results/run1/sub/b.txt"), "b")
+	ExpectEquals(t, job.Tasks[len(job.Tasks)-1].Name, "B2DROP stage-out")
+
+	// wrong credentials
+	CheckErr(t, database.SetB2DropAccount(db.B2DropAccount{UserID: user.ID, Username: "user", Password: "wrong"}))
+	res, body = postFiles(t, jobsURL, values, nil)
+	ExpectEquals(t, res.StatusCode, 201)
+	CheckErr(t, json.Unmarshal(body, &created))
+	job, err = database.GetJob(created.JobID)
+	CheckErr(t, err)
+	for job.State.Code == -1 {
+		job, err = database.GetJob(created.JobID)
+		CheckErr(t, err)
+	}
+	ExpectEquals(t, job.State.Error, "WebDAV data staging #1 failed")
+	Expect(t, strings.Contains(job.Tasks[0].Error, "401"))
+}
@@ -52,6 +52,7 @@ arg_parser = argparse.ArgumentParser()
 arg_parser.add_argument('deposition_id', help = 'Specify the id of the deposition to load into.')
 arg_parser.add_argument('filename', help = 'Specify the name of the file to be uploaded into the deposition.')
 arg_parser.add_argument('--access_token', help = 'Specify the required token for accessing B2SHARE. ')
+arg_parser.add_argument('--access_token_file', help = 'Specify a file containing the token, which keeps it off the command line.')
 arg_parser.add_argument('--target_url', help = 'Specify the URL of the B2SHARE instance to be adressed.')
 
 # Parses the argument string and retrieves the deposition id and the filename specified by the user.
@@ -67,13 +68,13 @@ filename = args.filename
 if args.access_token:   
     token = args.access_token
 else:
-    filename_access_token = 'access_token.txt'
+    filename_access_token = args.access_token_file or 'access_token.txt'
 
     if os.path.isfile(filename_access_token):
         file = open(filename_access_token, 'r')
-        token = file.read()
+        token = file.read().strip()
         file.close()
-        print('Access token %s has been read from file.' % token)
+        print('Access token has been read from file.')
     else:
         print('Calling the B2SHARE instance requires an access token.')
         sys.exit()
@@ -48,6 +48,13 @@ class FileTree extends React.Component {
         let downloadButton;
         let b2dropButton;
         let isContentVisible = false;
+        let volumeFilePath;
+        if (file.path == "") {
+            volumeFilePath = ""
+        } else {
+            volumeFilePath = "/" + file.path;
+        }
+        let fileURL = apiNames.volumes + "/" + this.props.selectedVolume.volumeID + volumeFilePath + "/" + file.name;
         if (file.isFolder) {
             iconClass = "glyphicon-folder-close";
             browseButton = <button style={{width:20, background:'none', border:'none', fontSize:20, padding:0}} onClick={ (e) => this.handleFolderClick(file, true, e)}>+</button>
@@ -57,15 +64,9 @@ class FileTree extends React.Component {
                     browseButton = <button style={{width:20, background:'none', border:'none', fontSize:20, padding:0}} onClick={ (e) => this.handleFolderClick(file, false, e)}>-</button>
                 }
             }
+            downloadButton = <a href={fileURL + "?archive=zip"} title="Download as zip"><span className="glyphicon glyphicon-download-alt" aria-hidden={true}/></a>
         } else {
-            let volumeFilePath;
-            if (file.path == "") {
-                volumeFilePath = ""
-            } else {
-                volumeFilePath = "/" + file.path;
-            }
-
-            downloadButton = <a href={apiNames.volumes + "/" + this.props.selectedVolume.volumeID + volumeFilePath + "/" + file.name + "?content"}><span className="glyphicon glyphicon-download-alt" aria-hidden={true}/></a>
+            downloadButton = <a href={fileURL + "?content"}><span className="glyphicon glyphicon-download-alt" aria-hidden={true}/></a>
             b2dropButton = <span className="glyphicon glyphicon-cloud-upload" aria-hidden={true}/>
         }
 
@@ -119,7 +120,9 @@ class FileTree extends React.Component {
                 <div style={{margin: '1em'}}>
                     <ol className="list-unstyled fileList" style={{textAlign: 'left', minHeight: '5em'}}>
                         <li className="heading row" style={{padding: '0.5em 0'}}>
-                            <div className="col-sm-6" style={{fontWeight: 'bold'}}>File Name</div>
+                            <div className="col-sm-6" style={{fontWeight: 'bold'}}>File Name
+                                <a href={apiNames.volumes + "/" + this.props.selectedVolume.volumeID + "/?archive=zip"} title="Download all files as zip" style={{marginLeft: '1em'}}><span className="glyphicon glyphicon-download-alt" aria-hidden={true}/></a>
+                            </div>
                             <div className="col-sm-3" style={{fontWeight: 'bold'}}>Size</div>
                             <div className="col-sm-3" style={{fontWeight: 'bold'}}>Date</div>
                         </li>
@@ -183,7 +183,7 @@ class Jobs extends React.Component {
             }
             let serviceName = (service && service.Name && service.Name.length) ? service.Name :
                 (service && service.ID && service.ID.length) ? service.ID : "unknown service";
-            let title = "Job from " + serviceName;
+            let title = (job.Name && job.Name.length) ? job.Name : "Job from " + serviceName;
 
             let jobStartTime = new Date(job.Created);
             let jobFinishTime = new Date(jobStartTime.getTime() + (1000 * job.Duration));
@@ -80,6 +80,32 @@ const JobCreatorForm = (props) => {
                                            style={stringStyle} className="form-control" key={`pid_${inputSrc.ID}`}/>
                                 )
                             }
+                            if (inputSrc.Type.toLowerCase()=="urllist") {
+                                return (
+                                    <Field name={`pid_${inputSrc.ID}`} component="textarea"
+                                           placeholder={`Input source #${inputCounter + 1}: insert PIDs or URLs, one per line`}
+                                           style={stringStyle} className="form-control" key={`pid_${inputSrc.ID}`}/>
+                                )
+                            }
+                            if (inputSrc.Type.toLowerCase()=="enum") {
+                                return (
+                                    <Field name={`pid_${inputSrc.ID}`} component="select"
+                                           style={urlStyle} className="form-control" key={`pid_${inputSrc.ID}`}>
+                                        <option value="">{`Input source #${inputCounter + 1}: choose a value`}</option>
+                                        {(inputSrc.Values || []).map((value) =>
+                                            <option value={value} key={value}>{value}</option>
+                                        )}
+                                    </Field>
+                                )
+                            }
+                            if (["pid", "integer", "float", "boolean"].indexOf(inputSrc.Type.toLowerCase()) >= 0) {
+                                const defaultValue = inputSrc.Default ? ` (default: ${inputSrc.Default})` : "";
+                                return (
+                                    <Field name={`pid_${inputSrc.ID}`} component="input"
+                                           placeholder={`Input source #${inputCounter + 1}: insert a ${inputSrc.Type.toLowerCase()}${defaultValue}`}
+                                           style={urlStyle} className="form-control" key={`pid_${inputSrc.ID}`}/>
+                                )
+                            }
                         })}
 
                         <div className="text-center">
@@ -151,9 +151,15 @@ const TokenList = React.createClass({
         return (
             <li className="list-group-item" key={token.ID}>
                 {token.Name}
+                {token.Scopes && token.Scopes.length ?
+                    <small style={{margin:'0 1em'}}>
+                        {token.Scopes.join(', ')}
+                        {token.ServiceIDs && token.ServiceIDs.length ? ' (services: ' + token.ServiceIDs.join(', ') + ')' : ''}
+                        {token.Communities && token.Communities.length ? ' (communities: ' + token.Communities.join(', ') + ')' : ''}
+                    </small> : false
+                }
                 <a className="btn btn-xs btn-warning" style={{float:'right'}}
                     onClick={()=>this.deleteToken(token.ID)}>Delete</a>
-                <code style={{margin:'0 2em', float:'right'}}>{token.Secret}</code>
             </li>
         );
     },